@@ -0,0 +1,247 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// encode --archive and decode --archive rewrite a zip or tar(.gz) archive
+// member by member, without extracting it: regular files are encoded (and
+// gain .bck) or decoded (and lose it), everything else is copied with its
+// metadata untouched. With -i member names are left alone and the archive
+// is replaced in place.
+
+// archiveExts are the archive types --archive understands, longest first.
+var archiveExts = []string{".tar.gz", ".tgz", ".tar", ".zip"}
+
+// archiveExt returns the archive extension of name, or "" if it has none.
+func archiveExt(name string) string {
+	for _, ext := range archiveExts {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[len(name)-len(ext):]
+		}
+	}
+	return ""
+}
+
+// memberTransform turns one regular file of an archive into its
+// replacement; keep reports that it should be copied unchanged.
+type memberTransform func(name string, data []byte) (newName string, out []byte, keep bool, err error)
+
+// transformArchive is encode or decode (cmd) with --archive.
+func transformArchive(inPath, cmd string, opts options) (result, error) {
+	res := result{Command: cmd, Input: inPath, DryRun: opts.dryRun}
+	ext := archiveExt(inPath)
+	if ext == "" {
+		return res, newError(ErrUsage, "--archive needs a .zip, .tar, .tar.gz or .tgz file")
+	}
+	if _, err := os.Stat(inPath); err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	base := inPath[:len(inPath)-len(ext)]
+	out := base + ".bck" + ext
+	if cmd == "decode" {
+		if !strings.HasSuffix(strings.ToLower(base), ".bck") && !opts.inPlace && opts.output == "" {
+			return res, newError(ErrNotBck, "decode --archive expects a name like project.bck%s (or pass -o)", ext)
+		}
+		out = stripLastBck(base) + ext
+	}
+	if opts.output != "" {
+		out = opts.output
+	}
+	outPath, skip, err := outputPath(inPath, out, opts)
+	res.Output = outPath
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	res.Action = cmd + "d"
+	if opts.dryRun {
+		opts.infof("Would %s the members of %s\n", cmd, describeTransform(inPath, outPath))
+		return res, nil
+	}
+
+	// Encode skips members that are already .bck; decode (unless -i) only
+	// touches those.
+	converts := func(name string) bool {
+		encoded := strings.HasSuffix(strings.ToLower(name), ".bck")
+		return encoded == (cmd == "decode") || (cmd == "decode" && opts.inPlace)
+	}
+	rename := func(name string) string {
+		switch {
+		case !converts(name), opts.inPlace:
+			return name
+		case cmd == "encode":
+			return name + ".bck"
+		}
+		return stripLastBck(name)
+	}
+	f := format{mode: opts.mode, blockSize: opts.blockSize}
+	if opts.compress {
+		f.compress = compressGzip
+	}
+	transform := func(name string, data []byte) (string, []byte, bool, error) {
+		if !converts(name) {
+			return name, nil, true, nil
+		}
+		var out []byte
+		var err error
+		if cmd == "encode" {
+			out, err = encodeData(data, f)
+		} else if data, err = unwrapData(data, opts); err == nil {
+			out, _, err = decodeData(data)
+		}
+		if err != nil {
+			var ce *cliError
+			if errors.As(err, &ce) {
+				err = newError(ce.kind, "member '%s': %s", name, strings.TrimPrefix(ce.msg, "Error: "))
+			}
+			return name, nil, false, err
+		}
+		res.Files++
+		opts.logger().Debug("archive member", "op", cmd, "member", name, "output", rename(name))
+		return rename(name), out, false, nil
+	}
+
+	var fill func(io.Writer) error
+	if strings.EqualFold(ext, ".zip") {
+		fill = func(w io.Writer) error { return rewriteZip(w, inPath, transform) }
+	} else {
+		gz := !strings.EqualFold(ext, ".tar")
+		fill = func(w io.Writer) error { return rewriteTar(w, inPath, gz, transform, rename) }
+	}
+	if err := writeFileStream(outPath, 0o666, true, opts.sync, fill); err != nil {
+		var ce *cliError
+		if errors.As(err, &ce) {
+			return res, err
+		}
+		return res, wrapPathErr(err, outPath)
+	}
+	opts.infof("%sd %d members of %s\n", strings.ToUpper(cmd[:1])+cmd[1:], res.Files, describeTransform(inPath, outPath))
+	return res, nil
+}
+
+// rewriteZip copies the zip at inPath to w, passing regular files through
+// transform and everything else through raw.
+func rewriteZip(w io.Writer, inPath string, transform memberTransform) error {
+	zr, err := zip.OpenReader(inPath)
+	if err != nil {
+		return newError(ErrCorrupt, "'%s' is not a readable zip archive: %v", path.Base(inPath), err)
+	}
+	defer zr.Close()
+	zw := zip.NewWriter(w)
+	zw.SetComment(zr.Comment)
+	for _, f := range zr.File {
+		if !f.Mode().IsRegular() {
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return newError(ErrCorrupt, "member '%s': %v", f.Name, err)
+		}
+		name, out, keep, err := transform(f.Name, data)
+		if err != nil {
+			return err
+		}
+		if keep {
+			if err := zw.Copy(f); err != nil {
+				return err
+			}
+			continue
+		}
+		fh := f.FileHeader
+		fh.Name = name
+		mw, err := zw.CreateHeader(&fh)
+		if err != nil {
+			return err
+		}
+		if _, err := mw.Write(out); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// rewriteTar copies the tar (gzipped if gz) at inPath to w, passing regular
+// files through transform and renaming links the same way.
+func rewriteTar(w io.Writer, inPath string, gz bool, transform memberTransform, rename func(string) string) error {
+	file, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	var r io.Reader = file
+	var zw *gzip.Writer
+	if gz {
+		zr, err := gzip.NewReader(file)
+		if err != nil {
+			return newError(ErrCorrupt, "'%s' is not a readable gzip file: %v", path.Base(inPath), err)
+		}
+		zw = gzip.NewWriter(w)
+		zw.Header = zr.Header
+		r, w = zr, zw
+	}
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return newError(ErrCorrupt, "'%s' is not a readable tar archive: %v", path.Base(inPath), err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			if hdr.Typeflag == tar.TypeLink || hdr.Typeflag == tar.TypeSymlink {
+				// A link to a transformed file is one too.
+				hdr.Name, hdr.Linkname = rename(hdr.Name), rename(hdr.Linkname)
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := io.Copy(tw, tr); err != nil {
+				return err
+			}
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return newError(ErrCorrupt, "member '%s': %v", hdr.Name, err)
+		}
+		name, out, keep, err := transform(hdr.Name, data)
+		if err != nil {
+			return err
+		}
+		if !keep {
+			hdr.Name, hdr.Size = name, int64(len(out))
+			data = out
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if zw != nil {
+		return zw.Close()
+	}
+	return nil
+}
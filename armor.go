@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+// --armor wraps a finished .bck (header, compression, encryption and all)
+// in base64 between banners, with a CRC-32 line so a paste mangled by a mail
+// client or chat app is caught instead of decoded into nonsense:
+//
+//	-----BEGIN BACKLANG-----
+//	IyNCQ0tML05OTCMjCndvcmxkCmhlbGxvCg==
+//	=3W6k8A==
+//	-----END BACKLANG-----
+const (
+	armorBegin = "-----BEGIN BACKLANG-----"
+	armorEnd   = "-----END BACKLANG-----"
+	armorWidth = 64
+)
+
+// isArmored reports whether data is armored, allowing leading whitespace
+// picked up when pasting.
+func isArmored(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(data, " \t\r\n"), []byte(armorBegin))
+}
+
+// armored wraps fill so that what it writes comes out armored.
+func armored(fill func(io.Writer) error) func(io.Writer) error {
+	return func(w io.Writer) error {
+		if _, err := io.WriteString(w, armorBegin+"\n"); err != nil {
+			return err
+		}
+		lw := &lineWriter{w: w}
+		enc := base64.NewEncoder(base64.StdEncoding, lw)
+		crc := crc32.NewIEEE()
+		if err := fill(io.MultiWriter(enc, crc)); err != nil {
+			return err
+		}
+		if err := enc.Close(); err != nil {
+			return err
+		}
+		if lw.col > 0 {
+			if _, err := io.WriteString(w, "\n"); err != nil {
+				return err
+			}
+		}
+		sum := base64.StdEncoding.EncodeToString(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+		_, err := io.WriteString(w, "="+sum+"\n"+armorEnd+"\n")
+		return err
+	}
+}
+
+// lineWriter breaks what is written to it into lines of armorWidth bytes.
+type lineWriter struct {
+	w   io.Writer
+	col int
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		chunk := p[:min(len(p), armorWidth-lw.col)]
+		if _, err := lw.w.Write(chunk); err != nil {
+			return 0, err
+		}
+		p = p[len(chunk):]
+		if lw.col += len(chunk); lw.col == armorWidth {
+			if _, err := lw.w.Write([]byte("\n")); err != nil {
+				return 0, err
+			}
+			lw.col = 0
+		}
+	}
+	return n, nil
+}
+
+// dearmor returns the .bck inside armored data. Whitespace around and
+// within the base64 lines is ignored.
+func dearmor(data []byte) ([]byte, error) {
+	data = bytes.TrimLeft(data, " \t\r\n")
+	_, rest, _ := bytes.Cut(data, []byte("\n"))
+	body, _, ok := bytes.Cut(rest, []byte(armorEnd))
+	if !ok {
+		return nil, newError(ErrCorrupt, "armored data has no %s line", armorEnd)
+	}
+	var b64, sum []byte
+	for line := range bytes.Lines(body) {
+		line = bytes.TrimSpace(line)
+		if bytes.HasPrefix(line, []byte("=")) {
+			sum = line[1:]
+			continue
+		}
+		b64 = append(b64, line...)
+	}
+	out, err := base64.StdEncoding.DecodeString(string(b64))
+	if err != nil {
+		return nil, newError(ErrCorrupt, "armored data is damaged: %v", err)
+	}
+	want, err := base64.StdEncoding.DecodeString(string(sum))
+	if err != nil || len(want) != 4 {
+		return nil, newError(ErrCorrupt, "armored data has no valid checksum line")
+	}
+	if binary.BigEndian.Uint32(want) != crc32.ChecksumIEEE(out) {
+		return nil, newError(ErrCorrupt, "armored data is damaged: checksum mismatch")
+	}
+	return out, nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// keyOperations are what an API key can be allowed to do; "*" allows all.
+// Streaming calls count as their plain operation.
+var keyOperations = []string{"encode", "decode", "verify", "metrics"}
+
+// apiKey is a key "backlang serve" accepts and what it may do.
+type apiKey struct {
+	name  string
+	hash  [sha256.Size]byte // SHA-256 of the key, which is all that is kept
+	allow []string          // from keyOperations, or "*"
+}
+
+// allows reports whether k may perform op, as named by operation.
+func (k apiKey) allows(op string) bool {
+	op = strings.TrimSuffix(op, "_stream")
+	return slices.Contains(k.allow, "*") || slices.Contains(k.allow, op) || op == "other"
+}
+
+// findKey returns the key matching secret, comparing hashes in constant
+// time so response timing doesn't reveal how close a guess was.
+func findKey(keys []apiKey, secret string) (apiKey, bool) {
+	sum := sha256.Sum256([]byte(secret))
+	var found apiKey
+	ok := false
+	for _, k := range keys {
+		if subtle.ConstantTimeCompare(sum[:], k.hash[:]) == 1 {
+			found, ok = k, true
+		}
+	}
+	return found, ok
+}
+
+// requestKey is the key a request presents, as "Authorization: Bearer
+// <key>" (which gRPC clients send as metadata) or "X-API-Key: <key>".
+func requestKey(r *http.Request) string {
+	if v, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(v)
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+// loadAPIKeys returns the keys serve accepts: those in path (keys.toml in
+// the config directory if path is empty, where a missing file means none)
+// plus BACKLANG_API_KEY, which may do everything.
+func loadAPIKeys(path string) ([]apiKey, error) {
+	explicit := path != ""
+	if !explicit {
+		dir, err := configDir()
+		if err == nil {
+			path = filepath.Join(dir, "keys.toml")
+		}
+	}
+	var keys []apiKey
+	if path != "" {
+		data, err := os.ReadFile(path)
+		switch {
+		case errors.Is(err, os.ErrNotExist) && !explicit:
+		case err != nil:
+			return nil, wrapPathErr(err, path)
+		default:
+			if keys, err = parseKeysTOML(string(data)); err != nil {
+				return nil, newError(ErrUsage, "%s: %v", path, err)
+			}
+		}
+	}
+	if v := os.Getenv(envPrefix + "API_KEY"); v != "" {
+		keys = append(keys, apiKey{name: envPrefix + "API_KEY", hash: sha256.Sum256([]byte(v)), allow: []string{"*"}})
+	}
+	return keys, nil
+}
+
+// parseKeysTOML parses keys.toml, the same TOML subset as languages.toml:
+// [[key]] tables, each with a name, the key itself or its SHA-256 in hex
+// (so the file needn't hold the secret), and the operations it allows.
+//
+//	[[key]]
+//	name = "ci"
+//	sha256 = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+//	allow = ["encode", "decode"]
+func parseKeysTOML(src string) ([]apiKey, error) {
+	var keys []apiKey
+	var cur *apiKey
+	set := map[string]bool{}
+	for i, line := range strings.Split(src, "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(stripTOMLComment(line))
+		if line == "" {
+			continue
+		}
+		if line == "[[key]]" {
+			keys = append(keys, apiKey{})
+			cur = &keys[len(keys)-1]
+			clear(set)
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: unsupported table %s (only [[key]] is allowed)", lineNo, line)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: key outside a [[key]] table", lineNo)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if err := setKeyField(cur, key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+		set[key] = true
+		if set["key"] && set["sha256"] {
+			return nil, fmt.Errorf("line %d: key %q has both key and sha256", lineNo, cur.name)
+		}
+	}
+
+	seen := map[[sha256.Size]byte]string{}
+	for i, k := range keys {
+		switch {
+		case k.name == "":
+			return nil, fmt.Errorf("key #%d has no name", i+1)
+		case k.hash == [sha256.Size]byte{}:
+			return nil, fmt.Errorf("key %q needs key or sha256", k.name)
+		case len(k.allow) == 0:
+			return nil, fmt.Errorf("key %q allows nothing; list operations in allow", k.name)
+		case seen[k.hash] != "":
+			return nil, fmt.Errorf("keys %q and %q are the same key", seen[k.hash], k.name)
+		}
+		seen[k.hash] = k.name
+	}
+	return keys, nil
+}
+
+func setKeyField(k *apiKey, key, value string) error {
+	if key == "allow" {
+		list, err := parseTOMLStringArray(value)
+		if err != nil {
+			return fmt.Errorf("allow: %v", err)
+		}
+		for _, op := range list {
+			if op != "*" && !slices.Contains(keyOperations, op) {
+				return fmt.Errorf("allow: unknown operation %q (use %s or *)", op, strings.Join(keyOperations, ", "))
+			}
+		}
+		k.allow = list
+		return nil
+	}
+	s, rest, err := parseTOMLString(value)
+	if err == nil && strings.TrimSpace(rest) != "" {
+		err = fmt.Errorf("unexpected %q after string", rest)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", key, err)
+	}
+	switch key {
+	case "name":
+		k.name = s
+	case "key":
+		if len(s) < 16 {
+			return errors.New("key: too short; use at least 16 characters")
+		}
+		k.hash = sha256.Sum256([]byte(s))
+	case "sha256":
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != sha256.Size {
+			return errors.New("sha256: want 64 hex digits")
+		}
+		copy(k.hash[:], b)
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// defaultBackupSuffix is what --backup appends to a replaced file's name
+// unless --backup-suffix gives another.
+const defaultBackupSuffix = ".bak"
+
+// replaced remembers which files this process is overwriting and where
+// --backup or --trash put the old ones ("" if nowhere), by absolute path,
+// so the journal can tell undo how to put them back.
+var replaced = struct {
+	sync.Mutex
+	m map[string]string
+}{m: map[string]string{}}
+
+// beforeReplace keeps what --backup or --trash ask to of the file at name,
+// which is about to be overwritten.
+func beforeReplace(name string, opts options) error {
+	_, err := os.Lstat(name)
+	exists := err == nil
+	var saved string
+	if opts.trash {
+		saved, err = moveToTrash(name, opts)
+	} else if err = backUp(name, opts); err == nil && opts.backup != "" {
+		saved = name + opts.backup
+	}
+	if err != nil || !exists || opts.dryRun {
+		return err
+	}
+	if abs, err := filepath.Abs(name); err == nil {
+		if saved != "" {
+			saved, _ = filepath.Abs(saved)
+		}
+		replaced.Lock()
+		replaced.m[abs] = saved
+		replaced.Unlock()
+	}
+	return nil
+}
+
+// replacedBy reports whether this process overwrote an existing file at
+// name, and where the old one was kept.
+func replacedBy(name string) (backup string, ok bool) {
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", false
+	}
+	replaced.Lock()
+	defer replaced.Unlock()
+	backup, ok = replaced.m[abs]
+	return backup, ok
+}
+
+// backUp keeps a copy of the file at name, which is about to be replaced,
+// as name plus the --backup suffix, replacing any older backup there. A
+// symlink is backed up as a link to the same target. Without --backup it
+// does nothing.
+func backUp(name string, opts options) error {
+	if opts.backup == "" {
+		return nil
+	}
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return wrapPathErr(err, name)
+	}
+	dest := name + opts.backup
+	if opts.dryRun {
+		opts.infof("Would back up '%s' to '%s'\n", filepath.Base(name), filepath.Base(dest))
+		return nil
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(name)
+		if err != nil {
+			return wrapPathErr(err, name)
+		}
+		if err := os.Remove(dest); err != nil && !os.IsNotExist(err) {
+			return wrapPathErr(err, dest)
+		}
+		if err := os.Symlink(target, dest); err != nil {
+			return wrapPathErr(err, dest)
+		}
+	case fi.Mode().IsRegular():
+		if err := writeFileStream(dest, fi.Mode().Perm(), true, opts.sync, func(w io.Writer) error {
+			return copyFileTo(w, name)
+		}); err != nil {
+			return wrapPathErr(err, dest)
+		}
+		os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+	default:
+		return nil // a device or pipe is written to, not replaced
+	}
+	opts.infof("Backed up '%s' to '%s'\n", filepath.Base(name), filepath.Base(dest))
+	return nil
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// batch encodes, decodes or migrates every file named by inputs, descending
+// into directories with --recursive, on up to opts.jobs files at once. Each
+// file's progress lines are held back and printed, with its error or JSON
+// record, in input order, so the output is the same whatever the timing.
+// A failing file doesn't stop the others; the first failure is returned,
+// already reported.
+func batch(cmd string, inputs []string, opts options) error {
+	started := time.Now()
+	files, err := collectInputs(cmd, inputs, opts)
+	if err != nil {
+		report(result{Command: cmd, Input: inputs[0]}, opts, err)
+		return err
+	}
+	if len(files) == 0 {
+		opts.infof("No files to %s\n", cmd)
+		if opts.reportFile == "" {
+			return nil
+		}
+		err := writeReport(opts.reportFile, batchReport{Command: cmd, Started: started, DryRun: opts.dryRun, Counts: map[string]int{}, Files: []fileReport{}}, opts)
+		if err != nil {
+			report(result{Command: cmd, Input: inputs[0], Output: opts.reportFile}, opts, err)
+		}
+		return err
+	}
+	var state *resumeState
+	if opts.resume {
+		if state, err = openResume(cmd, inputs, opts); err != nil {
+			report(result{Command: cmd, Input: inputs[0]}, opts, err)
+			return err
+		}
+	}
+	verb := strings.TrimSuffix(cmd, "e") + "ing"
+	opts.logger().Debug("batch", "op", cmd, "files", len(files), "jobs", opts.jobs)
+
+	results := make([]result, len(files))
+	errs := make([]error, len(files))
+	logs := make([]bytes.Buffer, len(files))
+	reports := make([]fileReport, len(files))
+	var first error
+	counts := map[string]int{}
+	p := startProgress(opts, strings.ToUpper(verb[:1])+verb[1:], int64(len(files)), true)
+	ordered(len(files), opts.jobs, func(i int) {
+		o := opts
+		o.out, o.noProgress = &logs[i], true
+		if out, ok := state.finished(files[i]); ok {
+			results[i] = result{Command: cmd, Input: files[i], Output: out, Action: "skipped", DryRun: opts.dryRun}
+			reports[i] = fileReport{Input: files[i], Output: out, Status: "skipped"}
+			o.infof("Skipped '%s' (already %sd as '%s' by an earlier run)\n", files[i], cmd, out)
+			return
+		}
+		results[i], errs[i] = timedTransform(cmd, files[i], o, &reports[i])
+		if errs[i] == nil && results[i].Action == cmd+"d" && !opts.dryRun {
+			if err := state.record(files[i], results[i].Output); err != nil {
+				o.logger().Warn("not recording progress for --resume", "path", files[i], "err", err)
+			}
+		}
+		if errs[i] == nil {
+			journal(results[i], o)
+		}
+	}, func(i int) error {
+		p.around(func() {
+			opts.infof("%s", logs[i].Bytes())
+			report(results[i], opts, errs[i])
+		})
+		logs[i] = bytes.Buffer{}
+		p.add(1)
+		if errs[i] != nil {
+			counts["failed"]++
+			if first == nil {
+				first = errs[i]
+			}
+		} else {
+			counts[results[i].Action]++
+		}
+		return nil
+	})
+	p.finish()
+	state.close(first == nil)
+	if opts.manifest != "" {
+		var outputs []string
+		for i, res := range results {
+			if errs[i] == nil && res.Action == cmd+"d" {
+				outputs = append(outputs, res.Output)
+			}
+		}
+		if err := writeManifest(opts.manifest, outputs, opts); err != nil {
+			report(result{Command: cmd, Input: inputs[0], Output: opts.manifest}, opts, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if opts.reportFile != "" {
+		rep := batchReport{Command: cmd, Started: started, Duration: time.Since(started).Seconds(), DryRun: opts.dryRun, Counts: counts, Files: reports}
+		if err := writeReport(opts.reportFile, rep, opts); err != nil {
+			report(result{Command: cmd, Input: inputs[0], Output: opts.reportFile}, opts, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	if len(files) > 1 {
+		var parts []string
+		for _, action := range []string{cmd + "d", "current", "skipped", "failed"} {
+			if counts[action] == 0 {
+				continue
+			}
+			label := action
+			if opts.dryRun && action == cmd+"d" {
+				label = "would be " + action // nothing was written
+			}
+			parts = append(parts, fmt.Sprintf("%d %s", counts[action], label))
+		}
+		if len(parts) > 0 {
+			opts.infof("%s\n", strings.Join(parts, ", "))
+		}
+	}
+	return first
+}
+
+// transformFile is encode, decode or migrate on one file, with the checks
+// main applies to a single argument.
+func transformFile(cmd, path string, opts options) (result, error) {
+	if isObjectURL(path) {
+		return transformObject(cmd, path, opts)
+	}
+	if cmd == "encode" {
+		return encode(path, opts)
+	}
+	if cmd == "migrate" {
+		if !strings.HasSuffix(strings.ToLower(path), ".bck") {
+			return result{Command: cmd, Input: path}, newError(ErrNotBck, "'%s': migrate command only accepts .bck files", path)
+		}
+		return migrate(path, opts)
+	}
+	if err := checkDecodable(path, opts); err != nil {
+		return result{Command: cmd, Input: path}, err
+	}
+	return decode(path, opts)
+}
+
+// collectInputs expands inputs into the files to transform. Directories
+// need --recursive and contribute, in lexical order, the files under them
+// that cmd applies to: for encode everything but .bck files, otherwise
+// only .bck files, skipping hidden files and directories (unless --hidden)
+// and whatever .bckignore files exclude either way (as --watch and pack
+// do). Version control directories are never entered. Symlinked
+// directories are not descended into, nor, with --max-depth, those too
+// deep; --only and --skip-binary narrow the files further. An s3:// or
+// gs:// prefix (a key ending in "/") is listed the same way. Anything else
+// is taken as it is, to succeed or fail on its own.
+func collectInputs(cmd string, inputs []string, opts options) ([]string, error) {
+	return walkInputs(cmd, inputs, opts, nil)
+}
+
+// walkInputs is collectInputs, also calling visit, if not nil, with every
+// file it takes (and an empty reason) and every file or directory it
+// leaves out (and why), in the order it comes across them.
+func walkInputs(cmd string, inputs []string, opts options, visit func(path, reason string)) ([]string, error) {
+	if visit == nil {
+		visit = func(string, string) {}
+	}
+	var files []string
+	take := func(path string) {
+		visit(path, "")
+		files = append(files, path)
+	}
+	for _, in := range inputs {
+		if u, ok := parseObjectURL(in); ok && u.isPrefix() {
+			if !opts.recursive {
+				return nil, newError(ErrUsage, "'%s' is a prefix; pass -r to %s the objects under it", in, cmd)
+			}
+			objects, err := listObjects(cmd, u)
+			if err != nil {
+				return nil, err
+			}
+			for _, o := range objects {
+				take(o)
+			}
+			continue
+		}
+		fi, err := os.Stat(in)
+		if err != nil || !fi.IsDir() {
+			take(in)
+			continue
+		}
+		if !opts.recursive {
+			return nil, newError(ErrUsage, "'%s' is a directory; pass -r to %s the files under it", in, cmd)
+		}
+		ignore := newIgnoreList(in)
+		err = filepath.WalkDir(in, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			hidden := path != in && strings.HasPrefix(d.Name(), ".") && !opts.hidden
+			if d.IsDir() {
+				reason := ignore.why(path, true)
+				switch {
+				case path != in && slices.Contains(vcsDirs, d.Name()):
+					reason = "version control metadata"
+				case hidden:
+					reason = "hidden"
+				case reason == "" && opts.maxDepth > 0 && depth(in, path) >= opts.maxDepth:
+					reason = fmt.Sprintf("deeper than --max-depth %d", opts.maxDepth)
+				}
+				if reason != "" {
+					visit(path+string(filepath.Separator), reason)
+					return filepath.SkipDir
+				}
+				return ignore.load(path)
+			}
+			if reason := skipReason(cmd, in, path, d, hidden, ignore, opts); reason != "" {
+				visit(path, reason)
+				return nil
+			}
+			take(path)
+			return nil
+		})
+		if err != nil {
+			return nil, wrapPathErr(err, in)
+		}
+	}
+	return files, nil
+}
+
+// skipReason says why walkInputs leaves out path, a file found under root,
+// or returns "" if cmd applies to it.
+func skipReason(cmd, root, path string, d fs.DirEntry, hidden bool, ignore *ignoreList, opts options) string {
+	isBck := strings.HasSuffix(strings.ToLower(path), ".bck")
+	switch {
+	case hidden:
+		return "hidden"
+	case isBck && cmd == "encode":
+		return "already a .bck"
+	case !isBck && cmd != "encode":
+		return "not a .bck"
+	}
+	if reason := ignore.why(path, false); reason != "" {
+		return reason
+	}
+	if !matchesOnly(opts.only, root, path) {
+		return "doesn't match --only"
+	}
+	switch {
+	case d.Type()&fs.ModeSymlink != 0:
+		// Links are recreated with --no-dereference; otherwise only those
+		// to regular files are followed.
+		if fi, err := os.Stat(path); !opts.noDeref && (err != nil || !fi.Mode().IsRegular()) {
+			return "symlink to something other than a file"
+		}
+	case !d.Type().IsRegular():
+		return "not a regular file"
+	}
+	if opts.skipBinary && fileLooksBinary(path) {
+		return "looks binary, and --skip-binary"
+	}
+	return ""
+}
+
+// preview is --list: it walks inputs as batch would and prints each file
+// it would transform and each it would leave out, with the reason, without
+// reading or writing any of them beyond what deciding takes.
+func preview(cmd string, inputs []string, opts options) error {
+	skipped := 0
+	files, err := walkInputs(cmd, inputs, opts, func(path, reason string) {
+		if reason != "" {
+			skipped++
+		}
+		switch {
+		case opts.json && reason == "":
+			printJSON(result{Command: cmd, Input: path, Action: cmd + "d", DryRun: true})
+		case opts.json:
+			printJSON(result{Command: cmd, Input: path, Action: "skipped", DryRun: true, Reason: reason})
+		case reason == "":
+			fmt.Printf("%-7s %s\n", cmd, path)
+		default:
+			fmt.Printf("%-7s %s  (%s)\n", "skip", path, reason)
+		}
+	})
+	if err != nil {
+		report(result{Command: cmd, Input: inputs[0]}, opts, err)
+		return err
+	}
+	opts.infof("%d to %s, %d skipped\n", len(files), cmd, skipped)
+	return nil
+}
+
+// vcsDirs are the version control directories -r never enters, even with
+// --hidden: encoding their contents would only corrupt the repository.
+var vcsDirs = []string{".git", ".hg", ".svn", ".bzr", "_darcs", ".jj"}
+
+// depth is how many directories down from root path is: 0 for root
+// itself, 1 for what is directly in it.
+func depth(root, path string) int {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || rel == "." {
+		return 0
+	}
+	return strings.Count(rel, string(filepath.Separator)) + 1
+}
+
+// matchesOnly reports whether file, found under root, is one of those
+// --only asks for (all of them if there are no patterns). A pattern with a
+// "/" is matched against the path relative to root, any other against the
+// file name; either way with and without a .bck extension, so "*.py" also
+// selects x.py.bck for decode.
+func matchesOnly(patterns []string, root, file string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	rel, err := filepath.Rel(root, file)
+	if err != nil {
+		rel = file
+	}
+	rel = filepath.ToSlash(rel)
+	for _, p := range patterns {
+		target := path.Base(rel)
+		if strings.Contains(p, "/") {
+			target = rel
+		}
+		for _, t := range []string{target, trimBck(target)} {
+			if ok, _ := path.Match(p, t); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// trimBck removes a .bck extension, in any case, from name.
+func trimBck(name string) string {
+	if strings.HasSuffix(strings.ToLower(name), ".bck") {
+		return name[:len(name)-len(".bck")]
+	}
+	return name
+}
+
+// fileLooksBinary reports whether the start of the file at name looks
+// binary, as encode would judge it.
+func fileLooksBinary(name string) bool {
+	f, err := os.Open(name)
+	if err != nil {
+		return false // let encode report it
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	return looksBinary(head[:n])
+}
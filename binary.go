@@ -0,0 +1,39 @@
+package main
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// sniffLen is how much of a file looksBinary examines, as in git.
+const sniffLen = 8000
+
+// looksBinary reports whether head, the start of a file, is probably not
+// text: it holds a NUL byte, or more than one in ten of its characters
+// are not valid UTF-8. Latin-1 text with the odd accented letter still
+// passes, and so does UTF-16 that starts with a byte order mark.
+func looksBinary(head []byte) bool {
+	if isUTF16(head) {
+		return false
+	}
+	if len(head) > sniffLen {
+		head = head[:sniffLen]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return true
+	}
+	var chars, invalid int
+	for i := 0; i < len(head); {
+		r, size := utf8.DecodeRune(head[i:])
+		if r == utf8.RuneError && size == 1 {
+			// A character cut off by the end of the sample is not invalid.
+			if !utf8.FullRune(head[i:]) {
+				break
+			}
+			invalid++
+		}
+		chars++
+		i += size
+	}
+	return chars > 0 && invalid*10 > chars
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Blocks mode splits the input into blocks of at least the block size that
+// end on a line boundary, reverses the lines in each block and writes the
+// blocks in reverse order. The result has every line reversed, like line
+// mode, but encode and decode only ever hold a few blocks in memory and
+// work on blocks in parallel. Each encoded block is preceded by a frame line
+// with its length, so decode can find the blocks without scanning them:
+//
+//	##BCKL.BLOCK 1048601##
+
+// defaultBlockSize is the block size when --block-size is not given.
+const defaultBlockSize = 1 << 20
+
+// maxBlockSize keeps a block, and the several held at once, well within memory.
+const maxBlockSize = 1 << 30
+
+const (
+	framePrefix = "##BCKL.BLOCK "
+	frameSuffix = "##\n"
+	maxFrameLen = len(framePrefix) + 20 + len(frameSuffix)
+)
+
+// span is a block's position in a file.
+type span struct{ off, len int64 }
+
+// encodeBlocks writes the blocks-mode body for r[off:size].
+func encodeBlocks(w io.Writer, r io.ReaderAt, blockSize, off, size int64) error {
+	blocks, err := lineBlocks(r, blockSize, off, size)
+	if err != nil {
+		return err
+	}
+	return inOrder(len(blocks), func(i int) ([]byte, error) {
+		b := blocks[len(blocks)-1-i]
+		data, err := readSpan(r, b)
+		if err != nil {
+			return nil, err
+		}
+		enc := encodeBytes(data)
+		return append([]byte(framePrefix+strconv.Itoa(len(enc))+frameSuffix), enc...), nil
+	}, w)
+}
+
+// decodeBlocks writes the decoding of the blocks-mode body r[off:size].
+func decodeBlocks(w io.Writer, r io.ReaderAt, off, size int64) error {
+	var frames []span
+	for off < size {
+		head := make([]byte, min(int64(maxFrameLen), size-off))
+		if _, err := r.ReadAt(head, off); err != nil && err != io.EOF {
+			return err
+		}
+		line, _, ok := bytes.Cut(head, []byte("\n"))
+		n, err := strconv.ParseInt(string(bytes.TrimSuffix(bytes.TrimPrefix(line, []byte(framePrefix)), []byte("##"))), 10, 64)
+		if !ok || !bytes.HasPrefix(line, []byte(framePrefix)) || err != nil || n < 0 || n > size-off-int64(len(line))-1 {
+			return newError(ErrCorrupt, "malformed block frame at offset %d", off)
+		}
+		off += int64(len(line)) + 1
+		frames = append(frames, span{off, n})
+		off += n
+	}
+	return inOrder(len(frames), func(i int) ([]byte, error) {
+		data, err := readSpan(r, frames[len(frames)-1-i])
+		if err != nil {
+			return nil, err
+		}
+		return decodeBytes(data), nil
+	}, w)
+}
+
+// decodeBlocksData decodes a blocks-mode body held in memory.
+func decodeBlocksData(body []byte) ([]byte, error) {
+	var out bytes.Buffer
+	err := decodeBlocks(&out, bytes.NewReader(body), 0, int64(len(body)))
+	return out.Bytes(), err
+}
+
+// parseBlockSize reads a --block-size value (see parseSize), at most 1G.
+func parseBlockSize(s string) (int64, error) {
+	n, err := parseSize(s)
+	if err != nil || n > maxBlockSize {
+		return 0, fmt.Errorf("invalid block size %q: want a size like 65536, 512K or 4M, at most 1G", s)
+	}
+	return n, nil
+}
+
+// parseSize reads a byte count with an optional K, M or G suffix (powers
+// of 1024).
+func parseSize(s string) (int64, error) {
+	num, shift := strings.ToUpper(s), 0
+	for i, suffix := range []string{"K", "M", "G"} {
+		if n, ok := strings.CutSuffix(num, suffix); ok {
+			num, shift = n, 10*(i+1)
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n <= 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q: want a byte count like 65536, 512K or 4M", s)
+	}
+	return n << shift, nil
+}
+
+// lineBlocks finds the blocks of r[off:size]: each ends at the first line
+// end at least blockSize bytes after its start, or at size.
+func lineBlocks(r io.ReaderAt, blockSize, off, size int64) ([]span, error) {
+	var blocks []span
+	br := bufio.NewReaderSize(io.NewSectionReader(r, off, size-off), streamChunk)
+	start, pos := off, off
+	for {
+		line, err := br.ReadSlice('\n')
+		pos += int64(len(line))
+		if pos-start >= blockSize && len(line) > 0 && line[len(line)-1] == '\n' {
+			blocks = append(blocks, span{start, pos - start})
+			start = pos
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return nil, err
+		}
+	}
+	if pos > start {
+		blocks = append(blocks, span{start, pos - start})
+	}
+	return blocks, nil
+}
+
+func readSpan(r io.ReaderAt, s span) ([]byte, error) {
+	buf := make([]byte, s.len)
+	if _, err := r.ReadAt(buf, s.off); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// inOrder computes work(0..n-1) on all CPUs and writes the results to w in
+// order, keeping only about one result per CPU in memory.
+func inOrder(n int, work func(int) ([]byte, error), w io.Writer) error {
+	data := make([][]byte, n)
+	errs := make([]error, n)
+	return ordered(n, runtime.GOMAXPROCS(0), func(i int) {
+		data[i], errs[i] = work(i)
+	}, func(i int) error {
+		if errs[i] != nil {
+			return errs[i]
+		}
+		_, err := w.Write(data[i])
+		data[i] = nil
+		if err != nil {
+			return fmt.Errorf("writing block: %w", err)
+		}
+		return nil
+	})
+}
+
+// ordered runs work(0..n-1) on up to parallel goroutines and calls done for
+// each index in order once its work has finished, so at most parallel
+// items are started but not yet done. It stops at the first error from
+// done, leaving any work already running to finish on its own.
+func ordered(n, parallel int, work func(int), done func(int) error) error {
+	pending := make(chan chan struct{}, max(parallel-1, 0))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		defer close(pending)
+		for i := range n {
+			ch := make(chan struct{})
+			select {
+			case pending <- ch:
+			case <-stop:
+				return
+			}
+			go func() {
+				work(i)
+				close(ch)
+			}()
+		}
+	}()
+	i := 0
+	for ch := range pending {
+		<-ch
+		if err := done(i); err != nil {
+			return err
+		}
+		i++
+	}
+	return nil
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A .bcka bundle holds a directory's files, each stored as its own complete
+// .bck behind a line naming it. Sizes make the members self-delimiting, so
+// their contents can be anything, and the END line catches truncation:
+//
+//	##BCKA/1##
+//	##BCKA.FILE 0644 18 12 "src/main.py"##
+//	<18 bytes of encoded main.py>
+//	##BCKA.END##
+//
+// The numbers are the permission bits, the member's encoded size and the
+// original file's size. Each member is followed by a newline for
+// readability.
+const (
+	bundleExt    = ".bcka"
+	bundleHeader = "##BCKA/1##\n"
+	bundleFile   = "##BCKA.FILE "
+	bundleEnd    = "##BCKA.END##\n"
+)
+
+// bundleMember describes one file in a bundle; it is what list prints.
+type bundleMember struct {
+	Path string      `json:"path"` // slash-separated, relative to the packed directory
+	Mode fs.FileMode `json:"mode"`
+	Size int64       `json:"size"` // of the original file
+	enc  int64       // encoded size
+}
+
+// pack writes the files under dir (as encode --watch would see them) into a
+// bundle, encoding each with the --mode and --compress settings.
+func pack(dir string, opts options) (result, error) {
+	res := result{Command: "pack", Input: dir, DryRun: opts.dryRun}
+	if fi, err := os.Stat(dir); err != nil {
+		return res, wrapPathErr(err, dir)
+	} else if !fi.IsDir() {
+		return res, newError(ErrUsage, "pack needs a directory; use encode for a single file")
+	}
+	files, err := scanSources(dir, nil)
+	if err != nil {
+		return res, wrapPathErr(err, dir)
+	}
+	paths := slices.Sorted(func(yield func(string) bool) {
+		for p := range files {
+			if !yield(p) {
+				return
+			}
+		}
+	})
+
+	out := opts.output
+	if out == "" {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return res, err
+		}
+		out = abs + bundleExt
+	}
+	outPath, skip, err := resolveConflict(out, opts)
+	res.Output = outPath
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	res.Action, res.Files = "packed", len(paths)
+	if opts.dryRun {
+		opts.infof("Would pack %d files from %s\n", len(paths), describeTransform(dir, outPath))
+		return res, nil
+	}
+
+	f := format{mode: opts.mode}
+	if opts.compress {
+		f.compress = compressGzip
+	}
+	fill := func(w io.Writer) error {
+		if _, err := io.WriteString(w, bundleHeader); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return wrapPathErr(err, path)
+			}
+			rel, _ := filepath.Rel(dir, path)
+			rel = filepath.ToSlash(rel)
+			enc, err := encodeData(data, f)
+			if err != nil {
+				var ce *cliError
+				if errors.As(err, &ce) {
+					err = newError(ce.kind, "'%s': %s", rel, strings.TrimPrefix(ce.msg, "Error: "))
+				}
+				return err
+			}
+			fi, err := os.Stat(path)
+			if err != nil {
+				return wrapPathErr(err, path)
+			}
+			opts.logger().Debug("packing", "path", rel, "bytes", len(data))
+			line := fmt.Sprintf("%s%04o %d %d %s##\n", bundleFile, fi.Mode().Perm(), len(enc), len(data), strconv.Quote(rel))
+			if _, err := io.WriteString(w, line); err != nil {
+				return err
+			}
+			if _, err := w.Write(append(enc, '\n')); err != nil {
+				return err
+			}
+		}
+		_, err := io.WriteString(w, bundleEnd)
+		return err
+	}
+	if err := writeFileStream(outPath, 0o666, true, opts.sync, fill); err != nil {
+		var ce *cliError
+		if errors.As(err, &ce) {
+			return res, err
+		}
+		return res, wrapPathErr(err, outPath)
+	}
+	opts.infof("Packed %d files from %s\n", len(paths), describeTransform(dir, outPath))
+	return res, nil
+}
+
+// unpack decodes every member of a bundle into a directory, by default the
+// bundle's name without .bcka.
+func unpack(bundle string, opts options) (result, error) {
+	res := result{Command: "unpack", Input: bundle, DryRun: opts.dryRun}
+	dir := opts.output
+	if dir == "" {
+		var ok bool
+		if dir, ok = strings.CutSuffix(bundle, bundleExt); !ok {
+			return res, newError(ErrNotBck, "unpack needs a %s file (or -o <dir>)", bundleExt)
+		}
+	}
+	res.Output, res.Action = dir, "unpacked"
+	err := readBundle(bundle, func(m bundleMember, enc []byte) error {
+		target := filepath.Join(dir, filepath.FromSlash(m.Path))
+		outPath, skip, err := resolveConflict(target, opts)
+		if err != nil || skip {
+			return err
+		}
+		res.Files++
+		if opts.dryRun {
+			opts.infof("Would unpack '%s'\n", m.Path)
+			return nil
+		}
+		data, _, err := decodeData(enc)
+		if err != nil {
+			return err
+		}
+		opts.logger().Debug("unpacking", "path", m.Path, "bytes", len(data))
+		if err := os.MkdirAll(filepath.Dir(outPath), 0o777); err != nil {
+			return wrapPathErr(err, filepath.Dir(outPath))
+		}
+		if err := writeFileStream(outPath, m.Mode, true, opts.sync, writeAll(data)); err != nil {
+			return wrapPathErr(err, outPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return res, err
+	}
+	if opts.dryRun {
+		opts.infof("Would unpack %d files from %s\n", res.Files, describeTransform(bundle, dir))
+	} else {
+		opts.infof("Unpacked %d files from %s\n", res.Files, describeTransform(bundle, dir))
+	}
+	return res, nil
+}
+
+// list prints the members of a bundle without decoding them.
+func list(bundle string, opts options) (result, error) {
+	res := result{Command: "list", Input: bundle, Action: "listed"}
+	err := readBundle(bundle, func(m bundleMember, _ []byte) error {
+		res.Members = append(res.Members, m)
+		opts.infof("%s %10d  %s\n", m.Mode, m.Size, m.Path)
+		return nil
+	})
+	res.Files = len(res.Members)
+	return res, err
+}
+
+// readBundle calls member for each file in a bundle, with its encoded
+// contents.
+func readBundle(bundle string, member func(bundleMember, []byte) error) error {
+	file, err := os.Open(bundle)
+	if err != nil {
+		return wrapPathErr(err, bundle)
+	}
+	defer file.Close()
+	r := bufio.NewReader(file)
+	corrupt := func(format string, args ...any) error {
+		return newError(ErrCorrupt, "'%s': "+format, append([]any{filepath.Base(bundle)}, args...)...)
+	}
+	if line, _ := r.ReadString('\n'); line != bundleHeader {
+		return newError(ErrNotBck, "'%s' is not a backlang bundle", filepath.Base(bundle))
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return corrupt("truncated (no END line)")
+		}
+		if line == bundleEnd {
+			return nil
+		}
+		m, err := parseMemberLine(line)
+		if err != nil {
+			return corrupt("%v", err)
+		}
+		enc, err := io.ReadAll(io.LimitReader(r, m.enc+1))
+		if err != nil || int64(len(enc)) != m.enc+1 || enc[m.enc] != '\n' {
+			return corrupt("member '%s' is truncated", m.Path)
+		}
+		if err := member(m, enc[:m.enc]); err != nil {
+			return err
+		}
+	}
+}
+
+// parseMemberLine reads a ##BCKA.FILE line, rejecting paths that would
+// land outside the directory being unpacked.
+func parseMemberLine(line string) (bundleMember, error) {
+	var m bundleMember
+	fields, ok := strings.CutPrefix(strings.TrimSuffix(line, "##\n"), bundleFile)
+	parts := strings.SplitN(fields, " ", 4)
+	if !ok || len(parts) != 4 {
+		return m, fmt.Errorf("malformed member line %q", strings.TrimSpace(line))
+	}
+	perm, err1 := strconv.ParseUint(parts[0], 8, 32)
+	enc, err2 := strconv.ParseInt(parts[1], 10, 64)
+	size, err3 := strconv.ParseInt(parts[2], 10, 64)
+	path, err4 := strconv.Unquote(parts[3])
+	if err := errors.Join(err1, err2, err3, err4); err != nil || enc < 0 || size < 0 {
+		return m, fmt.Errorf("malformed member line %q", strings.TrimSpace(line))
+	}
+	if !filepath.IsLocal(filepath.FromSlash(path)) {
+		return m, fmt.Errorf("member path %q escapes the target directory", path)
+	}
+	return bundleMember{Path: path, Mode: fs.FileMode(perm).Perm(), Size: size, enc: enc}, nil
+}
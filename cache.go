@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cacheDir returns where run caches decoded programs and compiled binaries:
+// $BACKLANG_CACHE_DIR if set, otherwise backlang under the user cache
+// directory (~/.cache/backlang on Linux). It is always safe to delete.
+func cacheDir() (string, error) {
+	if dir := os.Getenv(envPrefix + "CACHE_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "backlang"), nil
+}
+
+// useRunCache reports whether run may reuse a cache entry. The sandbox and
+// container need a private directory, as does --user, which hands it to
+// another account; --keep writes next to the .bck and --stdin never touches
+// the disk.
+func useRunCache(opts options) bool {
+	return !opts.noCache && !opts.keep && !opts.stdin && !opts.sandbox && !opts.container && opts.user == ""
+}
+
+// runCacheEntry returns (creating it if needed) the cache directory for a
+// .bck with the given content run as lang. The key covers everything the
+// decoded program and compiled binary depend on, so a changed .bck, language
+// definition or compiler invocation gets a fresh entry.
+func runCacheEntry(data []byte, lang *Language) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	h.Write(data)
+	for _, s := range [][]string{{strconv.Itoa(formatVersion), lang.Name, lang.TempName, lang.BuildCommand}, lang.BuildArgs} {
+		h.Write([]byte(strings.Join(s, "\x00") + "\x00\x00"))
+	}
+	entry := filepath.Join(dir, "run", hex.EncodeToString(h.Sum(nil))[:32])
+	if err := os.MkdirAll(entry, 0o700); err != nil {
+		return "", err
+	}
+	return entry, nil
+}
@@ -0,0 +1,52 @@
+//go:build capi
+
+package main
+
+// The C API, for linking the transform into other programs instead of
+// spawning the CLI. Build it with
+//
+//	go build -tags capi -buildmode=c-shared -o libbacklang.so .
+//
+// which also writes libbacklang.h. Buffers returned by BacklangEncode and
+// BacklangDecode are allocated with malloc and must be released with
+// BacklangFree. BacklangDecode returns NULL if the input is not a valid
+// encoding. BacklangEncode uses line mode.
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import "unsafe"
+
+//export BacklangEncode
+func BacklangEncode(data *C.char, n C.size_t, outLen *C.size_t) *C.char {
+	return cTransform(func(b []byte) ([]byte, error) { return encodeData(b, format{mode: modeLines}) }, data, n, outLen)
+}
+
+//export BacklangDecode
+func BacklangDecode(data *C.char, n C.size_t, outLen *C.size_t) *C.char {
+	return cTransform(func(b []byte) ([]byte, error) {
+		out, _, err := decodeData(b)
+		return out, err
+	}, data, n, outLen)
+}
+
+//export BacklangFree
+func BacklangFree(p unsafe.Pointer) {
+	C.free(p)
+}
+
+func cTransform(transform func([]byte) ([]byte, error), data *C.char, n C.size_t, outLen *C.size_t) *C.char {
+	in := unsafe.Slice((*byte)(unsafe.Pointer(data)), int(n))
+	out, err := transform(in)
+	if err != nil {
+		*outLen = 0
+		return nil
+	}
+	*outLen = C.size_t(len(out))
+	if len(out) == 0 {
+		return (*C.char)(C.malloc(1))
+	}
+	return (*C.char)(C.CBytes(out))
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// capiProgram links against libbacklang and checks BacklangEncode and
+// BacklangDecode from C, including that an encoding from a newer format
+// decodes to NULL.
+const capiProgram = `#include <stdio.h>
+#include <string.h>
+#include "libbacklang.h"
+
+int main(void) {
+	size_t n;
+	char *enc = BacklangEncode("a\nb\n", 4, &n);
+	const char *want = "##BCKL/2 mode=lines##\nb\na\n";
+	if (enc == NULL || n != strlen(want) || memcmp(enc, want, n) != 0) {
+		fprintf(stderr, "BacklangEncode gave %.*s\n", (int)n, enc ? enc : "NULL");
+		return 1;
+	}
+	char *dec = BacklangDecode(enc, n, &n);
+	if (dec == NULL || n != 4 || memcmp(dec, "a\nb\n", 4) != 0) {
+		fprintf(stderr, "BacklangDecode gave %.*s\n", (int)n, dec ? dec : "NULL");
+		return 1;
+	}
+	BacklangFree(enc);
+	BacklangFree(dec);
+	const char *bad = "##BCKL/99 ##\nx\n";
+	if (BacklangDecode((char *)bad, strlen(bad), &n) != NULL || n != 0) {
+		fprintf(stderr, "BacklangDecode accepted an invalid encoding\n");
+		return 1;
+	}
+	return 0;
+}
+`
+
+func TestCAPI(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the C API as a shared library")
+	}
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" {
+		t.Skip("links the shared library the Unix way")
+	}
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler")
+	}
+	dir := t.TempDir()
+	build := exec.Command("go", "build", "-tags", "capi", "-buildmode=c-shared", "-o", filepath.Join(dir, "libbacklang.so"), ".")
+	build.Env = append(os.Environ(), "CGO_ENABLED=1")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("go build -tags capi -buildmode=c-shared: %v\n%s", err, out)
+	}
+	os.WriteFile(filepath.Join(dir, "main.c"), []byte(capiProgram), 0644)
+	prog := filepath.Join(dir, "capi")
+	link := exec.Command(cc, "-o", prog, "main.c", "-L.", "-lbacklang", "-Wl,-rpath,"+dir)
+	link.Dir = dir
+	if out, err := link.CombinedOutput(); err != nil {
+		t.Fatalf("linking against libbacklang: %v\n%s", err, out)
+	}
+	if out, err := exec.Command(prog).CombinedOutput(); err != nil {
+		t.Errorf("C API: %v\n%s", err, out)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+// captureOutput points the program's stdout and stderr at the terminal, or
+// at the files --stdout and --stderr name (both, with --tee). The files are
+// truncated, as a shell redirection would, and one named by both flags
+// gets both streams, like 2>&1. The returned function closes them.
+func (x *execution) captureOutput() (func() error, error) {
+	x.stdout, x.stderr = os.Stdout, os.Stderr
+	var files []*os.File
+	closeAll := func() error {
+		var errs []error
+		for _, f := range files {
+			errs = append(errs, f.Close())
+		}
+		return errors.Join(errs...)
+	}
+	open := func(name string, terminal io.Writer) (io.Writer, error) {
+		for _, f := range files {
+			if f.Name() == name || sameFile(f.Name(), name) {
+				return teeTo(f, terminal, x.opts.tee), nil
+			}
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			return nil, wrapPathErr(err, name)
+		}
+		files = append(files, f)
+		return teeTo(f, terminal, x.opts.tee), nil
+	}
+	var err error
+	if x.opts.stdoutFile != "" {
+		if x.stdout, err = open(x.opts.stdoutFile, os.Stdout); err != nil {
+			return closeAll, err
+		}
+	}
+	if x.opts.stderrFile != "" {
+		if x.stderr, err = open(x.opts.stderrFile, os.Stderr); err != nil {
+			return closeAll, err
+		}
+	}
+	return closeAll, nil
+}
+
+// teeTo returns f, or with tee a writer that copies to the terminal too.
+// The file is written first so nothing shown is missing from it.
+func teeTo(f *os.File, terminal io.Writer, tee bool) io.Writer {
+	if !tee {
+		return f
+	}
+	return io.MultiWriter(f, terminal)
+}
+
+// describeCapture says where captureOutput sends the program's output,
+// for --dry-run.
+func describeCapture(opts options) string {
+	var s string
+	switch {
+	case opts.stdoutFile != "" && (opts.stdoutFile == opts.stderrFile || sameFile(opts.stdoutFile, opts.stderrFile)):
+		s = "stdout and stderr to '" + opts.stdoutFile + "'"
+	case opts.stdoutFile != "" && opts.stderrFile != "":
+		s = "stdout to '" + opts.stdoutFile + "' and stderr to '" + opts.stderrFile + "'"
+	case opts.stdoutFile != "":
+		s = "stdout to '" + opts.stdoutFile + "'"
+	default:
+		s = "stderr to '" + opts.stderrFile + "'"
+	}
+	if opts.tee {
+		s += ", as well as to the terminal"
+	}
+	return s
+}
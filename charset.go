@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Text encodings recorded by the charset header field. The line, char and
+// word modes work on UTF-8 without a BOM, so encode strips a UTF-8 BOM and
+// transcodes UTF-16 (which must start with a BOM to be recognized); decode
+// restores the original bytes exactly.
+const (
+	charsetUTF8BOM = "utf-8-bom"
+	charsetUTF16LE = "utf-16le"
+	charsetUTF16BE = "utf-16be"
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// isUTF16 reports whether head starts with a UTF-16 byte order mark.
+func isUTF16(head []byte) bool {
+	return bytes.HasPrefix(head, bomUTF16LE) || bytes.HasPrefix(head, bomUTF16BE)
+}
+
+// toUTF8 returns data as BOM-less UTF-8 and the charset it was in. Data
+// that would not come back byte for byte, such as UTF-16 with an odd
+// length or unpaired surrogates, is returned unchanged with charset "".
+func toUTF8(data []byte) (string, []byte) {
+	if text, ok := bytes.CutPrefix(data, bomUTF8); ok {
+		return charsetUTF8BOM, text
+	}
+	var charset string
+	var order binary.ByteOrder
+	switch {
+	case bytes.HasPrefix(data, bomUTF16LE):
+		charset, order = charsetUTF16LE, binary.LittleEndian
+	case bytes.HasPrefix(data, bomUTF16BE):
+		charset, order = charsetUTF16BE, binary.BigEndian
+	default:
+		return "", data
+	}
+	units := data[2:]
+	if len(units)%2 != 0 {
+		return "", data
+	}
+	u := make([]uint16, len(units)/2)
+	for i := range u {
+		u[i] = order.Uint16(units[2*i:])
+	}
+	text := []byte(string(utf16.Decode(u)))
+	if back, err := fromUTF8(text, charset); err != nil || !bytes.Equal(back, data) {
+		return "", data
+	}
+	return charset, text
+}
+
+// fromUTF8 is the inverse of toUTF8.
+func fromUTF8(text []byte, charset string) ([]byte, error) {
+	var order binary.AppendByteOrder
+	var bom []byte
+	switch charset {
+	case "":
+		return text, nil
+	case charsetUTF8BOM:
+		return append(bytes.Clone(bomUTF8), text...), nil
+	case charsetUTF16LE:
+		order, bom = binary.LittleEndian, bomUTF16LE
+	case charsetUTF16BE:
+		order, bom = binary.BigEndian, bomUTF16BE
+	}
+	if !utf8.Valid(text) {
+		return nil, newError(ErrCorrupt, "decoded text is not valid UTF-8, so it cannot be converted back to %s", charset)
+	}
+	out := bytes.Clone(bom)
+	for _, u := range utf16.Encode([]rune(string(text))) {
+		out = order.AppendUint16(out, u)
+	}
+	return out, nil
+}
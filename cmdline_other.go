@@ -0,0 +1,8 @@
+//go:build !windows
+
+package main
+
+import "os/exec"
+
+// quoteForCmd is only needed for Windows's cmd.exe.
+func quoteForCmd(cmd *exec.Cmd) error { return nil }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// quoteForCmd writes the command line of a "cmd /S /C <program> <args>"
+// command the way cmd.exe reads it, rather than the way other programs
+// split theirs: with /S it strips one pair of quotes around everything
+// after /C and runs the rest as typed, so each argument is quoted whole
+// and metacharacters such as & or | in it stay literal. Quotes don't stop
+// cmd expanding %NAME%, so each % is written as "%%cd:~,%": a % and then
+// an empty slice of %cd%, which leaves a plain %. A line break would end
+// the command, and can't be passed at all. (!NAME! is not expanded on the
+// command line while /V:OFF, as Batch runs cmd.) Other commands are left
+// to the usual escaping.
+func quoteForCmd(cmd *exec.Cmd) error {
+	name := strings.ToLower(filepath.Base(cmd.Path))
+	if name != "cmd.exe" && name != "cmd" {
+		return nil
+	}
+	i := -1
+	for j, a := range cmd.Args {
+		if strings.EqualFold(a, "/C") {
+			i = j
+			break
+		}
+	}
+	if i < 0 || i+1 == len(cmd.Args) {
+		return nil
+	}
+	var head, rest []string
+	for _, a := range cmd.Args[:i+1] {
+		head = append(head, syscall.EscapeArg(a))
+	}
+	for _, a := range cmd.Args[i+1:] {
+		if strings.ContainsAny(a, "\r\n") {
+			return newError(ErrUsage, "cmd cannot pass an argument with a line break to a batch file: %q", a)
+		}
+		a = strings.ReplaceAll(a, `"`, `""`)
+		a = strings.ReplaceAll(a, "%", "%%cd:~,%")
+		rest = append(rest, `"`+a+`"`)
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.CmdLine = strings.Join(head, " ") + ` "` + strings.Join(rest, " ") + `"`
+	return nil
+}
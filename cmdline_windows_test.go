@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"testing"
+)
+
+func TestQuoteForCmd(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{
+			[]string{`C:\Users\A B\Temp\build.bat`, "two words", "a&b", `say "hi"`},
+			`cmd /D /V:OFF /S /C ""C:\Users\A B\Temp\build.bat" "two words" "a&b" "say ""hi"""`,
+		},
+		{
+			// %PATH% would be expanded even in quotes; !PATH! is left to /V:OFF.
+			[]string{"build.bat", "%PATH%", "100%", "!PATH!"},
+			`cmd /D /V:OFF /S /C ""build.bat" "%%cd:~,%PATH%%cd:~,%" "100%%cd:~,%" "!PATH!""`,
+		},
+	}
+	for _, tt := range tests {
+		cmd := exec.Command("cmd", append([]string{"/D", "/V:OFF", "/S", "/C"}, tt.args...)...)
+		if err := quoteForCmd(cmd); err != nil {
+			t.Fatalf("quoteForCmd(%q): %v", tt.args, err)
+		}
+		if cmd.SysProcAttr == nil {
+			t.Fatal("quoteForCmd left the command line to the usual escaping")
+		}
+		if got := cmd.SysProcAttr.CmdLine; got != tt.want {
+			t.Errorf("cmd line = %#q, want %#q", got, tt.want)
+		}
+	}
+
+	for _, arg := range []string{"a\nb", "a\r\nb", "a\r"} {
+		cmd := exec.Command("cmd", "/D", "/S", "/C", "build.bat", arg)
+		if err := quoteForCmd(cmd); !errors.Is(err, ErrUsage) {
+			t.Errorf("quoteForCmd with argument %q: err = %v, want ErrUsage", arg, err)
+		}
+	}
+
+	other := exec.Command("node", "a&b", "%PATH%")
+	if err := quoteForCmd(other); err != nil || other.SysProcAttr != nil {
+		t.Errorf("quoteForCmd touched a command other than cmd: %+v, %v", other.SysProcAttr, err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// configDir returns the backlang configuration directory:
+// $BACKLANG_CONFIG_DIR if set, otherwise <user config dir>/backlang.
+func configDir() (string, error) {
+	if dir := os.Getenv(envPrefix + "CONFIG_DIR"); dir != "" {
+		return dir, nil
+	}
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, "backlang"), nil
+}
+
+// loadUserLanguages reads languages.toml from the config directory. A
+// missing file is not an error.
+func loadUserLanguages() ([]Language, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, nil
+	}
+	path := filepath.Join(dir, "languages.toml")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapPathErr(err, path)
+	}
+	langs, err := parseLanguagesTOML(string(data))
+	if err != nil {
+		return nil, newError(ErrUsage, "%s: %v", path, err)
+	}
+	return langs, nil
+}
+
+// parseLanguagesTOML parses the small TOML subset used by languages.toml:
+// [[language]] tables containing string and string-array keys.
+//
+//	[[language]]
+//	name = "Deno"
+//	extensions = [".ts"]
+//	shebangs = ["#!/usr/bin/env -S deno run"]
+//	modelines = ["typescript"]
+//	command = "deno"
+//	args = ["run", "--allow-read"]
+func parseLanguagesTOML(src string) ([]Language, error) {
+	var langs []Language
+	var cur *Language
+	lines := strings.Split(src, "\n")
+	for i := 0; i < len(lines); i++ {
+		lineNo := i + 1
+		line := strings.TrimSpace(stripTOMLComment(lines[i]))
+		if line == "" {
+			continue
+		}
+		if line == "[[language]]" {
+			langs = append(langs, Language{})
+			cur = &langs[len(langs)-1]
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			return nil, fmt.Errorf("line %d: unsupported table %s (only [[language]] is allowed)", lineNo, line)
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+		if cur == nil {
+			return nil, fmt.Errorf("line %d: key outside a [[language]] table", lineNo)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		// Arrays may span several lines.
+		if strings.HasPrefix(value, "[") {
+			for !strings.HasSuffix(value, "]") && i+1 < len(lines) {
+				i++
+				value += " " + strings.TrimSpace(stripTOMLComment(lines[i]))
+			}
+		}
+
+		if err := setLanguageField(cur, key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNo, err)
+		}
+	}
+
+	for i, l := range langs {
+		switch {
+		case l.Name == "":
+			return nil, fmt.Errorf("language #%d has no name", i+1)
+		case l.Command == "" && l.BuildCommand == "":
+			return nil, fmt.Errorf("language %q needs a command or build_command", l.Name)
+		case len(l.Extensions) == 0 && len(l.Shebangs) == 0 && len(l.Modelines) == 0:
+			return nil, fmt.Errorf("language %q needs extensions, shebangs or modelines", l.Name)
+		}
+	}
+	return langs, nil
+}
+
+func setLanguageField(l *Language, key, value string) error {
+	strs := map[string]*string{
+		"name":          &l.Name,
+		"command":       &l.Command,
+		"temp_name":     &l.TempName,
+		"build_command": &l.BuildCommand,
+		"image":         &l.Image,
+	}
+	lists := map[string]*[]string{
+		"extensions":       &l.Extensions,
+		"shebangs":         &l.Shebangs,
+		"modelines":        &l.Modelines,
+		"args":             &l.Args,
+		"stdin_args":       &l.StdinArgs,
+		"file_args":        &l.FileArgs,
+		"build_args":       &l.BuildArgs,
+		"fallbacks":        &l.Fallbacks,
+		"windows_commands": &l.WindowsCommands,
+	}
+	if p, ok := strs[key]; ok {
+		s, rest, err := parseTOMLString(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		if strings.TrimSpace(rest) != "" {
+			return fmt.Errorf("%s: unexpected %q after string", key, rest)
+		}
+		*p = s
+		return nil
+	}
+	if p, ok := lists[key]; ok {
+		list, err := parseTOMLStringArray(value)
+		if err != nil {
+			return fmt.Errorf("%s: %v", key, err)
+		}
+		*p = list
+		return nil
+	}
+	return fmt.Errorf("unknown key %q", key)
+}
+
+// parseTOMLString parses a basic ("...") or literal ('...') string at the
+// start of s and returns it with the remaining input.
+func parseTOMLString(s string) (value, rest string, err error) {
+	if s == "" {
+		return "", "", errors.New("expected a string")
+	}
+	switch s[0] {
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", errors.New("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '"':
+		for i := 1; i < len(s); i++ {
+			switch s[i] {
+			case '\\':
+				i++
+			case '"':
+				v, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return v, s[i+1:], nil
+			}
+		}
+		return "", "", errors.New("unterminated string")
+	}
+	return "", "", fmt.Errorf("expected a string, got %s", s)
+}
+
+func parseTOMLStringArray(s string) ([]string, error) {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return nil, errors.New("expected an array of strings")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	list := []string{}
+	for s != "" {
+		v, rest, err := parseTOMLString(s)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, v)
+		rest = strings.TrimSpace(rest)
+		if rest != "" {
+			if rest[0] != ',' {
+				return nil, fmt.Errorf("expected ',' between array items, got %q", rest)
+			}
+			rest = strings.TrimSpace(rest[1:])
+		}
+		s = rest
+	}
+	return list, nil
+}
+
+// stripTOMLComment removes a trailing # comment that is not inside a string.
+func stripTOMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
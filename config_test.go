@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLanguagesTOML(t *testing.T) {
+	src := `# my extra interpreters
+[[language]]
+name = "Deno"
+extensions = [".ts", '.tsx']  # both
+shebangs = [
+  "#!/usr/bin/env -S deno run",
+]
+command = "deno"
+args = ["run", "--allow-read"]
+
+[[language]]
+name = "Zig"
+extensions = [".zig"]
+build_command = "zig"
+build_args = ["build-exe"]
+`
+	langs, err := parseLanguagesTOML(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Language{
+		{
+			Name:       "Deno",
+			Extensions: []string{".ts", ".tsx"},
+			Shebangs:   []string{"#!/usr/bin/env -S deno run"},
+			Command:    "deno",
+			Args:       []string{"run", "--allow-read"},
+		},
+		{
+			Name:         "Zig",
+			Extensions:   []string{".zig"},
+			BuildCommand: "zig",
+			BuildArgs:    []string{"build-exe"},
+		},
+	}
+	if !reflect.DeepEqual(langs, want) {
+		t.Errorf("parseLanguagesTOML() =\n%+v\nwant\n%+v", langs, want)
+	}
+}
+
+func TestParseLanguagesTOMLErrors(t *testing.T) {
+	tests := []string{
+		"name = \"x\"\n",
+		"[[language]]\nname = \"x\"\nextensions = [\".x\"]\n",
+		"[[language]]\nname = \"x\"\ncommand = \"x\"\n",
+		"[[language]]\nname = \"x\"\ncommand = \"x\"\nextensions = [\".x\"]\ncolour = \"red\"\n",
+		"[[language]]\nname = \"x\ncommand = \"x\"\n",
+		"[settings]\n",
+	}
+	for _, src := range tests {
+		if _, err := parseLanguagesTOML(src); err == nil {
+			t.Errorf("parseLanguagesTOML(%q) should fail", src)
+		}
+	}
+}
+
+func TestLoadLanguagesUserPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("BACKLANG_CONFIG_DIR", dir)
+	os.WriteFile(filepath.Join(dir, "languages.toml"), []byte(`
+[[language]]
+name = "python"
+extensions = [".py"]
+command = "pypy3"
+
+[[language]]
+name = "Deno"
+extensions = [".ts"]
+command = "deno"
+args = ["run"]
+`), 0644)
+
+	lang, err := detectLanguage("script.py", []byte("print(1)\n"), options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lang.Command != "pypy3" {
+		t.Errorf("user entry did not replace built-in Python: command = %q", lang.Command)
+	}
+	lang, err = detectLanguage("app.ts", []byte("console.log(1)\n"), options{})
+	if err != nil || lang.Name != "Deno" {
+		t.Errorf("detectLanguage(app.ts) = %v, %v; want Deno", lang, err)
+	}
+
+	os.WriteFile(filepath.Join(dir, "languages.toml"), []byte("[[language]]\nbogus\n"), 0644)
+	if _, err := loadLanguages(); !errors.Is(err, ErrUsage) {
+		t.Errorf("loadLanguages() with invalid file error = %v, want ErrUsage", err)
+	}
+}
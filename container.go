@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// containerWorkdir is where the run's temporary directory is mounted inside
+// the container.
+const containerWorkdir = "/work"
+
+// containerRuntime returns the container CLI to use for run --container:
+// $BACKLANG_CONTAINER_RUNTIME if set, otherwise podman or docker, whichever
+// is found first on PATH.
+func containerRuntime() (string, error) {
+	if rt := os.Getenv(envPrefix + "CONTAINER_RUNTIME"); rt != "" {
+		if _, err := exec.LookPath(rt); err != nil {
+			return "", newError(ErrNoInterpreter, "container runtime '%s' was not found on PATH", rt)
+		}
+		return rt, nil
+	}
+	for _, rt := range []string{"podman", "docker"} {
+		if _, err := exec.LookPath(rt); err == nil {
+			return rt, nil
+		}
+	}
+	return "", newError(ErrNoInterpreter, "--container needs podman or docker on PATH")
+}
+
+// containerImage picks the image for lang: --image wins over the language's
+// default.
+func containerImage(lang *Language, opts options) (string, error) {
+	if opts.image != "" {
+		return opts.image, nil
+	}
+	if lang.Image == "" {
+		return "", newError(ErrUsage, "no container image is known for %s; pass --image", lang.Name)
+	}
+	return lang.Image, nil
+}
+
+// containerCommand rewrites name and args into a "<runtime> run" invocation
+// that mounts only workdir, at containerWorkdir, and starts there, with env
+// set inside and any further runtime flags. Paths inside workdir are
+// translated to their location in the container.
+func containerCommand(rt, image, containerName, workdir string, env, flags []string, name string, args []string) (string, []string) {
+	runArgs := []string{"run", "--rm", "-i", "--name", containerName,
+		"-v", workdir + ":" + containerWorkdir, "-w", containerWorkdir,
+		"-e", "HOME=" + containerWorkdir, "-e", "TMPDIR=" + containerWorkdir}
+	// Files the program creates in the mount must stay removable by us.
+	if strings.Contains(filepath.Base(rt), "podman") {
+		runArgs = append(runArgs, "--userns=keep-id")
+	} else if runtime.GOOS != "windows" {
+		runArgs = append(runArgs, "--user", strconv.Itoa(os.Getuid())+":"+strconv.Itoa(os.Getgid()))
+	}
+	for _, kv := range env {
+		runArgs = append(runArgs, "-e", kv)
+	}
+	runArgs = append(runArgs, flags...)
+	runArgs = append(runArgs, image, containerPath(workdir, name))
+	for _, arg := range args {
+		runArgs = append(runArgs, containerPath(workdir, arg))
+	}
+	return rt, runArgs
+}
+
+// containerPath maps a host path inside workdir to the mounted location;
+// anything else is returned unchanged.
+func containerPath(workdir, p string) string {
+	rel, err := filepath.Rel(workdir, p)
+	if err != nil || !filepath.IsAbs(p) || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return p
+	}
+	return containerWorkdir + "/" + filepath.ToSlash(rel)
+}
+
+// newContainerName returns a unique name so a timed-out container can be
+// removed even after its client has been killed.
+func newContainerName() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return "backlang-run-" + hex.EncodeToString(b)
+}
+
+// removeContainer force-removes a container started by run --container.
+func removeContainer(rt, containerName string) {
+	exec.Command(rt, "rm", "-f", containerName).Run()
+}
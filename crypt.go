@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Encrypted files keep their header readable; it gains encrypt and kdf
+// fields and the body becomes salt || nonce || AES-256-GCM(body), with the
+// header line as additional data so it cannot be altered either:
+//
+//	##BCKL/2 mode=lines encrypt=aes-256-gcm kdf=pbkdf2-sha256:600000##
+//
+// The key comes from the passphrase through PBKDF2-HMAC-SHA256, the
+// memory-hard KDFs being outside the standard library. Encryption happens
+// after encoding (and compression), on the whole body at once.
+const (
+	cipherAESGCM  = "aes-256-gcm"
+	kdfPBKDF2     = "pbkdf2-sha256"
+	kdfIterations = 600_000 // OWASP's 2023 recommendation for PBKDF2-HMAC-SHA256
+	saltLen       = 16
+)
+
+// seal encrypts the encoded file enc with pass.
+func seal(enc, pass []byte) ([]byte, error) {
+	f, body, err := parseHeader(enc)
+	if err != nil {
+		return nil, err
+	}
+	f.encrypt, f.kdfIter = cipherAESGCM, kdfIterations
+	header := f.header()
+	salt := make([]byte, saltLen)
+	rand.Read(salt)
+	aead, err := newAEAD(pass, salt, f.kdfIter)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	out := append(append([]byte(header), salt...), nonce...)
+	return aead.Seal(out, nonce, body, []byte(header)), nil
+}
+
+// unseal reverses seal, returning the encoded file that was encrypted.
+func unseal(data, pass []byte) ([]byte, error) {
+	f, body, err := parseHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	header := data[:len(data)-len(body)]
+	if len(body) < saltLen {
+		return nil, newError(ErrCorrupt, "encrypted body is truncated")
+	}
+	aead, err := newAEAD(pass, body[:saltLen], f.kdfIter)
+	if err != nil {
+		return nil, err
+	}
+	body = body[saltLen:]
+	if len(body) < aead.NonceSize()+aead.Overhead() {
+		return nil, newError(ErrCorrupt, "encrypted body is truncated")
+	}
+	plain, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+	if err != nil {
+		return nil, newError(ErrEncrypted, "wrong passphrase, or the file was modified")
+	}
+	f.encrypt, f.kdfIter = "", 0
+	return append([]byte(f.header()), plain...), nil
+}
+
+func newAEAD(pass, salt []byte, iter int) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(pass), salt, iter, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// promptedPassphrase remembers a passphrase typed at the terminal, so one
+// command never asks twice.
+var promptedPassphrase []byte
+
+// passphrase returns the passphrase from --passphrase-file, then
+// $BACKLANG_PASSPHRASE, then by asking on the terminal (twice when confirm
+// is set, for encrypting).
+func passphrase(opts options, confirm bool) ([]byte, error) {
+	if opts.passFile != "" {
+		data, err := os.ReadFile(opts.passFile)
+		if err != nil {
+			return nil, wrapPathErr(err, opts.passFile)
+		}
+		if pass := bytes.TrimRight(data, "\r\n"); len(pass) > 0 {
+			return pass, nil
+		}
+		return nil, newError(ErrUsage, "passphrase file '%s' is empty", opts.passFile)
+	}
+	if v := os.Getenv(envPrefix + "PASSPHRASE"); v != "" {
+		return []byte(v), nil
+	}
+	termMu.Lock()
+	defer termMu.Unlock()
+	if promptedPassphrase != nil {
+		return promptedPassphrase, nil
+	}
+	if !stdinIsTerminal() {
+		return nil, newError(ErrUsage, "a passphrase is needed and stdin is not a terminal; use --passphrase-file or %sPASSPHRASE", envPrefix)
+	}
+	in := bufio.NewReader(os.Stdin)
+	pass, err := readSecret(in, "Passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if len(pass) == 0 {
+		return nil, newError(ErrUsage, "empty passphrase")
+	}
+	if confirm {
+		again, err := readSecret(in, "Repeat passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(pass, again) {
+			return nil, newError(ErrUsage, "passphrases do not match")
+		}
+	}
+	promptedPassphrase = pass
+	return pass, nil
+}
+
+// readSecret prompts on stderr and reads a line from the terminal without
+// echoing it (where the platform lets us turn echo off).
+func readSecret(in *bufio.Reader, prompt string) ([]byte, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	if restore, err := disableEcho(os.Stdin.Fd()); err == nil {
+		defer restore()
+	}
+	line, err := in.ReadString('\n')
+	fmt.Fprintln(os.Stderr)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return []byte(strings.TrimRight(line, "\r\n")), nil
+}
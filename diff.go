@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// diffContext is the number of unchanged lines shown around each change.
+const diffContext = 3
+
+// diff compares two files, decoding any .bck operand in memory first, and
+// prints a unified diff of the plain text. The result's action is
+// "identical" or "differ"; main turns the latter into exit status 1.
+func diff(aPath, bPath string, opts options) (result, error) {
+	res := result{Command: "diff", Input: aPath, Output: bPath}
+	a, err := readPlain(aPath, opts)
+	if err != nil {
+		return res, err
+	}
+	b, err := readPlain(bPath, opts)
+	if err != nil {
+		return res, err
+	}
+	opts.logger().Debug("comparing", "a", aPath, "a_bytes", len(a), "b", bPath, "b_bytes", len(b))
+	res.Action = "identical"
+	if string(a) != string(b) {
+		res.Action = "differ"
+		opts.infof("%s", unifiedDiff(aPath, bPath, string(a), string(b)))
+	}
+	return res, nil
+}
+
+// readPlain returns the contents of name, decoded if it is a .bck.
+func readPlain(name string, opts options) ([]byte, error) {
+	if !strings.HasSuffix(strings.ToLower(name), ".bck") {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			return nil, wrapPathErr(err, name)
+		}
+		return data, nil
+	}
+	data, release, err := mapFile(name)
+	if err != nil {
+		return nil, wrapPathErr(err, name)
+	}
+	defer release()
+	if data, err = unwrapData(data, opts); err != nil {
+		return nil, err
+	}
+	data, _, err = decodeData(data)
+	if err != nil {
+		var ce *cliError
+		if errors.As(err, &ce) {
+			err = newError(ce.kind, "'%s': %s", filepath.Base(name), strings.TrimPrefix(ce.msg, "Error: "))
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// unifiedDiff returns the differences between a and b in unified format,
+// or "" if they are equal.
+func unifiedDiff(aName, bName, a, b string) string {
+	al, bl := strings.SplitAfter(a, "\n"), strings.SplitAfter(b, "\n")
+	if al[len(al)-1] == "" {
+		al = al[:len(al)-1]
+	}
+	if bl[len(bl)-1] == "" {
+		bl = bl[:len(bl)-1]
+	}
+	ops := diffLines(al, bl)
+
+	var sb strings.Builder
+	line := func(prefix byte, s string) {
+		sb.WriteByte(prefix)
+		sb.WriteString(s)
+		if !strings.HasSuffix(s, "\n") {
+			sb.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+	for i := 0; i < len(ops); {
+		// Find the next change, then extend the hunk while the gap to the
+		// following one is small enough to share context.
+		for i < len(ops) && ops[i].kind == ' ' {
+			i++
+		}
+		if i == len(ops) {
+			break
+		}
+		start := max(i-diffContext, 0)
+		end := i
+		for end < len(ops) {
+			if ops[end].kind != ' ' {
+				end++
+				continue
+			}
+			gap := end
+			for gap < len(ops) && ops[gap].kind == ' ' {
+				gap++
+			}
+			if gap == len(ops) || gap-end > 2*diffContext {
+				end = min(end+diffContext, len(ops))
+				break
+			}
+			end = gap
+		}
+		if sb.Len() == 0 {
+			fmt.Fprintf(&sb, "--- %s\n+++ %s\n", aName, bName)
+		}
+		aStart, bStart := ops[start].a, ops[start].b
+		var aLen, bLen int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&sb, "@@ -%s +%s @@\n", hunkRange(aStart, aLen), hunkRange(bStart, bLen))
+		for _, op := range ops[start:end] {
+			if op.kind == '+' {
+				line(op.kind, bl[op.b])
+			} else {
+				line(op.kind, al[op.a])
+			}
+		}
+		i = end
+	}
+	return sb.String()
+}
+
+// hunkRange formats a hunk's line range the way diff -u does: 1-based,
+// the length omitted when it is 1, and an empty range naming the line
+// before it.
+func hunkRange(start, n int) string {
+	switch n {
+	case 0:
+		return fmt.Sprintf("%d,0", start)
+	case 1:
+		return fmt.Sprint(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, n)
+}
+
+// diffOp is one line of an edit script: kept (' '), deleted ('-') or
+// inserted ('+'), with its index in a and in b (the position it would
+// have for the side it is not on).
+type diffOp struct {
+	kind byte
+	a, b int
+}
+
+// diffLines returns a shortest edit script turning a into b (Myers'
+// algorithm), after setting aside their common prefix and suffix.
+func diffLines(a, b []string) []diffOp {
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	var ops []diffOp
+	for i := range pre {
+		ops = append(ops, diffOp{' ', i, i})
+	}
+	ops = append(ops, myers(a[pre:len(a)-suf], b[pre:len(b)-suf], pre)...)
+	for i := range suf {
+		ops = append(ops, diffOp{' ', len(a) - suf + i, len(b) - suf + i})
+	}
+	return ops
+}
+
+// myers diffs a and b, numbering lines from off.
+func myers(a, b []string, off int) []diffOp {
+	n, m := len(a), len(b)
+	mid := n + m + 1
+	v := make([]int, 2*mid+1)
+	// trace[d] holds v[-d..d] as it was before step d.
+	var trace [][]int
+	var d int
+search:
+	for d = 0; d <= n+m; d++ {
+		trace = append(trace, append([]int(nil), v[mid-d:mid+d+1]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[mid+k-1] < v[mid+k+1]) {
+				x = v[mid+k+1]
+			} else {
+				x = v[mid+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x, y = x+1, y+1
+			}
+			v[mid+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back from the end, collecting the script in reverse.
+	var rev []diffOp
+	x, y := n, m
+	for ; d > 0; d-- {
+		prev := trace[d]
+		at := func(k int) int { return prev[k+d] }
+		k := x - y
+		var pk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := at(pk)
+		py := px - pk
+		for x > px && y > py {
+			x, y = x-1, y-1
+			rev = append(rev, diffOp{' ', off + x, off + y})
+		}
+		if x == px {
+			y--
+			rev = append(rev, diffOp{'+', off + x, off + y})
+		} else {
+			x--
+			rev = append(rev, diffOp{'-', off + x, off + y})
+		}
+	}
+	for x > 0 && y > 0 {
+		x, y = x-1, y-1
+		rev = append(rev, diffOp{' ', off + x, off + y})
+	}
+	reverse(rev)
+	return rev
+}
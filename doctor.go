@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// check is one finding of backlang doctor: what was looked at, how it
+// stands (ok, warn or fail) and, unless ok, what to do about it.
+type check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+	kind   error  // what a failure means, for the exit status
+}
+
+// versionTimeout bounds each interpreter's --version.
+const versionTimeout = 5 * time.Second
+
+// doctor checks what backlang depends on: its environment variables and
+// config files, the interpreters run would use and their versions,
+// whether the cache and data directories are writable, and what the
+// terminal can do. Each check prints a line, with a fix for anything
+// wrong. A missing interpreter only warns (few people have them all); any
+// failure makes doctor fail, with the kind of the first one.
+func doctor(opts options) (result, error) {
+	res := result{Command: "doctor", Action: "checked"}
+	var checks []check
+	add := func(c check) {
+		checks = append(checks, c)
+		status := map[string]string{"ok": "ok", "warn": "warn", "fail": "FAIL"}[c.Status]
+		opts.infof("%-4s  %-15s %s\n", status, c.Name, c.Detail)
+		if c.Fix != "" {
+			opts.infof("%-4s  %-15s fix: %s\n", "", "", c.Fix)
+		}
+	}
+
+	var scratch options
+	if err := applyEnv(&scratch); err != nil {
+		add(check{Name: "environment", Status: "fail", Detail: strings.TrimPrefix(err.Error(), "Error: "), Fix: "correct or unset the variable", kind: ErrUsage})
+	} else {
+		add(check{Name: "environment", Status: "ok", Detail: describeEnvSettings()})
+	}
+	add(configCheck("languages.toml", func(data []byte) (string, error) {
+		langs, err := parseLanguagesTOML(string(data))
+		return fmt.Sprintf("%d languages", len(langs)), err
+	}))
+	add(configCheck("keys.toml", func(data []byte) (string, error) {
+		keys, err := parseKeysTOML(string(data))
+		return fmt.Sprintf("%d API keys", len(keys)), err
+	}))
+
+	languages, err := loadLanguages()
+	if err != nil {
+		languages = getSupportedLanguages() // already reported above
+		applyInterpreterOverrides(languages)
+	}
+	for i := range languages {
+		add(interpreterCheck(&languages[i]))
+	}
+
+	dir, err := cacheDir()
+	add(writableCheck("cache", dir, err, "point "+envPrefix+"CACHE_DIR at a writable directory, or run with --no-cache", "fail"))
+	dir, err = dataDir()
+	add(writableCheck("data", dir, err, "point "+envPrefix+"DATA_DIR at a writable directory; until then undo and log have nothing to go on", "warn"))
+	add(writableCheck("temp", os.TempDir(), nil, "set TMPDIR (TEMP on Windows) to a writable directory; run decodes programs there", "fail"))
+	add(terminalCheck())
+
+	res.Checks = checks
+	failed, warned := 0, 0
+	var kind error
+	for _, c := range checks {
+		switch c.Status {
+		case "fail":
+			if failed++; kind == nil {
+				kind = c.kind
+			}
+		case "warn":
+			warned++
+		}
+	}
+	if failed > 0 {
+		res.Action = "failed"
+		return res, newError(kind, "%d of %d checks failed", failed, len(checks))
+	}
+	opts.infof("%d checks, %d warnings\n", len(checks), warned)
+	return res, nil
+}
+
+// describeEnvSettings lists the BACKLANG_ variables that are set.
+func describeEnvSettings() string {
+	var set []string
+	for _, kv := range os.Environ() {
+		if name, _, _ := strings.Cut(kv, "="); strings.HasPrefix(name, envPrefix) {
+			set = append(set, name)
+		}
+	}
+	if len(set) == 0 {
+		return "no " + envPrefix + " variables set"
+	}
+	return "set: " + strings.Join(set, ", ")
+}
+
+// configCheck checks a file in the config directory with parse, which
+// describes what it holds. A missing file is fine.
+func configCheck(name string, parse func([]byte) (string, error)) check {
+	c := check{Name: name, Status: "ok"}
+	dir, err := configDir()
+	if err != nil {
+		c.Detail = "no config directory: " + err.Error()
+		return c
+	}
+	path := filepath.Join(dir, name)
+	data, err := os.ReadFile(path)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		c.Detail = "none (" + path + ")"
+	case err != nil:
+		c.Status, c.kind = "fail", ErrPermission
+		c.Detail = fmt.Sprintf("cannot read %s: %v", path, errors.Unwrap(err))
+		c.Fix = "make it readable, or set " + envPrefix + "CONFIG_DIR to another directory"
+	default:
+		what, err := parse(data)
+		if err != nil {
+			c.Status, c.kind = "fail", ErrUsage
+			c.Detail = fmt.Sprintf("%s: %v", path, err)
+			c.Fix = "correct it; every command that reads it refuses to start until then"
+			return c
+		}
+		c.Detail = what + " (" + path + ")"
+	}
+	return c
+}
+
+// interpreterCheck reports which command run would use for lang, where it
+// is and what version it says it is.
+func interpreterCheck(lang *Language) check {
+	c := check{Name: lang.Name}
+	l, path, err := resolveCommand(lang, runtime.GOOS, exec.LookPath)
+	if err != nil && lang.Command == "cmd" && runtime.GOOS != "windows" {
+		c.Status, c.Detail = "ok", "only on Windows"
+		return c
+	}
+	if err != nil {
+		var names []string
+		for _, cand := range lang.candidates(runtime.GOOS) {
+			names = append(names, cand[0])
+		}
+		c.Status = "warn"
+		c.Detail = "not found on PATH (looked for " + strings.Join(names, ", ") + ")"
+		c.Fix = fmt.Sprintf("install %s to run %s programs, or point %s%s at one", lang.Name, lang.Name, envPrefix, strings.ToUpper(lang.Name))
+		return c
+	}
+	tool := l.tool()
+	version, err := toolVersion(path, tool)
+	if err != nil {
+		c.Status = "warn"
+		c.Detail = fmt.Sprintf("%s (%s) did not say its version: %v", tool, path, err)
+		c.Fix = "check that " + path + " runs; run will fail the same way"
+		return c
+	}
+	c.Status = "ok"
+	c.Detail = fmt.Sprintf("%s, %s (%s)", tool, version, path)
+	if _, overridden := interpreterOverride(lang.Name); overridden {
+		c.Detail += fmt.Sprintf(", set by %s%s", envPrefix, strings.ToUpper(lang.Name))
+	}
+	return c
+}
+
+// toolVersion runs path to ask its version and returns the first line it
+// prints. tool is the name it was found by, which decides how to ask.
+func toolVersion(path, tool string) (string, error) {
+	var args []string
+	switch name := strings.TrimSuffix(strings.ToLower(filepath.Base(tool)), ".exe"); {
+	case name == "go":
+		args = []string{"version"}
+	case name == "cmd":
+		args = []string{"/D", "/C", "ver"}
+	case name == "powershell":
+		// Windows PowerShell has no --version; it would start a shell.
+		args = []string{"-NoProfile", "-Command", "$PSVersionTable.PSVersion.ToString()"}
+	case name == "py":
+		args = []string{"-3", "--version"}
+	case strings.HasPrefix(name, "lua"):
+		args = []string{"-v"}
+	default:
+		args = []string{"--version"}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, args...)
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+	if ctx.Err() != nil {
+		return "", fmt.Errorf("no answer in %s", versionTimeout)
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			if err != nil {
+				return "", fmt.Errorf("%v: %s", err, line)
+			}
+			return line, nil
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", errors.New("it printed nothing")
+}
+
+// writableCheck checks that a file can be created in dir (made if need
+// be), as backlang will. status is how bad it is if not.
+func writableCheck(name, dir string, err error, fix, status string) check {
+	c := check{Name: name, Status: "ok", Detail: dir + " is writable"}
+	if err == nil {
+		if err = os.MkdirAll(dir, 0o700); err == nil {
+			var f *os.File
+			if f, err = os.CreateTemp(dir, ".doctor-*"); err == nil {
+				f.Close()
+				os.Remove(f.Name())
+			}
+		}
+	}
+	if err != nil {
+		c.Status, c.kind, c.Fix = status, ErrPermission, fix
+		c.Detail = fmt.Sprintf("cannot write in %s: %v", dir, err)
+		if dir == "" {
+			c.Detail = "no directory: " + err.Error()
+		}
+	}
+	return c
+}
+
+// terminalCheck reports what the terminal allows: prompts (the passphrase
+// with echo off, overwrite questions, confirming a downloaded program)
+// need stdin to be one, and the progress line needs stderr to be.
+func terminalCheck() check {
+	c := check{Name: "terminal", Status: "ok"}
+	in, errOut := isTerminal(os.Stdin), isTerminal(os.Stderr)
+	switch {
+	case !in:
+		c.Status = "warn"
+		c.Detail = "stdin is not a terminal, so backlang cannot ask for passphrases or confirmation"
+		c.Fix = "pass --passphrase-file, --on-conflict and --yes where they would be asked for"
+		return c
+	default:
+		restore, err := disableEcho(os.Stdin.Fd())
+		if err != nil {
+			c.Status = "warn"
+			c.Detail = "stdin is a terminal, but echo cannot be turned off: passphrases would show as they are typed"
+			c.Fix = "use --passphrase-file"
+			return c
+		}
+		restore()
+		c.Detail = "stdin is a terminal; passphrases are read with echo off"
+	}
+	if errOut {
+		c.Detail += "; stderr shows progress"
+	} else {
+		c.Detail += "; stderr is not a terminal, so no progress is shown"
+	}
+	return c
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// edit decodes a .bck into a private temporary file, opens it in the
+// user's editor and, if it was changed, encodes it back over the .bck the
+// same way it was encoded before: same mode and compression, encrypted
+// with the same passphrase, armored if it was.
+func edit(inPath string, opts options) (result, error) {
+	res := result{Command: "edit", Input: inPath, Output: inPath, DryRun: opts.dryRun}
+	fi, err := os.Stat(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	armor := isArmored(data)
+	outer := data
+	if armor {
+		if outer, err = dearmor(data); err != nil {
+			return res, err
+		}
+	}
+	hf, _, err := parseHeader(outer)
+	if err != nil {
+		return res, err
+	}
+	inner, err := unwrapData(data, opts)
+	if err != nil {
+		return res, err
+	}
+	plain, f, err := decodeData(inner)
+	if err != nil {
+		return res, err
+	}
+	editor := editorCommand()
+	name := filepath.Base(stripLastBck(inPath))
+	if opts.dryRun {
+		res.Action = "edited"
+		opts.infof("Would open a decoded copy of '%s' in %s and re-encode it on save\n", filepath.Base(inPath), editor)
+		return res, nil
+	}
+
+	// The plain text only ever lives in a directory nobody else can read,
+	// removed as soon as the editor exits.
+	dir, err := os.MkdirTemp("", "backlang-edit-*")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+	tmp := filepath.Join(dir, name)
+	if err := os.WriteFile(tmp, plain, 0o600); err != nil {
+		return res, wrapPathErr(err, tmp)
+	}
+	opts.logger().Debug("decoded to temporary file", "path", tmp, "editor", editor)
+	if err := runEditor(editor, tmp); err != nil {
+		return res, execError(err, "Editor %s failed", editor)
+	}
+	edited, err := os.ReadFile(tmp)
+	if err != nil {
+		return res, wrapPathErr(err, tmp)
+	}
+	if bytes.Equal(edited, plain) {
+		res.Action = "unchanged"
+		opts.infof("No changes to '%s'\n", filepath.Base(inPath))
+		return res, nil
+	}
+
+	f.version = 0 // saved in the current format, even if it was format 1
+	out, err := encodeData(edited, f)
+	if err != nil {
+		return res, err
+	}
+	if hf.encrypt != "" {
+		pass, err := passphrase(opts, false)
+		if err != nil {
+			return res, err
+		}
+		if out, err = seal(out, pass); err != nil {
+			return res, err
+		}
+	}
+	fill := writeAll(out)
+	if armor {
+		fill = armored(fill)
+	}
+	if err := writeFileStream(inPath, fi.Mode().Perm(), true, opts.sync, fill); err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	res.Action = "edited"
+	opts.infof("Updated '%s'\n", filepath.Base(inPath))
+	return res, nil
+}
+
+// editorCommand returns $VISUAL, else $EDITOR, else the platform's basic
+// editor.
+func editorCommand() string {
+	for _, v := range []string{"VISUAL", "EDITOR"} {
+		if e := strings.TrimSpace(os.Getenv(v)); e != "" {
+			return e
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return "notepad"
+	}
+	return "vi"
+}
+
+// runEditor opens file in editor, attached to our terminal.
+func runEditor(editor, file string) error {
+	cmd := shellCommand(editor, file)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	return cmd.Run()
+}
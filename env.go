@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Environment variables read by backlang. They sit between the built-in
+// defaults and the command-line flags: a flag always wins.
+//
+//	BACKLANG_ON_CONFLICT  prompt, overwrite, rename, skip or fail
+//	BACKLANG_FORCE        same as --force
+//	BACKLANG_NO_CLOBBER   same as --no-clobber
+//	BACKLANG_DRY_RUN      same as --dry-run
+//	BACKLANG_QUIET        same as --quiet
+//	BACKLANG_VERBOSE      same as --verbose
+//	BACKLANG_LOG_LEVEL    same as --log-level
+//	BACKLANG_LOG_FORMAT   same as --log-format
+//	BACKLANG_JSON         same as --json
+//	BACKLANG_NO_VENV      same as --no-venv
+//	BACKLANG_NO_CACHE     same as --no-cache
+//	BACKLANG_<LANGUAGE>   interpreter command for a language, e.g. BACKLANG_PYTHON=python3.12
+//	BACKLANG_CONFIG_DIR   where to look for languages.toml
+//	BACKLANG_CACHE_DIR    where run caches decoded programs and binaries
+//	BACKLANG_DATA_DIR     where the journal undo and log read is kept
+//	BACKLANG_PASSPHRASE   passphrase for --encrypt and encrypted files (read by passphrase)
+//	BACKLANG_API_KEY      an API key serve accepts for every operation (read by loadAPIKeys)
+//	BACKLANG_CONTAINER_RUNTIME  container CLI for run --container (podman or docker)
+const envPrefix = "BACKLANG_"
+
+// applyEnv fills opts from BACKLANG_* environment variables.
+func applyEnv(opts *options) error {
+	if v, ok := os.LookupEnv(envPrefix + "ON_CONFLICT"); ok {
+		p, err := parseConflictPolicy(v)
+		if err != nil {
+			return newError(ErrUsage, "%sON_CONFLICT: %v", envPrefix, err)
+		}
+		opts.onConflict = p
+	}
+	if v := os.Getenv(envPrefix + "LOG_LEVEL"); v != "" {
+		if _, err := parseLogLevel(v); err != nil {
+			return newError(ErrUsage, "%sLOG_LEVEL: %v", envPrefix, err)
+		}
+		opts.logLevel = v
+	}
+	if v := os.Getenv(envPrefix + "LOG_FORMAT"); v != "" {
+		f, err := parseLogFormat(v)
+		if err != nil {
+			return newError(ErrUsage, "%sLOG_FORMAT: %v", envPrefix, err)
+		}
+		opts.logFormat = f
+	}
+
+	bools := []struct {
+		name string
+		set  func(bool)
+	}{
+		{"FORCE", func(b bool) {
+			if b {
+				opts.onConflict, opts.force = conflictOverwrite, true
+			}
+		}},
+		{"NO_CLOBBER", func(b bool) {
+			if b {
+				opts.onConflict = conflictRename
+			}
+		}},
+		{"DRY_RUN", func(b bool) { opts.dryRun = b }},
+		{"QUIET", func(b bool) { opts.quiet = b }},
+		{"VERBOSE", func(b bool) { opts.verbose = b }},
+		{"JSON", func(b bool) { opts.json = b }},
+		{"NO_VENV", func(b bool) { opts.noVenv = b }},
+		{"NO_CACHE", func(b bool) { opts.noCache = b }},
+		{"SYNC", func(b bool) { opts.sync = b }},
+	}
+	for _, e := range bools {
+		v, ok := os.LookupEnv(envPrefix + e.name)
+		if !ok || v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return newError(ErrUsage, "%s%s must be a boolean (1/0, true/false), got %q", envPrefix, e.name, v)
+		}
+		e.set(b)
+	}
+	return nil
+}
+
+// interpreterOverride returns the command set in BACKLANG_<LANGUAGE> for the
+// named language, if any. Characters other than letters and digits in the
+// name become underscores.
+func interpreterOverride(langName string) (string, bool) {
+	name := strings.Map(func(r rune) rune {
+		if ('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9') {
+			return r
+		}
+		return '_'
+	}, strings.ToUpper(langName))
+	v := strings.TrimSpace(os.Getenv(envPrefix + name))
+	return v, v != ""
+}
+
+// cleanEnvKeys are the variables --clean-env passes through to the program.
+var cleanEnvKeys = []string{"PATH", "HOME", "LANG"}
+
+// windowsEnvKeys are the ones Windows programs cannot do without as well:
+// most fail to start, or to create a socket or a temporary file, when
+// SystemRoot or TEMP is missing, and batch files need COMSPEC to find cmd.
+// USERPROFILE is Windows's HOME.
+var windowsEnvKeys = []string{"SystemRoot", "SystemDrive", "WINDIR", "COMSPEC", "PATHEXT", "TEMP", "TMP", "USERPROFILE"}
+
+// cleanEnv returns the minimal environment used by run --clean-env.
+func cleanEnv() []string {
+	return cleanEnvFor(runtime.GOOS, os.LookupEnv)
+}
+
+// cleanEnvFor is cleanEnv for goos, taking the variables from lookup.
+func cleanEnvFor(goos string, lookup func(string) (string, bool)) []string {
+	var env []string
+	keys := cleanEnvKeys
+	if goos == "windows" {
+		keys = slices.Concat(keys, windowsEnvKeys)
+	}
+	for _, key := range keys {
+		if v, ok := lookup(key); ok {
+			env = append(env, key+"="+v)
+		}
+	}
+	return env
+}
+
+// programEnv returns the variables run adds to the program's environment:
+// the --env-file entries followed by the --env ones, so flags win.
+func programEnv(opts options) ([]string, error) {
+	var env []string
+	if opts.envFile != "" {
+		data, err := os.ReadFile(opts.envFile)
+		if err != nil {
+			return nil, wrapPathErr(err, opts.envFile)
+		}
+		if env, err = parseEnvFile(data); err != nil {
+			return nil, newError(ErrUsage, "%s: %v", opts.envFile, err)
+		}
+	}
+	return append(env, opts.env...), nil
+}
+
+// parseEnvFile reads dotenv-style KEY=VAL lines. Blank lines and # comments
+// are skipped, an "export " prefix is allowed, and a value wrapped in single
+// or double quotes has them removed.
+func parseEnvFile(data []byte) ([]string, error) {
+	var env []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, val, _ := strings.Cut(line, "=")
+		key, val = strings.TrimSpace(key), strings.TrimSpace(val)
+		if len(val) >= 2 && (val[0] == '"' || val[0] == '\'') && val[len(val)-1] == val[0] {
+			val = val[1 : len(val)-1]
+		}
+		entry := key + "=" + val
+		if err := checkEnvEntry(entry); err != nil || !strings.Contains(line, "=") {
+			return nil, fmt.Errorf("line %d: expected KEY=VAL, got %q", n, sc.Text())
+		}
+		env = append(env, entry)
+	}
+	return env, sc.Err()
+}
+
+// checkEnvEntry validates a KEY=VAL environment entry.
+func checkEnvEntry(s string) error {
+	key, _, ok := strings.Cut(s, "=")
+	if !ok || key == "" || strings.ContainsAny(key, " \t") {
+		return errors.New("expected KEY=VAL")
+	}
+	return nil
+}
+
+// splitArgs splits s into words as a POSIX shell would, short of
+// expanding anything: white space separates them unless quoted or escaped,
+// single quotes keep everything, and within double quotes a backslash
+// escapes the next character.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var word strings.Builder
+	var quote rune
+	inWord, escaped := false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord {
+				args = append(args, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	switch {
+	case quote != 0:
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	case escaped:
+		return nil, errors.New("backslash at the end")
+	}
+	if inWord {
+		args = append(args, word.String())
+	}
+	return args, nil
+}
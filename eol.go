@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// Line ending conversions for --eol. Preserve, the default, is "".
+const (
+	eolLF   = "lf"
+	eolCRLF = "crlf"
+)
+
+func parseEOL(s string) (string, error) {
+	switch s {
+	case "preserve":
+		return "", nil
+	case eolLF, eolCRLF:
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid line ending %q (want lf, crlf or preserve)", s)
+}
+
+// eolWriter converts line endings on their way to w: to \n, dropping the
+// \r of every \r\n, or to \r\n, adding one before every lone \n. Lone \r
+// characters are left alone either way. Close flushes a trailing \r held
+// back in case a \n followed.
+type eolWriter struct {
+	w      io.Writer
+	crlf   bool
+	lastCR bool // the last byte written was \r (held back in lf mode)
+	buf    []byte
+}
+
+func newEOLWriter(w io.Writer, eol string) *eolWriter {
+	return &eolWriter{w: w, crlf: eol == eolCRLF}
+}
+
+func (e *eolWriter) Write(p []byte) (int, error) {
+	out := e.buf[:0]
+	for _, b := range p {
+		switch {
+		case e.crlf:
+			if b == '\n' && !e.lastCR {
+				out = append(out, '\r')
+			}
+			out = append(out, b)
+		case e.lastCR && b != '\n':
+			out = append(out, '\r')
+			fallthrough
+		default:
+			if b != '\r' {
+				out = append(out, b)
+			}
+		}
+		e.lastCR = b == '\r'
+	}
+	e.buf = out
+	if _, err := e.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (e *eolWriter) Close() error {
+	if !e.crlf && e.lastCR {
+		e.lastCR = false
+		_, err := e.w.Write([]byte{'\r'})
+		return err
+	}
+	return nil
+}
+
+// convertEOL returns data with its line endings converted to eol.
+func convertEOL(data []byte, eol string) []byte {
+	if eol == "" {
+		return data
+	}
+	var out bytes.Buffer
+	ew := newEOLWriter(&out, eol)
+	ew.Write(data)
+	ew.Close()
+	return out.Bytes()
+}
+
+// withEOL wraps fill so everything it writes has its line endings
+// converted to eol.
+func withEOL(fill func(io.Writer) error, eol string) func(io.Writer) error {
+	if eol == "" {
+		return fill
+	}
+	return func(w io.Writer) error {
+		ew := newEOLWriter(w, eol)
+		if err := fill(ew); err != nil {
+			return err
+		}
+		return ew.Close()
+	}
+}
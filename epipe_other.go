@@ -0,0 +1,13 @@
+//go:build !plan9
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isBrokenPipe reports whether err is a write to a pipe nobody reads.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE)
+}
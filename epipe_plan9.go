@@ -0,0 +1,5 @@
+package main
+
+// isBrokenPipe reports whether err is a write to a pipe nobody reads.
+// Plan 9 has no EPIPE to recognise it by.
+func isBrokenPipe(err error) bool { return false }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors describing why a command failed. Every error returned by
+// encode, decode and run wraps one of these, so callers can branch with
+// errors.Is and main can map them to exit codes.
+var (
+	ErrUsage         = errors.New("invalid usage")
+	ErrNotBck        = errors.New("not a .bck file")
+	ErrBinary        = errors.New("binary input")
+	ErrNotFound      = errors.New("file not found")
+	ErrPermission    = errors.New("permission denied")
+	ErrConflict      = errors.New("output file already exists")
+	ErrNoInterpreter = errors.New("no interpreter")
+	ErrExec          = errors.New("execution failed")
+	ErrCorrupt       = errors.New("corrupt encoded data")
+	ErrTimeout       = errors.New("timed out")
+	ErrSandbox       = errors.New("sandbox unavailable")
+	ErrEncrypted     = errors.New("cannot decrypt")
+	ErrNetwork       = errors.New("download failed")
+	ErrProgramExit   = errors.New("program exited with non-zero status")
+)
+
+// Exit codes returned by the CLI. 1 is used for any error without a more
+// specific code. When run's program exits non-zero, its status is used
+// instead.
+const (
+	exitOK            = 0
+	exitError         = 1
+	exitDiffer        = 1 // diff: the files differ, as diff(1) reports it
+	exitUsage         = 2
+	exitNotFound      = 3
+	exitPermission    = 4
+	exitConflict      = 5
+	exitNoInterpreter = 6
+	exitExec          = 7
+	exitCorrupt       = 8
+	exitSandbox       = 9
+	exitEncrypted     = 10
+	exitNetwork       = 11
+	exitTimeout       = 124 // same as timeout(1)
+)
+
+// cliError pairs a user-facing message with the sentinel describing its cause.
+type cliError struct {
+	kind error
+	msg  string
+}
+
+func (e *cliError) Error() string { return e.msg }
+func (e *cliError) Unwrap() error { return e.kind }
+
+// exitStatusError reports that the program started by run exited with a
+// non-zero status. backlang exits with that same status, so wrappers see
+// the program's own code rather than one of ours.
+type exitStatusError struct {
+	cliError
+	status int
+}
+
+// newError returns an error printed as "Error: <message>" that matches kind
+// under errors.Is.
+func newError(kind error, format string, args ...any) error {
+	return &cliError{kind: kind, msg: "Error: " + fmt.Sprintf(format, args...)}
+}
+
+// exitCode maps an error returned by a command to the process exit status.
+func exitCode(err error) int {
+	var se *exitStatusError
+	if errors.As(err, &se) {
+		return se.status
+	}
+	switch {
+	case err == nil:
+		return exitOK
+	case errors.Is(err, ErrUsage), errors.Is(err, ErrNotBck), errors.Is(err, ErrBinary):
+		return exitUsage
+	case errors.Is(err, ErrNotFound):
+		return exitNotFound
+	case errors.Is(err, ErrPermission):
+		return exitPermission
+	case errors.Is(err, ErrConflict):
+		return exitConflict
+	case errors.Is(err, ErrNoInterpreter):
+		return exitNoInterpreter
+	case errors.Is(err, ErrExec):
+		return exitExec
+	case errors.Is(err, ErrCorrupt):
+		return exitCorrupt
+	case errors.Is(err, ErrSandbox):
+		return exitSandbox
+	case errors.Is(err, ErrEncrypted):
+		return exitEncrypted
+	case errors.Is(err, ErrNetwork):
+		return exitNetwork
+	case errors.Is(err, ErrTimeout):
+		return exitTimeout
+	}
+	return exitError
+}
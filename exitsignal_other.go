@@ -0,0 +1,17 @@
+//go:build !plan9
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// exitSignal reports the number and name of the signal that killed a
+// finished process, if one did.
+func exitSignal(ps *os.ProcessState) (int, string, bool) {
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return int(ws.Signal()), ws.Signal().String(), true
+	}
+	return 0, "", false
+}
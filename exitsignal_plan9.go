@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// exitSignal reports the number and name of the signal that killed a
+// finished process, if one did. Plan 9 processes end with a note, not a
+// numbered signal.
+func exitSignal(ps *os.ProcessState) (int, string, bool) { return 0, "", false }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+// filterMain runs "backlang filter encode|decode": stdin to stdout with no
+// progress output and no prompts, for git's clean and smudge filters.
+// Errors go to stderr and the exit code says what went wrong, as usual.
+func filterMain(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("filter", flag.ContinueOnError)
+	fs.Func("mode", "encode: what to reverse: lines (default), chars, words, bytes or blocks", func(s string) error {
+		m, err := parseMode(s)
+		opts.mode = m
+		return err
+	})
+	fs.BoolVar(&opts.compress, "compress", false, "encode: gzip the encoded content")
+	fs.StringVar(&opts.passFile, "passphrase-file", "", "decode: passphrase for encrypted input")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fs.PrintDefaults()
+	}
+	positional, _, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if len(positional) != 1 || (positional[0] != "encode" && positional[0] != "decode") {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(exitUsage)
+	}
+	if err := filter(positional[0], os.Stdin, os.Stdout, opts); err != nil {
+		printErr(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// filter encodes or decodes (cmd) everything from r onto w.
+func filter(cmd string, r io.Reader, w io.Writer, opts options) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var out []byte
+	if cmd == "encode" {
+		f := format{mode: opts.mode}
+		if opts.compress {
+			f.compress = compressGzip
+		}
+		out, err = encodeData(data, f)
+	} else if data, err = unwrapData(data, opts); err == nil {
+		out, _, err = decodeData(data)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
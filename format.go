@@ -0,0 +1,625 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Encoding modes, selected with --mode on encode.
+const (
+	modeLines  = "lines"  // reverse the order of lines (the original format)
+	modeChars  = "chars"  // reverse the characters within each line
+	modeWords  = "words"  // reverse the order of words within each line
+	modeBytes  = "bytes"  // reverse the whole file byte for byte (binary-safe)
+	modeBlocks = "blocks" // reverse the order of fixed-size blocks and of the lines in each
+)
+
+// A mode is a reversible transform: decode(encode(x)) == x. Streaming modes
+// have no in-memory encode; encodeFile writes them a chunk or block at a
+// time, and decodeStream reads them back the same way.
+type mode struct {
+	encode func([]byte) ([]byte, error)
+	decode func([]byte) ([]byte, error)
+	stream bool
+}
+
+var modes = map[string]mode{
+	modeLines:  {encode: infallible(encodeBytes), decode: infallible(decodeBytes)},
+	modeChars:  {encode: encodeChars, decode: infallible(reverseChars)},
+	modeWords:  {encode: infallible(reverseWords), decode: infallible(reverseWords)},
+	modeBytes:  {decode: infallible(reversedCopy), stream: true},
+	modeBlocks: {decode: decodeBlocksData, stream: true},
+}
+
+func infallible(transform func([]byte) []byte) func([]byte) ([]byte, error) {
+	return func(b []byte) ([]byte, error) { return transform(b), nil }
+}
+
+// modeNames lists the modes for usage and error messages.
+const modeNames = "lines, chars, words, bytes or blocks"
+
+func parseMode(s string) (string, error) {
+	if _, ok := modes[s]; !ok {
+		return "", fmt.Errorf("invalid mode %q (want %s)", s, modeNames)
+	}
+	return s, nil
+}
+
+// format describes how a .bck was encoded. Format 1 files are plain line
+// mode without a header; encode now always writes a header line recording
+// the mode and anything else, which decode reads to pick the right inverse:
+//
+//	##BCKL/2 mode=lines##
+//	##BCKL/2 mode=chars##
+//	##BCKL/2 mode=chars chars=graphemes##
+//	##BCKL/2 mode=blocks block=1048576##
+//	##BCKL/2 mode=lines compress=gzip##
+//	##BCKL/2 mode=lines encrypt=aes-256-gcm kdf=pbkdf2-sha256:600000##
+//	##BCKL/2 mode=lines charset=utf-16le##
+type format struct {
+	version   int // as read by parseHeader; encoding always writes formatVersion
+	mode      string
+	blockSize int64  // blocks mode only
+	compress  string // "" or compressGzip: the body after the header is compressed
+	encrypt   string // "" or cipherAESGCM: the body is encrypted (see seal)
+	kdfIter   int    // PBKDF2 iterations for the encryption key
+	charset   string // "" or the encoding the original was in before it became UTF-8 (see toUTF8)
+	graphemes bool   // chars mode only: grapheme clusters were reversed, not code points
+	name      string // "" or the original file's base name, recorded by --store-name
+}
+
+// compressGzip is the only compression --compress offers.
+const compressGzip = "gzip"
+
+const (
+	headerPrefix = "##BCKL/"
+	headerSuffix = "##"
+)
+
+func (f format) header() string {
+	fields := "mode=" + f.mode
+	if f.mode == modeBlocks {
+		fields += " block=" + strconv.FormatInt(f.blockSize, 10)
+	}
+	if f.graphemes {
+		fields += " chars=graphemes"
+	}
+	if f.charset != "" {
+		fields += " charset=" + f.charset
+	}
+	if f.name != "" {
+		fields += " name=" + escapeName(f.name)
+	}
+	if f.compress != "" {
+		fields += " compress=" + f.compress
+	}
+	if f.encrypt != "" {
+		fields += fmt.Sprintf(" encrypt=%s kdf=%s:%d", f.encrypt, kdfPBKDF2, f.kdfIter)
+	}
+	return fmt.Sprintf("%s%d %s%s\n", headerPrefix, formatVersion, fields, headerSuffix)
+}
+
+// escapeName percent-escapes what would break a header line if stored raw
+// in a name: spaces, #, % itself, control characters and invalid UTF-8.
+// Other non-ASCII text stays as it is; escaping it would triple its length.
+func escapeName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); {
+		r, size := utf8.DecodeRuneInString(name[i:])
+		raw := r != utf8.RuneError || size > 1
+		if r < utf8.RuneSelf {
+			raw = r > ' ' && r != '#' && r != '%' && r != 0x7f
+		} else if raw {
+			raw = unicode.IsPrint(r)
+		}
+		if raw {
+			b.WriteString(name[i : i+size])
+		} else {
+			for _, c := range []byte(name[i : i+size]) {
+				fmt.Fprintf(&b, "%%%02X", c)
+			}
+		}
+		i += size
+	}
+	return b.String()
+}
+
+// checkStoredName refuses a name for --store-name that would not fit in a
+// header of at most maxHeaderLen bytes alongside every other field one can
+// carry, since decode could then not find the header's end.
+func checkStoredName(name string) error {
+	worst := format{mode: modeBlocks, blockSize: math.MaxInt64, graphemes: true, charset: charsetUTF8BOM, name: name,
+		compress: compressGzip, encrypt: cipherAESGCM, kdfIter: 100 * kdfIterations}
+	stored := len(escapeName(name))
+	if room := maxHeaderLen - (len(worst.header()) - stored); stored > room {
+		return newError(ErrUsage, "'%s' is too long a name to record with --store-name: it takes %d bytes in the header, where %d fit", name, stored, room)
+	}
+	return nil
+}
+
+// encodeData encodes data as f describes, behind a header. Only a format
+// parsed from a format 1 file (version 1) is written back as format 1,
+// without one, so verify can re-encode such a file byte for byte.
+func encodeData(data []byte, f format) ([]byte, error) {
+	if f.mode == "" {
+		f.mode = modeLines
+	}
+	if f.mode == modeBlocks && f.blockSize == 0 {
+		f.blockSize = defaultBlockSize
+	}
+	if modes[f.mode].stream {
+		var out bytes.Buffer
+		err := encodeFile(&out, bytes.NewReader(data), f, int64(len(data)))
+		return out.Bytes(), err
+	}
+	f.charset, data = toUTF8(data)
+	var body []byte
+	var err error
+	if f.mode == modeChars {
+		body, f.graphemes, err = encodeGraphemes(data)
+	} else {
+		body, err = modes[f.mode].encode(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if f.version == 1 && f.mode == modeLines && f.charset == "" {
+		return body, nil
+	}
+	out := bytes.NewBufferString(f.header())
+	if f.compress == "" {
+		out.Write(body)
+		return out.Bytes(), nil
+	}
+	zw := gzip.NewWriter(out)
+	zw.Write(body)
+	zw.Close()
+	return out.Bytes(), nil
+}
+
+// decodeData decodes a .bck in any format this binary understands and
+// reports the format it found.
+func decodeData(data []byte) ([]byte, format, error) {
+	return decodeDataLimit(data, 0)
+}
+
+// decompressLimitError is what decodeDataLimit fails with when a
+// compressed body inflates past its limit.
+type decompressLimitError struct{ limit int64 }
+
+func (e *decompressLimitError) Error() string {
+	return fmt.Sprintf("decompressed data is larger than the %s limit", humanBytes(e.limit))
+}
+
+// decodeDataLimit is decodeData refusing, if limit is positive, to inflate
+// a compressed body to more than limit bytes, so a small upload can't
+// claim gigabytes of memory.
+func decodeDataLimit(data []byte, limit int64) ([]byte, format, error) {
+	if isArmored(data) {
+		var err error
+		if data, err = dearmor(data); err != nil {
+			return nil, format{}, err
+		}
+	}
+	f, body, err := parseHeader(data)
+	if err != nil {
+		return nil, f, err
+	}
+	if f.encrypt != "" {
+		return nil, f, newError(ErrEncrypted, "data is encrypted; decrypt it with the passphrase first")
+	}
+	if f.compress != "" {
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err == nil {
+			var r io.Reader = zr
+			if limit > 0 {
+				r = io.LimitReader(zr, limit+1)
+			}
+			body, err = io.ReadAll(r)
+		}
+		if err != nil {
+			return nil, f, corruptGzip(err)
+		}
+		if limit > 0 && int64(len(body)) > limit {
+			return nil, f, &decompressLimitError{limit}
+		}
+	}
+	out, err := decodeBody(body, f)
+	if err != nil {
+		return nil, f, err
+	}
+	return out, f, nil
+}
+
+// decodeBody decodes the uncompressed body of a non-streaming mode.
+func decodeBody(body []byte, f format) ([]byte, error) {
+	decode := modes[f.mode].decode
+	if f.graphemes {
+		decode = infallible(reverseGraphemes)
+	}
+	out, err := decode(body)
+	if err != nil {
+		return nil, err
+	}
+	return fromUTF8(out, f.charset)
+}
+
+// parseHeader splits data into its format and body. Data without a header
+// is a format 1 (line mode) file.
+func parseHeader(data []byte) (format, []byte, error) {
+	f := format{version: 1, mode: modeLines}
+	if !bytes.HasPrefix(data, []byte(headerPrefix)) {
+		return f, data, nil
+	}
+	line, body, _ := bytes.Cut(data, []byte("\n"))
+	fields := strings.Fields(strings.TrimSuffix(strings.TrimPrefix(string(line), headerPrefix), headerSuffix))
+	if !strings.HasSuffix(string(line), headerSuffix) || len(fields) == 0 {
+		return f, nil, newError(ErrCorrupt, "malformed header %q", line)
+	}
+	version, err := strconv.Atoi(fields[0])
+	if err != nil || version < 2 {
+		return f, nil, newError(ErrCorrupt, "malformed header %q", line)
+	}
+	if version > formatVersion {
+		return f, nil, newError(ErrCorrupt, "written in format %d by a newer backlang (this one reads up to %d)", version, formatVersion)
+	}
+	f.version = version
+	for _, field := range fields[1:] {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "mode":
+			if _, ok := modes[value]; !ok {
+				return f, nil, newError(ErrCorrupt, "unknown mode %q in header", value)
+			}
+			f.mode = value
+		case "block":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return f, nil, newError(ErrCorrupt, "invalid block size %q in header", value)
+			}
+			f.blockSize = n
+		case "chars":
+			if value != "graphemes" {
+				return f, nil, newError(ErrCorrupt, "unknown chars unit %q in header", value)
+			}
+			f.graphemes = true
+		case "charset":
+			if value != charsetUTF8BOM && value != charsetUTF16LE && value != charsetUTF16BE {
+				return f, nil, newError(ErrCorrupt, "unknown charset %q in header", value)
+			}
+			f.charset = value
+		case "name":
+			name, err := url.PathUnescape(value)
+			if err != nil || !validBaseName(name) {
+				return f, nil, newError(ErrCorrupt, "invalid name %q in header", value)
+			}
+			f.name = name
+		case "compress":
+			if value != compressGzip {
+				return f, nil, newError(ErrCorrupt, "unknown compression %q in header", value)
+			}
+			f.compress = value
+		case "encrypt":
+			if value != cipherAESGCM {
+				return f, nil, newError(ErrCorrupt, "unknown cipher %q in header", value)
+			}
+			f.encrypt = value
+		case "kdf":
+			name, iter, _ := strings.Cut(value, ":")
+			n, err := strconv.Atoi(iter)
+			if name != kdfPBKDF2 || err != nil || n <= 0 || n > 100*kdfIterations {
+				return f, nil, newError(ErrCorrupt, "unsupported key derivation %q in header", value)
+			}
+			f.kdfIter = n
+		default:
+			// Fields change how the body decodes, so guessing is unsafe
+			return f, nil, newError(ErrCorrupt, "unknown header field %q", key)
+		}
+	}
+	if f.graphemes && f.mode != modeChars {
+		return f, nil, newError(ErrCorrupt, "malformed header %q: chars=graphemes needs mode=chars", line)
+	}
+	if (f.encrypt == "") != (f.kdfIter == 0) {
+		return f, nil, newError(ErrCorrupt, "malformed header %q: encrypt and kdf go together", line)
+	}
+	return f, body, nil
+}
+
+// validBaseName reports whether name is a plain file name, safe to create
+// next to the .bck it came from: no directories, no "." or "..".
+func validBaseName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// encodeChars is reverseChars for input that is valid UTF-8. Reversing
+// characters of malformed text could assemble new multi-byte characters
+// and would not round-trip.
+func encodeChars(data []byte) ([]byte, error) {
+	if !utf8.Valid(data) {
+		return nil, newError(ErrUsage, "--mode=chars only works on UTF-8 text; use --mode=lines")
+	}
+	return reverseChars(data), nil
+}
+
+// reverseChars reverses the characters of each line, leaving line endings
+// (\n or \r\n) where they are. It is its own inverse.
+func reverseChars(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		content, ending := cutLineEnding(line)
+		for len(content) > 0 {
+			_, size := utf8.DecodeLastRune(content)
+			out = append(out, content[len(content)-size:]...)
+			content = content[:len(content)-size]
+		}
+		out = append(out, ending...)
+	}
+	return out
+}
+
+// reverseWords reverses the order of the words in each line. Whitespace runs
+// (spaces and tabs) stay exactly where they were, so "a  b\tc" becomes
+// "c  b\ta". It is its own inverse.
+func reverseWords(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		content, ending := cutLineEnding(line)
+		words := bytes.FieldsFunc(content, isWordSpace)
+		for i := 0; len(content) > 0; {
+			if isWordSpace(rune(content[0])) {
+				out = append(out, content[0])
+				content = content[1:]
+				continue
+			}
+			// Fill this word's slot with the word from the mirrored slot
+			out = append(out, words[len(words)-1-i]...)
+			content = content[len(words[i]):]
+			i++
+		}
+		out = append(out, ending...)
+	}
+	return out
+}
+
+func isWordSpace(r rune) bool { return r == ' ' || r == '\t' }
+
+// cutLineEnding splits a line into its content and its \n or \r\n ending.
+func cutLineEnding(line []byte) (content, ending []byte) {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		if n > 1 && line[n-2] == '\r' {
+			return line[:n-2], line[n-2:]
+		}
+		return line[:n-1], line[n-1:]
+	}
+	return line, nil
+}
+
+// reversedCopy returns data reversed byte for byte.
+func reversedCopy(data []byte) []byte {
+	out := slices.Clone(data)
+	slices.Reverse(out)
+	return out
+}
+
+// Files are processed in chunks of this size where streaming is possible.
+const streamChunk = 64 << 10
+
+// maxHeaderLen bounds how far openEncoded looks for the end of a header.
+const maxHeaderLen = 512
+
+func openSized(path string) (*os.File, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
+// openEncoded opens a .bck and reads just its header, returning the format
+// and the offset and end of the body.
+func openEncoded(path string) (file *os.File, f format, off, size int64, err error) {
+	file, size, err = openSized(path)
+	if err != nil {
+		return nil, f, 0, 0, wrapPathErr(err, path)
+	}
+	head := make([]byte, min(size, maxHeaderLen))
+	if _, err := file.ReadAt(head, 0); err != nil && err != io.EOF {
+		file.Close()
+		return nil, f, 0, 0, wrapPathErr(err, path)
+	}
+	f, off, err = encodedHeader(head)
+	if err != nil {
+		file.Close()
+		return nil, f, 0, 0, err
+	}
+	return file, f, off, size, nil
+}
+
+// mapEncoded is openEncoded for read-only uses: the whole file is mapped
+// into memory (see mapFile), and decodeStream decodes straight from the
+// mapping. release must be called once the data is no longer used.
+func mapEncoded(path string) (data byteSlice, f format, off int64, release func(), err error) {
+	data, release, err = mapFile(path)
+	if err != nil {
+		return nil, f, 0, nil, wrapPathErr(err, path)
+	}
+	f, off, err = encodedHeader(data[:min(len(data), maxHeaderLen)])
+	if err != nil {
+		release()
+		return nil, f, 0, nil, err
+	}
+	return data, f, off, release, nil
+}
+
+// encodedHeader parses the header at the start of head, the first bytes
+// of a .bck, and returns the format and where the body starts.
+func encodedHeader(head []byte) (format, int64, error) {
+	if bytes.HasPrefix(head, []byte(headerPrefix)) {
+		if i := bytes.IndexByte(head, '\n'); i >= 0 {
+			head = head[:i+1]
+		}
+	}
+	f, body, err := parseHeader(head)
+	return f, int64(len(head) - len(body)), err
+}
+
+// byteSlice is an io.ReaderAt over data already in memory. decodeStream
+// uses its bytes directly instead of copying them.
+type byteSlice []byte
+
+func (b byteSlice) ReadAt(p []byte, off int64) (int, error) {
+	if off >= int64(len(b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// encodeFile writes the header and the encoding of r[0:size] in a streaming
+// mode.
+func encodeFile(w io.Writer, r io.ReaderAt, f format, size int64) error {
+	if _, err := io.WriteString(w, f.header()); err != nil {
+		return err
+	}
+	if f.compress == "" {
+		return encodeBody(w, r, f, size)
+	}
+	zw := gzip.NewWriter(w)
+	if err := encodeBody(zw, r, f, size); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func encodeBody(w io.Writer, r io.ReaderAt, f format, size int64) error {
+	if f.mode == modeBlocks {
+		return encodeBlocks(w, r, f.blockSize, 0, size)
+	}
+	return copyReversed(w, r, 0, size)
+}
+
+// decodeStream writes the decoding of the body r[off:size], encoded as f.
+// Streaming modes never hold the whole body; the others need it in memory.
+func decodeStream(w io.Writer, r io.ReaderAt, f format, off, size int64) error {
+	if f.compress != "" {
+		return decodeCompressed(w, r, f, off, size)
+	}
+	switch f.mode {
+	case modeBytes:
+		return copyReversed(w, r, off, size)
+	case modeBlocks:
+		return decodeBlocks(w, r, off, size)
+	}
+	var body []byte
+	if b, ok := r.(byteSlice); ok {
+		body = b[off:size]
+	} else {
+		var err error
+		if body, err = io.ReadAll(io.NewSectionReader(r, off, size-off)); err != nil {
+			return err
+		}
+	}
+	out, err := decodeBody(body, f)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+// decodeCompressed is decodeStream for a gzipped body. Streaming modes need
+// random access, so their body is decompressed into a temporary file; the
+// others are decompressed into memory.
+func decodeCompressed(w io.Writer, r io.ReaderAt, f format, off, size int64) error {
+	zr, err := gzip.NewReader(io.NewSectionReader(r, off, size-off))
+	if err != nil {
+		return corruptGzip(err)
+	}
+	f.compress = ""
+	if !modes[f.mode].stream {
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			return corruptGzip(err)
+		}
+		return decodeStream(w, bytes.NewReader(body), f, 0, int64(len(body)))
+	}
+	tmp, err := os.CreateTemp("", "backlang-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	n, err := io.Copy(tmp, zr)
+	if err != nil {
+		var pe *os.PathError
+		if errors.As(err, &pe) {
+			return err
+		}
+		return corruptGzip(err)
+	}
+	return decodeStream(w, tmp, f, 0, n)
+}
+
+func corruptGzip(err error) error {
+	return newError(ErrCorrupt, "compressed body is damaged: %v", err)
+}
+
+// copyReversed writes r[start:end] to w in reverse byte order, reading
+// backwards from end one chunk at a time.
+func copyReversed(w io.Writer, r io.ReaderAt, start, end int64) error {
+	buf := make([]byte, streamChunk)
+	for end > start {
+		chunk := buf[:min(int64(len(buf)), end-start)]
+		if _, err := r.ReadAt(chunk, end-int64(len(chunk))); err != nil && err != io.EOF {
+			return err
+		}
+		slices.Reverse(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			return err
+		}
+		end -= int64(len(chunk))
+	}
+	return nil
+}
+
+// compareWriter checks that everything written to it matches r, in order.
+type compareWriter struct {
+	r        *bufio.Reader
+	mismatch bool
+}
+
+func (c *compareWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, min(len(p), streamChunk))
+	for rest := p; len(rest) > 0 && !c.mismatch; {
+		n, _ := io.ReadFull(c.r, buf[:min(len(rest), len(buf))])
+		c.mismatch = n == 0 || !bytes.Equal(buf[:n], rest[:n])
+		rest = rest[n:]
+	}
+	return len(p), nil
+}
+
+// matched reports whether the writes matched all of r.
+func (c *compareWriter) matched() bool {
+	_, err := c.r.ReadByte()
+	return !c.mismatch && err == io.EOF
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCharsMode(t *testing.T) {
+	tests := []struct{ in, body string }{
+		{"hello\nworld\n", "olleh\ndlrow\n"},
+		{"abc\r\ndef", "cba\r\nfed"},
+		{"héllo wörld ✓\n", "✓ dlröw olléh\n"},
+		{"", ""},
+		{"\n\n", "\n\n"},
+	}
+	for _, tt := range tests {
+		enc, err := encodeData([]byte(tt.in), format{mode: modeChars})
+		if err != nil {
+			t.Fatalf("encode(%q): %v", tt.in, err)
+		}
+		if want := "##BCKL/2 mode=chars##\n" + tt.body; string(enc) != want {
+			t.Errorf("encode(%q) = %q, want %q", tt.in, enc, want)
+		}
+		dec, f, err := decodeData(enc)
+		if err != nil || f.mode != modeChars || string(dec) != tt.in {
+			t.Errorf("decode(encode(%q)) = %q, %s, %v", tt.in, dec, f.mode, err)
+		}
+	}
+
+	if _, err := encodeData([]byte("bad \xff byte\n"), format{mode: modeChars}); !errors.Is(err, ErrUsage) {
+		t.Errorf("encode(invalid UTF-8) error = %v, want ErrUsage", err)
+	}
+}
+
+func TestCharsModeGraphemes(t *testing.T) {
+	tests := []struct {
+		name, in, body string
+		graphemes      bool
+	}{
+		{"combining accent", "e\u0301a\n", "ae\u0301\n", true},
+		{"zwj family", "👩\u200d👩\u200d👧 hi\n", "ih 👩\u200d👩\u200d👧\n", true},
+		{"flags", "🇩🇪🇫🇷!", "!🇫🇷🇩🇪", true},
+		{"skin tone", "👍🏽ok", "ko👍🏽", true},
+		{"hangul jamo", "\u1100\u1161\u11a8z", "z\u1100\u1161\u11a8", true},
+		{"single code points", "héllo ✓\n", "✓ olléh\n", false},
+		// Reversed, the leading mark would join the x and not come back.
+		{"leading mark", "\u0301xe\u0301\n", "\u0301ex\u0301\n", false},
+	}
+	for _, tt := range tests {
+		enc, err := encodeData([]byte(tt.in), format{mode: modeChars})
+		if err != nil {
+			t.Fatalf("%s: encode: %v", tt.name, err)
+		}
+		f, body, err := parseHeader(enc)
+		if err != nil || string(body) != tt.body || f.graphemes != tt.graphemes {
+			t.Errorf("%s: encoded %q (graphemes %v, %v), want body %q (graphemes %v)", tt.name, enc, f.graphemes, err, tt.body, tt.graphemes)
+		}
+		if dec, _, err := decodeData(enc); err != nil || string(dec) != tt.in {
+			t.Errorf("%s: round trip = %q, %v", tt.name, dec, err)
+		}
+	}
+	if _, _, err := parseHeader([]byte("##BCKL/2 mode=lines chars=graphemes##\n")); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("chars=graphemes outside chars mode: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestWordsMode(t *testing.T) {
+	tests := []struct{ in, body string }{
+		{"one two three\n", "three two one\n"},
+		{"  lead  and\ttrail \r\n", "  trail  and\tlead \r\n"},
+		{"x = f(a, b)\nsolo", "b) f(a, = x\nsolo"},
+		{"\t\n", "\t\n"},
+	}
+	for _, tt := range tests {
+		enc, err := encodeData([]byte(tt.in), format{mode: modeWords})
+		if err != nil {
+			t.Fatalf("encode(%q): %v", tt.in, err)
+		}
+		if want := "##BCKL/2 mode=words##\n" + tt.body; string(enc) != want {
+			t.Errorf("encode(%q) = %q, want %q", tt.in, enc, want)
+		}
+		if dec, _, err := decodeData(enc); err != nil || string(dec) != tt.in {
+			t.Errorf("decode(encode(%q)) = %q, %v", tt.in, dec, err)
+		}
+	}
+}
+
+// linesHeader starts everything encode writes in plain line mode.
+var linesHeader = format{mode: modeLines}.header()
+
+func TestLineModeHeader(t *testing.T) {
+	// Line mode is written with a header too, so --strict and migrate can
+	// tell it from text that was never encoded.
+	enc, _ := encodeData([]byte("a\nb"), format{})
+	if string(enc) != linesHeader+nnlMarker+"b\na\n" {
+		t.Errorf("line mode encode = %q", enc)
+	}
+
+	// Format 1 files are only written back as format 1.
+	enc, _ = encodeData([]byte("a\nb\n"), format{version: 1, mode: modeLines})
+	if string(enc) != "b\na\n" {
+		t.Errorf("format 1 line mode encode = %q", enc)
+	}
+
+	// A first line that looks like a header is never misread.
+	in := "x\n##BCKL/2 mode=chars##\n"
+	enc, _ = encodeData([]byte(in), format{})
+	if !strings.HasPrefix(string(enc), "##BCKL/2 mode=lines##\n") {
+		t.Errorf("header-like body was not disambiguated: %q", enc)
+	}
+	if dec, _, err := decodeData(enc); err != nil || string(dec) != in {
+		t.Errorf("decode = %q, %v", dec, err)
+	}
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+	for _, data := range []string{
+		"##BCKL/9 mode=lines##\nx\n",
+		"##BCKL/2 mode=sideways##\nx\n",
+		"##BCKL/2 mode=chars colour=blue##\nx\n",
+		"##BCKL/two##\nx\n",
+		"##BCKL/2 mode=chars\nx\n",
+		"##BCKL/2 mode=lines name=..%2Fescape##\nx\n",
+		"##BCKL/2 mode=lines name=..##\nx\n",
+		"##BCKL/2 mode=lines name=%zz##\nx\n",
+	} {
+		if _, _, err := decodeData([]byte(data)); !errors.Is(err, ErrCorrupt) {
+			t.Errorf("decodeData(%q) error = %v, want ErrCorrupt", data, err)
+		}
+	}
+}
+
+func TestStoreName(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "my report #1.txt")
+	os.WriteFile(src, []byte("one\ntwo\n"), 0644)
+	if _, err := encode(src, options{quiet: true, storeName: true}); err != nil {
+		t.Fatal(err)
+	}
+	enc, _ := os.ReadFile(src + ".bck")
+	if want := "##BCKL/2 mode=lines name=my%20report%20%231.txt##\ntwo\none\n"; string(enc) != want {
+		t.Errorf("encoded = %q, want %q", enc, want)
+	}
+	renamed := filepath.Join(dir, "notes.bck")
+	os.Rename(src+".bck", renamed)
+	os.Remove(src)
+
+	res, err := decode(renamed, options{quiet: true, restore: true})
+	if err != nil || res.Output != src {
+		t.Fatalf("decode --restore-name wrote %q, %v; want %q", res.Output, err, src)
+	}
+	if got, _ := os.ReadFile(src); string(got) != "one\ntwo\n" {
+		t.Errorf("decoded = %q", got)
+	}
+	if res, _ := decode(renamed, options{quiet: true}); res.Output != filepath.Join(dir, "notes") {
+		t.Errorf("decode without --restore-name wrote %q", res.Output)
+	}
+}
+
+func TestStoreLongName(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, strings.Repeat("é", 100)+" 100%.txt")
+	if err := os.WriteFile(src, []byte("one\ntwo\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encode(src, options{quiet: true, storeName: true, compress: true}); err != nil {
+		t.Fatal(err)
+	}
+	renamed := filepath.Join(dir, "x.bck")
+	os.Rename(src+".bck", renamed)
+	os.Remove(src)
+	res, err := decode(renamed, options{quiet: true, restore: true})
+	if err != nil || res.Output != src {
+		t.Fatalf("decode --restore-name wrote %q, %v; want %q", res.Output, err, src)
+	}
+	if got, _ := os.ReadFile(src); string(got) != "one\ntwo\n" {
+		t.Errorf("decoded = %q", got)
+	}
+
+	// Every # takes three bytes escaped: this one cannot fit.
+	long := filepath.Join(dir, strings.Repeat("#", 200))
+	if err := os.WriteFile(long, []byte("x\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := encode(long, options{quiet: true, storeName: true}); !errors.Is(err, ErrUsage) {
+		t.Errorf("encode --store-name of a 600-byte escaped name: err = %v, want ErrUsage", err)
+	}
+	if fileExists(long + ".bck") {
+		t.Error("encode wrote a .bck whose header decode cannot read")
+	}
+}
+
+func TestBytesMode(t *testing.T) {
+	tempDir := t.TempDir()
+	// Larger than a chunk, with bytes line-based modes would mangle
+	data := make([]byte, 3*streamChunk+123)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	src := filepath.Join(tempDir, "blob.bin")
+	os.WriteFile(src, data, 0644)
+
+	if _, err := encode(src, options{quiet: true, mode: modeBytes, deleteOrig: true}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	enc, _ := os.ReadFile(src + ".bck")
+	header := "##BCKL/2 mode=bytes##\n"
+	if string(enc[:len(header)]) != header || enc[len(header)] != data[len(data)-1] {
+		t.Fatalf("encoded file does not start with the header and the last byte")
+	}
+	if want, _ := encodeData(data, format{mode: modeBytes}); !bytes.Equal(enc, want) {
+		t.Error("streamed encoding differs from the in-memory one")
+	}
+
+	if _, err := decode(src+".bck", options{quiet: true}); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Error("bytes mode did not round-trip")
+	}
+}
+
+func TestBlocksMode(t *testing.T) {
+	tempDir := t.TempDir()
+	var buf bytes.Buffer
+	for i := range 5000 {
+		fmt.Fprintf(&buf, "line %d\n", i)
+	}
+	buf.WriteString("no newline at the end")
+	data := buf.Bytes()
+	src := filepath.Join(tempDir, "big.txt")
+	os.WriteFile(src, data, 0644)
+
+	if _, err := encode(src, options{quiet: true, mode: modeBlocks, blockSize: 4096, deleteOrig: true}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	enc, _ := os.ReadFile(src + ".bck")
+	if !bytes.HasPrefix(enc, []byte("##BCKL/2 mode=blocks block=4096##\n##BCKL.BLOCK ")) {
+		t.Fatalf("encoded file starts with %q", enc[:60])
+	}
+	// Apart from the frames, the lines come out fully reversed.
+	var lines []string
+	for _, line := range strings.SplitAfter(string(enc), "\n")[1:] {
+		if line != "" && line != nnlMarker && !strings.HasPrefix(line, framePrefix) {
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	if lines[0] != "no newline at the end" || lines[len(lines)-1] != "line 0" {
+		t.Errorf("lines not reversed: first %q, last %q", lines[0], lines[len(lines)-1])
+	}
+	if want, _ := encodeData(data, format{mode: modeBlocks, blockSize: 4096}); !bytes.Equal(enc, want) {
+		t.Error("streamed encoding differs from the in-memory one")
+	}
+
+	if _, err := decode(src+".bck", options{quiet: true}); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Error("blocks mode did not round-trip")
+	}
+
+	bad := []byte("##BCKL/2 mode=blocks block=4096##\n##BCKL.BLOCK 99##\nshort\n")
+	if _, _, err := decodeData(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("truncated block: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestCharset(t *testing.T) {
+	utf16le := []byte{0xFF, 0xFE, 'a', 0, '\n', 0, 0x3D, 0xD8, 0x00, 0xDE, '\n', 0} // "a\n😀\n"
+	utf16be := []byte{0xFE, 0xFF, 0, 'a', 0, '\n', 0, 'b', 0, '\n'}
+	tests := []struct {
+		name    string
+		in      []byte
+		charset string
+		body    string
+	}{
+		{"utf-8 bom", []byte("\xef\xbb\xbfone\ntwo\n"), charsetUTF8BOM, "two\none\n"},
+		{"utf-16le", utf16le, charsetUTF16LE, "😀\na\n"},
+		{"utf-16be", utf16be, charsetUTF16BE, "b\na\n"},
+		{"odd-length utf-16", []byte{0xFF, 0xFE, 'a', 0, '\n'}, "", ""},
+		{"unpaired surrogate", []byte{0xFF, 0xFE, 0x3D, 0xD8, '\n', 0}, "", ""},
+	}
+	for _, tt := range tests {
+		enc, err := encodeData(tt.in, format{})
+		if err != nil {
+			t.Fatalf("%s: encode: %v", tt.name, err)
+		}
+		f, body, err := parseHeader(enc)
+		if err != nil || f.charset != tt.charset || tt.charset != "" && string(body) != tt.body {
+			t.Errorf("%s: encoded %q (charset %q, %v)", tt.name, enc, f.charset, err)
+		}
+		dec, _, err := decodeData(enc)
+		if err != nil || !bytes.Equal(dec, tt.in) {
+			t.Errorf("%s: round trip = %q, %v", tt.name, dec, err)
+		}
+	}
+	if looksBinary(utf16le) {
+		t.Error("looksBinary(UTF-16 with BOM) = true")
+	}
+}
+
+func TestMapEncoded(t *testing.T) {
+	dir := t.TempDir()
+	// One file small enough to be read, one large enough to be mapped.
+	for _, n := range []int{10, 300_000} {
+		src := filepath.Join(dir, fmt.Sprintf("f%d.txt", n))
+		var in bytes.Buffer
+		for i := range n {
+			fmt.Fprintf(&in, "line %d\n", i)
+		}
+		os.WriteFile(src, in.Bytes(), 0644)
+		if _, err := encode(src, options{quiet: true, mode: modeWords}); err != nil {
+			t.Fatal(err)
+		}
+		data, f, off, release, err := mapEncoded(src + ".bck")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		err = decodeStream(&out, data, f, off, int64(len(data)))
+		release()
+		if err != nil || !bytes.Equal(out.Bytes(), in.Bytes()) {
+			t.Errorf("%d lines: decodeStream from mapping: %v (%d bytes, want %d)", n, err, out.Len(), in.Len())
+		}
+	}
+	if _, _, _, _, err := mapEncoded(filepath.Join(dir, "missing.bck")); !errors.Is(err, ErrNotFound) {
+		t.Errorf("mapEncoded(missing) error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	tempDir := t.TempDir()
+	data := []byte(strings.Repeat("the same line again\n", 1000) + "last")
+	for _, m := range []string{modeLines, modeWords, modeBytes, modeBlocks} {
+		src := filepath.Join(tempDir, m+".txt")
+		os.WriteFile(src, data, 0644)
+		if _, err := encode(src, options{quiet: true, mode: m, compress: true, deleteOrig: true}); err != nil {
+			t.Fatalf("%s: encode: %v", m, err)
+		}
+		enc, _ := os.ReadFile(src + ".bck")
+		if !bytes.Contains(enc[:bytes.IndexByte(enc, '\n')], []byte(" compress=gzip##")) || len(enc) > len(data)/4 {
+			t.Errorf("%s: %d bytes, header %q", m, len(enc), enc[:bytes.IndexByte(enc, '\n')])
+		}
+		if got, _, err := decodeData(enc); err != nil || !bytes.Equal(got, data) {
+			t.Errorf("%s: in-memory decode failed: %v", m, err)
+		}
+		if _, err := decode(src+".bck", options{quiet: true}); err != nil {
+			t.Fatalf("%s: decode: %v", m, err)
+		}
+		if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+			t.Errorf("%s: compressed file did not round-trip", m)
+		}
+	}
+
+	bad := []byte("##BCKL/2 mode=lines compress=gzip##\nnot gzip at all\n")
+	if _, _, err := decodeData(bad); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("damaged body: got %v, want ErrCorrupt", err)
+	}
+}
+
+func TestEncrypt(t *testing.T) {
+	tempDir := t.TempDir()
+	data := []byte("dear diary\nnothing happened")
+	src := filepath.Join(tempDir, "note.txt")
+	os.WriteFile(src, data, 0644)
+	t.Setenv(envPrefix+"PASSPHRASE", "correct horse")
+
+	if _, err := encode(src, options{quiet: true, encrypt: true, compress: true, deleteOrig: true}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	enc, _ := os.ReadFile(src + ".bck")
+	if bytes.Contains(enc, []byte("diary")) {
+		t.Error("plaintext visible in encrypted file")
+	}
+	if _, _, err := decodeData(enc); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("decodeData on encrypted data: got %v, want ErrEncrypted", err)
+	}
+
+	t.Setenv(envPrefix+"PASSPHRASE", "wrong")
+	if _, err := decode(src+".bck", options{quiet: true}); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("wrong passphrase: got %v, want ErrEncrypted", err)
+	}
+	// The header is authenticated too.
+	tampered := bytes.Replace(enc, []byte("mode=lines"), []byte("mode=words"), 1)
+	if _, err := unseal(tampered, []byte("correct horse")); !errors.Is(err, ErrEncrypted) {
+		t.Errorf("tampered header: got %v, want ErrEncrypted", err)
+	}
+
+	t.Setenv(envPrefix+"PASSPHRASE", "correct horse")
+	if _, err := decode(src+".bck", options{quiet: true}); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Errorf("decrypted %q, want %q", got, data)
+	}
+}
+
+func TestArmor(t *testing.T) {
+	tempDir := t.TempDir()
+	data := []byte(strings.Repeat("some text worth pasting\n", 20))
+	src := filepath.Join(tempDir, "paste.txt")
+	os.WriteFile(src, data, 0644)
+
+	if _, err := encode(src, options{quiet: true, armor: true, compress: true, deleteOrig: true}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	enc, _ := os.ReadFile(src + ".bck")
+	lines := strings.Split(strings.TrimSuffix(string(enc), "\n"), "\n")
+	if lines[0] != armorBegin || lines[len(lines)-1] != armorEnd {
+		t.Fatalf("missing banners:\n%s", enc)
+	}
+	for _, line := range lines {
+		if len(line) > armorWidth {
+			t.Errorf("line longer than %d: %q", armorWidth, line)
+		}
+	}
+
+	// Pasted with indentation and a trailing signature still decodes.
+	pasted := "\n" + strings.ReplaceAll(string(enc), "\n", "\n   ") + "\n-- \nsent from my phone\n"
+	if got, _, err := decodeData([]byte(pasted)); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("pasted armor: %v", err)
+	}
+	damaged := strings.Replace(string(enc), lines[1][:4], "AAAA", 1)
+	if _, _, err := decodeData([]byte(damaged)); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("damaged armor: got %v, want ErrCorrupt", err)
+	}
+
+	if _, err := decode(src+".bck", options{quiet: true}); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if got, _ := os.ReadFile(src); !bytes.Equal(got, data) {
+		t.Error("armored file did not round-trip")
+	}
+
+	// A plain file whose encoding would look like armor gets a header.
+	if enc, _ := encodeData([]byte(armorBegin+"\n"), format{}); !bytes.HasPrefix(enc, []byte(headerPrefix)) {
+		t.Errorf("armor-like line-mode output has no header: %q", enc)
+	}
+}
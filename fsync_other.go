@@ -0,0 +1,7 @@
+//go:build !unix
+
+package main
+
+// syncDir is a no-op where directories can't be opened for syncing; on
+// Windows, NTFS commits renames through its journal.
+func syncDir(dir string) error { return nil }
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitAttributes is the .gitattributes line git-setup adds.
+const gitAttributes = "*.bck filter=backlang diff=backlang"
+
+// gitSetupMain runs "backlang git-setup".
+func gitSetupMain(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("git-setup", flag.ContinueOnError)
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "show what would be written without doing it")
+	fs.BoolVar(&opts.quiet, "q", false, "quiet: only print errors")
+	fs.BoolVar(&opts.quiet, "quiet", false, "same as -q")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fs.PrintDefaults()
+	}
+	positional, _, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if len(positional) > 0 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(exitUsage)
+	}
+	if err := gitSetup(".", opts); err != nil {
+		printErr(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// gitSetup wires backlang into the git repository containing dir: *.bck
+// files are stored encoded but checked out decoded (clean and smudge
+// filters), and diffs show the decoded text (textconv). The filter config
+// goes into the repository's own .git/config; .gitattributes is shared, so
+// everyone who clones gets the attributes and only needs git-setup once.
+func gitSetup(dir string, opts options) error {
+	top, err := gitOutput(dir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	self := backlangCommand()
+	config := [][2]string{
+		{"filter.backlang.clean", self + " filter encode"},
+		{"filter.backlang.smudge", self + " filter decode"},
+		{"filter.backlang.required", "true"},
+		// Diffs compare the stored (encoded) blobs, but git hands textconv
+		// a copy already smudged back to plain text, so it only has to
+		// pass that through.
+		{"diff.backlang.textconv", "cat"},
+	}
+	for _, kv := range config {
+		if opts.dryRun {
+			opts.infof("Would set git config %s = %s\n", kv[0], kv[1])
+			continue
+		}
+		if _, err := gitOutput(top, "config", "--local", kv[0], kv[1]); err != nil {
+			return err
+		}
+		opts.infof("Set git config %s = %s\n", kv[0], kv[1])
+	}
+
+	attrPath := filepath.Join(top, ".gitattributes")
+	attrs, err := os.ReadFile(attrPath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return wrapPathErr(err, attrPath)
+	}
+	for line := range strings.Lines(string(attrs)) {
+		if strings.TrimSpace(line) == gitAttributes {
+			opts.infof("'%s' already has %s\n", attrPath, gitAttributes)
+			return nil
+		}
+	}
+	if opts.dryRun {
+		opts.infof("Would add %s to '%s'\n", gitAttributes, attrPath)
+		return nil
+	}
+	if len(attrs) > 0 && !bytes.HasSuffix(attrs, []byte("\n")) {
+		attrs = append(attrs, '\n')
+	}
+	attrs = append(attrs, gitAttributes+"\n"...)
+	if err := writeFileAtomic(attrPath, attrs, 0o666); err != nil {
+		return wrapPathErr(err, attrPath)
+	}
+	opts.infof("Added %s to '%s'\n", gitAttributes, attrPath)
+	return nil
+}
+
+// backlangCommand is how git should invoke this binary: plain "backlang"
+// if that is what PATH finds, otherwise its absolute path.
+func backlangCommand() string {
+	self, err := os.Executable()
+	if err != nil {
+		return "backlang"
+	}
+	if onPath, err := exec.LookPath("backlang"); err == nil && sameFile(onPath, self) {
+		return "backlang"
+	}
+	if strings.ContainsAny(self, " '\"\\") {
+		return `"` + self + `"`
+	}
+	return self
+}
+
+func sameFile(a, b string) bool {
+	fa, err1 := os.Stat(a)
+	fb, err2 := os.Stat(b)
+	return err1 == nil && err2 == nil && os.SameFile(fa, fb)
+}
+
+// gitOutput runs git in dir and returns its trimmed stdout.
+func gitOutput(dir string, args ...string) (string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", newError(ErrNoInterpreter, "git not found in PATH")
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", newError(ErrExec, "git %s: %s", args[0], strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
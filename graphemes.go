@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"unicode"
+	"unicode/utf8"
+)
+
+// --mode=chars reverses user-perceived characters: extended grapheme
+// clusters as Unicode (UAX #29) defines them, so "é" spelled e + U+0301,
+// flags, skin-toned emoji and ZWJ sequences such as 👩‍👩‍👧 survive intact.
+// Go's standard library has no segmenter, so this is a compact one: the
+// property tables come from package unicode where it has them, and
+// Extended_Pictographic is approximated by the emoji blocks.
+
+// Grapheme cluster break properties.
+const (
+	gbOther = iota
+	gbCR
+	gbLF
+	gbControl
+	gbExtend
+	gbZWJ
+	gbRegional
+	gbPrepend
+	gbSpacingMark
+	gbL
+	gbV
+	gbT
+	gbLV
+	gbLVT
+	gbPictographic
+)
+
+var pictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00A9, 0x00A9, 1}, {0x00AE, 0x00AE, 1}, {0x203C, 0x203C, 1}, {0x2049, 0x2049, 1},
+		{0x2122, 0x2122, 1}, {0x2139, 0x2139, 1}, {0x2194, 0x2199, 1}, {0x21A9, 0x21AA, 1},
+		{0x231A, 0x231B, 1}, {0x2328, 0x2328, 1}, {0x2388, 0x2388, 1}, {0x23CF, 0x23CF, 1},
+		{0x23E9, 0x23F3, 1}, {0x23F8, 0x23FA, 1}, {0x24C2, 0x24C2, 1}, {0x25AA, 0x25AB, 1},
+		{0x25B6, 0x25B6, 1}, {0x25C0, 0x25C0, 1}, {0x25FB, 0x25FE, 1}, {0x2600, 0x27BF, 1},
+		{0x2934, 0x2935, 1}, {0x2B05, 0x2B07, 1}, {0x2B1B, 0x2B1C, 1}, {0x2B50, 0x2B50, 1},
+		{0x2B55, 0x2B55, 1}, {0x3030, 0x3030, 1}, {0x303D, 0x303D, 1}, {0x3297, 0x3297, 1},
+		{0x3299, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1F000, 0x1F1E5, 1}, {0x1F200, 0x1F3FA, 1}, {0x1F400, 0x1FAFF, 1}, {0x1FC00, 0x1FFFD, 1},
+	},
+}
+
+func graphemeProperty(r rune) int {
+	switch {
+	case r == '\r':
+		return gbCR
+	case r == '\n':
+		return gbLF
+	case r == 0x200D:
+		return gbZWJ
+	case r >= 0x1F1E6 && r <= 0x1F1FF:
+		return gbRegional
+	case r == 0x200C, r >= 0x1F3FB && r <= 0x1F3FF, r >= 0xE0020 && r <= 0xE007F,
+		unicode.In(r, unicode.Mn, unicode.Me, unicode.Other_Grapheme_Extend):
+		return gbExtend
+	case unicode.Is(unicode.Prepended_Concatenation_Mark, r):
+		return gbPrepend
+	case unicode.In(r, unicode.Cc, unicode.Cf, unicode.Zl, unicode.Zp):
+		return gbControl
+	case unicode.Is(unicode.Mc, r), r == 0x0E33, r == 0x0EB3:
+		return gbSpacingMark
+	case r >= 0x1100 && r <= 0x115F, r >= 0xA960 && r <= 0xA97C:
+		return gbL
+	case r >= 0x1160 && r <= 0x11A7, r >= 0xD7B0 && r <= 0xD7C6:
+		return gbV
+	case r >= 0x11A8 && r <= 0x11FF, r >= 0xD7CB && r <= 0xD7FB:
+		return gbT
+	case r >= 0xAC00 && r <= 0xD7A3:
+		if (r-0xAC00)%28 == 0 {
+			return gbLV
+		}
+		return gbLVT
+	case unicode.Is(pictographic, r):
+		return gbPictographic
+	}
+	return gbOther
+}
+
+// graphemeLen returns the length in bytes of the grapheme cluster at the
+// start of b.
+func graphemeLen(b []byte) int {
+	r, n := utf8.DecodeRune(b)
+	prev := graphemeProperty(r)
+	emoji := prev == gbPictographic // inside Pictographic Extend* (ZWJ)
+	regional := 0                   // regional indicators so far in this run
+	if prev == gbRegional {
+		regional = 1
+	}
+	for n < len(b) {
+		r, size := utf8.DecodeRune(b[n:])
+		p := graphemeProperty(r)
+		joined := false
+		switch {
+		case prev == gbCR && p == gbLF:
+			joined = true
+		case prev == gbCR, prev == gbLF, prev == gbControl, p == gbCR, p == gbLF, p == gbControl:
+		case prev == gbL && (p == gbL || p == gbV || p == gbLV || p == gbLVT),
+			(prev == gbLV || prev == gbV) && (p == gbV || p == gbT),
+			(prev == gbLVT || prev == gbT) && p == gbT:
+			joined = true
+		case p == gbExtend, p == gbZWJ, p == gbSpacingMark, prev == gbPrepend:
+			joined = true
+		case prev == gbZWJ && p == gbPictographic && emoji:
+			joined = true
+		case prev == gbRegional && p == gbRegional && regional%2 == 1:
+			joined = true
+		}
+		if !joined {
+			break
+		}
+		switch {
+		case p == gbPictographic:
+			emoji = true
+		case p == gbExtend && prev != gbZWJ, p == gbZWJ:
+		default:
+			emoji = false
+		}
+		if p == gbRegional {
+			regional++
+		}
+		prev = p
+		n += size
+	}
+	return n
+}
+
+// reverseGraphemes reverses the grapheme clusters of each line, leaving
+// line endings where they are.
+func reverseGraphemes(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	var clusters [][]byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		content, ending := cutLineEnding(line)
+		clusters = clusters[:0]
+		for len(content) > 0 {
+			n := graphemeLen(content)
+			clusters = append(clusters, content[:n])
+			content = content[n:]
+		}
+		for i := len(clusters) - 1; i >= 0; i-- {
+			out = append(out, clusters[i]...)
+		}
+		out = append(out, ending...)
+	}
+	return out
+}
+
+// encodeGraphemes is encodeChars by grapheme cluster. Reversal can make
+// neighbouring clusters merge (a combining mark at the start of a line
+// lands after a letter), so where that would stop the text from coming
+// back it falls back to reversing code points; graphemes reports which
+// was used, and is false too when the two would be the same.
+func encodeGraphemes(data []byte) (body []byte, graphemes bool, err error) {
+	runes, err := encodeChars(data)
+	if err != nil {
+		return nil, false, err
+	}
+	body = reverseGraphemes(data)
+	if bytes.Equal(body, runes) || !bytes.Equal(reverseGraphemes(body), data) {
+		return runes, false, nil
+	}
+	return body, true, nil
+}
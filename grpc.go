@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// A minimal gRPC server for the service in backlang.proto, built on net/http
+// (HTTP/2, including cleartext h2c) so backlang keeps no dependencies. Every
+// message in the service has at most a bytes/string field 1 and field 2, so
+// the protobuf encoding is done by hand.
+
+// gRPC status codes used by the server.
+const (
+	grpcOK                = 0
+	grpcInvalidArgument   = 3
+	grpcPermissionDenied  = 7
+	grpcResourceExhausted = 8
+	grpcUnimplemented     = 12
+	grpcInternal          = 13
+	grpcUnauthenticated   = 16
+)
+
+// grpcChunkSize is the largest chunk the streaming RPCs send back.
+const grpcChunkSize = 64 << 10
+
+const grpcService = "/backlang.v1.Backlang/"
+
+// grpcError is a failed RPC's status.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string { return e.msg }
+
+// isGRPC reports whether r is a gRPC call.
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// serveGRPC dispatches a gRPC call to the matching method.
+func serveGRPC(w http.ResponseWriter, r *http.Request, limit int64) {
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	err := callGRPC(w, r, limit)
+	status, msg := grpcOK, ""
+	if err != nil {
+		status, msg = grpcInternal, err.Error()
+		var ge *grpcError
+		if errors.As(err, &ge) {
+			status = ge.code
+		}
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(status))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+func callGRPC(w http.ResponseWriter, r *http.Request, limit int64) error {
+	method, ok := strings.CutPrefix(r.URL.Path, grpcService)
+	if !ok || r.Method != http.MethodPost {
+		return &grpcError{grpcUnimplemented, "unknown method " + r.URL.Path}
+	}
+	switch method {
+	case "Encode", "Decode", "Verify":
+		msgs, err := readGRPCMessages(r.Body)
+		if err != nil {
+			return err
+		}
+		if len(msgs) != 1 {
+			return &grpcError{grpcInvalidArgument, fmt.Sprintf("%s takes exactly one message, got %d", method, len(msgs))}
+		}
+		data, _, err := parseDataMessage(msgs[0])
+		if err != nil {
+			return err
+		}
+		if method == "Verify" {
+			return writeGRPCMessage(w, verifyMessage(verifyBytes(data, limit)))
+		}
+		out, err := grpcTransform(method, data, limit)
+		if err != nil {
+			return err
+		}
+		return writeGRPCMessage(w, dataMessage(out))
+	case "EncodeStream", "DecodeStream":
+		msgs, err := readGRPCMessages(r.Body)
+		if err != nil {
+			return err
+		}
+		var data []byte
+		for _, m := range msgs {
+			chunk, _, err := parseDataMessage(m)
+			if err != nil {
+				return err
+			}
+			data = append(data, chunk...)
+		}
+		data, err = grpcTransform(strings.TrimSuffix(method, "Stream"), data, limit)
+		if err != nil {
+			return err
+		}
+		for len(data) > 0 {
+			n := min(len(data), grpcChunkSize)
+			if err := writeGRPCMessage(w, dataMessage(data[:n])); err != nil {
+				return err
+			}
+			data = data[n:]
+		}
+		return nil
+	}
+	return &grpcError{grpcUnimplemented, "unknown method " + method}
+}
+
+// grpcTransform encodes (in line mode) or decodes data for method,
+// decompressing at most limit bytes.
+func grpcTransform(method string, data []byte, limit int64) ([]byte, error) {
+	var out []byte
+	var err error
+	if method == "Encode" {
+		out, err = encodeData(data, format{mode: modeLines})
+	} else {
+		out, _, err = decodeDataLimit(data, limit)
+	}
+	var tooBig *decompressLimitError
+	if errors.As(err, &tooBig) {
+		return nil, &grpcError{grpcResourceExhausted, err.Error()}
+	}
+	if err != nil {
+		return nil, &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	return out, nil
+}
+
+// readGRPCMessages reads every length-prefixed message in a request body.
+// A message's buffer grows as its bytes arrive rather than being allocated
+// at the declared length, so a five-byte header can't claim gigabytes.
+func readGRPCMessages(body io.Reader) ([][]byte, error) {
+	var msgs [][]byte
+	var hdr [5]byte
+	for {
+		if _, err := io.ReadFull(body, hdr[:]); err == io.EOF {
+			return msgs, nil
+		} else if err != nil {
+			return nil, readGRPCError(err)
+		}
+		if hdr[0] != 0 {
+			return nil, &grpcError{grpcUnimplemented, "compressed messages are not supported"}
+		}
+		n := int64(binary.BigEndian.Uint32(hdr[1:]))
+		msg, err := io.ReadAll(io.LimitReader(body, n))
+		if err == nil && int64(len(msg)) < n {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return nil, readGRPCError(err)
+		}
+		msgs = append(msgs, msg)
+	}
+}
+
+// readGRPCError is the status for a body that couldn't be read in full.
+func readGRPCError(err error) error {
+	var tooBig *http.MaxBytesError
+	if errors.As(err, &tooBig) {
+		return &grpcError{grpcResourceExhausted, tooLarge(tooBig.Limit)}
+	}
+	return &grpcError{grpcInvalidArgument, "truncated message: " + err.Error()}
+}
+
+// writeGRPCMessage writes one length-prefixed message and flushes it.
+func writeGRPCMessage(w http.ResponseWriter, msg []byte) error {
+	var hdr [5]byte
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(msg)))
+	if _, err := w.Write(append(hdr[:], msg...)); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// dataMessage encodes a message whose only field is "bytes data = 1".
+func dataMessage(data []byte) []byte {
+	return appendBytesField(nil, 1, data)
+}
+
+// verifyMessage encodes a VerifyResponse.
+func verifyMessage(err error) []byte {
+	if err != nil {
+		return appendBytesField(nil, 2, []byte(err.Error()))
+	}
+	return []byte{1<<3 | 0, 1} // ok = true
+}
+
+func appendBytesField(b []byte, field int, data []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(field)<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(data)))
+	return append(b, data...)
+}
+
+// parseDataMessage decodes fields 1 and 2 (both length-delimited) of msg,
+// skipping any other fields as protobuf requires.
+func parseDataMessage(msg []byte) (field1, field2 []byte, err error) {
+	bad := &grpcError{grpcInvalidArgument, "malformed protobuf message"}
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return nil, nil, bad
+		}
+		msg = msg[n:]
+		switch key & 7 {
+		case 0: // varint
+			if _, n = binary.Uvarint(msg); n <= 0 {
+				return nil, nil, bad
+			}
+			msg = msg[n:]
+		case 1: // fixed64
+			if len(msg) < 8 {
+				return nil, nil, bad
+			}
+			msg = msg[8:]
+		case 5: // fixed32
+			if len(msg) < 4 {
+				return nil, nil, bad
+			}
+			msg = msg[4:]
+		case 2: // length-delimited
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return nil, nil, bad
+			}
+			value := msg[n : n+int(size)]
+			msg = msg[n+int(size):]
+			switch key >> 3 {
+			case 1:
+				field1 = append(field1, value...)
+			case 2:
+				field2 = append(field2, value...)
+			}
+		default:
+			return nil, nil, bad
+		}
+	}
+	return field1, field2, nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// identify says what the file at inPath holds, going by its contents alone
+// (a renamed file's suffix proves nothing): plaintext, binary, or a
+// backlang encoding, with the format and mode of the outer layer and how
+// many layers there are. The marks it trusts are those looksEncoded does,
+// armor, a header or the no-newline marker, and failing those a shebang on
+// the last line, which is where line mode puts a script's first.
+func identify(inPath string, opts options) (result, error) {
+	res := result{Command: "identify", Input: inPath, Action: "identified"}
+	data, release, err := mapFile(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	defer release()
+
+	var outer format
+	var marks []string
+	var encrypted, armor bool
+	inner := []byte(data)
+	for {
+		var mark string
+		isArmor := isArmored(inner)
+		if isArmor {
+			if inner, err = dearmor(inner); err != nil {
+				return res, err
+			}
+			mark = "armor"
+		}
+		f, _, err := parseHeader(inner)
+		switch {
+		case err != nil:
+			return res, newError(ErrCorrupt, "'%s' has a backlang header, but: %s", inPath, strings.TrimPrefix(err.Error(), "Error: "))
+		case f.version > 1:
+			mark = "a header"
+		case bytes.HasPrefix(inner, []byte(nnlMarker)):
+			mark = "the no-newline marker"
+		case mark == "" && lastLineShebang(inner):
+			mark = "a shebang on the last line"
+		}
+		if mark == "" {
+			break
+		}
+		if len(marks) == 0 {
+			outer, armor = f, isArmor
+		}
+		marks = append(marks, mark)
+		if f.encrypt != "" {
+			encrypted = true
+			break
+		}
+		decoded, _, err := decodeData(inner)
+		if err != nil {
+			if len(marks) == 1 {
+				return res, err
+			}
+			marks = marks[:len(marks)-1] // an inner "layer" that doesn't decode wasn't one
+			break
+		}
+		inner = decoded
+	}
+
+	var desc string
+	switch n := len(marks); {
+	case n == 0 && len(data) == 0:
+		res.Kind, desc = "empty", "empty"
+	case n == 0 && looksBinary(inner):
+		res.Kind, desc = "binary", "binary"
+	case n == 0:
+		res.Kind = "plaintext"
+		desc = "plaintext, as far as can be told (no header, marker or armor; an older backlang's format 1 encoding of text that ended in a newline has none either)"
+	default:
+		res.Kind, res.Layers = "encoded", n
+		res.Format, res.Mode, res.Compress, res.Charset = outer.version, outer.mode, outer.compress, outer.charset
+		desc = "backlang-encoded"
+		switch {
+		case n == 2:
+			desc += " twice"
+		case n > 2:
+			desc += fmt.Sprintf(" %d times", n)
+		}
+		if marks[0] == "a shebang on the last line" {
+			desc = "probably " + desc
+		}
+		detail := fmt.Sprintf("format %d, %s mode", outer.version, outer.mode)
+		if n > 1 {
+			detail = "outer layer " + detail
+		}
+		if outer.compress != "" {
+			detail += ", " + outer.compress + "-compressed"
+		}
+		if outer.encrypt != "" {
+			detail += ", encrypted"
+		}
+		if armor {
+			detail += ", armored"
+		}
+		desc += ": " + detail + " (going by " + strings.Join(marks, ", then ") + ")"
+		switch {
+		case encrypted:
+			desc += "; what is inside the encryption can't be seen without the passphrase"
+		case looksBinary(inner):
+			desc += "; it holds binary data"
+		}
+	}
+	res.Reason = desc
+	opts.infof("%s: %s\n", inPath, desc)
+	return res, nil
+}
+
+// lastLineShebang reports whether data ends with a line starting "#!" but
+// doesn't start with one: a script encoded in line mode. A Rust "#![...]"
+// attribute is not a shebang.
+func lastLineShebang(data []byte) bool {
+	if bytes.HasPrefix(data, []byte("#!")) {
+		return false
+	}
+	data = bytes.TrimRight(data, "\r\n")
+	last := data[bytes.LastIndexByte(data, '\n')+1:]
+	return bytes.HasPrefix(last, []byte("#!")) && !bytes.HasPrefix(last, []byte("#!["))
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreFile names the files, in the directory walked or any directory
+// under it, whose patterns say what -r, --watch and pack leave out.
+const ignoreFile = ".bckignore"
+
+// ignoreRule is one .bckignore pattern, in gitignore syntax.
+type ignoreRule struct {
+	base     string   // directory of the .bckignore, relative to the root ("" for the root)
+	segments []string // the pattern split at "/"; "**" matches any number of directories
+	anchored bool     // the pattern had a "/" other than a trailing one, so it matches from base
+	negate   bool     // "!pattern": re-include what an earlier pattern excluded
+	dirOnly  bool     // "pattern/": match only directories
+	text     string   // the line as written, for --list
+	line     int      // where it is in its .bckignore
+}
+
+// ignoreList holds the rules from the .bckignore files seen so far in a
+// walk of root. Directories must be loaded before what is in them, as
+// filepath.WalkDir visits them.
+type ignoreList struct {
+	root  string
+	rules []ignoreRule
+}
+
+func newIgnoreList(root string) *ignoreList {
+	return &ignoreList{root: root}
+}
+
+// rel returns name relative to the root, with "/" separators.
+func (l *ignoreList) rel(name string) string {
+	rel, err := filepath.Rel(l.root, name)
+	if err != nil || rel == "." {
+		return ""
+	}
+	return filepath.ToSlash(rel)
+}
+
+// load adds the rules in dir's .bckignore, if it has one.
+func (l *ignoreList) load(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, ignoreFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	l.rules = append(l.rules, parseIgnore(string(data), l.rel(dir))...)
+	return nil
+}
+
+// ignored reports whether name, a file or (with isDir) directory under the
+// root, is excluded.
+func (l *ignoreList) ignored(name string, isDir bool) bool {
+	return l.why(name, isDir) != ""
+}
+
+// why returns, if name is excluded, the pattern responsible and where it
+// is; otherwise "". As in git, the last matching pattern decides.
+func (l *ignoreList) why(name string, isDir bool) string {
+	rel := l.rel(name)
+	if rel == "" {
+		return ""
+	}
+	var decided *ignoreRule
+	for i, r := range l.rules {
+		sub := rel
+		if r.base != "" {
+			var ok bool
+			if sub, ok = strings.CutPrefix(rel, r.base+"/"); !ok {
+				continue
+			}
+		}
+		if (isDir || !r.dirOnly) && r.match(sub) {
+			decided = &l.rules[i]
+		}
+	}
+	if decided == nil || decided.negate {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d: %s", filepath.Join(l.root, filepath.FromSlash(decided.base), ignoreFile), decided.line, decided.text)
+}
+
+func (r ignoreRule) match(rel string) bool {
+	if !r.anchored {
+		ok, _ := path.Match(r.segments[0], path.Base(rel))
+		return ok
+	}
+	return matchSegments(r.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches a path, split at "/", against pattern segments,
+// each a path.Match glob or "**".
+func matchSegments(pattern, segs []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(pattern[1:], segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], segs[0]); !ok {
+			return false
+		}
+		pattern, segs = pattern[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// parseIgnore reads .bckignore patterns found in the directory base:
+// one per line, with blank lines and # comments skipped, "!" negating,
+// a trailing "/" matching only directories and any other "/" anchoring the
+// pattern to base. "\#" and "\!" start a pattern with a literal # or !.
+func parseIgnore(src, base string) []ignoreRule {
+	var rules []ignoreRule
+	for i, line := range strings.Split(src, "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		r := ignoreRule{base: base, text: line, line: i + 1}
+		if rest, ok := strings.CutPrefix(line, "!"); ok {
+			r.negate, line = true, rest
+		} else if strings.HasPrefix(line, `\#`) || strings.HasPrefix(line, `\!`) {
+			line = line[1:]
+		}
+		if rest, ok := strings.CutSuffix(line, "/"); ok {
+			r.dirOnly, line = true, rest
+		}
+		r.anchored = strings.Contains(line, "/")
+		line = strings.TrimPrefix(line, "/")
+		if line == "" {
+			continue
+		}
+		r.segments = strings.Split(line, "/")
+		rules = append(rules, r)
+	}
+	return rules
+}
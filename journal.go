@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// journalOp identifies this invocation in the journal, so undo can treat
+// the files of one batch as one operation.
+var journalOp = fmt.Sprintf("%x-%d", time.Now().UnixNano(), os.Getpid())
+
+// journalEntry is one line of the journal: a file an encode or decode
+// wrote, a program run ran, or an undo of an earlier operation.
+type journalEntry struct {
+	Op           string    `json:"op"`
+	Time         time.Time `json:"time"`
+	Dir          string    `json:"dir"` // working directory the command ran in
+	Command      string    `json:"command"`
+	Action       string    `json:"action,omitempty"`
+	Input        string    `json:"input,omitempty"`  // absolute
+	Output       string    `json:"output,omitempty"` // absolute; run: the file --keep left
+	InputSHA256  string    `json:"input_sha256,omitempty"`
+	OutputSHA256 string    `json:"output_sha256,omitempty"`
+	Replaced     bool      `json:"replaced,omitempty"` // the output overwrote an existing file
+	Backup       string    `json:"backup,omitempty"`   // where --backup or --trash kept that file
+	Deleted      bool      `json:"deleted_input,omitempty"`
+	Undoes       string    `json:"undoes,omitempty"` // undo: the operation it reverted
+}
+
+// dataDir returns where backlang keeps what is worth keeping, such as the
+// journal: $BACKLANG_DATA_DIR if set, otherwise backlang under
+// $XDG_DATA_HOME (~/.local/share), or the platform's equivalent.
+func dataDir() (string, error) {
+	if dir := os.Getenv(envPrefix + "DATA_DIR"); dir != "" {
+		return dir, nil
+	}
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "backlang"), nil
+	}
+	if dir := os.Getenv("LocalAppData"); runtime.GOOS == "windows" && dir != "" {
+		return filepath.Join(dir, "backlang"), nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	if runtime.GOOS == "darwin" {
+		return filepath.Join(home, "Library", "Application Support", "backlang"), nil
+	}
+	return filepath.Join(home, ".local", "share", "backlang"), nil
+}
+
+func journalPath() (string, error) {
+	dir, err := dataDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "journal.jsonl"), nil
+}
+
+// appendJournal adds entries to the journal, creating it if needed.
+func appendJournal(entries ...journalEntry) error {
+	path, err := journalPath()
+	if err != nil {
+		return err
+	}
+	var buf []byte
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf = append(append(buf, line...), '\n')
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readJournal returns every entry in the journal, oldest first. A missing
+// journal has none; a line that doesn't parse (cut short by a crash, say)
+// is skipped.
+func readJournal() ([]journalEntry, error) {
+	path, err := journalPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, wrapPathErr(err, path)
+	}
+	defer f.Close()
+	var entries []journalEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		var e journalEntry
+		if json.Unmarshal(sc.Bytes(), &e) == nil {
+			entries = append(entries, e)
+		}
+	}
+	return entries, sc.Err()
+}
+
+// journal records what a command did: a file an encode or decode wrote,
+// for undo, or a program run ran. It is a no-op unless main turned the
+// journal on, and for dry runs and results that changed or ran nothing; a
+// journal that can't be written is only worth a warning.
+func journal(res result, opts options) {
+	if !opts.journal || res.DryRun || isObjectURL(res.Input) || isObjectURL(res.Output) {
+		return
+	}
+	switch {
+	case res.Action == "ran":
+	case res.Action != "encoded" && res.Action != "decoded":
+		return
+	case res.Output == "" || res.Output == "-":
+		return
+	}
+	dir, _ := os.Getwd()
+	e := journalEntry{Op: journalOp, Time: time.Now().UTC(), Dir: dir, Command: res.Command, Action: res.Action, Input: res.Input, Deleted: res.Deleted}
+	if !isURL(res.Input) {
+		e.Input, _ = filepath.Abs(res.Input)
+		e.InputSHA256, _ = fileSHA256(res.Input)
+	}
+	if res.Output != "" {
+		e.Output, _ = filepath.Abs(res.Output)
+		e.Backup, e.Replaced = replacedBy(res.Output)
+		e.Replaced = e.Replaced || e.Input == e.Output
+		e.OutputSHA256, _ = fileSHA256(res.Output)
+	}
+	if e.Replaced && e.Input == e.Output {
+		e.InputSHA256 = "" // read before the rewrite; what is there now is the output
+	}
+	if err := appendJournal(e); err != nil {
+		opts.logger().Warn("not recorded in the journal", "path", res.Input, "err", err)
+	}
+}
+
+// showLog prints the journal, oldest first: everything, or with a path
+// only the entries that read or wrote it, or a file with the same contents
+// (a .bck that has since been moved or renamed, say).
+func showLog(path string, opts options) (result, error) {
+	res := result{Command: "log", Input: path, Action: "listed"}
+	entries, err := readJournal()
+	if err != nil {
+		return res, err
+	}
+	var abs, sum string
+	if path != "" {
+		if abs, err = filepath.Abs(path); err != nil {
+			return res, err
+		}
+		sum, _ = fileSHA256(path)
+	}
+	first := map[string]journalEntry{} // operation → its first entry, for undo lines
+	for _, e := range entries {
+		if _, ok := first[e.Op]; !ok {
+			first[e.Op] = e
+		}
+		if path != "" && e.Input != abs && e.Output != abs && (sum == "" || e.InputSHA256 != sum && e.OutputSHA256 != sum) {
+			continue
+		}
+		res.Journal = append(res.Journal, e)
+		at := e.Time.Local().Format(time.DateTime)
+		switch {
+		case e.Undoes != "":
+			undone := first[e.Undoes]
+			opts.infof("%s  %-6s  the %s of %s\n", at, e.Command, undone.Command, undone.Time.Local().Format(time.DateTime))
+		case e.Output == "":
+			opts.infof("%s  %-6s  %s\n", at, e.Command, relToCwd(e.Input))
+		default:
+			opts.infof("%s  %-6s  %s → %s\n", at, e.Command, relToCwd(e.Input), relToCwd(e.Output))
+		}
+	}
+	res.Files = len(res.Journal)
+	if path != "" && res.Files == 0 {
+		return res, newError(ErrNotFound, "the journal has nothing on '%s'", path)
+	}
+	return res, nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Encoding an encoded file adds another layer: x.bck.bck. A layer shows
+// either as a .bck suffix on the name or as a header at the start of the
+// data (encode writes one whenever the data could be mistaken for an older
+// format). Plain line mode with neither is invisible: reversing lines twice
+// gives the original back, so only the name can tell.
+
+// peelLayers decodes up to limit layers of data, or with limit < 0 every
+// layer it can detect (at least one). Encrypted layers are decrypted with
+// unseal; when it is nil, peeling stops at the first one. It returns the
+// decoded data, the name left once each peeled layer's .bck is removed, and
+// the number of layers.
+func peelLayers(name string, data []byte, limit int, unseal func([]byte) ([]byte, error)) ([]byte, string, int, error) {
+	n := 0
+	for limit < 0 || n < limit {
+		named := strings.HasSuffix(strings.ToLower(name), ".bck")
+		if limit < 0 && n > 0 && !named && !bytes.HasPrefix(data, []byte(headerPrefix)) && !isArmored(data) {
+			break
+		}
+		if isArmored(data) {
+			var err error
+			if data, err = dearmor(data); err != nil {
+				return nil, name, n, err
+			}
+		}
+		if f, _, err := parseHeader(data); err == nil && f.encrypt != "" {
+			if unseal == nil {
+				break
+			}
+			if data, err = unseal(data); err != nil {
+				return nil, name, n, err
+			}
+		}
+		out, _, err := decodeData(data)
+		if err != nil {
+			var ce *cliError
+			if errors.As(err, &ce) {
+				err = newError(ce.kind, "layer %d: %s", n+1, strings.TrimPrefix(ce.msg, "Error: "))
+			}
+			return nil, name, n, err
+		}
+		data = out
+		n++
+		if named {
+			name = stripLastBck(name)
+		}
+	}
+	return data, name, n, nil
+}
+
+// unwrapData removes the layers around an encoding that need no decoding
+// of their own: armor, then encryption (asking for the passphrase as
+// needed). Anything else is returned unchanged.
+func unwrapData(data []byte, opts options) ([]byte, error) {
+	if isArmored(data) {
+		var err error
+		if data, err = dearmor(data); err != nil {
+			return nil, err
+		}
+	}
+	if f, _, err := parseHeader(data); err != nil || f.encrypt == "" {
+		return data, nil
+	}
+	pass, err := passphrase(opts, false)
+	if err != nil {
+		return nil, err
+	}
+	return unseal(data, pass)
+}
+
+// unwrapFile is unwrapData for a file opened with openEncoded. Armored or
+// encrypted files are unwrapped into memory and their inner encoding
+// returned; others are returned as they are, to be streamed.
+func unwrapFile(r io.ReaderAt, f format, off, size int64, opts options) (io.ReaderAt, format, int64, int64, error) {
+	head := make([]byte, min(size, maxHeaderLen))
+	if _, err := r.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, f, 0, 0, err
+	}
+	if f.encrypt == "" && !isArmored(head) {
+		return r, f, off, size, nil
+	}
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, size))
+	if err != nil {
+		return nil, f, 0, 0, err
+	}
+	if data, err = unwrapData(data, opts); err != nil {
+		return nil, f, 0, 0, err
+	}
+	f, body, err := parseHeader(data)
+	return byteSlice(data), f, int64(len(data) - len(body)), int64(len(data)), err
+}
+
+// info describes an encoded file: the format of its outer layer and how
+// many layers it has.
+func info(inPath string, opts options) (result, error) {
+	res := result{Command: "info", Input: inPath, Action: "inspected"}
+	data, release, err := mapFile(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	defer release()
+	size, armor := len(data), isArmored(data)
+	outer := data
+	if armor {
+		if outer, err = dearmor(data); err != nil {
+			return res, err
+		}
+	}
+	f, _, err := parseHeader(outer)
+	if err != nil {
+		return res, err
+	}
+	rest, name, n, err := peelLayers(inPath, data, -1, nil)
+	if err != nil {
+		return res, err
+	}
+	layers := fmt.Sprint(n)
+	if rest, _, err := parseHeader(rest); err == nil && rest.encrypt != "" {
+		// Encrypted layers are opaque without the passphrase.
+		layers = fmt.Sprintf("%d or more (layer %d is encrypted)", n+1, n+1)
+		name = stripLastBck(name)
+		n++
+	}
+	res.Output, res.Format, res.Mode, res.Compress, res.Layers = name, f.version, f.mode, f.compress, n
+	res.Charset, res.Name = f.charset, f.name
+
+	header := "no header"
+	if f.version > 1 {
+		header = "header"
+	}
+	mode := f.mode
+	if f.mode == modeBlocks {
+		mode += fmt.Sprintf(" (block size %d)", f.blockSize)
+	}
+	if f.charset != "" {
+		mode += ", original in " + f.charset
+	}
+	if f.compress != "" {
+		mode += ", " + f.compress + "-compressed"
+	}
+	if f.encrypt != "" {
+		mode += ", encrypted (" + f.encrypt + ")"
+	}
+	if armor {
+		mode += ", armored"
+	}
+	opts.infof("File:    %s\n", inPath)
+	opts.infof("Size:    %d bytes\n", size)
+	opts.infof("Format:  %d (%s)\n", f.version, header)
+	opts.infof("Mode:    %s\n", mode)
+	opts.infof("Layers:  %s (decodes to '%s')\n", layers, name)
+	if f.name != "" {
+		opts.infof("Name:    '%s' (recorded; decode --restore-name uses it)\n", f.name)
+	}
+	if n == 1 {
+		if lang, err := peekLanguage(inPath, opts); err == nil {
+			res.Language = lang.Name
+			opts.infof("Lang:    %s (what run would use)\n", lang.Name)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limitHelper is the hidden subcommand backlang re-executes itself with to
+// lower its resource limits before exec'ing the real program, which
+// inherits them.
+const limitHelper = "__limit"
+
+// limitCommand wraps name and args so they are started through the limit
+// helper, which applies --max-mem and --max-cpu.
+func limitCommand(name string, args []string, opts options) (string, []string, error) {
+	if err := checkLimits(); err != nil {
+		return "", nil, err
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, newError(ErrSandbox, "cannot locate the backlang executable: %v", err)
+	}
+	mem, cpu := strconv.FormatInt(opts.maxMem, 10), strconv.FormatInt(cpuSeconds(opts.maxCPU), 10)
+	return self, append([]string{limitHelper, mem, cpu, name}, args...), nil
+}
+
+// containerLimits are the container runtime flags for --max-mem and
+// --max-cpu: a cgroup memory limit, and the CPU rlimit inside.
+func containerLimits(opts options) []string {
+	var flags []string
+	if opts.maxMem > 0 {
+		flags = append(flags, "--memory", strconv.FormatInt(opts.maxMem, 10))
+	}
+	if n := cpuSeconds(opts.maxCPU); n > 0 {
+		flags = append(flags, "--ulimit", fmt.Sprintf("cpu=%d:%d", n, n+1))
+	}
+	return flags
+}
+
+// cpuSeconds rounds a --max-cpu duration up to the whole seconds RLIMIT_CPU
+// counts in.
+func cpuSeconds(d time.Duration) int64 {
+	return int64((d + time.Second - 1) / time.Second)
+}
+
+// describeLimits lists the limits --max-mem and --max-cpu apply.
+func describeLimits(opts options) string {
+	var parts []string
+	if opts.maxMem > 0 {
+		parts = append(parts, humanBytes(opts.maxMem)+" of memory")
+	}
+	if opts.maxCPU > 0 {
+		parts = append(parts, fmt.Sprintf("%ds of CPU time", cpuSeconds(opts.maxCPU)))
+	}
+	return strings.Join(parts, ", ")
+}
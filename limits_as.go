@@ -0,0 +1,8 @@
+//go:build unix && !openbsd
+
+package main
+
+import "syscall"
+
+// rlimitMem is the limit --max-mem sets: the address space, as ulimit -v.
+const rlimitMem = syscall.RLIMIT_AS
@@ -0,0 +1,7 @@
+package main
+
+import "syscall"
+
+// rlimitMem is the limit --max-mem sets. OpenBSD has no RLIMIT_AS; its data
+// limit counts anonymous mappings too.
+const rlimitMem = syscall.RLIMIT_DATA
@@ -0,0 +1,17 @@
+//go:build !unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func checkLimits() error {
+	return newError(ErrSandbox, "--max-mem and --max-cpu are only supported on Unix systems (or with --container)")
+}
+
+func limitMain(args []string) {
+	fmt.Fprintln(os.Stderr, "backlang: limit: only supported on Unix systems")
+	os.Exit(exitSandbox)
+}
@@ -0,0 +1,76 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+func checkLimits() error { return nil }
+
+// limitMain is the limit helper: args are the memory limit in bytes and the
+// CPU limit in seconds (0 for none), the program and its arguments. It sets
+// the limits and execs the program; it only returns on error.
+//
+// Memory is capped through rlimitMem, the address space on most systems,
+// as ulimit -v does; the hard limits match so the program cannot raise
+// them again, but for CPU time the hard limit is a second later: at the
+// soft limit the program gets SIGXCPU, at the hard one SIGKILL.
+func limitMain(args []string) {
+	if len(args) < 3 {
+		fmt.Fprintln(os.Stderr, "backlang: limit: missing program")
+		os.Exit(exitExec)
+	}
+	mem, err1 := strconv.ParseUint(args[0], 10, 64)
+	cpu, err2 := strconv.ParseUint(args[1], 10, 64)
+	if err1 != nil || err2 != nil {
+		fmt.Fprintln(os.Stderr, "backlang: limit: bad limits")
+		os.Exit(exitExec)
+	}
+	name, progArgs := args[2], args[3:]
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backlang: limit: %v\n", err)
+		os.Exit(exitNoInterpreter)
+	}
+	if err := lowerLimit(rlimitMem, mem, mem); err != nil {
+		fmt.Fprintf(os.Stderr, "backlang: limit: --max-mem: %v\n", err)
+		os.Exit(exitSandbox)
+	}
+	if err := lowerLimit(syscall.RLIMIT_CPU, cpu, cpu+1); err != nil {
+		fmt.Fprintf(os.Stderr, "backlang: limit: --max-cpu: %v\n", err)
+		os.Exit(exitSandbox)
+	}
+	err = syscall.Exec(path, append([]string{name}, progArgs...), os.Environ())
+	fmt.Fprintf(os.Stderr, "backlang: limit: exec %s: %v\n", name, err)
+	os.Exit(exitExec)
+}
+
+// lowerLimit sets resource's soft and hard limits to cur and max, or
+// leaves them where they already are lower. Zero means no limit to set.
+func lowerLimit(resource int, cur, max uint64) error {
+	if cur == 0 {
+		return nil
+	}
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(resource, &lim); err != nil {
+		return err
+	}
+	lim.Max = atMost(lim.Max, max)
+	lim.Cur = atMost(atMost(lim.Cur, cur), uint64(lim.Max))
+	return syscall.Setrlimit(resource, &lim)
+}
+
+// atMost returns the lower of v and n. Rlimit's fields are signed on some
+// systems.
+func atMost[T int64 | uint64](v T, n uint64) T {
+	if uint64(v) > n {
+		return T(n)
+	}
+	return v
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Operational detail (paths, byte counts, timings, which interpreter run
+// resolved) is logged with log/slog to stderr, filtered by --log-level and
+// written as logfmt-style text or, with --log-format json, one JSON object
+// per line for log collectors. What a command reports ("Encoded 'a' →
+// 'a.bck'", errors, --json records) is not logging and is unaffected.
+
+// defaultLogLevel is the level without --log-level: warnings only, so a
+// plain run prints nothing extra. --verbose means debug and --quiet error.
+const defaultLogLevel = slog.LevelWarn
+
+var discardLogger = slog.New(slog.DiscardHandler)
+
+// parseLogLevel accepts debug, info, warn or error, in any case.
+func parseLogLevel(s string) (slog.Level, error) {
+	var l slog.Level
+	switch strings.ToLower(s) {
+	case "debug", "info", "warn", "error":
+		return l, l.UnmarshalText([]byte(s))
+	}
+	return l, fmt.Errorf("invalid log level %q (use debug, info, warn or error)", s)
+}
+
+// parseLogFormat accepts text or json.
+func parseLogFormat(s string) (string, error) {
+	switch s {
+	case "text", "json":
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid log format %q (use text or json)", s)
+}
+
+// newLogger returns a logger writing records at level or above to w.
+func newLogger(w io.Writer, level slog.Level, format string) *slog.Logger {
+	ho := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(w, ho))
+	}
+	return slog.New(slog.NewTextHandler(w, ho))
+}
+
+// logger returns the logger main set up from the flags, or one that
+// discards everything when there is none (as in tests).
+func (o options) logger() *slog.Logger {
+	if o.log == nil {
+		return discardLogger
+	}
+	return o.log
+}
+
+// logLevelFor picks the level: --log-level if given, else what --verbose
+// or --quiet imply, else defaultLogLevel.
+func logLevelFor(opts options) slog.Level {
+	switch {
+	case opts.logLevel != "":
+		l, _ := parseLogLevel(opts.logLevel) // validated when set
+		return l
+	case opts.verbose:
+		return slog.LevelDebug
+	case opts.quiet:
+		return slog.LevelError
+	}
+	return defaultLogLevel
+}
@@ -2,57 +2,1164 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
+	"math/rand/v2"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
-const usageText = "Usage: backlang <encode|decode|run> <file>\n"
+const usageText = "Usage: backlang <encode|decode> [flags] <file>...\n       backlang <encode|decode> -r [--jobs N] <dir|s3://bucket/prefix/>...\n       backlang migrate [-r] <file.bck|dir>...\n       backlang cat <file.bck>\n       backlang edit <file.bck>\n       backlang info [--json] <file.bck>\n       backlang stats [--json] <file[.bck]>\n       backlang identify [--json] <file>\n       backlang verify --manifest <SHA256SUMS>\n       backlang undo [--dry-run] [--force]\n       backlang log [--json] [file]\n       backlang doctor [--json]\n       backlang self-update [--dry-run] [--force] [--allow-unsigned]\n       backlang selftest [--mode m] [--compress] [--encrypt] [--armor] <file>\n       backlang pack [flags] <dir> [-o bundle.bcka]\n       backlang <unpack|list> [flags] <bundle.bcka>\n       backlang diff [-q] <file> <file>\n       backlang run [flags] <file.bck|url> [-- program args...]\n       backlang filter <encode|decode> [--mode m] < in > out\n       backlang git-setup [--dry-run]\n       backlang repl [--mode m]\n       backlang serve [--addr host:port] [flags]\n       backlang version\n"
+
+// options holds the command-line flags shared by the subcommands.
+type options struct {
+	onConflict conflictPolicy // what to do when the output file already exists
+	dryRun     bool           // report what would happen without writing or executing anything
+	quiet      bool           // suppress progress lines such as "Encoded X → Y"
+	verbose    bool           // log byte counts, timings and decisions (--log-level debug)
+	logLevel   string         // --log-level, validated; empty means from verbose/quiet
+	logFormat  string         // --log-format: text or json
+	log        *slog.Logger   // where operational detail goes; see logger
+	json       bool           // print a machine-readable result record instead of progress lines
+	deleteOrig bool           // remove the input after a verified, synced encode
+	inPlace    bool           // rewrite the input file itself instead of adding/removing .bck
+	scriptArgs []string       // run: arguments passed to the executed program
+	interpArgs []string       // run: arguments for the interpreter (or compiler) itself, before the program
+	keep       bool           // run: leave the decoded program next to the .bck
+	keepPath   string         // run: where --keep=path leaves it instead ("" for next to the .bck)
+	module     bool           // run: decode the Python package around the input and run it with python -m
+	stdoutFile string         // run: write the program's stdout to this file
+	stderrFile string         // run: write the program's stderr to this file
+	tee        bool           // run: with --stdout/--stderr, show the output on the terminal as well
+	runStats   bool           // run: report the program's time, memory and exit status when it ends
+	maxMem     int64          // run: the program's address space limit in bytes (0 for none)
+	maxCPU     time.Duration  // run: the program's CPU time limit (0 for none)
+	user       string         // run: start the program as this user (name or uid, optionally :group)
+	stdin      bool           // run: pipe the program into the interpreter instead of writing a file
+	noVenv     bool           // run: ignore $VIRTUAL_ENV and .venv directories for Python
+	timeout    time.Duration  // run: kill the program (and its children) after this long
+	sandbox    bool           // run: confine the program (Linux only)
+	sandboxNet bool           // run: keep network access inside the sandbox
+	container  bool           // run: execute in a podman/docker container
+	image      string         // run: container image, overriding the language default
+	env        []string       // run: KEY=VAL entries added to the program's environment
+	envFile    string         // run: file of KEY=VAL lines added before env
+	cleanEnv   bool           // run: start from a minimal environment instead of ours
+	noCache    bool           // run: decode (and build) afresh instead of reusing the cache
+	mode       string         // encode: lines (default), chars, words, bytes or blocks
+	blockSize  int64          // encode: block size for blocks mode
+	compress   bool           // encode: gzip the encoded body
+	encrypt    bool           // encode: encrypt the encoded body with a passphrase
+	passFile   string         // file holding the passphrase, instead of asking
+	armor      bool           // encode: write base64 between BEGIN/END banners
+	output     string         // pack: bundle to write; unpack: directory to write into; --archive: archive to write
+	archive    bool           // encode/decode: rewrite the members of a zip or tar(.gz) archive
+	watch      bool           // encode: keep .bck mirrors current; run: rerun the program when the .bck changes
+	layers     int            // decode: how many encoding layers to peel (0 means 1)
+	allLayers  bool           // decode: peel every layer info would count
+	exec       string         // decode/run: command to pipe the decoded content into instead of writing a file
+	binary     bool           // encode: accept binary input, encoding it byte-for-byte
+	eol        string         // encode/decode: convert line endings to lf or crlf ("" preserves them)
+	recursive  bool           // encode/decode/migrate: process the files under directory arguments
+	jobs       int            // encode/decode/migrate: how many files to process at once
+	out        io.Writer      // where infof writes; nil means stdout
+	noProgress bool           // never draw a progress line (batches draw their own)
+	sync       bool           // fsync outputs and their directories before reporting success
+	noDeref    bool           // encode/decode: recreate symlinked inputs as links instead of reading their targets
+	storeName  bool           // encode: record the input's name in the header
+	restore    bool           // decode: name the output after the name recorded in the header
+	strict     bool           // decode: refuse input without a header or no-newline marker
+	force      bool           // --force: also lets encode take input that is already encoded
+	sha256     string         // URL input: the SHA-256 the download must have (lowercase hex)
+	maxFetch   int64          // URL input: largest download accepted; 0 means defaultMaxDownload
+	yes        bool           // run from a URL without asking first
+	unsigned   bool           // self-update: install a release this build has no key to check the signature of
+	source     string         // URL the input was downloaded from; run asks before executing it
+	manifest   string         // encode: SHA256SUMS file to write for the outputs; verify: the one to check
+	reportFile string         // encode/decode/migrate: where to write a JSON report of the batch
+	resume     bool           // encode/decode: skip files an interrupted run of the same batch finished
+	only       []string       // -r: glob patterns the files found must match
+	skipBinary bool           // encode -r: leave out files that look binary
+	listOnly   bool           // encode/decode/migrate: print which files a batch would take and skip, and stop
+	hidden     bool           // -r: also take hidden files and directories
+	backup     string         // suffix for a copy of each file about to be replaced; "" for none
+	trash      bool           // move each file about to be replaced to the desktop trash first
+	journal    bool           // record changed files in the journal for undo (set by main, never by tests)
+	maxDepth   int            // -r: how many directory levels to descend (1: only files directly inside); 0 means all
+}
+
+// result describes the outcome of one command and is what --json prints.
+
+type result struct {
+	Command  string         `json:"command"`
+	Input    string         `json:"input"`
+	Output   string         `json:"output,omitempty"`
+	Action   string         `json:"action"` // encoded, decoded, ran, skipped or failed (diff: identical or differ; migrate: migrated or current; selftest: passed; verify: verified; undo: undone; log: listed; doctor: checked; self-update: updated or current)
+	DryRun   bool           `json:"dry_run,omitempty"`
+	Deleted  bool           `json:"deleted_input,omitempty"` // input removed by --delete-original
+	Error    string         `json:"error,omitempty"`
+	ExitCode int            `json:"exit_code,omitempty"` // backlang's exit status on failure
+	Format   int            `json:"format,omitempty"`    // info: format version of the outer layer; migrate: format now
+	Mode     string         `json:"mode,omitempty"`      // info: mode of the outer layer
+	Compress string         `json:"compress,omitempty"`  // info: compression of the outer layer
+	Charset  string         `json:"charset,omitempty"`   // info: original text encoding of the outer layer, if not plain UTF-8
+	Name     string         `json:"name,omitempty"`      // info: original file name recorded by encode --store-name
+	Layers   int            `json:"layers,omitempty"`    // decode and info: encoding layers peeled or found
+	Files    int            `json:"files,omitempty"`     // pack, unpack and list: number of bundle members; verify: files checked; undo: files reverted; log: entries
+	Members  []bundleMember `json:"members,omitempty"`   // list: the bundle's members
+	Reason   string         `json:"reason,omitempty"`    // --list: why the file would be skipped; identify: what it is, and why
+	Kind     string         `json:"kind,omitempty"`      // identify: plaintext, encoded, binary or empty
+	Language string         `json:"language,omitempty"`  // info: the language run would detect, found without decoding
+	Journal  []journalEntry `json:"journal,omitempty"`   // log: the matching journal entries
+	Stats    *fileStats     `json:"stats,omitempty"`     // stats: what the file holds
+	Usage    *runUsage      `json:"usage,omitempty"`     // run --stats: the program's time, memory and exit status
+	Checks   []check        `json:"checks,omitempty"`    // doctor: every check and how it went
+	Version  string         `json:"version,omitempty"`   // self-update: the latest release
+}
+
+// infof prints a progress line to stdout unless --quiet is set.
+func (o options) infof(format string, args ...any) {
+	if o.quiet {
+		return
+	}
+	if o.out != nil {
+		fmt.Fprintf(o.out, format, args...)
+		return
+	}
+	fmt.Printf(format, args...)
+}
+
+// conflictPolicy decides what happens when an output file already exists.
+type conflictPolicy string
+
+const (
+	conflictPrompt    conflictPolicy = "prompt"    // ask the user (overwrite or rename)
+	conflictOverwrite conflictPolicy = "overwrite" // replace the existing file
+	conflictRename    conflictPolicy = "rename"    // write to the next free numbered name
+	conflictSkip      conflictPolicy = "skip"      // leave the existing file and do nothing
+	conflictFail      conflictPolicy = "fail"      // stop with an error
+)
+
+func parseConflictPolicy(s string) (conflictPolicy, error) {
+	switch p := conflictPolicy(s); p {
+	case conflictPrompt, conflictOverwrite, conflictRename, conflictSkip, conflictFail:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid conflict policy %q (want prompt, overwrite, rename, skip or fail)", s)
+}
+
+// keepFlag is run's --keep, a boolean flag that also takes a path:
+// --keep leaves the decoded program next to the .bck, --keep=path at path.
+type keepFlag struct{ opts *options }
+
+func (k keepFlag) IsBoolFlag() bool { return true }
+
+func (k keepFlag) String() string {
+	if k.opts == nil {
+		return ""
+	}
+	return k.opts.keepPath
+}
+
+func (k keepFlag) Set(s string) error {
+	switch s {
+	case "":
+		return errors.New("empty path")
+	case "true", "false":
+		k.opts.keep, k.opts.keepPath = s == "true", ""
+	default:
+		k.opts.keep, k.opts.keepPath = true, s
+	}
+	return nil
+}
 
 func main() {
-	if len(os.Args) != 3 {
+	if len(os.Args) < 2 {
 		fmt.Fprint(os.Stderr, usageText)
-		os.Exit(2)
+		os.Exit(exitUsage)
 	}
 
 	cmd := os.Args[1]
-	inPath := os.Args[2]
+	switch cmd {
+	case "version", "--version", "-version":
+		printVersion()
+		os.Exit(exitOK)
+	case sandboxHelper:
+		sandboxMain(os.Args[2:])
+	case limitHelper:
+		limitMain(os.Args[2:])
+	case "serve":
+		serveMain(os.Args[2:])
+		os.Exit(exitOK)
+	case "filter":
+		filterMain(os.Args[2:])
+		os.Exit(exitOK)
+	case "git-setup":
+		gitSetupMain(os.Args[2:])
+		os.Exit(exitOK)
+	case "repl":
+		replMain(os.Args[2:])
+		os.Exit(exitOK)
+	}
+
+	// Environment variables supply defaults; flags override them.
+	var opts options
+	if err := applyEnv(&opts); err != nil && cmd != "doctor" { // doctor reports it
+		printErr(err)
+		os.Exit(exitUsage)
+	}
+
+	var force, noClobber, backup bool
+	var backupSuffix string
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	fs.Func("on-conflict", "when the output exists: prompt, overwrite, rename, skip or fail (default prompt)", func(s string) error {
+		p, err := parseConflictPolicy(s)
+		opts.onConflict = p
+		return err
+	})
+	fs.Func("mode", "encode: what to reverse: lines (default), chars or words (within each line), bytes (the whole file) or blocks (large files)", func(s string) error {
+		m, err := parseMode(s)
+		opts.mode = m
+		return err
+	})
+	fs.Func("block-size", "encode: block size for --mode=blocks, e.g. 512K or 4M (default 1M)", func(s string) error {
+		n, err := parseBlockSize(s)
+		opts.blockSize = n
+		return err
+	})
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "show what would be read, written or executed without doing it")
+	fs.BoolVar(&opts.quiet, "q", false, "quiet: only print errors")
+	fs.BoolVar(&opts.quiet, "quiet", false, "same as -q")
+	fs.BoolVar(&opts.verbose, "v", false, "verbose: log byte counts, timings and decisions (--log-level debug)")
+	fs.BoolVar(&opts.verbose, "verbose", false, "same as -v")
+	fs.Func("log-level", "log operational detail to stderr at this `level` or above: debug, info, warn or error (default warn)", func(s string) error {
+		_, err := parseLogLevel(s)
+		opts.logLevel = s
+		return err
+	})
+	fs.Func("log-format", "write log records as text (default) or json, one object per line", func(s string) error {
+		f, err := parseLogFormat(s)
+		opts.logFormat = f
+		return err
+	})
+	fs.BoolVar(&opts.json, "json", false, "print a JSON result record on stdout instead of progress lines")
+	fs.BoolVar(&opts.deleteOrig, "delete-original", false, "encode: remove the input once the .bck is written, synced and verified")
+	fs.BoolVar(&opts.inPlace, "i", false, "rewrite the file in place (same name, no .bck added or removed)")
+	fs.BoolVar(&opts.inPlace, "in-place", false, "same as -i")
+	fs.Var(keepFlag{&opts}, "keep", "run: keep the decoded program next to the .bck instead of a temporary copy, or with --keep=`path` there (a file, or a directory to put it in)")
+	fs.BoolVar(&opts.stdin, "stdin", false, "run: pipe the decoded program into the interpreter's stdin; nothing is written to disk")
+	fs.BoolVar(&opts.module, "module", false, "run: decode a Python package (a directory, or the package around a .py.bck) and run it with python -m so relative imports work")
+	fs.StringVar(&opts.stdoutFile, "stdout", "", "run: write the program's stdout to this `file` (truncated first)")
+	fs.StringVar(&opts.stderrFile, "stderr", "", "run: write the program's stderr to this `file`; the same file as --stdout gets both")
+	fs.BoolVar(&opts.tee, "tee", false, "run: with --stdout or --stderr, still stream the output to the terminal too")
+	fs.BoolVar(&opts.runStats, "stats", false, "run: when the program ends, print its wall and CPU time, peak memory and exit status to stderr, like time(1)")
+	fs.Func("max-mem", "run: limit the program's memory (address space) to this `size`, e.g. 512M or 2G", func(s string) (err error) {
+		opts.maxMem, err = parseSize(s)
+		return err
+	})
+	fs.Func("max-cpu", "run: kill the program once it has used this much CPU `time`, e.g. 30s (whole seconds, rounded up)", func(s string) error {
+		d, err := time.ParseDuration(s)
+		if err == nil && d <= 0 {
+			err = fmt.Errorf("must be positive")
+		}
+		opts.maxCPU = d
+		return err
+	})
+	fs.StringVar(&opts.user, "user", "", "run: as root, start the program as this `user` (name or uid, optionally :group), e.g. nobody")
+	fs.BoolVar(&opts.noVenv, "no-venv", false, "run: use the global python3 even if a virtualenv is active or a .venv exists")
+	fs.DurationVar(&opts.timeout, "timeout", 0, "run: kill the program and everything it started after this long (e.g. 30s)")
+	fs.BoolVar(&opts.sandbox, "sandbox", false, "run: private workdir, cleared environment, no network, writes only in the workdir (Linux)")
+	fs.BoolVar(&opts.sandboxNet, "sandbox-net", false, "run: allow network access inside the sandbox")
+	fs.BoolVar(&opts.container, "container", false, "run: execute in a podman/docker container that only sees the temporary directory")
+	fs.StringVar(&opts.image, "image", "", "run: container image to use with --container (default depends on the language)")
+	fs.Func("env", "run: set `KEY=VAL` in the program's environment (repeatable)", func(s string) error {
+		if err := checkEnvEntry(s); err != nil {
+			return err
+		}
+		opts.env = append(opts.env, s)
+		return nil
+	})
+	fs.Func("interp-args", "run: pass these `args` to the interpreter itself, before the program, e.g. '-u -X dev' (shell quoting; repeatable); to the compiler for compiled languages", func(s string) error {
+		args, err := splitArgs(s)
+		opts.interpArgs = append(opts.interpArgs, args...)
+		return err
+	})
+	fs.StringVar(&opts.envFile, "env-file", "", "run: read KEY=VAL lines for the program's environment from this file")
+	fs.BoolVar(&opts.cleanEnv, "clean-env", false, "run: give the program only PATH, HOME and LANG (plus --env and --env-file, and the few variables Windows needs to start programs)")
+	fs.BoolVar(&opts.noCache, "no-cache", false, "run: don't reuse or store decoded programs and binaries in the cache")
+	fs.BoolVar(&opts.watch, "watch", false, "encode: keep a .bck next to every file in a directory up to date; run: rerun the program whenever the .bck changes (told of changes by inotify on Linux; elsewhere the files are checked every 300ms)")
+	fs.BoolVar(&opts.compress, "compress", false, "encode: gzip the encoded content (decode and run decompress it automatically)")
+	fs.BoolVar(&opts.encrypt, "encrypt", false, "encode: encrypt with a passphrase (AES-256-GCM); decode and run ask for it")
+	fs.StringVar(&opts.output, "o", "", "pack: bundle to write (default <dir>.bcka); unpack: directory to unpack into; --archive: archive to write; URL input: file to write, or - for stdout")
+	fs.BoolVar(&opts.archive, "archive", false, "encode/decode: transform each file inside a .zip, .tar, .tar.gz or .tgz and write a new archive")
+	fs.BoolVar(&opts.armor, "armor", false, "encode: write base64 text between BEGIN/END lines, safe to paste anywhere (decode reads it directly)")
+	fs.StringVar(&opts.passFile, "passphrase-file", "", "read the passphrase for --encrypt or an encrypted .bck from this file instead of asking")
+	fs.IntVar(&opts.layers, "layers", 0, "decode: peel this many encoding layers (x.bck.bck needs 2)")
+	fs.BoolVar(&opts.allLayers, "all-layers", false, "decode: peel every encoding layer found (as counted by info)")
+	fs.Func("eol", "encode/decode: convert line endings to lf or crlf while transforming, or preserve them (default)", func(s string) error {
+		e, err := parseEOL(s)
+		opts.eol = e
+		return err
+	})
+	fs.BoolVar(&opts.binary, "binary", false, "encode: accept binary input and encode it byte-for-byte (--mode=bytes)")
+	fs.StringVar(&opts.exec, "exec", "", "decode/run: pipe the decoded content into this shell `command` instead of writing a file (run passes args after -- to it)")
+	fs.Func("sha256", "URL input: refuse the download unless its SHA-256 is this `hex` digest", func(s string) (err error) {
+		opts.sha256, err = parseSHA256(s)
+		return err
+	})
+	fs.Func("max-download", "URL input: refuse downloads larger than this `size`, e.g. 512K or 4M (default 16M)", func(s string) (err error) {
+		opts.maxFetch, err = parseSize(s)
+		return err
+	})
+	fs.BoolVar(&opts.yes, "y", false, "same as --yes")
+	fs.BoolVar(&opts.yes, "yes", false, "run: run a program downloaded from a URL without asking first")
+	fs.BoolVar(&opts.unsigned, "allow-unsigned", false, "self-update: install the release even though this build has no release key to check its signature with")
+	fs.StringVar(&opts.manifest, "manifest", "", "encode: write a SHA256SUMS-style `file` listing every .bck produced; verify: the manifest to check")
+	fs.StringVar(&opts.reportFile, "report", "", "encode/decode/migrate: write a JSON report of every file's outcome, sizes and timing to `file`")
+	fs.BoolVar(&opts.resume, "resume", false, "encode/decode: record progress, and skip files an interrupted run of the same command already finished")
+	fs.Func("only", "-r: only take files matching these comma-separated `globs`, e.g. '*.py,*.md' (repeatable)", func(s string) error {
+		for _, p := range strings.Split(s, ",") {
+			if p = strings.TrimSpace(p); p == "" {
+				continue
+			}
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q", p)
+			}
+			opts.only = append(opts.only, p)
+		}
+		return nil
+	})
+	fs.BoolVar(&opts.hidden, "hidden", false, "-r: also take hidden files and directories (version control directories stay skipped)")
+	fs.Func("max-depth", "-r: descend at most `N` levels; 1 takes only the files directly in each directory", func(s string) error {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return errors.New("want a whole number of at least 1")
+		}
+		opts.maxDepth = n
+		return nil
+	})
+	fs.BoolVar(&opts.skipBinary, "skip-binary", false, "encode -r: leave out files that look binary instead of failing on them")
+	fs.BoolVar(&opts.listOnly, "list", false, "encode/decode/migrate: list the files that would be transformed and those skipped, with why, and do nothing")
+	fs.BoolVar(&opts.recursive, "r", false, "encode/decode/migrate: process every file under directory arguments (skipping hidden ones)")
+	fs.BoolVar(&opts.recursive, "recursive", false, "same as -r")
+	fs.IntVar(&opts.jobs, "jobs", runtime.NumCPU(), "encode/decode/migrate: with several files, process up to `N` at once")
+	fs.IntVar(&opts.jobs, "j", runtime.NumCPU(), "same as --jobs")
+	fs.BoolVar(&opts.storeName, "store-name", false, "encode: record the file's name in the header, for decode --restore-name")
+	fs.BoolVar(&opts.restore, "restore-name", false, "decode: name the output as recorded by encode --store-name, whatever the .bck is called now")
+	fs.BoolVar(&opts.strict, "strict", false, "decode: refuse files that don't look encoded (no backlang header or marker) instead of reversing any text")
+	var follow bool
+	fs.BoolVar(&follow, "follow-symlinks", false, "encode/decode: transform what symlinked inputs point to (the default)")
+	fs.BoolVar(&opts.noDeref, "no-dereference", false, "encode/decode: give a symlinked input a matching link (a.bck → b.bck) instead of transforming its target")
+	fs.BoolVar(&backup, "backup", false, "before replacing an existing file, keep a copy of it as <name>.bak")
+	fs.StringVar(&backupSuffix, "backup-suffix", defaultBackupSuffix, "the `suffix` --backup appends (implies --backup)")
+	fs.BoolVar(&opts.trash, "trash", false, "before replacing an existing file, move it to the trash (Recycle Bin on Windows)")
+	fs.BoolVar(&opts.sync, "sync", false, "flush every output file and its directory to disk before reporting success")
+	fs.BoolVar(&force, "force", false, "overwrite existing output files without prompting (same as --on-conflict=overwrite); encode: accept input that is already encoded")
+	fs.BoolVar(&noClobber, "no-clobber", false, "never overwrite; write to the next free numbered name (same as --on-conflict=rename)")
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fs.PrintDefaults()
+	}
 
+	args, rest, err := parseArgs(fs, os.Args[2:])
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if cmd == "run" {
+		// run forwards everything after "--" to the program it executes.
+		opts.scriptArgs = rest
+	} else {
+		args = append(args, rest...)
+	}
+	// diff compares two files, encode, decode and migrate take any number,
+	// verify (it reads --manifest), undo, doctor and self-update take none, log one or
+	// none, and everything else takes one.
+	want := 1
 	switch cmd {
-	case "encode":
-		if err := encode(inPath); err != nil {
-			printErr(err)
-			os.Exit(1)
+	case "diff":
+		want = 2
+	case "verify", "undo", "doctor", "self-update":
+		want = 0
+	case "log":
+		want = min(len(args), 1)
+	}
+	multi := (cmd == "encode" || cmd == "decode" || cmd == "migrate") && len(args) > 0
+	if len(args) != want && !multi {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(exitUsage)
+	}
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if countTrue(set["force"], set["no-clobber"], set["on-conflict"]) > 1 {
+		fmt.Fprintln(os.Stderr, "Error: --force, --no-clobber and --on-conflict cannot be used together")
+		os.Exit(exitUsage)
+	}
+	switch {
+	case force:
+		opts.onConflict, opts.force = conflictOverwrite, true
+	case noClobber:
+		opts.onConflict = conflictRename
+	}
+	if backup || set["backup-suffix"] {
+		if backupSuffix == "" || strings.ContainsAny(backupSuffix, `/\`) {
+			fmt.Fprintln(os.Stderr, "Error: --backup-suffix must be a non-empty suffix, not a path")
+			os.Exit(exitUsage)
+		}
+		opts.backup = backupSuffix
+		if !slices.Contains([]string{"encode", "decode", "pack", "unpack", "run"}, cmd) || cmd == "run" && !opts.keep {
+			fmt.Fprintln(os.Stderr, "Error: --backup only applies to encode, decode, pack, unpack and run --keep, which can replace files")
+			os.Exit(exitUsage)
+		}
+	}
+	if opts.trash {
+		switch {
+		case !slices.Contains([]string{"encode", "decode", "pack", "unpack", "run"}, cmd) || cmd == "run" && !opts.keep:
+			fmt.Fprintln(os.Stderr, "Error: --trash only applies to encode, decode, pack, unpack and run --keep, which can replace files")
+			os.Exit(exitUsage)
+		case opts.backup != "":
+			fmt.Fprintln(os.Stderr, "Error: --trash and --backup cannot be used together")
+			os.Exit(exitUsage)
+		case opts.inPlace:
+			fmt.Fprintln(os.Stderr, "Error: --trash cannot be combined with -i, which replaces the input it reads; use --backup")
+			os.Exit(exitUsage)
+		}
+	}
+	flagQuiet, flagVerbose := set["q"] || set["quiet"], set["v"] || set["verbose"]
+	if flagQuiet && flagVerbose {
+		fmt.Fprintln(os.Stderr, "Error: --quiet and --verbose cannot be used together")
+		os.Exit(exitUsage)
+	}
+	// A flag for one level wins over the environment asking for the other.
+	if flagQuiet {
+		opts.verbose = false
+	} else if flagVerbose {
+		opts.quiet = false
+	}
+	if opts.quiet && opts.verbose {
+		fmt.Fprintln(os.Stderr, "Error: BACKLANG_QUIET and BACKLANG_VERBOSE cannot both be set")
+		os.Exit(exitUsage)
+	}
+	if flagVerbose && set["log-level"] {
+		fmt.Fprintln(os.Stderr, "Error: --verbose and --log-level cannot be used together; --verbose means --log-level debug")
+		os.Exit(exitUsage)
+	}
+	// -v and -q also win over BACKLANG_LOG_LEVEL.
+	if (flagVerbose || flagQuiet) && !set["log-level"] {
+		opts.logLevel = ""
+	}
+	opts.log = newLogger(os.Stderr, logLevelFor(opts), opts.logFormat)
+	if opts.deleteOrig && cmd != "encode" {
+		fmt.Fprintln(os.Stderr, "Error: --delete-original only applies to encode")
+		os.Exit(exitUsage)
+	}
+	if opts.mode != "" && cmd != "encode" && cmd != "pack" && cmd != "selftest" {
+		fmt.Fprintln(os.Stderr, "Error: --mode only applies to encode, pack and selftest; decode reads the mode from the file")
+		os.Exit(exitUsage)
+	}
+	if opts.archive && (cmd != "encode" && cmd != "decode" || opts.watch || opts.deleteOrig || opts.encrypt || opts.armor || opts.layers != 0 || opts.allLayers) {
+		fmt.Fprintln(os.Stderr, "Error: --archive only applies to encode and decode, without --watch, --delete-original, --encrypt, --armor or the layer flags")
+		os.Exit(exitUsage)
+	}
+	urlInput := len(args) == 1 && isURL(args[0]) && (cmd == "encode" || cmd == "decode")
+	if opts.output != "" && cmd != "pack" && cmd != "unpack" && !opts.archive && !urlInput {
+		fmt.Fprintln(os.Stderr, "Error: -o only applies to pack, unpack, --archive and encode or decode of a URL")
+		os.Exit(exitUsage)
+	}
+	if opts.compress && cmd != "encode" && cmd != "pack" && cmd != "selftest" {
+		fmt.Fprintln(os.Stderr, "Error: --compress only applies to encode, pack and selftest; decode reads it from the file")
+		os.Exit(exitUsage)
+	}
+	if (opts.encrypt || opts.armor) && cmd != "encode" && cmd != "selftest" {
+		fmt.Fprintln(os.Stderr, "Error: --encrypt and --armor only apply to encode and selftest; decode reads them from the file")
+		os.Exit(exitUsage)
+	}
+	if opts.eol != "" && (cmd != "encode" && cmd != "decode" || opts.archive || opts.deleteOrig || opts.exec != "") {
+		fmt.Fprintln(os.Stderr, "Error: --eol only applies to encode and decode, without --archive, --delete-original or --exec")
+		os.Exit(exitUsage)
+	}
+	if opts.binary && (cmd != "encode" && cmd != "selftest" || opts.archive || opts.mode != "" && opts.mode != modeBytes) {
+		fmt.Fprintln(os.Stderr, "Error: --binary only applies to encode, which it switches to --mode=bytes")
+		os.Exit(exitUsage)
+	}
+	if opts.binary {
+		opts.mode = modeBytes
+	}
+	if opts.blockSize != 0 && opts.mode != modeBlocks {
+		fmt.Fprintln(os.Stderr, "Error: --block-size only applies to --mode=blocks")
+		os.Exit(exitUsage)
+	}
+	if (opts.layers != 0 || opts.allLayers) && cmd != "decode" {
+		fmt.Fprintln(os.Stderr, "Error: --layers and --all-layers only apply to decode")
+		os.Exit(exitUsage)
+	}
+	if opts.layers < 0 || (opts.layers != 0 && opts.allLayers) {
+		fmt.Fprintln(os.Stderr, "Error: --layers must be positive and cannot be combined with --all-layers")
+		os.Exit(exitUsage)
+	}
+	if opts.timeout < 0 {
+		fmt.Fprintln(os.Stderr, "Error: --timeout must not be negative")
+		os.Exit(exitUsage)
+	}
+	if opts.sandboxNet {
+		opts.sandbox = true
+	}
+	if opts.image != "" {
+		opts.container = true
+	}
+	if opts.watch && cmd == "decode" {
+		fmt.Fprintln(os.Stderr, "Error: --watch only applies to encode and run")
+		os.Exit(exitUsage)
+	}
+	if opts.watch && (opts.deleteOrig || opts.inPlace) {
+		fmt.Fprintln(os.Stderr, "Error: encode --watch cannot be combined with --delete-original or --in-place")
+		os.Exit(exitUsage)
+	}
+	runOnly := opts.keep || opts.module || opts.runStats || opts.maxMem > 0 || opts.maxCPU > 0 || opts.user != "" || opts.stdoutFile != "" || opts.stderrFile != "" || opts.tee || opts.stdin || opts.sandbox || opts.container || opts.cleanEnv || opts.envFile != "" || len(opts.env) > 0 || len(opts.interpArgs) > 0
+	if runOnly && cmd != "run" {
+		fmt.Fprintln(os.Stderr, "Error: --keep, --module, --stdin, --stats, --user, --sandbox, --container, --interp-args, the output, limit and environment flags only apply to run")
+		os.Exit(exitUsage)
+	}
+	if len(opts.interpArgs) > 0 && opts.exec != "" {
+		fmt.Fprintln(os.Stderr, "Error: --interp-args cannot be combined with --exec; put the arguments in the command")
+		os.Exit(exitUsage)
+	}
+	if opts.container && (opts.keep || opts.sandbox) {
+		fmt.Fprintln(os.Stderr, "Error: --container cannot be combined with --keep or --sandbox (the container only sees a temporary directory)")
+		os.Exit(exitUsage)
+	}
+	if opts.keep && opts.stdin {
+		fmt.Fprintln(os.Stderr, "Error: --keep and --stdin cannot be used together")
+		os.Exit(exitUsage)
+	}
+	if opts.tee && opts.stdoutFile == "" && opts.stderrFile == "" {
+		fmt.Fprintln(os.Stderr, "Error: --tee copies the output of --stdout or --stderr to the terminal; give one of them")
+		os.Exit(exitUsage)
+	}
+	if opts.user != "" && (opts.sandbox || opts.container) {
+		fmt.Fprintln(os.Stderr, "Error: --user cannot be combined with --sandbox or --container")
+		os.Exit(exitUsage)
+	}
+	if opts.module && (opts.keep || opts.stdin || opts.container || opts.watch || opts.exec != "") {
+		fmt.Fprintln(os.Stderr, "Error: --module cannot be combined with --keep, --stdin, --container, --watch or --exec")
+		os.Exit(exitUsage)
+	}
+	if cmd == "cat" && (opts.json || opts.dryRun || opts.inPlace) {
+		fmt.Fprintln(os.Stderr, "Error: cat only prints the decoded content; --json, --dry-run and --in-place do not apply")
+		os.Exit(exitUsage)
+	}
+	if opts.exec != "" && (cmd != "decode" && cmd != "run" || opts.inPlace || opts.watch || opts.archive || opts.layers != 0 || opts.allLayers || runOnly) {
+		fmt.Fprintln(os.Stderr, "Error: --exec only applies to decode and run, without --in-place, --watch, --archive, the layer flags or run's execution flags")
+		os.Exit(exitUsage)
+	}
+	if set["sync"] && (cmd == "run" || cmd == "cat" || cmd == "info" || cmd == "list" || cmd == "diff" || opts.exec != "") {
+		fmt.Fprintln(os.Stderr, "Error: --sync only applies to commands that write files: encode, decode, edit, pack and unpack")
+		os.Exit(exitUsage)
+	}
+	if opts.strict && cmd != "decode" {
+		fmt.Fprintln(os.Stderr, "Error: --strict only applies to decode")
+		os.Exit(exitUsage)
+	}
+	if opts.storeName && cmd != "encode" {
+		fmt.Fprintln(os.Stderr, "Error: --store-name only applies to encode")
+		os.Exit(exitUsage)
+	}
+	if opts.restore && (cmd != "decode" || opts.inPlace || opts.archive || opts.exec != "") {
+		fmt.Fprintln(os.Stderr, "Error: --restore-name only applies to decode, without --in-place, --archive or --exec")
+		os.Exit(exitUsage)
+	}
+	if follow && opts.noDeref {
+		fmt.Fprintln(os.Stderr, "Error: --follow-symlinks and --no-dereference cannot be used together")
+		os.Exit(exitUsage)
+	}
+	if opts.noDeref && (cmd != "encode" && cmd != "decode" || opts.inPlace || opts.archive || opts.watch || opts.exec != "") {
+		fmt.Fprintln(os.Stderr, "Error: --no-dereference only applies to encode and decode, without --in-place, --archive, --watch or --exec")
+		os.Exit(exitUsage)
+	}
+	if opts.inPlace && (cmd == "run" || opts.deleteOrig) {
+		fmt.Fprintln(os.Stderr, "Error: --in-place only applies to encode and decode, without --delete-original")
+		os.Exit(exitUsage)
+	}
+	if (opts.recursive || set["jobs"] || set["j"]) && cmd != "encode" && cmd != "decode" && cmd != "migrate" {
+		fmt.Fprintln(os.Stderr, "Error: -r and --jobs only apply to encode, decode and migrate")
+		os.Exit(exitUsage)
+	}
+	if opts.jobs < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --jobs must be at least 1")
+		os.Exit(exitUsage)
+	}
+	switch {
+	case opts.manifest != "" && cmd != "encode" && cmd != "verify":
+		fmt.Fprintln(os.Stderr, "Error: --manifest only applies to encode and verify")
+		os.Exit(exitUsage)
+	case cmd == "verify" && opts.manifest == "":
+		fmt.Fprintln(os.Stderr, "Error: verify needs --manifest <file>, as written by encode --manifest")
+		os.Exit(exitUsage)
+	case cmd == "encode" && opts.manifest != "" && (opts.watch || opts.archive || opts.exec != "" || slices.ContainsFunc(args, isObjectURL) || slices.ContainsFunc(args, isURL)):
+		fmt.Fprintln(os.Stderr, "Error: --manifest cannot be combined with --watch, --archive, --exec or URL inputs")
+		os.Exit(exitUsage)
+	}
+	if opts.reportFile != "" && (cmd != "encode" && cmd != "decode" && cmd != "migrate" || opts.watch || opts.archive || opts.exec != "" || slices.ContainsFunc(args, isURL)) {
+		fmt.Fprintln(os.Stderr, "Error: --report only applies to encode, decode and migrate, without --watch, --archive, --exec or URL inputs")
+		os.Exit(exitUsage)
+	}
+	if (len(opts.only) > 0 || opts.skipBinary || opts.maxDepth > 0 || opts.hidden) && !opts.recursive {
+		fmt.Fprintln(os.Stderr, "Error: --only, --skip-binary, --max-depth and --hidden choose among the files -r finds; they need -r")
+		os.Exit(exitUsage)
+	}
+	if opts.skipBinary && (cmd != "encode" || opts.binary) {
+		fmt.Fprintln(os.Stderr, "Error: --skip-binary only applies to encode, without --binary")
+		os.Exit(exitUsage)
+	}
+	if opts.listOnly && (cmd != "encode" && cmd != "decode" && cmd != "migrate" || opts.watch || opts.archive || opts.exec != "" || slices.ContainsFunc(args, isURL)) {
+		fmt.Fprintln(os.Stderr, "Error: --list only applies to encode, decode and migrate, without --watch, --archive, --exec or URL inputs")
+		os.Exit(exitUsage)
+	}
+	if opts.resume && (cmd != "encode" && cmd != "decode" || opts.watch || opts.archive || opts.exec != "" || slices.ContainsFunc(args, isURL) || slices.ContainsFunc(args, isObjectURL)) {
+		fmt.Fprintln(os.Stderr, "Error: --resume only applies to encode and decode of local files, without --watch, --archive or --exec")
+		os.Exit(exitUsage)
+	}
+	// A manifest or report is written once the batch is done, and progress
+	// is recorded as it goes, so each makes a batch even of one file.
+	batchMode := len(args) > 1 || opts.recursive || cmd == "encode" && opts.manifest != "" || opts.reportFile != "" || opts.resume
+	if batchMode && (opts.watch || opts.archive || opts.exec != "") {
+		fmt.Fprintln(os.Stderr, "Error: several files or -r cannot be combined with --watch, --archive or --exec")
+		os.Exit(exitUsage)
+	}
+	inPath := opts.manifest // verify, undo and log may take no file arguments
+	if len(args) > 0 {
+		inPath = args[0]
+	}
+	if isURL(inPath) {
+		switch {
+		case cmd != "run" && cmd != "encode" && cmd != "decode" && cmd != "cat":
+			fmt.Fprintln(os.Stderr, "Error: only encode, decode, cat and run take a URL")
+			os.Exit(exitUsage)
+		case batchMode || opts.keep || opts.module || opts.watch || opts.exec != "" || opts.inPlace || opts.archive || opts.deleteOrig || opts.noDeref:
+			fmt.Fprintln(os.Stderr, "Error: a URL input is a single file; it cannot be combined with other inputs, -r, --keep, --module, --watch, --exec, --in-place, --archive, --delete-original or --no-dereference")
+			os.Exit(exitUsage)
+		case opts.yes && cmd != "run":
+			fmt.Fprintln(os.Stderr, "Error: --yes only applies to run")
+			os.Exit(exitUsage)
 		}
-	case "decode":
+	}
+	if slices.ContainsFunc(args, isObjectURL) {
+		switch {
+		case cmd != "encode" && cmd != "decode" && cmd != "cat":
+			fmt.Fprintln(os.Stderr, "Error: only encode, decode and cat take an s3:// or gs:// input")
+			os.Exit(exitUsage)
+		case opts.keep || opts.watch || opts.exec != "" || opts.inPlace || opts.archive || opts.deleteOrig || opts.noDeref:
+			fmt.Fprintln(os.Stderr, "Error: an s3:// or gs:// input cannot be combined with --keep, --watch, --exec, --in-place, --archive, --delete-original or --no-dereference")
+			os.Exit(exitUsage)
+		}
+	}
+	if opts.unsigned && cmd != "self-update" {
+		fmt.Fprintln(os.Stderr, "Error: --allow-unsigned only applies to self-update")
+		os.Exit(exitUsage)
+	}
+	if (opts.sha256 != "" || opts.maxFetch != 0 && cmd != "self-update" || opts.yes) && !isURL(inPath) {
+		fmt.Fprintln(os.Stderr, "Error: --sha256, --max-download and --yes only apply to a URL input (and --max-download to self-update)")
+		os.Exit(exitUsage)
+	}
+	if opts.json {
+		opts.quiet = true
+	}
+	opts.journal = true
+	if opts.listOnly {
+		if err := preview(cmd, args, opts); err != nil {
+			os.Exit(exitCode(err))
+		}
+		os.Exit(exitOK)
+	}
+	if batchMode {
+		if err := batch(cmd, args, opts); err != nil {
+			os.Exit(exitCode(err))
+		}
+		os.Exit(exitOK)
+	}
+
+	var res result
+	switch {
+	case isObjectURL(inPath):
+		res, err = transformObject(cmd, inPath, opts)
+	case isURL(inPath) && cmd != "run":
+		res, err = transformURL(cmd, inPath, opts)
+	case opts.exec != "":
+		res, err = pipeTo(inPath, cmd, opts)
+	case opts.archive:
+		res, err = transformArchive(inPath, cmd, opts)
+	case cmd == "encode":
+		if opts.watch {
+			stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			err = watchEncode(stop, inPath, opts)
+			res = result{Command: cmd, Input: inPath}
+			cancel()
+			break
+		}
+		res, err = encode(inPath, opts)
+	case cmd == "decode":
+		if err := checkDecodable(inPath, opts); err != nil {
+			exit(result{Command: cmd, Input: inPath}, opts, err)
+		}
+		res, err = decode(inPath, opts)
+	case cmd == "migrate":
+		if !strings.HasSuffix(strings.ToLower(inPath), ".bck") {
+			exit(result{Command: cmd, Input: inPath}, opts, newError(ErrNotBck, "migrate command only accepts .bck files"))
+		}
+		res, err = migrate(inPath, opts)
+	case cmd == "cat":
 		if !strings.HasSuffix(strings.ToLower(inPath), ".bck") {
-			fmt.Fprintln(os.Stderr, "Error: decode command only accepts .bck files")
-			os.Exit(2)
+			exit(result{Command: cmd, Input: inPath}, opts, newError(ErrNotBck, "cat command only accepts .bck files"))
 		}
-		if err := decode(inPath); err != nil {
-			printErr(err)
-			os.Exit(1)
+		res, err = cat(inPath, os.Stdout, opts)
+	case cmd == "edit":
+		if !strings.HasSuffix(strings.ToLower(inPath), ".bck") {
+			exit(result{Command: cmd, Input: inPath}, opts, newError(ErrNotBck, "edit command only accepts .bck files"))
+		}
+		res, err = edit(inPath, opts)
+	case cmd == "selftest":
+		res, err = selftest(inPath, opts)
+	case cmd == "verify":
+		res, err = verifyManifest(opts.manifest, opts)
+	case cmd == "undo":
+		res, err = undo(opts)
+	case cmd == "log":
+		res, err = showLog(inPath, opts)
+	case cmd == "doctor":
+		res, err = doctor(opts)
+	case cmd == "self-update":
+		res, err = selfUpdate(opts)
+	case cmd == "info":
+		res, err = info(inPath, opts)
+	case cmd == "stats":
+		res, err = stats(inPath, opts)
+	case cmd == "identify":
+		res, err = identify(inPath, opts)
+	case cmd == "pack":
+		res, err = pack(inPath, opts)
+	case cmd == "unpack":
+		res, err = unpack(inPath, opts)
+	case cmd == "list":
+		res, err = list(inPath, opts)
+	case cmd == "diff":
+		res, err = diff(inPath, args[1], opts)
+	case cmd == "run":
+		if isURL(inPath) {
+			res, err = runURL(inPath, opts)
+			break
+		}
+		if opts.watch {
+			stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			err = watchRun(stop, inPath, opts)
+			cancel()
+			res = result{Command: cmd, Input: inPath}
+			break
 		}
-	case "run":
-		if err := run(inPath); err != nil {
-			printErr(err)
-			os.Exit(1)
+		if opts.module {
+			res, err = runModule(inPath, opts)
+			break
 		}
+		res, err = run(inPath, opts)
 	default:
 		fmt.Fprint(os.Stderr, usageText)
-		os.Exit(2)
+		os.Exit(exitUsage)
+	}
+	if err != nil {
+		exit(res, opts, err)
+	}
+	journal(res, opts)
+	if opts.json && !opts.watch {
+		printJSON(res)
+	}
+	if res.Action == "differ" {
+		os.Exit(exitDiffer)
+	}
+}
+
+// exit reports err and terminates with the exit code matching its cause.
+func exit(res result, opts options, err error) {
+	report(res, opts, err)
+	os.Exit(exitCode(err))
+}
+
+// report prints the outcome of a command: with --json the result record
+// (marked failed if err is set), otherwise err, if any, on stderr.
+func report(res result, opts options, err error) {
+	switch {
+	case err != nil && opts.json:
+		res.Action = "failed"
+		res.Error = err.Error()
+		res.ExitCode = exitCode(err)
+		printJSON(res)
+	case err != nil:
+		printErr(err)
+	case opts.json:
+		printJSON(res)
+	}
+}
+
+func encode(inPath string, opts options) (result, error) {
+	if opts.noDeref && isSymlink(inPath) {
+		return transformLink("encode", inPath, opts)
+	}
+	res := result{Command: "encode", Input: inPath, DryRun: opts.dryRun}
+	if !opts.force {
+		if err := checkNotEncoded(inPath); err != nil {
+			return res, err
+		}
+	}
+	start := time.Now()
+	// Bytes and blocks modes stream the file backwards in chunks or blocks;
+	// the other modes work on the whole file in memory.
+	f := format{mode: opts.mode, blockSize: opts.blockSize}
+	if opts.storeName {
+		f.name = filepath.Base(inPath)
+		if err := checkStoredName(f.name); err != nil {
+			return res, err
+		}
+	}
+	if opts.compress {
+		f.compress = compressGzip
+	}
+	if f.mode == modeBlocks && f.blockSize == 0 {
+		f.blockSize = defaultBlockSize
+	}
+	var data []byte
+	var in *os.File
+	var size int64
+	// Encryption seals the whole body at once, so it needs it in memory, as
+	// does converting line endings.
+	if modes[f.mode].stream && !opts.encrypt && opts.eol == "" {
+		var err error
+		if in, size, err = openSized(inPath); err != nil {
+			return res, wrapPathErr(err, inPath)
+		}
+		defer in.Close()
+		opts.logger().Debug("streaming input", "path", inPath, "bytes", size)
+		if f.mode != modeBytes {
+			head := make([]byte, min(size, sniffLen))
+			if _, err := in.ReadAt(head, 0); err != nil && err != io.EOF {
+				return res, wrapPathErr(err, inPath)
+			}
+			if err := checkText(inPath, head); err != nil {
+				return res, err
+			}
+		}
+	} else {
+		var err error
+		if data, err = os.ReadFile(inPath); err != nil {
+			return res, wrapPathErr(err, inPath)
+		}
+		opts.logger().Debug("read input", "path", inPath, "bytes", len(data))
+		if f.mode != modeBytes {
+			if err := checkText(inPath, data); err != nil {
+				return res, err
+			}
+		}
+		if opts.eol != "" {
+			data = convertEOL(data, opts.eol)
+			opts.logger().Debug("converted line endings", "eol", opts.eol)
+		}
+		if len(data) > 0 && data[len(data)-1] != '\n' && (opts.mode == "" || opts.mode == modeLines) {
+			opts.logger().Debug("no trailing newline; adding marker", "marker", strings.TrimSpace(nnlMarker))
+		}
+	}
+
+	outPath, skip, err := outputPath(inPath, inPath+".bck", opts)
+	res.Output = outPath
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	res.Action = "encoded"
+	if opts.dryRun {
+		opts.infof("Would encode %s\n", describeTransform(inPath, outPath))
+		if opts.deleteOrig {
+			opts.infof("Would delete '%s'\n", filepath.Base(inPath))
+		}
+		return res, nil
+	}
+	var p *progress
+	fill := func(w io.Writer) error { return encodeFile(w, p.readerAt(in), f, size) }
+	if in == nil {
+		out, err := encodeData(data, f)
+		if err != nil {
+			return res, err
+		}
+		if opts.encrypt {
+			pass, err := passphrase(opts, true)
+			if err != nil {
+				return res, err
+			}
+			if out, err = seal(out, pass); err != nil {
+				return res, err
+			}
+		}
+		size = int64(len(out))
+		fill = func(w io.Writer) error { return writeAll(out)(p.writer(w)) }
+	}
+	if opts.armor {
+		fill = armored(fill)
+	}
+	p = startProgress(opts, "Encoding '"+filepath.Base(inPath)+"'", size, false)
+	// In place, readers must never see a half-written file; with
+	// --delete-original the .bck must be on disk before the original goes.
+	err = writeFileStream(outPath, 0o666, true, opts.sync || opts.deleteOrig, fill)
+	p.finish()
+	if err != nil {
+		return res, wrapPathErr(err, outPath)
+	}
+	opts.logger().Debug("wrote output", "path", outPath, "duration", time.Since(start))
+
+	opts.infof("Encoded %s\n", describeTransform(inPath, outPath))
+
+	if opts.deleteOrig {
+		if err := deleteVerified(inPath, outPath, opts); err != nil {
+			return res, err
+		}
+		res.Deleted = true
+		opts.infof("Deleted '%s'\n", filepath.Base(inPath))
+	}
+	return res, nil
+}
+
+// checkText refuses input whose start looks binary: reversing its lines,
+// characters or words would scramble it around stray newline bytes.
+func checkText(inPath string, head []byte) error {
+	if looksBinary(head) {
+		return newError(ErrBinary, "'%s' looks like a binary file; pass --binary to encode it byte-for-byte", filepath.Base(inPath))
+	}
+	return nil
+}
+
+// checkNotEncoded refuses input that is already a .bck, by name or by
+// content: encoding it again makes x.bck.bck, which is almost always a
+// slip. --force allows it.
+func checkNotEncoded(inPath string) error {
+	if strings.HasSuffix(strings.ToLower(inPath), ".bck") || looksEncoded(inPath) {
+		return newError(ErrUsage, "'%s' is already encoded; pass --force to encode it again (decode peels one layer at a time)", filepath.Base(inPath))
 	}
+	return nil
 }
 
-func encode(inPath string) error {
-	data, err := os.ReadFile(inPath)
+// checkDecodable lets decode take a file not named .bck only if its
+// content looks encoded, or with --force.
+func checkDecodable(inPath string, opts options) error {
+	if opts.inPlace || opts.force || strings.HasSuffix(strings.ToLower(inPath), ".bck") || looksEncoded(inPath) {
+		return nil
+	}
+	return newError(ErrNotBck, "'%s' is not a .bck file and doesn't look encoded; pass --force to decode it anyway", filepath.Base(inPath))
+}
+
+// looksEncoded reports whether the file at path starts the way only
+// backlang output does: with a header, armor or the no-newline marker.
+// (A plain line-mode encoding has no such mark.)
+func looksEncoded(path string) bool {
+	f, err := os.Open(path)
 	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, maxHeaderLen)
+	n, _ := io.ReadFull(f, head)
+	head = head[:n]
+	return bytes.HasPrefix(head, []byte(headerPrefix)) || bytes.HasPrefix(head, []byte(nnlMarker)) || isArmored(head)
+}
+
+// checkEncoded is decode --strict's test that inPath was really encoded:
+// it must start with a header or, being an old-style line-mode file, with
+// the no-newline marker. Any other text would "decode" to itself reversed.
+func checkEncoded(inPath string, r io.ReaderAt, f format, off int64) error {
+	if f.version > 1 {
+		return nil
+	}
+	head := make([]byte, len(nnlMarker))
+	if n, _ := r.ReadAt(head, off); n == len(head) && string(head) == nnlMarker {
+		return nil
+	}
+	return newError(ErrNotBck, "'%s' has no backlang header or marker; it may never have been encoded", filepath.Base(inPath))
+}
+
+// deleteVerified removes inPath only if the encoded file at outPath reads
+// back and decodes to exactly its contents.
+func deleteVerified(inPath, outPath string, opts options) error {
+	data, f, off, release, err := mapEncoded(outPath)
+	if err != nil {
+		return err
+	}
+	defer release()
+	enc, f, off, size, err := unwrapFile(data, f, off, int64(len(data)), opts)
+	if err != nil {
+		return err
+	}
+	orig, err := os.Open(inPath)
+	if err != nil {
+		return wrapPathErr(err, inPath)
+	}
+	cmp := &compareWriter{r: bufio.NewReader(orig)}
+	err = decodeStream(cmp, enc, f, off, size)
+	ok := err == nil && cmp.matched()
+	orig.Close()
+	if !ok {
+		return newError(ErrCorrupt, "'%s' did not round-trip; keeping '%s'", filepath.Base(outPath), filepath.Base(inPath))
+	}
+	if err := os.Remove(inPath); err != nil {
 		return wrapPathErr(err, inPath)
 	}
+	return nil
+}
+
+func decode(inPath string, opts options) (result, error) {
+	if opts.noDeref && isSymlink(inPath) {
+		return transformLink("decode", inPath, opts)
+	}
+	res := result{Command: "decode", Input: inPath, DryRun: opts.dryRun}
+	start := time.Now()
+	file, f, off, size, err := openEncoded(inPath)
+	if err != nil {
+		return res, err
+	}
+	defer file.Close()
+	opts.logger().Debug("reading input", "path", inPath, "bytes", size, "mode", f.mode)
+	in, f, off, size, err := unwrapFile(file, f, off, size, opts)
+	if err != nil {
+		return res, err
+	}
+	if opts.strict {
+		if err := checkEncoded(inPath, in, f, off); err != nil {
+			return res, err
+		}
+	}
 
+	name := stripLastBck(inPath)
+	if name == inPath {
+		name = decodedName(inPath, f)
+	}
+	var p *progress
+	fill := func(w io.Writer) error { return decodeStream(w, p.readerAt(in), f, off, size) }
+	total := size - off
+	// Several layers are peeled in memory; one streams straight to the output.
+	if opts.layers > 1 || opts.allLayers {
+		data, err := io.ReadAll(io.NewSectionReader(in, 0, size))
+		if err != nil {
+			return res, wrapPathErr(err, inPath)
+		}
+		limit := opts.layers
+		if opts.allLayers {
+			limit = -1
+		}
+		var out []byte
+		unseal := func(b []byte) ([]byte, error) { return unwrapData(b, opts) }
+		if out, name, res.Layers, err = peelLayers(inPath, data, limit, unseal); err != nil {
+			return res, err
+		}
+		opts.logger().Debug("peeled layers", "layers", res.Layers)
+		total = int64(len(out))
+		fill = func(w io.Writer) error { return writeAll(out)(p.writer(w)) }
+	}
+
+	fill = withEOL(fill, opts.eol)
+
+	if opts.restore {
+		name = restoredName(inPath, name, f, res.Layers, opts)
+	}
+	outPath, skip, err := outputPath(inPath, name, opts)
+	res.Output = outPath
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	res.Action = "decoded"
+	if opts.dryRun {
+		opts.infof("Would decode %s\n", describeTransform(inPath, outPath))
+		return res, nil
+	}
+	p = startProgress(opts, "Decoding '"+filepath.Base(inPath)+"'", total, false)
+	err = writeFileStream(outPath, 0o666, true, opts.sync, fill)
+	p.finish()
+	if err != nil {
+		return res, wrapPathErr(err, outPath)
+	}
+	opts.logger().Debug("wrote output", "path", outPath, "duration", time.Since(start))
+
+	opts.infof("Decoded %s\n", describeTransform(inPath, outPath))
+	return res, nil
+}
+
+// decodedName names the output for input without a .bck to remove: the
+// name recorded by encode --store-name, if any, otherwise the input's
+// with ".decoded" before its extension (notes.txt → notes.decoded.txt).
+func decodedName(inPath string, f format) string {
+	dir := filepath.Dir(inPath)
+	if f.name != "" && f.name != filepath.Base(inPath) {
+		return filepath.Join(dir, f.name)
+	}
+	base := filepath.Base(inPath)
+	ext := filepath.Ext(base)
+	if ext == base {
+		ext = "" // a dotfile has no extension
+	}
+	return filepath.Join(dir, strings.TrimSuffix(base, ext)+".decoded"+ext)
+}
+
+// restoredName is where decode --restore-name writes: next to the .bck,
+// under the name encode --store-name recorded in f (less a .bck for each
+// further layer peeled), or name if none was recorded.
+func restoredName(inPath, name string, f format, layers int, opts options) string {
+	if f.name == "" {
+		opts.logger().Debug("no recorded name", "path", inPath, "output", filepath.Base(name))
+		return name
+	}
+	restored := f.name
+	for range layers - 1 {
+		restored = stripLastBck(restored)
+	}
+	opts.logger().Debug("restoring recorded name", "name", restored)
+	return filepath.Join(filepath.Dir(inPath), restored)
+}
+
+// cat decodes a .bck onto w without writing any file.
+func cat(inPath string, w io.Writer, opts options) (result, error) {
+	res := result{Command: "cat", Input: inPath, Action: "printed"}
+	data, f, off, release, err := mapEncoded(inPath)
+	if err != nil {
+		return res, err
+	}
+	defer release()
+	opts.logger().Debug("read input", "path", inPath, "bytes", len(data), "mode", f.mode)
+	in, f, off, size, err := unwrapFile(data, f, off, int64(len(data)), opts)
+	if err != nil {
+		return res, err
+	}
+	return res, decodeStream(w, in, f, off, size)
+}
+
+// nnlMarker is the first line of an encoded file whose original had no
+// trailing newline.
+const nnlMarker = "##BCKL.NNL##\n"
+
+// encodeBytes reverses the line order of data. If the original lacks a
+// trailing newline, the ##BCKL.NNL## marker is prepended so decode can
+// restore it exactly.
+func encodeBytes(data []byte) []byte {
 	// Check if original file lacks trailing newline
 	hasTrailingNewline := len(data) > 0 && (data[len(data)-1] == '\n')
 	
@@ -61,30 +1168,18 @@ func encode(inPath string) error {
 	
 	// Add marker if original had no trailing newline
 	if !hasTrailingNewline && len(data) > 0 {
-		marker := []byte("##BCKL.NNL##\n")
-		lines = append([][]byte{marker}, lines...)
-	}
-
-	outPath := inPath + ".bck"
-	if err := os.WriteFile(outPath, join(lines), 0o666); err != nil {
-		return wrapPathErr(err, outPath)
+		lines = append([][]byte{[]byte(nnlMarker)}, lines...)
 	}
-
-	fmt.Printf("Encoded '%s' → '%s'\n", filepath.Base(inPath), filepath.Base(outPath))
-	return nil
+	return join(lines)
 }
 
-func decode(inPath string) error {
-	data, err := os.ReadFile(inPath)
-	if err != nil {
-		return wrapPathErr(err, inPath)
-	}
-
+// decodeBytes is the inverse of encodeBytes.
+func decodeBytes(data []byte) []byte {
 	lines := splitLinesPreserveEndings(data)
 	
 	// Check for marker at the beginning
 	hasMarker := false
-	if len(lines) > 0 && string(lines[0]) == "##BCKL.NNL##\n" {
+	if len(lines) > 0 && string(lines[0]) == nnlMarker {
 		hasMarker = true
 		lines = lines[1:] // Remove marker
 	}
@@ -98,29 +1193,51 @@ func decode(inPath string) error {
 			lines[len(lines)-1] = lastLine[:len(lastLine)-1]
 		}
 	}
+	return join(lines)
+}
 
-	outPath := stripLastBck(inPath)
-	// If target exists, prompt and either overwrite or auto-increment.
-	if fileExists(outPath) {
-		overwrite, err := promptOverwrite(outPath)
-		if err != nil {
+// verifyBytes checks that data is a well-formed encoding: decoding it and
+// encoding the result must give back exactly data.
+func verifyBytes(data []byte, limit int64) error {
+	if isArmored(data) {
+		var err error
+		if data, err = dearmor(data); err != nil {
 			return err
 		}
-		if !overwrite {
-			outPath = nextAvailableName(outPath)
-		}
 	}
-
-	if err := os.WriteFile(outPath, join(lines), 0o666); err != nil {
-		return wrapPathErr(err, outPath)
+	decoded, f, err := decodeDataLimit(data, limit)
+	if err != nil {
+		return err
+	}
+	if again, err := encodeData(decoded, f); err != nil || !bytes.Equal(again, data) {
+		return newError(ErrCorrupt, "data does not round-trip: decoding and re-encoding changes it")
 	}
-
-	fmt.Printf("Decoded '%s' → '%s'\n", filepath.Base(inPath), filepath.Base(outPath))
 	return nil
 }
 
 // --- helpers ---
 
+// parseArgs parses flags that may appear before or after the positional
+// arguments (e.g. "decode file.bck --force") and returns the positionals.
+// Everything after a "--" terminator is returned separately as rest.
+func parseArgs(fs *flag.FlagSet, args []string) (positional, rest []string, err error) {
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, nil, err
+		}
+		consumed := len(args) - len(fs.Args())
+		if consumed > 0 && args[consumed-1] == "--" {
+			return positional, fs.Args(), nil
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional, nil, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
 // splitLinesPreserveEndings splits into records where each element includes its original
 // newline sequence (LF or CRLF) if present. The last element may not end with a newline.
 func splitLinesPreserveEndings(b []byte) [][]byte {
@@ -196,13 +1313,237 @@ func nextAvailableName(path string) string {
 	}
 }
 
+// writeNumbered writes data to path, a numbered name nextAvailableName
+// picked for base, creating it exclusively. If another process has taken
+// path since, it moves on to the next free name rather than share it. It
+// returns the name written.
+func writeNumbered(base, path string, data []byte, perm os.FileMode) (string, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+		if errors.Is(err, os.ErrExist) {
+			path = nextAvailableName(base)
+			continue
+		}
+		if err != nil {
+			return path, err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return path, err
+	}
+}
+
+// outputPath returns where a transform of inPath should be written: inPath
+// itself with --in-place (the file a symlink points to, for a link, backed
+// up first with --backup),
+// otherwise defaultPath after applying the conflict policy (see
+// resolveConflict). With -r an output that is a symlink is never
+// replaced: a link in a tree is usually there on purpose.
+func outputPath(inPath, defaultPath string, opts options) (path string, skip bool, err error) {
+	if opts.inPlace {
+		path, err := filepath.EvalSymlinks(inPath)
+		if err != nil {
+			return "", false, wrapPathErr(err, inPath)
+		}
+		if path != inPath {
+			opts.logger().Debug("following symlink", "path", inPath, "target", path)
+		}
+		return path, false, beforeReplace(path, opts)
+	}
+	if opts.recursive && isSymlink(defaultPath) {
+		return "", false, newError(ErrConflict, "'%s' is a symlink; not replacing it", defaultPath)
+	}
+	return resolveConflict(defaultPath, opts)
+}
+
+// describeTransform formats "'in' → 'out'", or "'in' in place" when both are
+// the same file (perhaps through a symlink).
+func describeTransform(inPath, outPath string) string {
+	if inPath == outPath || sameFile(inPath, outPath) {
+		return fmt.Sprintf("'%s' in place", filepath.Base(inPath))
+	}
+	return fmt.Sprintf("'%s' → '%s'", filepath.Base(inPath), filepath.Base(outPath))
+}
+
+// resolveConflict applies the conflict policy to outPath and returns the path
+// to write to. skip reports that the existing file should be left alone and
+// the operation abandoned. In dry-run mode it describes the decision instead
+// of prompting. A file about to be overwritten is backed up first with
+// --backup, or moved to the trash with --trash.
+func resolveConflict(outPath string, opts options) (path string, skip bool, err error) {
+	// A dangling symlink counts as existing too.
+	if _, err := os.Lstat(outPath); err != nil {
+		return outPath, false, nil
+	}
+	name := filepath.Base(outPath)
+	switch opts.onConflict {
+	case conflictOverwrite:
+		if opts.dryRun {
+			opts.infof("Would overwrite existing '%s'\n", name)
+		}
+		return outPath, false, beforeReplace(outPath, opts)
+	case conflictRename:
+		next := nextAvailableName(outPath)
+		if opts.dryRun {
+			opts.infof("'%s' exists, would write '%s' instead\n", name, filepath.Base(next))
+		}
+		return next, false, nil
+	case conflictSkip:
+		if opts.dryRun {
+			opts.infof("Would skip '%s' (already exists)\n", name)
+		} else {
+			opts.infof("Skipped '%s' (already exists)\n", name)
+		}
+		return outPath, true, nil
+	case conflictFail:
+		return "", false, newError(ErrConflict, "File '%s' already exists", name)
+	}
+	if opts.dryRun {
+		opts.infof("'%s' exists, would ask before overwriting\n", name)
+		return outPath, false, nil
+	}
+	overwrite, err := promptOverwrite(outPath)
+	if err != nil {
+		return "", false, err
+	}
+	if !overwrite {
+		return nextAvailableName(outPath), false, nil
+	}
+	return outPath, false, beforeReplace(outPath, opts)
+}
+
+// writeFileSync is os.WriteFile followed by an fsync, so the data is on
+// disk before it returns.
+func writeFileSync(name string, data []byte, perm os.FileMode) error {
+	return writeFileStream(name, perm, false, true, writeAll(data))
+}
+
+// writeFileAtomic replaces name with data by writing a synced temporary file
+// in the same directory and renaming it into place, so a crash leaves either
+// the old or the new content. An existing file's permissions are kept.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	return writeFileStream(name, perm, true, true, writeAll(data))
+}
+
+func writeAll(data []byte) func(io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
+
+// writeFileStream writes name with whatever fill writes. With atomic the
+// data goes to a temporary file in the same directory, which is given the
+// existing file's permissions and renamed over name, so readers (and a
+// crash or kill halfway) see the old or the new contents and never a
+// truncated mix; when it replaces a file it is synced first, so the old
+// contents are not gone before the new ones are on disk. Targets that are
+// not regular files, such as /dev/stdout, are written directly. With sync
+// the file and then its directory are fsynced before it returns, so it
+// survives a crash right after.
+func writeFileStream(name string, perm os.FileMode, atomic, sync bool, fill func(io.Writer) error) error {
+	var f *os.File
+	var err error
+	chmod, replacing := false, false
+	if atomic {
+		if fi, err := os.Stat(name); err == nil {
+			atomic = fi.Mode().IsRegular()
+			perm, chmod, replacing = fi.Mode().Perm(), true, true
+		}
+	}
+	if atomic {
+		f, err = createTemp(name, perm)
+	} else {
+		f, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	}
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriterSize(f, 64<<10)
+	err = fill(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil && (sync || atomic && replacing) {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if !atomic {
+		if err == nil && sync {
+			err = syncDir(filepath.Dir(name))
+		}
+		return err
+	}
+	// A new file got perm less the umask from createTemp; an existing
+	// file's permissions are copied exactly.
+	if err == nil && chmod {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if sync {
+		return syncDir(filepath.Dir(name))
+	}
+	return nil
+}
+
+// createTemp creates a new, uniquely named hidden file next to name, like
+// os.CreateTemp but with perm (less the umask) rather than 0600.
+func createTemp(name string, perm os.FileMode) (*os.File, error) {
+	prefix := tempPrefix(name)
+	for range 10000 {
+		f, err := os.OpenFile(prefix+strconv.FormatUint(uint64(rand.Uint32()), 10), os.O_RDWR|os.O_CREATE|os.O_EXCL, perm)
+		if !errors.Is(err, os.ErrExist) {
+			return f, err
+		}
+	}
+	return nil, &os.PathError{Op: "createtemp", Path: prefix + "*", Err: os.ErrExist}
+}
+
+// maxTempBase is how much of a file's name its temporary file's name
+// keeps: with the dot, ".tmp", ten random digits and room for an ".exe",
+// it stays within the 255 bytes most file systems allow a name.
+const maxTempBase = 200
+
+// tempPrefix is the path a temporary file standing in for name starts
+// with, before its random digits: hidden, next to name, and named after it
+// as far as fits.
+func tempPrefix(name string) string {
+	base := filepath.Base(name)
+	if len(base) > maxTempBase {
+		base = base[:maxTempBase]
+		for !utf8.ValidString(base) { // don't split a character
+			base = base[:len(base)-1]
+		}
+	}
+	return filepath.Join(filepath.Dir(name), "."+base+".tmp")
+}
+
 func fileExists(p string) bool {
 	_, err := os.Stat(p)
 	return err == nil
 }
 
+// termMu keeps prompts from files processed in parallel from interleaving.
+var termMu sync.Mutex
+
 func promptOverwrite(target string) (bool, error) {
-	fmt.Printf("File '%s' exists. Overwrite? (y/n): ", filepath.Base(target))
+	termMu.Lock()
+	defer termMu.Unlock()
+	// Never read an answer out of piped data (or treat EOF as "no").
+	if !stdinIsTerminal() {
+		return false, newError(ErrConflict, "File '%s' exists and stdin is not a terminal; pass --force or --no-clobber (or --on-conflict) to choose", filepath.Base(target))
+	}
+	fmt.Fprintf(os.Stderr, "File '%s' exists. Overwrite? (y/n): ", filepath.Base(target))
 	reader := bufio.NewReader(os.Stdin)
 	line, err := reader.ReadString('\n')
 	if err != nil && !errors.Is(err, io.EOF) {
@@ -212,17 +1553,37 @@ func promptOverwrite(target string) (bool, error) {
 	return line == "y" || line == "yes", nil
 }
 
+// stdinIsTerminal reports whether stdin is an interactive terminal.
+func stdinIsTerminal() bool {
+	return isTerminal(os.Stdin)
+}
+
 func wrapPathErr(err error, path string) error {
 	if errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("Error: File '%s' not found", filepath.Base(path))
+		return newError(ErrNotFound, "File '%s' not found", filepath.Base(path))
 	}
 	if errors.Is(err, os.ErrPermission) {
-		return fmt.Errorf("Error: Permission denied accessing '%s'", filepath.Base(path))
+		return newError(ErrPermission, "Permission denied accessing '%s'", filepath.Base(path))
 	}
 	// fallback with original message
 	return err
 }
 
+func countTrue(bs ...bool) int {
+	n := 0
+	for _, b := range bs {
+		if b {
+			n++
+		}
+	}
+	return n
+}
+
+func printJSON(res result) {
+	data, _ := json.Marshal(res)
+	fmt.Println(string(data))
+}
+
 func printErr(err error) {
 	fmt.Fprintln(os.Stderr, err.Error())
 }
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// manifestEntry is one line of a SHA256SUMS-style manifest.
+type manifestEntry struct {
+	sum  string // lowercase hex SHA-256
+	path string // relative to the manifest's directory, with "/" separators
+}
+
+// fileSHA256 returns the hex SHA-256 of the file at name.
+func fileSHA256(name string) (string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", wrapPathErr(err, name)
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", wrapPathErr(err, name)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeManifest writes the SHA-256 of every file in outputs to the
+// manifest at name, in the format sha256sum prints, so "sha256sum -c" run
+// in the manifest's directory checks it as well as verify --manifest
+// does. Paths are relative to that directory. An existing manifest is
+// replaced.
+func writeManifest(name string, outputs []string, opts options) error {
+	dir, err := filepath.Abs(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	if opts.dryRun {
+		opts.infof("Would write manifest '%s' (%d files)\n", name, len(outputs))
+		return nil
+	}
+	var buf bytes.Buffer
+	for _, out := range outputs {
+		abs, err := filepath.Abs(out)
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, abs)
+		if err != nil {
+			rel = abs
+		}
+		if strings.ContainsAny(rel, "\n\r") {
+			return newError(ErrUsage, "'%s' cannot be listed in a manifest: its name contains a line break", out)
+		}
+		sum, err := fileSHA256(out)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, filepath.ToSlash(rel))
+	}
+	if err := writeFileStream(name, 0o666, true, opts.sync, writeAll(buf.Bytes())); err != nil {
+		return wrapPathErr(err, name)
+	}
+	opts.infof("Wrote manifest '%s' (%d files)\n", name, len(outputs))
+	return nil
+}
+
+// parseManifest reads SHA256SUMS lines: a hex digest, a space, then " "
+// or "*" (sha256sum's text and binary markers) and the path. Blank lines
+// and # comments are skipped.
+func parseManifest(r io.Reader) ([]manifestEntry, error) {
+	var entries []manifestEntry
+	sc := bufio.NewScanner(r)
+	for lineNo := 1; sc.Scan(); lineNo++ {
+		line := strings.TrimSuffix(sc.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		sum, rest, ok := strings.Cut(line, " ")
+		if ok && (strings.HasPrefix(rest, " ") || strings.HasPrefix(rest, "*")) {
+			rest = rest[1:]
+		}
+		if _, err := parseSHA256(sum); err != nil || !ok || rest == "" {
+			return nil, fmt.Errorf("line %d: want \"<sha256>  <path>\"", lineNo)
+		}
+		entries = append(entries, manifestEntry{strings.ToLower(sum), rest})
+	}
+	return entries, sc.Err()
+}
+
+// verifyManifest checks every file listed in the manifest at name, relative
+// to its directory, against its recorded SHA-256, printing each one that
+// changed or is missing. A changed file fails with ErrCorrupt; if files
+// are only missing, with ErrNotFound.
+func verifyManifest(name string, opts options) (result, error) {
+	res := result{Command: "verify", Input: name}
+	f, err := os.Open(name)
+	if err != nil {
+		return res, wrapPathErr(err, name)
+	}
+	entries, err := parseManifest(f)
+	f.Close()
+	if err != nil {
+		return res, newError(ErrUsage, "%s: %v", name, err)
+	}
+	res.Files = len(entries)
+	dir := filepath.Dir(name)
+	changed, missing := 0, 0
+	for _, e := range entries {
+		path := filepath.FromSlash(e.path)
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(dir, path)
+		}
+		sum, err := fileSHA256(path)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			missing++
+			opts.infof("%s: MISSING\n", e.path)
+		case err != nil:
+			return res, err
+		case sum != e.sum:
+			changed++
+			opts.infof("%s: FAILED\n", e.path)
+		default:
+			opts.logger().Debug("verified", "path", path, "sha256", sum)
+		}
+	}
+	switch {
+	case changed > 0:
+		return res, newError(ErrCorrupt, "%s: %d of %d files changed, %d missing", name, changed, len(entries), missing)
+	case missing > 0:
+		return res, newError(ErrNotFound, "%s: %d of %d files missing", name, missing, len(entries))
+	}
+	res.Action = "verified"
+	opts.infof("%d files OK\n", len(entries))
+	return res, nil
+}
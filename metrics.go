@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// durationBuckets are the upper bounds, in seconds, of the request
+// duration histogram: Prometheus's usual defaults.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// metrics counts what "backlang serve" has done, for GET /metrics in the
+// Prometheus text format. It is written by hand, like the gRPC encoding,
+// so the server keeps no dependencies.
+type metrics struct {
+	mu     sync.Mutex
+	series map[metricKey]*metricSeries
+}
+
+// metricKey is the labels every series carries.
+type metricKey struct {
+	operation string // encode, decode, verify, encode_stream, ... or other
+	transport string // http or grpc
+}
+
+type metricSeries struct {
+	requests  int64
+	bytesIn   int64
+	bytesOut  int64
+	errors    map[string]int64 // by HTTP status, or gRPC status for grpc
+	durations []int64          // count per durationBuckets, then one for +Inf
+	seconds   float64
+}
+
+func newMetrics() *metrics {
+	return &metrics{series: map[metricKey]*metricSeries{}}
+}
+
+// instrument wraps h, counting every request it answers.
+func (m *metrics) instrument(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+
+		key := metricKey{operation(r), "http"}
+		code, failed := strconv.Itoa(sw.status), sw.status >= 400
+		if isGRPC(r) {
+			// gRPC answers 200 and puts the outcome in a trailer.
+			key.transport = "grpc"
+			code = sw.Header().Get("Grpc-Status")
+			failed = code != strconv.Itoa(grpcOK)
+		}
+		m.record(key, body.n, sw.bytes, time.Since(start), failed, code)
+	})
+}
+
+func (m *metrics) record(key metricKey, in, out int64, d time.Duration, failed bool, code string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.series[key]
+	if s == nil {
+		s = &metricSeries{errors: map[string]int64{}, durations: make([]int64, len(durationBuckets)+1)}
+		m.series[key] = s
+	}
+	s.requests++
+	s.bytesIn += in
+	s.bytesOut += out
+	if failed {
+		s.errors[code]++
+	}
+	secs := d.Seconds()
+	s.seconds += secs
+	i, _ := slices.BinarySearch(durationBuckets, secs)
+	s.durations[i]++
+}
+
+// operation names what r asks for, from a fixed set so a caller can't
+// create new series by inventing paths.
+func operation(r *http.Request) string {
+	if isGRPC(r) {
+		switch method, _ := strings.CutPrefix(r.URL.Path, grpcService); method {
+		case "Encode", "Decode", "Verify":
+			return strings.ToLower(method)
+		case "EncodeStream", "DecodeStream":
+			return strings.ToLower(strings.TrimSuffix(method, "Stream")) + "_stream"
+		}
+		return "other"
+	}
+	switch r.URL.Path {
+	case "/v1/encode", "/v1/decode", "/v1/verify":
+		return strings.TrimPrefix(r.URL.Path, "/v1/")
+	case "/metrics":
+		return "metrics"
+	}
+	return "other"
+}
+
+// ServeHTTP writes every series in the Prometheus text exposition format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	keys := slices.SortedFunc(maps.Keys(m.series), func(a, b metricKey) int {
+		return strings.Compare(a.operation+" "+a.transport, b.operation+" "+b.transport)
+	})
+	family := func(name, typ, help string, each func(key metricKey, labels string, s *metricSeries)) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		for _, k := range keys {
+			each(k, fmt.Sprintf("operation=%q,transport=%q", k.operation, k.transport), m.series[k])
+		}
+	}
+	family("backlang_requests_total", "counter", "Requests answered.", func(_ metricKey, l string, s *metricSeries) {
+		fmt.Fprintf(w, "backlang_requests_total{%s} %d\n", l, s.requests)
+	})
+	family("backlang_request_errors_total", "counter", "Requests that failed, by HTTP status (gRPC status for grpc).", func(_ metricKey, l string, s *metricSeries) {
+		for _, code := range slices.Sorted(maps.Keys(s.errors)) {
+			fmt.Fprintf(w, "backlang_request_errors_total{%s,code=%q} %d\n", l, code, s.errors[code])
+		}
+	})
+	family("backlang_received_bytes_total", "counter", "Request body bytes read.", func(_ metricKey, l string, s *metricSeries) {
+		fmt.Fprintf(w, "backlang_received_bytes_total{%s} %d\n", l, s.bytesIn)
+	})
+	family("backlang_sent_bytes_total", "counter", "Response body bytes written.", func(_ metricKey, l string, s *metricSeries) {
+		fmt.Fprintf(w, "backlang_sent_bytes_total{%s} %d\n", l, s.bytesOut)
+	})
+	family("backlang_request_duration_seconds", "histogram", "Time to answer a request.", func(_ metricKey, l string, s *metricSeries) {
+		var n int64
+		for i, le := range durationBuckets {
+			n += s.durations[i]
+			fmt.Fprintf(w, "backlang_request_duration_seconds_bucket{%s,le=%q} %d\n", l, strconv.FormatFloat(le, 'g', -1, 64), n)
+		}
+		fmt.Fprintf(w, "backlang_request_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", l, s.requests)
+		fmt.Fprintf(w, "backlang_request_duration_seconds_sum{%s} %g\n", l, s.seconds)
+		fmt.Fprintf(w, "backlang_request_duration_seconds_count{%s} %d\n", l, s.requests)
+	})
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+)
+
+// migrate rewrites a .bck in an older format as the current one. The only
+// older format is format 1, headerless line mode, which becomes the same
+// body behind a header, so --strict and other tools can recognize it.
+// Files already current, as everything encode writes is, are left alone.
+// Armored files stay armored, and the result must decode to exactly what
+// the original did before it replaces it. decode reads both formats, so
+// migrating is never required.
+func migrate(inPath string, opts options) (result, error) {
+	res := result{Command: "migrate", Input: inPath, Output: inPath, DryRun: opts.dryRun}
+	fi, err := os.Stat(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	armor := isArmored(data)
+	inner := data
+	if armor {
+		if inner, err = dearmor(data); err != nil {
+			return res, err
+		}
+	}
+	f, body, err := parseHeader(inner)
+	if err != nil {
+		return res, err
+	}
+	res.Format = f.version
+	name := filepath.Base(inPath)
+	if f.version >= formatVersion {
+		res.Action = "current"
+		opts.infof("'%s' is already format %d\n", name, f.version)
+		return res, nil
+	}
+
+	out := append([]byte(format{mode: modeLines}.header()), body...)
+	before, _, err := decodeData(inner)
+	if err != nil {
+		return res, err
+	}
+	if after, _, err := decodeData(out); err != nil || !bytes.Equal(before, after) {
+		return res, newError(ErrCorrupt, "'%s' would not decode the same in format %d; leaving it alone", name, formatVersion)
+	}
+	res.Action, res.Format = "migrated", formatVersion
+	if opts.dryRun {
+		opts.infof("Would migrate '%s' from format %d to %d\n", name, f.version, formatVersion)
+		return res, nil
+	}
+	fill := writeAll(out)
+	if armor {
+		fill = armored(fill)
+	}
+	if err := writeFileStream(inPath, fi.Mode().Perm(), true, opts.sync, fill); err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	opts.infof("Migrated '%s' from format %d to %d\n", name, f.version, formatVersion)
+	return res, nil
+}
@@ -0,0 +1,37 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// mmapMin is the size from which mapFile maps a file instead of reading
+// it; below it a plain read is cheaper than setting up the mapping.
+const mmapMin = 1 << 20
+
+// mapFile returns the contents of name, mapped read-only into memory when
+// it is a large regular file, and a function that releases them. The data
+// must not be used after release.
+func mapFile(name string) ([]byte, func(), error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	size := fi.Size()
+	if fi.Mode().IsRegular() && size >= mmapMin && size == int64(int(size)) {
+		data, err := syscall.Mmap(int(f.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+		if err == nil {
+			return data, func() { syscall.Munmap(data) }, nil
+		}
+		// Some file systems cannot be mapped; read those instead.
+	}
+	data, err := os.ReadFile(name)
+	return data, func() {}, err
+}
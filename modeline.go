@@ -0,0 +1,108 @@
+package main
+
+import "strings"
+
+// modelineLines is how many lines at each end of a file vim searches for a
+// modeline (its 'modelines' default).
+const modelineLines = 5
+
+// modelineType returns the file type a vim or emacs modeline in content
+// names, lower-cased, or "" if there is none. Vim's are looked for where vim
+// looks, in the first and last five lines:
+//
+//	# vim: ft=python
+//	// vim: set filetype=javascript :
+//
+// and emacs's in its first line (its second after a shebang), or in a
+// Local Variables block at the end:
+//
+//	# -*- mode: ruby; coding: utf-8 -*-
+//	;; -*- lua -*-
+//	# Local Variables:
+//	# mode: perl
+//	# End:
+func modelineType(content []byte) string {
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	for i := range min(2, len(lines)) {
+		if i == 1 && !strings.HasPrefix(lines[0], "#!") {
+			break
+		}
+		if ft := emacsMode(lines[i]); ft != "" {
+			return ft
+		}
+	}
+	for i, line := range lines {
+		if i >= modelineLines && i < len(lines)-modelineLines {
+			continue
+		}
+		if ft := vimFiletype(line); ft != "" {
+			return ft
+		}
+	}
+	if i := strings.LastIndex(string(content), "Local Variables:"); i >= 0 {
+		for _, line := range strings.Split(string(content[i:]), "\n")[1:] {
+			// Each line carries the comment leader the first one did.
+			line = strings.TrimLeft(line, "#;/*-% \t")
+			if strings.HasPrefix(line, "End:") {
+				break
+			}
+			if value, ok := strings.CutPrefix(line, "mode:"); ok && strings.TrimSpace(value) != "" {
+				return emacsModeName(strings.Fields(value)[0])
+			}
+		}
+	}
+	return ""
+}
+
+// vimFiletype returns the ft or filetype a vim modeline on line sets. The
+// marker, vi:, vim: or ex:, must follow white space, as vim requires (vim:
+// may also start the line).
+func vimFiletype(line string) string {
+	for _, marker := range []string{"vim:", "vi:", "ex:"} {
+		i := strings.Index(line, marker)
+		if i < 0 || i > 0 && line[i-1] != ' ' && line[i-1] != '\t' || i == 0 && marker != "vim:" {
+			continue
+		}
+		opts := strings.TrimSpace(line[i+len(marker):])
+		if rest, ok := strings.CutPrefix(opts, "set "); ok {
+			opts, _, _ = strings.Cut(rest, ":") // "set" form: options end at the next colon
+		} else if rest, ok := strings.CutPrefix(opts, "se "); ok {
+			opts, _, _ = strings.Cut(rest, ":")
+		}
+		for _, opt := range strings.FieldsFunc(opts, func(r rune) bool { return r == ' ' || r == '\t' || r == ':' }) {
+			key, value, _ := strings.Cut(opt, "=")
+			if key == "ft" || key == "filetype" {
+				return strings.ToLower(value)
+			}
+		}
+	}
+	return ""
+}
+
+// emacsMode returns the major mode an emacs -*- ... -*- line names: the
+// value of its mode variable, or the whole of it when it holds no
+// variables at all.
+func emacsMode(line string) string {
+	_, rest, ok := strings.Cut(line, "-*-")
+	vars, _, closed := strings.Cut(rest, "-*-")
+	if !ok || !closed {
+		return ""
+	}
+	if !strings.Contains(vars, ":") {
+		return emacsModeName(vars)
+	}
+	for _, v := range strings.Split(vars, ";") {
+		key, value, _ := strings.Cut(v, ":")
+		if strings.EqualFold(strings.TrimSpace(key), "mode") {
+			return emacsModeName(value)
+		}
+	}
+	return ""
+}
+
+// emacsModeName turns "python-mode" or "Python-ts" into "python".
+func emacsModeName(s string) string {
+	s = strings.ToLower(strings.TrimSpace(s))
+	s = strings.TrimSuffix(s, "-mode")
+	return strings.TrimSuffix(s, "-ts")
+}
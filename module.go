@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+)
+
+// runModule is run --module: it decodes a Python package, or the package
+// around a .bck module, into a temporary directory and runs it with
+// "python -m", so the package's relative imports resolve as they would
+// in place. The module name comes from where the input sits: a directory
+// is a package to run (through its __main__.py), and a file is a module of
+// every enclosing directory that has an __init__.py (or .bck of one).
+// Plain files in the package are copied as they are.
+func runModule(inPath string, opts options) (result, error) {
+	ctx := context.Background()
+	res := result{Command: "run", Input: inPath, DryRun: opts.dryRun}
+	top, module, err := moduleOf(inPath)
+	if err != nil {
+		return res, err
+	}
+	languages, err := loadLanguages()
+	if err != nil {
+		return res, err
+	}
+	i := slices.IndexFunc(languages, func(l Language) bool { return l.Name == "Python" })
+	if i < 0 {
+		return res, newError(ErrNoInterpreter, "no Python language is defined to run '%s' with", module)
+	}
+	lang := languages[i]
+	if _, overridden := interpreterOverride(lang.Name); !overridden && !opts.noVenv {
+		if py := findVenvPython(filepath.Dir(top)); py != "" {
+			opts.logger().Debug("using virtualenv interpreter", "interpreter", py)
+			lang.Command = py
+		}
+	}
+	l, _, err := resolveCommand(&lang, runtime.GOOS, exec.LookPath)
+	if err != nil {
+		return res, err
+	}
+	lang = *l
+	var as *runAs
+	if opts.user != "" {
+		if as, err = lookupRunAs(opts.user); err != nil {
+			return res, err
+		}
+	}
+	args := slices.Concat(lang.Args, opts.interpArgs, []string{"-m", module}, opts.scriptArgs)
+	res.Action = "ran"
+
+	if opts.dryRun {
+		opts.infof("Would decode '%s' to a temporary directory\n", filepath.Base(top))
+		opts.infof("Would run %s %s\n", lang.Command, strings.Join(args, " "))
+		if opts.sandbox {
+			opts.infof("Would run inside the sandbox (%s)\n", describeSandbox(opts))
+		}
+		if opts.maxMem > 0 || opts.maxCPU > 0 {
+			opts.infof("Would limit the program to %s\n", describeLimits(opts))
+		}
+		if as != nil {
+			opts.infof("Would run the program as %s\n", as)
+		}
+		if opts.stdoutFile != "" || opts.stderrFile != "" {
+			opts.infof("Would write the program's %s\n", describeCapture(opts))
+		}
+		return res, nil
+	}
+
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
+	env, err := programEnv(opts)
+	if err != nil {
+		return res, err
+	}
+	tmpDir, err := os.MkdirTemp("", "backlang-run-*")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(tmpDir)
+	n, err := decodeTree(top, tmpDir, opts)
+	if err != nil {
+		return res, err
+	}
+	opts.logger().Debug("decoded module", "module", module, "files", n, "dir", tmpDir)
+	if as != nil {
+		if err := as.handOver(tmpDir); err != nil {
+			return res, wrapPathErr(err, tmpDir)
+		}
+		env = append(as.env(), env...)
+	}
+
+	// The decoded tree goes first on the import path. The program keeps our
+	// working directory, but not on the path, where python -m would put it
+	// (from 3.11): the still-encoded package is usually right there.
+	pythonPath := tmpDir
+	if v := os.Getenv("PYTHONPATH"); v != "" && !opts.cleanEnv && !opts.sandbox {
+		pythonPath += string(os.PathListSeparator) + v
+	}
+	env = append(env, "PYTHONPATH="+pythonPath, "PYTHONSAFEPATH=1")
+	x := &execution{ctx: ctx, opts: opts, workdir: tmpDir, env: env, as: as}
+	closeOutput, err := x.captureOutput()
+	defer closeOutput()
+	if err != nil {
+		return res, err
+	}
+	opts.infof("Running %s -m %s...\n", lang.Command, module)
+	if err := x.runCommand(lang.Command, args, os.Stdin, x.stdout, x.stderr); err != nil {
+		return x.done(res, programError(err, module, "Failed to execute with %s", lang.Command))
+	}
+	return x.done(res, nil)
+}
+
+// moduleOf returns what run --module decodes for inPath, the outermost
+// package containing it (or the file itself, outside any package), and
+// the dotted name python -m runs it by.
+func moduleOf(inPath string) (top, module string, err error) {
+	abs, err := filepath.Abs(inPath)
+	if err != nil {
+		return "", "", err
+	}
+	fi, err := os.Stat(abs)
+	if err != nil {
+		return "", "", wrapPathErr(err, inPath)
+	}
+	name := filepath.Base(abs)
+	if fi.IsDir() {
+		if !fileExists(filepath.Join(abs, "__main__.py")) && !fileExists(filepath.Join(abs, "__main__.py.bck")) {
+			return "", "", newError(ErrNotFound, "'%s' has no __main__.py (or .bck of one) for python -m to run", name)
+		}
+	} else {
+		stem, ok := strings.CutSuffix(stripLastBck(name), ".py")
+		if !ok || stem == "" {
+			return "", "", newError(ErrUsage, "run --module takes a package directory or a Python module (.py or .py.bck), not '%s'", name)
+		}
+		name = stem
+	}
+	parts, top := []string{name}, abs
+	for dir := filepath.Dir(abs); isPackageDir(dir) && filepath.Dir(dir) != dir; dir = filepath.Dir(dir) {
+		parts = append([]string{filepath.Base(dir)}, parts...)
+		top = dir
+	}
+	return top, strings.Join(parts, "."), nil
+}
+
+func isPackageDir(dir string) bool {
+	return fileExists(filepath.Join(dir, "__init__.py")) || fileExists(filepath.Join(dir, "__init__.py.bck"))
+}
+
+// decodeTree writes the file or directory at src into dir under its own
+// name, decoding each .bck (and dropping the suffix) and copying anything
+// else. Hidden files and __pycache__ directories are left out. It returns
+// how many files it wrote.
+func decodeTree(src, dir string, opts options) (int, error) {
+	n := 0
+	root := filepath.Dir(src)
+	err := filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != src && (strings.HasPrefix(d.Name(), ".") || d.Name() == "__pycache__") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(dir, rel)
+		if d.IsDir() {
+			return os.MkdirAll(dest, 0o700)
+		}
+		fi, err := os.Stat(path) // through symlinks
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		fill := func(w io.Writer) error { return copyFileTo(w, path) }
+		if strings.HasSuffix(strings.ToLower(path), ".bck") {
+			dest = stripLastBck(dest)
+			fill = func(w io.Writer) error {
+				_, err := cat(path, w, opts)
+				return err
+			}
+		}
+		n++
+		return writeFileStream(dest, fi.Mode().Perm(), false, false, fill)
+	})
+	if err != nil {
+		return n, wrapPathErr(err, src)
+	}
+	return n, nil
+}
@@ -0,0 +1,488 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Object storage support: s3://bucket/key and gs://bucket/key inputs for
+// encode, decode and cat, with results written back next to the input
+// object. Both speak the S3 REST API (Google Cloud Storage through its XML
+// API with HMAC keys), signed with AWS Signature Version 4 by hand so
+// backlang keeps no dependencies. Credentials come from the environment:
+//
+//	s3://  AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN,
+//	       AWS_REGION (or AWS_DEFAULT_REGION; default us-east-1), and
+//	       AWS_ENDPOINT_URL for S3-compatible stores such as MinIO
+//	gs://  GS_ACCESS_KEY_ID, GS_SECRET_ACCESS_KEY (HMAC keys), and
+//	       GS_ENDPOINT_URL
+//
+// Without keys, requests are sent unsigned, which is enough to read
+// public buckets.
+
+// objectURL is a parsed s3://bucket/key or gs://bucket/key. A key that is
+// empty or ends in "/" is a prefix, for -r.
+type objectURL struct {
+	scheme, bucket, key string
+}
+
+func (u objectURL) String() string { return u.scheme + "://" + u.bucket + "/" + u.key }
+
+func (u objectURL) isPrefix() bool { return u.key == "" || strings.HasSuffix(u.key, "/") }
+
+// parseObjectURL splits s if it is an s3:// or gs:// URL.
+func parseObjectURL(s string) (objectURL, bool) {
+	for _, scheme := range []string{"s3", "gs"} {
+		if rest, ok := strings.CutPrefix(s, scheme+"://"); ok {
+			bucket, key, _ := strings.Cut(rest, "/")
+			return objectURL{scheme, bucket, key}, bucket != ""
+		}
+	}
+	return objectURL{}, false
+}
+
+func isObjectURL(s string) bool {
+	_, ok := parseObjectURL(s)
+	return ok
+}
+
+// objectStore is a client for one scheme's service.
+type objectStore struct {
+	endpoint    *url.URL // with pathStyle, requests go to endpoint/bucket/key
+	pathStyle   bool     // otherwise to bucket.endpoint-host/key
+	region      string
+	accessKey   string
+	secretKey   string
+	token       string
+	client      *http.Client
+	credentials string // the variables to set, for error messages
+}
+
+// storeFor returns the client for u's scheme, configured from the
+// environment.
+func storeFor(u objectURL) (*objectStore, error) {
+	s := &objectStore{client: &http.Client{Timeout: 10 * time.Minute}}
+	endpoint := ""
+	if u.scheme == "gs" {
+		s.region, s.credentials = "auto", "GS_ACCESS_KEY_ID and GS_SECRET_ACCESS_KEY"
+		s.accessKey, s.secretKey = os.Getenv("GS_ACCESS_KEY_ID"), os.Getenv("GS_SECRET_ACCESS_KEY")
+		endpoint, s.pathStyle = firstNonEmpty(os.Getenv("GS_ENDPOINT_URL"), "https://storage.googleapis.com"), true
+	} else {
+		s.region = firstNonEmpty(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+		s.credentials = "AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY"
+		s.accessKey, s.secretKey, s.token = os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN")
+		endpoint = os.Getenv("AWS_ENDPOINT_URL")
+		s.pathStyle = endpoint != "" || strings.Contains(u.bucket, ".")
+		if endpoint == "" {
+			endpoint = "https://s3." + s.region + ".amazonaws.com"
+		}
+	}
+	var err error
+	if s.endpoint, err = url.Parse(endpoint); err != nil || s.endpoint.Host == "" {
+		return nil, newError(ErrUsage, "invalid endpoint URL %q for %s://", endpoint, u.scheme)
+	}
+	return s, nil
+}
+
+// firstNonEmpty returns the first of vals that isn't empty.
+func firstNonEmpty(vals ...string) string {
+	for _, v := range vals {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// request builds a signed request for u with query and a body whose
+// SHA-256 is payloadHash.
+func (s *objectStore) request(method string, u objectURL, query url.Values, body io.Reader, size int64, payloadHash string) (*http.Request, error) {
+	target := *s.endpoint
+	if s.pathStyle {
+		target.Path = strings.TrimSuffix(target.Path, "/") + "/" + u.bucket
+		if u.key != "" {
+			target.Path += "/" + u.key
+		}
+	} else {
+		target.Host = u.bucket + "." + target.Host
+		target.Path = "/" + u.key
+	}
+	target.RawPath = awsEscape(target.Path, true)
+	target.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequest(method, target.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if s.accessKey != "" {
+		signV4(req, payloadHash, s.region, s.accessKey, s.secretKey, s.token, time.Now())
+	}
+	return req, nil
+}
+
+// check turns a failed response into an error for u.
+func (s *objectStore) check(resp *http.Response, u objectURL) error {
+	if resp.StatusCode/100 == 2 {
+		return nil
+	}
+	var body struct{ Code, Message string }
+	xml.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+	msg := firstNonEmpty(body.Message, body.Code, resp.Status)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return newError(ErrNotFound, "%s: %s", u, msg)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		if s.accessKey == "" {
+			msg += " (set " + s.credentials + ")"
+		}
+		return newError(ErrPermission, "%s: %s", u, msg)
+	}
+	return newError(ErrNetwork, "%s: %s", u, msg)
+}
+
+// send performs req, reporting transport failures as ErrNetwork.
+func (s *objectStore) send(req *http.Request, u objectURL) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, newError(ErrNetwork, "%s: %v", u, err)
+	}
+	if err := s.check(resp, u); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// download copies object u to the file name.
+func (s *objectStore) download(u objectURL, name string) error {
+	req, err := s.request(http.MethodGet, u, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return err
+	}
+	resp, err := s.send(req, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return wrapPathErr(err, name)
+	}
+	_, err = io.Copy(f, resp.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return newError(ErrNetwork, "%s: %v", u, err)
+	}
+	return nil
+}
+
+// upload writes the file name to object u, replacing any object there.
+func (s *objectStore) upload(u objectURL, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return wrapPathErr(err, name)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return wrapPathErr(err, name)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return wrapPathErr(err, name)
+	}
+	req, err := s.request(http.MethodPut, u, nil, f, size, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	resp, err := s.send(req, u)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// exists reports whether object u exists.
+func (s *objectStore) exists(u objectURL) (bool, error) {
+	req, err := s.request(http.MethodHead, u, nil, nil, 0, emptySHA256)
+	if err != nil {
+		return false, err
+	}
+	resp, err := s.send(req, u)
+	if errors.Is(err, ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	return true, nil
+}
+
+// list returns the keys of every object under prefix u, in order.
+func (s *objectStore) list(u objectURL) ([]string, error) {
+	var keys []string
+	bucket := objectURL{u.scheme, u.bucket, ""}
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {u.key}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := s.request(http.MethodGet, bucket, q, nil, 0, emptySHA256)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := s.send(req, u)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []struct{ Key string }
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, newError(ErrNetwork, "%s: listing: %v", u, err)
+		}
+		for _, c := range page.Contents {
+			keys = append(keys, c.Key)
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			break
+		}
+		token = page.NextContinuationToken
+	}
+	slices.Sort(keys)
+	return keys, nil
+}
+
+// listObjects expands prefix u into the objects cmd applies to, as
+// collectInputs does for a directory.
+func listObjects(cmd string, u objectURL) ([]string, error) {
+	s, err := storeFor(u)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := s.list(u)
+	if err != nil {
+		return nil, err
+	}
+	var objects []string
+	for _, key := range keys {
+		rel := strings.TrimPrefix(key, u.key)
+		isBck := strings.HasSuffix(strings.ToLower(key), ".bck")
+		hidden := strings.HasPrefix(rel, ".") || strings.Contains(rel, "/.")
+		if strings.HasSuffix(key, "/") || hidden || isBck == (cmd == "encode") {
+			continue
+		}
+		objects = append(objects, objectURL{u.scheme, u.bucket, key}.String())
+	}
+	return objects, nil
+}
+
+// transformObject is encode, decode or cat for the object at rawURL. It is
+// downloaded to a private temporary directory and transformed there, and
+// the result uploaded next to it under the name a local file would get,
+// subject to the conflict policy.
+func transformObject(cmd, rawURL string, opts options) (result, error) {
+	res := result{Command: cmd, Input: rawURL, DryRun: opts.dryRun}
+	u, _ := parseObjectURL(rawURL)
+	if u.isPrefix() {
+		return res, newError(ErrUsage, "'%s' is a prefix; pass -r to %s the objects under it", rawURL, cmd)
+	}
+	s, err := storeFor(u)
+	if err != nil {
+		return res, err
+	}
+	dir, err := os.MkdirTemp("", "backlang-object-*")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+	inPath := filepath.Join(dir, path.Base(u.key))
+	if err := s.download(u, inPath); err != nil {
+		return res, err
+	}
+	opts.logger().Debug("downloaded object", "url", rawURL, "path", inPath)
+	if cmd == "cat" {
+		res, err = cat(inPath, os.Stdout, opts)
+		res.Input = rawURL
+		return res, err
+	}
+
+	o := opts
+	o.quiet, o.dryRun, o.out, o.onConflict = true, false, nil, conflictOverwrite
+	var tr result
+	if cmd == "encode" {
+		tr, err = encode(inPath, o)
+	} else if err = checkDecodable(inPath, o); err == nil {
+		tr, err = decode(inPath, o)
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Action, res.Mode, res.Format, res.Layers, res.Name = tr.Action, tr.Mode, tr.Format, tr.Layers, tr.Name
+
+	dest := objectURL{u.scheme, u.bucket, path.Join(path.Dir(u.key), filepath.Base(tr.Output))}
+	if path.Dir(u.key) == "." {
+		dest.key = filepath.Base(tr.Output)
+	}
+	dest, skip, err := resolveObjectConflict(s, dest, opts)
+	res.Output = dest.String()
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	verb := strings.ToUpper(cmd[:1]) + cmd[1:] + "d"
+	if opts.dryRun {
+		opts.infof("Would write %s (%s %s)\n", dest, strings.ToLower(verb), rawURL)
+		return res, nil
+	}
+	if err := s.upload(dest, tr.Output); err != nil {
+		return res, err
+	}
+	opts.infof("%s %s → %s\n", verb, rawURL, dest)
+	return res, nil
+}
+
+// resolveObjectConflict is resolveConflict for an object.
+func resolveObjectConflict(s *objectStore, u objectURL, opts options) (objectURL, bool, error) {
+	exists, err := s.exists(u)
+	if err != nil || !exists {
+		return u, false, err
+	}
+	switch opts.onConflict {
+	case conflictOverwrite:
+		if opts.dryRun {
+			opts.infof("Would overwrite existing %s\n", u)
+		}
+		return u, false, nil
+	case conflictSkip:
+		if opts.dryRun {
+			opts.infof("Would skip %s (already exists)\n", u)
+		} else {
+			opts.infof("Skipped %s (already exists)\n", u)
+		}
+		return u, true, nil
+	case conflictFail:
+		return u, false, newError(ErrConflict, "%s already exists", u)
+	case conflictPrompt:
+		if opts.dryRun {
+			opts.infof("%s exists, would ask before overwriting\n", u)
+			return u, false, nil
+		}
+		if overwrite, err := promptOverwrite(u.String()); err != nil || overwrite {
+			return u, false, err
+		}
+	}
+	// Rename, or a "no" to the prompt: the first free numbered key.
+	ext := path.Ext(u.key)
+	base := strings.TrimSuffix(u.key, ext)
+	for i := 1; ; i++ {
+		next := objectURL{u.scheme, u.bucket, fmt.Sprintf("%s_%d%s", base, i, ext)}
+		if exists, err := s.exists(next); err != nil || !exists {
+			if opts.dryRun {
+				opts.infof("%s exists, would write %s instead\n", u, next)
+			}
+			return next, false, err
+		}
+	}
+}
+
+// emptySHA256 is the SHA-256 of an empty body.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signV4 signs req for service s3 with AWS Signature Version 4, covering
+// the host and every header already set.
+func signV4(req *http.Request, payloadHash, region, accessKey, secretKey, token string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if token != "" {
+		req.Header.Set("X-Amz-Security-Token", token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, vals := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(vals, ","))
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonical strings.Builder
+	fmt.Fprintf(&canonical, "%s\n%s\n%s\n", req.Method, req.URL.EscapedPath(), req.URL.RawQuery)
+	for _, name := range names {
+		fmt.Fprintf(&canonical, "%s:%s\n", name, headers[name])
+	}
+	signed := strings.Join(names, ";")
+	fmt.Fprintf(&canonical, "\n%s\n%s", signed, payloadHash)
+
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical.String()))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{day, region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, toSign))))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// awsEscape percent-encodes s the way Signature Version 4 expects:
+// everything but unreserved characters (and "/" in a path).
+func awsEscape(s string, isPath bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~', c == '/' && isPath:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// canonicalQuery encodes q sorted by key, as both the request and its
+// signature need it.
+func canonicalQuery(q url.Values) string {
+	var parts []string
+	for _, k := range slices.Sorted(maps.Keys(q)) {
+		for _, v := range q[k] {
+			parts = append(parts, awsEscape(k, false)+"="+awsEscape(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"path/filepath"
+)
+
+// peekLen is how much of each end of a .bck peekLanguage reads.
+const peekLen = 8 << 10
+
+// peekLanguage detects the language of the program in the .bck at inPath
+// without decoding the file: from the first and last few lines of the
+// original, which every mode but blocks keeps within reach of the file's
+// ends (line mode puts the shebang last), and from the name the header
+// records, or failing that the .bck's own less .bck. Armored, compressed
+// and encrypted files give only their name.
+func peekLanguage(inPath string, opts options) (*Language, error) {
+	file, size, err := openSized(inPath)
+	if err != nil {
+		return nil, wrapPathErr(err, inPath)
+	}
+	defer file.Close()
+	head := make([]byte, min(size, peekLen))
+	if _, err := file.ReadAt(head, 0); err != nil && err != io.EOF {
+		return nil, wrapPathErr(err, inPath)
+	}
+
+	name := stripLastBck(inPath)
+	var excerpt []byte
+	if !isArmored(head) {
+		f, body, err := parseHeader(head)
+		if err != nil {
+			return nil, err
+		}
+		if f.name != "" {
+			name = filepath.Join(filepath.Dir(inPath), f.name)
+		}
+		if f.compress == "" && f.encrypt == "" {
+			tail := body
+			if size > peekLen {
+				start := max(int64(len(head)-len(body)), size-peekLen)
+				tail = make([]byte, size-start)
+				if _, err := file.ReadAt(tail, start); err != nil && err != io.EOF {
+					return nil, wrapPathErr(err, inPath)
+				}
+			}
+			excerpt = originalEnds(f, body, tail, size <= peekLen)
+		}
+	}
+	return detectLanguage(name, excerpt, opts)
+}
+
+// originalEnds returns the first and last lines of what an f-encoded body
+// decodes to (modelineLines of each), given its start, head, and its end,
+// tail. When whole, head is all of it and simply decodes.
+func originalEnds(f format, head, tail []byte, whole bool) []byte {
+	decode := modes[f.mode].decode
+	if f.graphemes {
+		decode = infallible(reverseGraphemes)
+	}
+	if whole {
+		out, _ := decode(head)
+		return out
+	}
+	var first, last []byte
+	switch f.mode {
+	case modeLines:
+		// The original's first lines are the body's last, and vice versa.
+		first = decodeBytes(lastLines(tail, modelineLines))
+		last = decodeBytes(firstLines(head, modelineLines))
+	case modeChars, modeWords:
+		first, _ = decode(firstLines(head, modelineLines))
+		last, _ = decode(lastLines(tail, modelineLines))
+	case modeBytes:
+		first, last = reversedCopy(tail), reversedCopy(head)
+	default:
+		return nil // a blocks-mode file's ends hold the middle of the original
+	}
+	if len(first) > 0 && first[len(first)-1] != '\n' {
+		first = append(first, '\n')
+	}
+	return append(first, last...)
+}
+
+// firstLines returns the first n whole lines of a chunk read from the
+// start of something longer.
+func firstLines(chunk []byte, n int) []byte {
+	lines := splitLinesPreserveEndings(chunk)
+	if k := len(lines); k > 0 && lines[k-1][len(lines[k-1])-1] != '\n' {
+		lines = lines[:k-1] // cut off by the end of the chunk
+	}
+	return join(lines[:min(n, len(lines))])
+}
+
+// lastLines returns the last n whole lines of a chunk read from the end of
+// something longer.
+func lastLines(chunk []byte, n int) []byte {
+	lines := splitLinesPreserveEndings(chunk)
+	if len(lines) > 0 {
+		lines = lines[1:] // probably cut off by the start of the chunk
+	}
+	return join(lines[max(0, len(lines)-n):])
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// pipeTo is decode or run with --exec: the decoded content is streamed
+// into command's stdin instead of being written anywhere, and the
+// command's exit status becomes ours.
+func pipeTo(inPath, cmdName string, opts options) (result, error) {
+	res := result{Command: cmdName, Input: inPath, DryRun: opts.dryRun}
+	if !strings.HasSuffix(strings.ToLower(inPath), ".bck") {
+		return res, newError(ErrNotBck, "%s --exec only accepts .bck files", cmdName)
+	}
+	res.Action = "piped"
+	if opts.dryRun {
+		opts.infof("Would pipe decoded '%s' into '%s'\n", filepath.Base(stripLastBck(inPath)), opts.exec)
+		return res, nil
+	}
+	cmd := shellCommand(opts.exec, opts.scriptArgs...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return res, err
+	}
+	if err := cmd.Start(); err != nil {
+		return res, execError(err, "Failed to start %s", opts.exec)
+	}
+	opts.logger().Debug("piping decoded output", "path", inPath, "command", opts.exec)
+	_, catErr := cat(inPath, stdin, opts)
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		return res, programError(err, "'"+opts.exec+"'", "Failed to execute %s", opts.exec)
+	}
+	// A command that stops reading early (head, grep -q) is not an error.
+	if catErr != nil && !isBrokenPipe(catErr) && !errors.Is(catErr, os.ErrClosed) {
+		return res, catErr
+	}
+	return res, nil
+}
+
+// shellCommand returns a Cmd running command the way a shell would, with
+// args appended as separate words, so settings like "code --wait" or
+// "wc -l" work as users expect.
+func shellCommand(command string, args ...string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		fields := strings.Fields(command)
+		return exec.Command(fields[0], append(fields[1:], args...)...)
+	}
+	return exec.Command("sh", append([]string{"-c", command + ` "$@"`, command}, args...)...)
+}
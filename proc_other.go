@@ -0,0 +1,23 @@
+//go:build !unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// setProcessGroup is a no-op where process groups are unavailable.
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills cmd itself; children it spawned may survive.
+func killProcessGroup(cmd *exec.Cmd) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	return cmd.Process.Kill()
+}
+
+// maxRSS is unknown here: Windows keeps a process's peak working set only
+// while its handle is open.
+func maxRSS(ps *os.ProcessState) int64 { return 0 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	progressMinBytes = 64 << 20 // smaller files finish before a progress line is worth drawing
+	progressMinFiles = 50       // likewise for batches
+	progressEvery    = 250 * time.Millisecond
+)
+
+// progress draws a self-updating "Encoding 'x': 42% (1.3 GiB of 3.1 GiB)"
+// line on stderr while a long operation runs, so a multi-gigabyte encode
+// doesn't look hung. It counts bytes, or files for a batch. A nil
+// *progress is valid and draws nothing, which is what startProgress
+// returns unless stderr is a terminal and the work is big enough.
+type progress struct {
+	label string
+	total int64
+	files bool // counting files rather than bytes
+	done  atomic.Int64
+
+	w     io.Writer
+	mu    sync.Mutex // guards w and width
+	width int        // length of the line on screen, to blank it out
+	stop  chan struct{}
+	idle  sync.WaitGroup
+}
+
+// startProgress starts drawing progress towards total bytes (or files)
+// unless opts or the terminal rule it out.
+func startProgress(opts options, label string, total int64, files bool) *progress {
+	least := int64(progressMinBytes)
+	if files {
+		least = progressMinFiles
+	}
+	if opts.quiet || opts.noProgress || total < least || !isTerminal(os.Stderr) {
+		return nil
+	}
+	p := &progress{label: label, total: total, files: files, w: os.Stderr, stop: make(chan struct{})}
+	p.idle.Add(1)
+	go func() {
+		defer p.idle.Done()
+		tick := time.NewTicker(progressEvery)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				p.mu.Lock()
+				// A prompt owns the terminal; draw again next time.
+				if termMu.TryLock() {
+					p.draw()
+					termMu.Unlock()
+				}
+				p.mu.Unlock()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// add records n more bytes (or files) done.
+func (p *progress) add(n int64) {
+	if p != nil {
+		p.done.Add(n)
+	}
+}
+
+// finish stops drawing and removes the line.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+	close(p.stop)
+	p.idle.Wait()
+	p.mu.Lock()
+	p.clear()
+	p.mu.Unlock()
+}
+
+// around runs print, which writes to the terminal, with the progress line
+// out of its way.
+func (p *progress) around(print func()) {
+	if p == nil {
+		print()
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clear()
+	print()
+}
+
+// line is the text draw shows.
+func (p *progress) line() string {
+	done := min(p.done.Load(), p.total)
+	pct := 100 * done / max(p.total, 1)
+	if p.files {
+		return fmt.Sprintf("%s: %d%% (%d of %d files)", p.label, pct, done, p.total)
+	}
+	return fmt.Sprintf("%s: %d%% (%s of %s)", p.label, pct, humanBytes(done), humanBytes(p.total))
+}
+
+// draw and clear overwrite the line with \r and spaces rather than
+// terminal escapes, which not every console understands.
+func (p *progress) draw() {
+	s := p.line()
+	n := utf8.RuneCountInString(s)
+	fmt.Fprintf(p.w, "\r%s%s", s, strings.Repeat(" ", max(p.width-n, 0)))
+	p.width = n
+}
+
+func (p *progress) clear() {
+	if p.width > 0 {
+		fmt.Fprintf(p.w, "\r%s\r", strings.Repeat(" ", p.width))
+		p.width = 0
+	}
+}
+
+// readerAt counts what is read through r.
+func (p *progress) readerAt(r io.ReaderAt) io.ReaderAt {
+	if p == nil {
+		return r
+	}
+	return progressReaderAt{r, p}
+}
+
+type progressReaderAt struct {
+	r io.ReaderAt
+	p *progress
+}
+
+func (r progressReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n, err := r.r.ReadAt(b, off)
+	r.p.add(int64(n))
+	return n, err
+}
+
+// writer counts what is written through w.
+func (p *progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return progressWriter{w, p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+// Write passes b on in chunks, so one big write still shows movement.
+func (w progressWriter) Write(b []byte) (int, error) {
+	var n int
+	for n < len(b) {
+		m, err := w.w.Write(b[n:min(n+streamChunk, len(b))])
+		n += m
+		w.p.add(int64(m))
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// humanBytes formats n as "512 B", "3.4 MiB" and so on.
+func humanBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v, unit := float64(n)/1024, 0
+	for v >= 1024 && unit < 4 {
+		v, unit = v/1024, unit+1
+	}
+	return fmt.Sprintf("%.1f %ciB", v, "KMGTP"[unit])
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxDownload = 16 << 20 // --max-download unless given
+	fetchTimeout       = 2 * time.Minute
+)
+
+// isURL reports whether s names an http(s) resource rather than a file.
+func isURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// urlFileName is the file name a download from rawURL is given: the last
+// element of its path, or "download" if that is no usable name.
+func urlFileName(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "download"
+	}
+	name := path.Base(u.Path)
+	if !validBaseName(name) {
+		return "download"
+	}
+	return name
+}
+
+// fetch downloads rawURL, refusing bodies over opts.maxFetch (or
+// defaultMaxDownload) and, with --sha256, any whose checksum differs.
+func fetch(rawURL string, opts options) ([]byte, error) {
+	return fetchWith(&http.Client{Timeout: fetchTimeout}, rawURL, opts)
+}
+
+// fetchWith is fetch through client.
+func fetchWith(client *http.Client, rawURL string, opts options) ([]byte, error) {
+	limit := opts.maxFetch
+	if limit == 0 {
+		limit = defaultMaxDownload
+	}
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return nil, newError(ErrNetwork, "fetching %s: %v", rawURL, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return nil, newError(ErrNotFound, "%s: %s", rawURL, resp.Status)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return nil, newError(ErrPermission, "%s: %s", rawURL, resp.Status)
+	case resp.StatusCode/100 != 2:
+		return nil, newError(ErrNetwork, "%s: %s", rawURL, resp.Status)
+	case resp.ContentLength > limit:
+		return nil, newError(ErrNetwork, "%s is %s, over the %s --max-download limit", rawURL, humanBytes(resp.ContentLength), humanBytes(limit))
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, newError(ErrNetwork, "fetching %s: %v", rawURL, err)
+	}
+	if int64(len(data)) > limit {
+		return nil, newError(ErrNetwork, "%s is over the %s --max-download limit", rawURL, humanBytes(limit))
+	}
+	opts.logger().Debug("downloaded", "url", rawURL, "bytes", len(data), "sha256", sha256Hex(data))
+	if opts.sha256 != "" {
+		if got := sha256Hex(data); got != opts.sha256 {
+			return nil, newError(ErrCorrupt, "%s has SHA-256 %s, not the expected %s", rawURL, got, opts.sha256)
+		}
+	}
+	return data, nil
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// parseSHA256 reads a --sha256 value: 64 hex digits, in either case.
+func parseSHA256(s string) (string, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if b, err := hex.DecodeString(s); err != nil || len(b) != sha256.Size {
+		return "", fmt.Errorf("invalid SHA-256 %q: want 64 hex digits", s)
+	}
+	return s, nil
+}
+
+// runURL is run for a .bck at rawURL: it is downloaded into a private
+// temporary directory and run from there, after run has shown what it is
+// and the user has agreed (or passed --yes).
+func runURL(rawURL string, opts options) (result, error) {
+	res := result{Command: "run", Input: rawURL, DryRun: opts.dryRun}
+	name := urlFileName(rawURL)
+	if !strings.HasSuffix(strings.ToLower(name), ".bck") {
+		return res, newError(ErrNotBck, "%s does not name a .bck file", rawURL)
+	}
+	data, err := fetch(rawURL, opts)
+	if err != nil {
+		return res, err
+	}
+	dir, err := os.MkdirTemp("", "backlang-url-*")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+	inPath := filepath.Join(dir, name)
+	if err := os.WriteFile(inPath, data, 0o600); err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	opts.source = rawURL
+	res, err = run(inPath, opts)
+	res.Input = rawURL
+	return res, err
+}
+
+// confirmRun asks whether to run a program downloaded from opts.source,
+// showing where it came from, its checksum and its size, and the program
+// itself on request. It never reads the answer from piped input.
+func confirmRun(name string, lang *Language, encoded, decoded []byte, opts options) (bool, error) {
+	termMu.Lock()
+	defer termMu.Unlock()
+	if !stdinIsTerminal() {
+		return false, newError(ErrUsage, "'%s' was downloaded from %s and stdin is not a terminal to confirm running it; pass --yes if you trust it", filepath.Base(name), opts.source)
+	}
+	lines := "1 line"
+	if n := bytes.Count(decoded, []byte("\n")); n != 1 {
+		lines = fmt.Sprintf("%d lines", n)
+	}
+	fmt.Fprintf(os.Stderr, "'%s' was downloaded from %s\n  SHA-256 %s (pin it with --sha256)\n  %s, %s, to run with %s\n",
+		filepath.Base(name), opts.source, sha256Hex(encoded), lang.Name, lines, lang.tool())
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprint(os.Stderr, "Run it? (y/n, or s to show the program): ")
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return false, err
+		}
+		switch strings.TrimSpace(strings.ToLower(line)) {
+		case "y", "yes":
+			return true, nil
+		case "s", "show":
+			os.Stderr.Write(decoded)
+			if len(decoded) > 0 && decoded[len(decoded)-1] != '\n' {
+				fmt.Fprintln(os.Stderr)
+			}
+			continue
+		}
+		return false, nil
+	}
+}
+
+// transformURL is encode, decode or cat for a file at rawURL. The download
+// is transformed in a private temporary directory and the result written
+// to -o, or under its own name in the current directory (subject to the
+// conflict policy); "-o -" and cat write it to stdout instead.
+func transformURL(cmd, rawURL string, opts options) (result, error) {
+	res := result{Command: cmd, Input: rawURL, DryRun: opts.dryRun}
+	data, err := fetch(rawURL, opts)
+	if err != nil {
+		return res, err
+	}
+	dir, err := os.MkdirTemp("", "backlang-url-*")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(dir)
+	inPath := filepath.Join(dir, urlFileName(rawURL))
+	if err := os.WriteFile(inPath, data, 0o600); err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	if cmd == "cat" {
+		res, err = cat(inPath, os.Stdout, opts)
+		res.Input = rawURL
+		return res, err
+	}
+
+	// The transform itself is quiet and can't conflict: the directory is
+	// empty but for the download.
+	o := opts
+	o.quiet, o.dryRun, o.out, o.onConflict = true, false, nil, conflictOverwrite
+	var tr result
+	if cmd == "encode" {
+		tr, err = encode(inPath, o)
+	} else if err = checkDecodable(inPath, o); err == nil {
+		tr, err = decode(inPath, o)
+	}
+	if err != nil {
+		return res, err
+	}
+	res.Action, res.Mode, res.Format, res.Layers, res.Name = tr.Action, tr.Mode, tr.Format, tr.Layers, tr.Name
+
+	dest := opts.output
+	if dest == "" {
+		dest = filepath.Base(tr.Output)
+	}
+	if dest == "-" {
+		res.Output = dest
+		if opts.dryRun {
+			opts.infof("Would %s %s to stdout\n", cmd, rawURL)
+			return res, nil
+		}
+		return res, copyFileTo(os.Stdout, tr.Output)
+	}
+	dest, skip, err := resolveConflict(dest, opts)
+	res.Output = dest
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	verb := strings.ToUpper(cmd[:1]) + cmd[1:] + "d"
+	if opts.dryRun {
+		opts.infof("Would write '%s' (%s %s)\n", dest, strings.ToLower(verb), rawURL)
+		return res, nil
+	}
+	if err := writeFileStream(dest, 0o666, true, opts.sync, func(w io.Writer) error {
+		return copyFileTo(w, tr.Output)
+	}); err != nil {
+		return res, wrapPathErr(err, dest)
+	}
+	opts.infof("%s %s → '%s'\n", verb, rawURL, dest)
+	return res, nil
+}
+
+// copyFileTo copies the file at name to w.
+func copyFileTo(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return wrapPathErr(err, name)
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const replHelp = `Type lines to add them to the buffer. Commands:
+  :show            print the buffer encoded (what the .bck holds)
+  :decode          print the buffer decoded from its encoding
+  :mode <mode>     encode with lines, chars, words, bytes or blocks
+  :undo            drop the last line
+  :clear           empty the buffer
+  :save <file>     write the encoded buffer (.bck is added if missing)
+  :run <name>      run the buffer as a program; name (e.g. x.py) picks the
+                   language unless the first line is a shebang
+  :help            show this help
+  :quit            leave (so does end of input)
+Start a line with :: to add a line beginning with a single colon.
+`
+
+// replMain runs "backlang repl".
+func replMain(args []string) {
+	var opts options
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	fs.Func("mode", "what to reverse: lines (default), chars, words, bytes or blocks", func(s string) error {
+		m, err := parseMode(s)
+		opts.mode = m
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fs.PrintDefaults()
+	}
+	positional, _, err := parseArgs(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if len(positional) > 0 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(exitUsage)
+	}
+	prompt := ""
+	if stdinIsTerminal() {
+		prompt = "bck> "
+		fmt.Print("backlang repl — :help for commands\n")
+	}
+	if err := repl(os.Stdin, os.Stdout, prompt, opts); err != nil {
+		printErr(err)
+		os.Exit(exitCode(err))
+	}
+}
+
+// repl reads lines and commands from r until :quit or end of input. A
+// failing command is reported and the session goes on; only an error
+// reading r ends it.
+func repl(r io.Reader, w io.Writer, prompt string, opts options) error {
+	var lines []string
+	encoded := func() ([]byte, error) {
+		return encodeData([]byte(strings.Join(lines, "")), format{mode: opts.mode})
+	}
+	in := bufio.NewReader(r)
+	for {
+		fmt.Fprint(w, prompt)
+		line, err := in.ReadString('\n')
+		if err == io.EOF && line == "" {
+			if prompt != "" {
+				fmt.Fprintln(w)
+			}
+			return nil
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if !strings.HasSuffix(line, "\n") {
+			line += "\n"
+		}
+		if !strings.HasPrefix(line, ":") || strings.HasPrefix(line, "::") {
+			lines = append(lines, strings.TrimPrefix(line, ":"))
+			continue
+		}
+
+		cmd, arg, _ := strings.Cut(strings.TrimSpace(line[1:]), " ")
+		arg = strings.TrimSpace(arg)
+		var cmdErr error
+		switch cmd {
+		case "show":
+			var enc []byte
+			if enc, cmdErr = encoded(); cmdErr == nil {
+				w.Write(enc)
+			}
+		case "decode":
+			var enc, dec []byte
+			if enc, cmdErr = encoded(); cmdErr == nil {
+				if dec, _, cmdErr = decodeData(enc); cmdErr == nil {
+					w.Write(dec)
+				}
+			}
+		case "mode":
+			var m string
+			if m, cmdErr = parseMode(arg); cmdErr == nil {
+				opts.mode = m
+			}
+		case "undo":
+			if len(lines) > 0 {
+				lines = lines[:len(lines)-1]
+			}
+		case "clear":
+			lines = nil
+		case "save":
+			cmdErr = replSave(arg, encoded, w, opts)
+		case "run":
+			cmdErr = replRun(arg, encoded, opts)
+		case "help":
+			fmt.Fprint(w, replHelp)
+		case "quit", "q", "exit":
+			return nil
+		default:
+			cmdErr = newError(ErrUsage, "unknown command :%s (try :help)", cmd)
+		}
+		if cmdErr != nil {
+			printErr(cmdErr)
+		}
+	}
+}
+
+// replSave writes the encoded buffer to name, adding .bck if missing.
+func replSave(name string, encoded func() ([]byte, error), w io.Writer, opts options) error {
+	if name == "" {
+		return newError(ErrUsage, ":save needs a file name")
+	}
+	if !strings.HasSuffix(strings.ToLower(name), ".bck") {
+		name += ".bck"
+	}
+	enc, err := encoded()
+	if err != nil {
+		return err
+	}
+	outPath, skip, err := resolveConflict(name, opts)
+	if err != nil || skip {
+		return err
+	}
+	if err := writeFileStream(outPath, 0o666, true, false, writeAll(enc)); err != nil {
+		return wrapPathErr(err, outPath)
+	}
+	fmt.Fprintf(w, "Saved '%s'\n", outPath)
+	return nil
+}
+
+// replRun runs the buffer the way run runs a .bck named name.bck.
+func replRun(name string, encoded func() ([]byte, error), opts options) error {
+	if name == "" {
+		name = "program"
+	}
+	enc, err := encoded()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "backlang-repl-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	bck := filepath.Join(dir, filepath.Base(name)+".bck")
+	if err := os.WriteFile(bck, enc, 0o600); err != nil {
+		return wrapPathErr(err, bck)
+	}
+	opts.quiet, opts.noCache = true, true
+	_, err = run(bck, opts)
+	return err
+}
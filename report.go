@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// batchReport is what --report writes: the outcome of every file in a
+// batch, for tooling that would otherwise scrape the progress lines.
+type batchReport struct {
+	Command  string         `json:"command"`
+	Started  time.Time      `json:"started"`
+	Duration float64        `json:"duration_seconds"`
+	DryRun   bool           `json:"dry_run,omitempty"`
+	Counts   map[string]int `json:"counts"` // files per status
+	Files    []fileReport   `json:"files"`  // in input order
+}
+
+// fileReport is one file's entry in a batchReport.
+type fileReport struct {
+	Input       string  `json:"input"`
+	Output      string  `json:"output,omitempty"`
+	Status      string  `json:"status"` // the result's action, or failed
+	InputBytes  int64   `json:"input_bytes,omitempty"`
+	OutputBytes int64   `json:"output_bytes,omitempty"`
+	Duration    float64 `json:"duration_seconds"`
+	Error       string  `json:"error,omitempty"`
+	ExitCode    int     `json:"exit_code,omitempty"`
+}
+
+// timedTransform is transformFile, also filling in rep with the file's
+// sizes before and after and how long it took. The input is measured
+// first, as --in-place and --delete-original replace or remove it.
+func timedTransform(cmd, path string, opts options, rep *fileReport) (result, error) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+		rep.InputBytes = fi.Size()
+	}
+	start := time.Now()
+	res, err := transformFile(cmd, path, opts)
+	rep.Duration = time.Since(start).Seconds()
+	rep.Input, rep.Output, rep.Status = path, res.Output, res.Action
+	if err != nil {
+		rep.Status, rep.Error, rep.ExitCode = "failed", err.Error(), exitCode(err)
+	} else if fi, serr := os.Stat(res.Output); serr == nil && !res.DryRun && fi.Mode().IsRegular() {
+		rep.OutputBytes = fi.Size()
+	}
+	return res, err
+}
+
+// writeReport writes rep as indented JSON to name, replacing any file
+// there.
+func writeReport(name string, rep batchReport, opts options) error {
+	if opts.dryRun {
+		opts.infof("Would write report '%s'\n", name)
+		return nil
+	}
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if err := writeFileStream(name, 0o666, true, opts.sync, writeAll(data)); err != nil {
+		return wrapPathErr(err, name)
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// resumeState is the progress file of a batch run with --resume: one JSON
+// line per finished file, appended as each one completes, so a run that
+// dies halfway can be rerun with --resume and skip what it already did.
+// Files live under the cache directory, keyed by the command, the inputs
+// and the flags that shape the output, and are removed once a run
+// finishes without failures. A nil *resumeState (no --resume) has nothing
+// finished and records nothing.
+type resumeState struct {
+	path string
+	mu   sync.Mutex
+	f    *os.File                // nil with --dry-run, which records nothing
+	done map[string]resumeRecord // by input path
+}
+
+// resumeRecord is one finished file: the input as it was afterwards and
+// the output it produced.
+type resumeRecord struct {
+	Input   string `json:"in"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"` // Unix nanoseconds
+	Output  string `json:"out"`
+	OutSize int64  `json:"out_size"`
+}
+
+// resumePath returns the progress file for cmd over inputs with opts.
+func resumePath(cmd string, inputs []string, opts options) (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%d\x00%t\x00%t\x00%t\x00%s\x00%t\x00%t\x00%t\x00", cmd, opts.mode, opts.blockSize,
+		opts.compress, opts.encrypt, opts.armor, opts.eol, opts.storeName, opts.restore, opts.inPlace)
+	for _, in := range inputs {
+		abs, err := filepath.Abs(in)
+		if err != nil {
+			abs = in
+		}
+		fmt.Fprintf(h, "%s\x00", abs)
+	}
+	return filepath.Join(dir, "resume", hex.EncodeToString(h.Sum(nil))[:32]+".jsonl"), nil
+}
+
+// openResume loads the progress of an earlier run of the same batch, if
+// there is one, and opens its file for recording this run's.
+func openResume(cmd string, inputs []string, opts options) (*resumeState, error) {
+	path, err := resumePath(cmd, inputs, opts)
+	if err != nil {
+		return nil, err
+	}
+	s := &resumeState{path: path, done: map[string]resumeRecord{}}
+	if f, err := os.Open(path); err == nil {
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			// A line cut short by the interruption is just not done.
+			var r resumeRecord
+			if json.Unmarshal(sc.Bytes(), &r) == nil {
+				s.done[r.Input] = r
+			}
+		}
+		f.Close()
+	}
+	opts.logger().Debug("resuming", "state", path, "finished", len(s.done))
+	if opts.dryRun {
+		return s, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	if s.f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// finished returns the output an earlier run made from input, if it
+// finished it and neither the input nor the output has changed since.
+func (s *resumeState) finished(input string) (string, bool) {
+	if s == nil {
+		return "", false
+	}
+	s.mu.Lock()
+	r, ok := s.done[input]
+	s.mu.Unlock()
+	if !ok {
+		return "", false
+	}
+	in, err := os.Stat(input)
+	if err != nil || in.Size() != r.Size || in.ModTime().UnixNano() != r.ModTime {
+		return "", false
+	}
+	out, err := os.Stat(r.Output)
+	if err != nil || out.Size() != r.OutSize {
+		return "", false
+	}
+	return r.Output, true
+}
+
+// record notes that input has been transformed into output.
+func (s *resumeState) record(input, output string) error {
+	if s == nil || s.f == nil {
+		return nil
+	}
+	in, err := os.Stat(input)
+	if os.IsNotExist(err) {
+		return nil // --delete-original: there is nothing left to redo
+	}
+	if err != nil {
+		return err
+	}
+	out, err := os.Stat(output)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(resumeRecord{input, in.Size(), in.ModTime().UnixNano(), output, out.Size()})
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.f.Write(append(line, '\n'))
+	return err
+}
+
+// close closes the progress file, removing it if the run is complete.
+func (s *resumeState) close(complete bool) {
+	if s == nil || s.f == nil {
+		return
+	}
+	s.f.Close()
+	if complete {
+		os.Remove(s.path)
+	}
+}
@@ -1,12 +1,20 @@
 package main
 
 import (
-	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
 // Language represents a supported programming language
@@ -14,150 +22,833 @@ type Language struct {
 	Name       string
 	Extensions []string
 	Shebangs   []string
+	Modelines  []string // File types a vim or emacs modeline names it by (vim: ft=python)
 	Command    string
 	Args       []string
+	StdinArgs  []string // Args that make Command read the program from stdin (nil if unsupported)
+	FileArgs   []string // Args that go right before the program file ("-File"), after Args and --interp-args
+	TempName   string   // Fixed file name for the temporary decoded copy ("" keeps the original name)
+	// Compiled languages set BuildCommand instead of Command: the source is
+	// built with "BuildCommand BuildArgs... -o <binary> <source>" and the
+	// binary is run with Args and the program arguments.
+	BuildCommand string
+	BuildArgs    []string
+	Image        string // Container image for run --container ("" if none is known)
+	// Where the command goes by other names, Fallbacks are tried in order
+	// when it is not on PATH, and on Windows WindowsCommands before it.
+	// Each is a command with any arguments it needs first ("py -3").
+	Fallbacks       []string
+	WindowsCommands []string
 }
 
-// getSupportedLanguages returns the list of supported languages
+// tool returns the program that must be on PATH: the compiler for compiled
+// languages, the interpreter otherwise
+func (l *Language) tool() string {
+	if l.BuildCommand != "" {
+		return l.BuildCommand
+	}
+	return l.Command
+}
+
+// candidates returns the commands, with their leading arguments, that may
+// run l on goos, in the order to try them. An interpreter set through
+// BACKLANG_<NAME> or a virtualenv's python is the only one.
+func (l *Language) candidates(goos string) [][]string {
+	tool := l.tool()
+	if _, overridden := interpreterOverride(l.Name); overridden || strings.ContainsAny(tool, `/\`) {
+		return [][]string{{tool}}
+	}
+	var names []string
+	if goos == "windows" {
+		names = append(names, l.WindowsCommands...)
+	}
+	names = append(append(names, tool), l.Fallbacks...)
+	var out [][]string
+	for _, name := range names {
+		if f := strings.Fields(name); len(f) > 0 && !slices.ContainsFunc(out, func(c []string) bool { return slices.Equal(c, f) }) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// resolveCommand returns lang with its interpreter (or compiler) set to the
+// first of its candidates on goos that lookPath finds, and that
+// candidate's arguments ahead of its own. exec.LookPath finds node.exe for
+// "node" on Windows, by PATHEXT.
+func resolveCommand(lang *Language, goos string, lookPath func(string) (string, error)) (*Language, string, error) {
+	candidates := lang.candidates(goos)
+	for _, c := range candidates {
+		path, err := lookPath(c[0])
+		if err != nil {
+			continue
+		}
+		l := *lang
+		if l.BuildCommand != "" {
+			l.BuildCommand, l.BuildArgs = c[0], append(slices.Clone(c[1:]), l.BuildArgs...)
+		} else {
+			l.Command, l.Args = c[0], append(slices.Clone(c[1:]), l.Args...)
+		}
+		return &l, path, nil
+	}
+	if len(candidates) == 1 {
+		return nil, "", newError(ErrNoInterpreter, "%s detected but '%s' was not found on PATH", lang.Name, lang.tool())
+	}
+	var names []string
+	for _, c := range candidates {
+		names = append(names, "'"+c[0]+"'")
+	}
+	return nil, "", newError(ErrNoInterpreter, "%s detected but none of %s was found on PATH", lang.Name, strings.Join(names, ", "))
+}
+
+// loadLanguages returns the user-defined languages from languages.toml
+// followed by the built-in ones. User entries are checked first and replace
+// a built-in language of the same name.
+func loadLanguages() ([]Language, error) {
+	user, err := loadUserLanguages()
+	if err != nil {
+		return nil, err
+	}
+	languages := user
+	for _, lang := range getSupportedLanguages() {
+		overridden := false
+		for _, u := range user {
+			if strings.EqualFold(u.Name, lang.Name) {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			languages = append(languages, lang)
+		}
+	}
+	applyInterpreterOverrides(languages)
+	return languages, nil
+}
+
+// getSupportedLanguages returns the list of built-in languages
 func getSupportedLanguages() []Language {
-	return []Language{
+	languages := []Language{
 		{
 			Name:       "Python",
 			Extensions: []string{".py"},
 			Shebangs:   []string{"#!/usr/bin/env python3", "#!/usr/bin/python3", "#!/usr/bin/env python", "#!/usr/bin/python"},
+			Modelines:  []string{"python"},
 			Command:    "python3",
 			Args:       []string{}, // Will append filename
+			StdinArgs:  []string{"-"},
+			Image:      "python:3-slim",
+			// Windows has the py launcher and python.exe; its python3.exe
+			// is often only a shortcut to the Microsoft Store.
+			Fallbacks:       []string{"python"},
+			WindowsCommands: []string{"py -3", "python"},
 		},
 		{
 			Name:       "JavaScript",
-			Extensions: []string{".js"},
-			Shebangs:   []string{"#!/usr/bin/env node", "#!/usr/bin/node"},
+			Extensions: []string{".js", ".mjs", ".cjs"},
+			Shebangs:   []string{"#!/usr/bin/env node", "#!/usr/bin/node", "#!/usr/local/bin/node", "#!/usr/bin/env nodejs", "#!/usr/bin/nodejs"},
+			Modelines:  []string{"javascript", "js", "js2"},
 			Command:    "node",
 			Args:       []string{},
+			StdinArgs:  []string{"-"},
+			Image:      "node:lts-slim",
 		},
 		{
 			Name:       "Bash",
 			Extensions: []string{".sh", ".bash"},
 			Shebangs:   []string{"#!/bin/bash", "#!/usr/bin/env bash", "#!/bin/sh", "#!/usr/bin/env sh"},
+			Modelines:  []string{"sh", "bash", "shell-script"},
 			Command:    "bash",
 			Args:       []string{},
+			StdinArgs:  []string{"-s"},
+			Image:      "bash:5",
+		},
+		{
+			Name:       "Ruby",
+			Extensions: []string{".rb"},
+			Shebangs:   []string{"#!/usr/bin/env ruby", "#!/usr/bin/ruby"},
+			Modelines:  []string{"ruby"},
+			Command:    "ruby",
+			Args:       []string{},
+			StdinArgs:  []string{"-"},
+			Image:      "ruby:3-slim",
+		},
+		{
+			Name:       "Perl",
+			Extensions: []string{".pl"},
+			Shebangs:   []string{"#!/usr/bin/env perl", "#!/usr/bin/perl"},
+			Modelines:  []string{"perl", "cperl"},
+			Command:    "perl",
+			Args:       []string{},
+			StdinArgs:  []string{"-"},
+			Image:      "perl:5-slim",
+		},
+		{
+			Name:       "PHP",
+			Extensions: []string{".php"},
+			Shebangs:   []string{"#!/usr/bin/env php", "#!/usr/bin/php"},
+			Modelines:  []string{"php"},
+			Command:    "php",
+			Args:       []string{},
+			StdinArgs:  []string{"--"},
+			Image:      "php:8-cli",
+		},
+		{
+			Name:       "Lua",
+			Extensions: []string{".lua"},
+			Shebangs:   []string{"#!/usr/bin/env lua", "#!/usr/bin/lua"},
+			Modelines:  []string{"lua"},
+			Command:    "lua",
+			Args:       []string{},
+			StdinArgs:  []string{"-"},
+			Fallbacks:  []string{"lua5.4", "lua5.3"},
+		},
+		{
+			Name:       "Go",
+			Extensions: []string{".go"},
+			Shebangs:   []string{}, // Go doesn't use shebangs
+			Modelines:  []string{"go"},
+			Command:    "go",
+			Args:       []string{"run"},
+			// go run rejects *_test.go and applies build constraints to
+			// names like tool_windows.go, so always decode to main.go.
+			TempName: "main.go",
+			Image:    "golang:1",
 		},
+		{
+			Name:         "C",
+			Extensions:   []string{".c"},
+			Shebangs:     []string{},
+			Modelines:    []string{"c"},
+			BuildCommand: "cc",
+			BuildArgs:    []string{"-O2"},
+			Args:         []string{},
+			Image:        "gcc:14",
+			Fallbacks:    []string{"gcc", "clang"}, // MinGW and LLVM on Windows have no cc
+		},
+		{
+			Name:       "PowerShell",
+			Extensions: []string{".ps1"},
+			Shebangs:   []string{"#!/usr/bin/env pwsh", "#!/usr/bin/pwsh", "#!/usr/local/bin/pwsh"},
+			Modelines:  []string{"ps1", "powershell"},
+			Command:    "pwsh",
+			// Windows PowerShell's default policy refuses to run any
+			// script file; the user asked to run this one.
+			Args:      []string{"-NoLogo", "-NoProfile", "-ExecutionPolicy", "Bypass"},
+			FileArgs:  []string{"-File"},
+			Fallbacks: []string{"powershell"}, // Windows PowerShell 5.1, where PowerShell 7 is not installed
+			Image:     "mcr.microsoft.com/powershell",
+		},
+		{
+			Name:       "Batch",
+			Extensions: []string{".bat", ".cmd"},
+			Shebangs:   []string{},
+			Modelines:  []string{"dosbatch", "bat"},
+			Command:    "cmd",
+			Args:       []string{"/D", "/V:OFF", "/S"}, // no AutoRun commands from the registry, no !VAR! expansion; see quoteForCmd
+			FileArgs:   []string{"/C"},
+		},
+		{
+			Name:         "Rust",
+			Extensions:   []string{".rs"},
+			Shebangs:     []string{},
+			Modelines:    []string{"rust", "rustic"},
+			BuildCommand: "rustc",
+			BuildArgs:    []string{"--edition", "2021", "-O"},
+			Args:         []string{},
+			Image:        "rust:1-slim",
+		},
+	}
+	return languages
+}
+
+// applyInterpreterOverrides applies BACKLANG_<LANGUAGE> environment
+// overrides to the interpreter (or compiler) of each language
+func applyInterpreterOverrides(languages []Language) {
+	for i := range languages {
+		if cmd, ok := interpreterOverride(languages[i].Name); ok {
+			if languages[i].BuildCommand != "" {
+				languages[i].BuildCommand = cmd
+			} else {
+				languages[i].Command = cmd
+			}
+		}
 	}
 }
 
 // run decodes a .bck file and executes it with the appropriate interpreter
-func run(inPath string) error {
+func run(inPath string, opts options) (result, error) {
+	return runContext(context.Background(), inPath, opts)
+}
+
+// runContext is run, stopping the program (and everything it started) when
+// ctx is cancelled.
+func runContext(ctx context.Context, inPath string, opts options) (result, error) {
+	res := result{Command: "run", Input: inPath, DryRun: opts.dryRun}
+
 	// Validate input is a .bck file
 	if !strings.HasSuffix(strings.ToLower(inPath), ".bck") {
-		return fmt.Errorf("Error: run command only accepts .bck files")
+		return res, newError(ErrNotBck, "run command only accepts .bck files")
 	}
 
 	// Decode the file
-	data, err := os.ReadFile(inPath)
+	raw, err := os.ReadFile(inPath)
 	if err != nil {
-		return wrapPathErr(err, inPath)
+		return res, wrapPathErr(err, inPath)
+	}
+	opts.logger().Debug("read input", "path", inPath, "bytes", len(raw))
+	data, err := unwrapData(raw, opts)
+	if err != nil {
+		return res, err
+	}
+	decoded, f, err := decodeData(data)
+	if err != nil {
+		return res, err
 	}
 
-	lines := splitLinesPreserveEndings(data)
-	
-	// Check for marker at the beginning
-	hasMarker := false
-	if len(lines) > 0 && string(lines[0]) == "##BCKL.NNL##\n" {
-		hasMarker = true
-		lines = lines[1:] // Remove marker
+	// Detect language from the decoded content and name, the original's
+	// if encode --store-name recorded it
+	name := stripLastBck(inPath)
+	detectName := name
+	if f.name != "" {
+		detectName = filepath.Join(filepath.Dir(inPath), f.name)
+	}
+	lang, err := detectLanguage(detectName, decoded, opts)
+	if err != nil {
+		return res, err
 	}
-	
-	reverse(lines)
-	
-	// If marker was present, remove the trailing newline we added during encode
-	if hasMarker && len(lines) > 0 {
-		lastLine := lines[len(lines)-1]
-		if len(lastLine) > 0 && lastLine[len(lastLine)-1] == '\n' {
-			lines[len(lines)-1] = lastLine[:len(lastLine)-1]
+	res.Action = "ran"
+
+	// --interp-args go to the interpreter before the program, or to the
+	// compiler (which changes what it builds, so the cached binary too)
+	if len(opts.interpArgs) > 0 {
+		l := *lang
+		if l.BuildCommand != "" {
+			l.BuildArgs = append(slices.Clone(l.BuildArgs), opts.interpArgs...)
+		} else {
+			l.Args = append(slices.Clone(l.Args), opts.interpArgs...)
 		}
+		lang = &l
 	}
 
-	// Create output file path (remove .bck extension)
-	outPath := stripLastBck(inPath)
-	
-	// Handle file collisions with numbering
-	if fileExists(outPath) {
-		outPath = nextAvailableName(outPath)
+	// Prefer the project's virtualenv python so its dependencies resolve
+	if lang.Name == "Python" && !opts.noVenv && !opts.container {
+		if _, overridden := interpreterOverride(lang.Name); !overridden {
+			if py := findVenvPython(filepath.Dir(inPath)); py != "" {
+				opts.logger().Debug("using virtualenv interpreter", "interpreter", py)
+				lang.Command = py
+			}
+		}
 	}
 
-	// Write decoded content
-	if err := os.WriteFile(outPath, join(lines), 0o666); err != nil {
-		return wrapPathErr(err, outPath)
+	// Make sure the interpreter (or compiler) exists before decoding anything
+	// for it; with --container it is the image's job to provide one.
+	var rt, image string
+	if opts.container {
+		if rt, err = containerRuntime(); err != nil {
+			return res, err
+		}
+		if image, err = containerImage(lang, opts); err != nil {
+			return res, err
+		}
+		opts.logger().Debug("using container", "language", lang.Name, "runtime", rt, "image", image)
+	} else {
+		var path string
+		if lang, path, err = resolveCommand(lang, runtime.GOOS, exec.LookPath); err != nil {
+			return res, err
+		}
+		opts.logger().Debug("resolved interpreter", "language", lang.Name, "tool", lang.tool(), "path", path)
+	}
+	var as *runAs
+	if opts.user != "" {
+		if as, err = lookupRunAs(opts.user); err != nil {
+			return res, err
+		}
 	}
 
-	fmt.Printf("Decoded '%s' → '%s'\n", filepath.Base(inPath), filepath.Base(outPath))
+	// --timeout bounds the whole execution, including any build step
+	if opts.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+		defer cancel()
+	}
 
-	// Detect language and run
-	lang, err := detectLanguage(outPath)
+	env, err := programEnv(opts)
 	if err != nil {
-		return err
+		return res, err
 	}
 
-	fmt.Printf("Detected %s, running with %s...\n", lang.Name, lang.Command)
-	return executeFile(lang, outPath)
-}
+	// With --stdin nothing touches the disk: the source is piped straight
+	// into the interpreter.
+	if opts.stdin && lang.StdinArgs == nil {
+		return res, newError(ErrUsage, "%s cannot read programs from stdin; run without --stdin", lang.Name)
+	}
 
-// detectLanguage determines the programming language based on shebang and extension
-func detectLanguage(filePath string) (*Language, error) {
-	languages := getSupportedLanguages()
-	
-	// Read first line to check for shebang
-	file, err := os.Open(filePath)
+	// With --keep the decoded program is written next to the .bck, or where
+	// --keep=path says (subject to the conflict policy either way), and left
+	// there; otherwise it lives in a private temporary directory that is
+	// removed after execution.
+	var outPath string
+	keepName := name
+	if opts.keepPath != "" {
+		keepName = opts.keepPath
+		if fi, err := os.Stat(keepName); err == nil && fi.IsDir() || os.IsPathSeparator(keepName[len(keepName)-1]) {
+			keepName = filepath.Join(keepName, filepath.Base(name))
+		}
+		if fi, err := os.Stat(filepath.Dir(keepName)); err != nil || !fi.IsDir() {
+			return res, newError(ErrNotFound, "--keep: there is no directory '%s'", filepath.Dir(keepName))
+		}
+	}
+	if opts.keep {
+		var skip bool
+		outPath, skip, err = resolveConflict(keepName, opts)
+		res.Output = outPath
+		if err != nil || skip {
+			res.Action = "skipped"
+			return res, err
+		}
+	}
+
+	if opts.dryRun {
+		switch {
+		case opts.stdin:
+			opts.infof("Would pipe decoded '%s' into %s (%s)\n", filepath.Base(name), lang.Command, lang.Name)
+		case opts.keep:
+			opts.infof("Would decode '%s' → '%s'\n", filepath.Base(inPath), keptName(outPath, opts))
+		default:
+			opts.infof("Would decode '%s' to a temporary '%s'\n", filepath.Base(inPath), filepath.Base(name))
+		}
+		if !opts.stdin {
+			if lang.BuildCommand != "" {
+				opts.infof("Would compile '%s' with %s (%s) into a temporary binary and run it\n", filepath.Base(name), lang.BuildCommand, lang.Name)
+			} else {
+				opts.infof("Would run '%s' with %s (%s)\n", filepath.Base(name), lang.Command, lang.Name)
+			}
+		}
+		if opts.sandbox {
+			opts.infof("Would run inside the sandbox (%s)\n", describeSandbox(opts))
+		}
+		if opts.container {
+			opts.infof("Would run inside a %s container from %s, mounting only the temporary directory\n", rt, image)
+		}
+		if len(opts.interpArgs) > 0 {
+			opts.infof("Would pass %s arguments: %q\n", lang.tool(), opts.interpArgs)
+		}
+		if len(opts.scriptArgs) > 0 {
+			opts.infof("Would pass arguments: %q\n", opts.scriptArgs)
+		}
+		if opts.maxMem > 0 || opts.maxCPU > 0 {
+			opts.infof("Would limit the program to %s\n", describeLimits(opts))
+		}
+		if as != nil {
+			opts.infof("Would run the program as %s\n", as)
+		}
+		if opts.stdoutFile != "" || opts.stderrFile != "" {
+			opts.infof("Would write the program's %s\n", describeCapture(opts))
+		}
+		return res, nil
+	}
+
+	// A program from the network runs only once the user has seen where it
+	// came from and agreed to.
+	if opts.source != "" && !opts.yes {
+		ok, err := confirmRun(name, lang, raw, decoded, opts)
+		if err != nil {
+			return res, err
+		}
+		if !ok {
+			res.Action = "skipped"
+			opts.infof("Not running '%s'\n", filepath.Base(name))
+			return res, nil
+		}
+	}
+
+	x := &execution{ctx: ctx, opts: opts, runtime: rt, image: image, env: env, as: as}
+	if as != nil {
+		x.env = append(as.env(), env...)
+	}
+	closeOutput, err := x.captureOutput()
+	defer closeOutput()
 	if err != nil {
-		return nil, wrapPathErr(err, filePath)
+		return res, err
+	}
+
+	// An unchanged .bck reuses its cache entry: the program is not decoded
+	// again and a compiled binary is not rebuilt.
+	if useRunCache(opts) {
+		if dir, err := runCacheEntry(data, lang); err == nil {
+			x.workdir, x.cached = dir, true
+		} else {
+			opts.logger().Warn("not caching", "error", err)
+		}
+	}
+
+	// Otherwise a temporary directory holds the decoded program (unless
+	// --keep or --stdin), any compiled binary, and is the sandbox's working
+	// directory or the container's only mount.
+	if x.workdir == "" && (!opts.stdin || opts.sandbox || opts.container) {
+		tmpDir, err := os.MkdirTemp("", "backlang-run-*")
+		if err != nil {
+			return res, err
+		}
+		defer os.RemoveAll(tmpDir)
+		x.workdir = tmpDir
+	}
+
+	if opts.stdin {
+		opts.infof("Detected %s, piping into %s...\n", lang.Name, lang.Command)
+		return x.done(res, x.executeStdin(lang, decoded))
+	}
+
+	if !opts.keep {
+		// Keep the original base name so extension-based tooling still works,
+		// unless the language needs a specific one.
+		tmpName := filepath.Base(name)
+		if lang.TempName != "" {
+			tmpName = lang.TempName
+		}
+		outPath = filepath.Join(x.workdir, tmpName)
+	}
+
+	// Write decoded content. Each run without --keep has a directory of its
+	// own; with --keep, concurrent runs must not share or see a
+	// half-written copy.
+	switch {
+	case opts.keep && outPath != keepName:
+		if outPath, err = writeNumbered(keepName, outPath, decoded, 0o666); err != nil {
+			return res, wrapPathErr(err, outPath)
+		}
+		res.Output = outPath
+	case opts.keep:
+		if err := writeFileStream(outPath, 0o666, true, false, writeAll(decoded)); err != nil {
+			return res, wrapPathErr(err, outPath)
+		}
+	case x.cached && fileExists(outPath):
+		opts.logger().Debug("reusing cached program", "path", outPath)
+	case x.cached:
+		// Another run may be using the same entry, so never expose a
+		// partially written file
+		if err := writeFileAtomic(outPath, decoded, 0o600); err != nil {
+			return res, wrapPathErr(err, outPath)
+		}
+	default:
+		if err := os.WriteFile(outPath, decoded, 0o666); err != nil {
+			return res, wrapPathErr(err, outPath)
+		}
 	}
-	defer file.Close()
 
-	scanner := bufio.NewScanner(file)
-	var firstLine string
-	if scanner.Scan() {
-		firstLine = strings.TrimSpace(scanner.Text())
+	if opts.keep {
+		opts.infof("Decoded '%s' → '%s'\n", filepath.Base(inPath), keptName(outPath, opts))
+	} else if !x.cached {
+		opts.logger().Debug("decoded to temporary file", "path", outPath)
 	}
+	if as != nil && x.workdir != "" {
+		if err := as.handOver(x.workdir); err != nil {
+			return res, wrapPathErr(err, x.workdir)
+		}
+	}
+	if lang.BuildCommand != "" {
+		opts.infof("Detected %s, compiling with %s...\n", lang.Name, lang.BuildCommand)
+		return x.done(res, x.buildAndRun(lang, outPath))
+	}
+	opts.infof("Detected %s, running with %s...\n", lang.Name, lang.Command)
+	return x.done(res, x.executeFile(lang, outPath))
+}
+
+// keptName is how messages name the program --keep left at path: by its
+// base name next to the .bck, in full where --keep=path put it.
+func keptName(path string, opts options) string {
+	if opts.keepPath != "" {
+		return path
+	}
+	return filepath.Base(path)
+}
+
+// detectLanguage determines the programming language based on the shebang in
+// content and the extension of filePath
+func detectLanguage(filePath string, content []byte, opts options) (*Language, error) {
+	languages, err := loadLanguages()
+	if err != nil {
+		return nil, err
+	}
+
+	// Read first line to check for shebang
+	firstLine, _, _ := bytes.Cut(content, []byte("\n"))
+	shebang := strings.TrimSpace(string(firstLine))
 
 	// Check shebang first (more specific)
-	if strings.HasPrefix(firstLine, "#!") {
+	if strings.HasPrefix(shebang, "#!") {
 		for _, lang := range languages {
-			for _, shebang := range lang.Shebangs {
-				if strings.HasPrefix(firstLine, shebang) {
+			for _, prefix := range lang.Shebangs {
+				if strings.HasPrefix(shebang, prefix) {
+					opts.logger().Debug("detected language", "shebang", shebang, "language", lang.Name)
 					return &lang, nil
 				}
 			}
 		}
 	}
 
+	// Then a vim or emacs modeline, which names the type outright
+	if ft := modelineType(content); ft != "" {
+		for _, lang := range languages {
+			if slices.ContainsFunc(lang.Modelines, func(m string) bool { return strings.EqualFold(m, ft) }) {
+				opts.logger().Debug("detected language", "modeline", ft, "language", lang.Name)
+				return &lang, nil
+			}
+		}
+	}
+
 	// Check file extension
 	ext := strings.ToLower(filepath.Ext(filePath))
 	for _, lang := range languages {
 		for _, langExt := range lang.Extensions {
 			if ext == langExt {
+				opts.logger().Debug("detected language", "extension", ext, "language", lang.Name)
 				return &lang, nil
 			}
 		}
 	}
 
-	return nil, fmt.Errorf("Error: No interpreter found for '%s'", filepath.Base(filePath))
+	return nil, newError(ErrNoInterpreter, "No interpreter found for '%s'", filepath.Base(filePath))
 }
 
-// executeFile runs the decoded file with the appropriate interpreter
-func executeFile(lang *Language, filePath string) error {
-	// Prepare command
-	args := append(lang.Args, filePath)
-	cmd := exec.Command(lang.Command, args...)
-	
-	// Connect stdin, stdout, stderr
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	
-	// Execute
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("Error: Failed to execute with %s: %v", lang.Command, err)
-	}
-	
+// findVenvPython returns the python of the active virtualenv ($VIRTUAL_ENV),
+// or of a .venv directory in dir or one of its parents, or "" if none exists
+func findVenvPython(dir string) string {
+	if venv := os.Getenv("VIRTUAL_ENV"); venv != "" {
+		if py := venvPython(venv); py != "" {
+			return py
+		}
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		if py := venvPython(filepath.Join(dir, ".venv")); py != "" {
+			return py
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// venvPython returns the python executable inside the virtualenv at venv
+func venvPython(venv string) string {
+	py := filepath.Join(venv, "bin", "python")
+	if runtime.GOOS == "windows" {
+		py = filepath.Join(venv, "Scripts", "python.exe")
+	}
+	if fi, err := os.Stat(py); err == nil && !fi.IsDir() {
+		return py
+	}
+	return ""
+}
+
+// execution holds the per-invocation settings run uses to start processes
+type execution struct {
+	ctx     context.Context // ends on --timeout or a --watch restart
+	opts    options
+	workdir string    // private temporary directory or cache entry for this run ("" if none)
+	cached  bool      // workdir is a cache entry shared with other runs
+	runtime string    // container CLI for --container
+	image   string    // container image for --container
+	env     []string  // --env-file and --env entries for the program
+	stdout  io.Writer // the program's stdout and stderr (see captureOutput)
+	stderr  io.Writer
+	usage   *runUsage // of the last command run, for --stats
+	as      *runAs    // --user's account for the program (not a compiler)
+}
+
+// executeFile runs the decoded file with the appropriate interpreter,
+// passing the program arguments
+func (x *execution) executeFile(lang *Language, filePath string) error {
+	// Prepare command: interpreter args, then the file, then program args
+	args := slices.Concat(lang.Args, lang.FileArgs, []string{filePath}, x.opts.scriptArgs)
+	if err := x.runCommand(lang.Command, args, os.Stdin, x.stdout, x.stderr); err != nil {
+		return programError(err, filepath.Base(filePath), "Failed to execute with %s", lang.Command)
+	}
+	return nil
+}
+
+// executeStdin runs the interpreter with source piped into its stdin, so
+// the decoded program is never written to disk
+func (x *execution) executeStdin(lang *Language, source []byte) error {
+	args := append(append(append([]string{}, lang.Args...), lang.StdinArgs...), x.opts.scriptArgs...)
+	if err := x.runCommand(lang.Command, args, bytes.NewReader(source), x.stdout, x.stderr); err != nil {
+		return programError(err, lang.Name+" program", "Failed to execute with %s", lang.Command)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// buildAndRun compiles filePath into a binary inside the working directory,
+// then runs the binary. Compiler output goes to stderr so the program's
+// stdout stays clean.
+func (x *execution) buildAndRun(lang *Language, filePath string) error {
+	bin := filepath.Join(x.workdir, "program")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	if x.cached && fileExists(bin) {
+		x.opts.logger().Debug("reusing cached binary", "path", bin)
+	} else {
+		// A cached binary is built under a private name and renamed into
+		// place, so concurrent runs never execute a half-written one
+		out := bin
+		if x.cached {
+			out = filepath.Join(x.workdir, fmt.Sprintf(".build-%d-%s", os.Getpid(), filepath.Base(bin)))
+			defer os.Remove(out)
+		}
+		args := append(append(append([]string{}, lang.BuildArgs...), "-o", out), filePath)
+		// The limits and --user are the program's; compilers often need
+		// more, and a home of their own for caches.
+		build := *x
+		build.opts.maxMem, build.opts.maxCPU, build.as = 0, 0, nil
+		if err := build.runCommand(lang.BuildCommand, args, nil, os.Stderr, os.Stderr); err != nil {
+			return execError(err, "Failed to compile with %s", lang.BuildCommand)
+		}
+		if out != bin {
+			if err := os.Rename(out, bin); err != nil {
+				return execError(err, "Failed to cache compiled %s program", lang.Name)
+			}
+		}
+	}
+	args := append(append([]string{}, lang.Args...), x.opts.scriptArgs...)
+	if err := x.runCommand(bin, args, os.Stdin, x.stdout, x.stderr); err != nil {
+		return programError(err, "compiled "+lang.Name+" program", "Failed to execute compiled %s program", lang.Name)
+	}
+	return nil
+}
+
+// runCommand starts name with args and waits for it to finish. With
+// --sandbox the command is wrapped in the sandbox helper, with --container it
+// runs in a fresh container. If the context can end (--timeout or --watch)
+// the command runs in its own process group, and the whole group is killed
+// when the context ends or backlang is interrupted.
+func (x *execution) runCommand(name string, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	display := filepath.Base(name)
+	// The limit helper goes innermost: the sandbox helper could not start
+	// under the limits.
+	if (x.opts.maxMem > 0 || x.opts.maxCPU > 0) && !x.opts.container {
+		var err error
+		if name, args, err = limitCommand(name, args, x.opts); err != nil {
+			return err
+		}
+	}
+	if x.opts.sandbox {
+		var err error
+		if name, args, err = sandboxCommand(x.workdir, name, args); err != nil {
+			return err
+		}
+	}
+	var containerName string
+	if x.opts.container {
+		containerName = newContainerName()
+		name, args = containerCommand(x.runtime, x.image, containerName, x.workdir, x.env, containerLimits(x.opts), name, args)
+		x.opts.logger().Debug("exec", "command", name, "args", args)
+	}
+	cmd := exec.CommandContext(x.ctx, name, args...)
+	if err := quoteForCmd(cmd); err != nil {
+		return err
+	}
+	if x.as != nil {
+		setCredential(cmd, x.as)
+	}
+
+	// Connect stdin, stdout, stderr
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	// The container gets its own environment; only the client runs here.
+	switch {
+	case x.opts.container:
+	case x.opts.sandbox:
+		cmd.Env = append(sandboxEnv(x.workdir), x.env...)
+	case x.opts.cleanEnv:
+		cmd.Env = append(cleanEnv(), x.env...)
+	case len(x.env) > 0:
+		cmd.Env = append(os.Environ(), x.env...)
+	}
+	if x.opts.sandbox {
+		cmd.Dir = x.workdir
+		if err := setSandboxAttrs(cmd, x.opts.sandboxNet); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	defer func() {
+		if cmd.ProcessState != nil {
+			x.usage = usageOf(display, cmd.ProcessState, time.Since(start))
+		}
+	}()
+	if x.ctx.Done() == nil {
+		return sandboxStartError(cmd.Run(), x.opts)
+	}
+
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		err := killProcessGroup(cmd)
+		// Killing the client does not stop the container itself.
+		if containerName != "" {
+			removeContainer(x.runtime, containerName)
+		}
+		return err
+	}
+	cmd.WaitDelay = time.Second
+	if err := cmd.Start(); err != nil {
+		return sandboxStartError(err, x.opts)
+	}
+	// The child no longer shares our process group, so forward Ctrl-C.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for range sigs {
+			killProcessGroup(cmd)
+		}
+	}()
+	err := cmd.Wait()
+	signal.Stop(sigs)
+	close(sigs)
+
+	if errors.Is(x.ctx.Err(), context.DeadlineExceeded) {
+		return newError(ErrTimeout, "%s timed out and was killed", display)
+	}
+	return err
+}
+
+// programError reports a failure of the user's program. A non-zero exit
+// keeps its status (128+N when killed by signal N, as shells report it);
+// anything else, such as an interpreter that could not be started, is an
+// execError.
+func programError(err error, what string, format string, args ...any) error {
+	var ee *exec.ExitError
+	if !errors.As(err, &ee) {
+		return execError(err, format, args...)
+	}
+	status := ee.ExitCode()
+	if sig, _, ok := exitSignal(ee.ProcessState); ok {
+		status = 128 + sig
+	}
+	if status <= 0 {
+		return execError(err, format, args...)
+	}
+	return &exitStatusError{
+		cliError: cliError{kind: ErrProgramExit, msg: fmt.Sprintf("Error: %s exited with status %d", what, status)},
+		status:   status,
+	}
+}
+
+// execError reports a failure from runCommand, keeping errors that already
+// carry a cause (such as a timeout) as they are
+func execError(err error, format string, args ...any) error {
+	var ce *cliError
+	if errors.As(err, &ce) {
+		return err
+	}
+	return newError(ErrExec, format+": %v", append(args, err)...)
+}
@@ -0,0 +1,789 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunLeavesNoArtifact(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	bck := filepath.Join(tempDir, "hello.sh.bck")
+	os.WriteFile(bck, []byte("exit 0\n"), 0644)
+
+	if _, err := run(bck, options{quiet: true}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if fileExists(filepath.Join(tempDir, "hello.sh")) {
+		t.Error("run left the decoded program behind without --keep")
+	}
+
+	if _, err := run(bck, options{quiet: true, keep: true}); err != nil {
+		t.Fatalf("run --keep failed: %v", err)
+	}
+	if !fileExists(filepath.Join(tempDir, "hello.sh")) {
+		t.Error("run --keep did not keep the decoded program")
+	}
+}
+
+func TestRunKeepPath(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	bck := filepath.Join(tempDir, "hello.sh.bck")
+	os.WriteFile(bck, []byte("exit 0\n"), 0644)
+	debug := filepath.Join(tempDir, "debug")
+	os.Mkdir(debug, 0o755)
+
+	for _, tt := range []struct{ keep, want string }{
+		{debug, filepath.Join(debug, "hello.sh")},
+		{filepath.Join(debug, "what-ran.sh"), filepath.Join(debug, "what-ran.sh")},
+	} {
+		res, err := run(bck, options{quiet: true, keep: true, keepPath: tt.keep})
+		if err != nil {
+			t.Fatalf("run --keep=%s failed: %v", tt.keep, err)
+		}
+		if got, _ := os.ReadFile(tt.want); string(got) != "exit 0\n" || res.Output != tt.want {
+			t.Errorf("run --keep=%s: output %q holds %q, want the program at %s", tt.keep, res.Output, got, tt.want)
+		}
+	}
+	if fileExists(filepath.Join(tempDir, "hello.sh")) {
+		t.Error("run --keep=path also left the program next to the .bck")
+	}
+	if _, err := run(bck, options{quiet: true, keep: true, keepPath: filepath.Join(tempDir, "missing", "x.sh")}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("run --keep into a missing directory: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRunInterpArgs(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	marker := filepath.Join(tempDir, "ran")
+	bck := filepath.Join(tempDir, "hello.sh.bck")
+	// "bash -e" stops at the failing command before it reaches touch
+	os.WriteFile(bck, encodeBytes([]byte("false\ntouch \"$1\"\n")), 0644)
+
+	if _, err := run(bck, options{quiet: true, scriptArgs: []string{marker}}); err != nil || !fileExists(marker) {
+		t.Fatalf("run without -e: err = %v, ran to the end = %v", err, fileExists(marker))
+	}
+	os.Remove(marker)
+	if _, err := run(bck, options{quiet: true, scriptArgs: []string{marker}, interpArgs: []string{"-e"}}); !errors.Is(err, ErrProgramExit) || fileExists(marker) {
+		t.Errorf("run --interp-args -e: err = %v, ran past false = %v; want bash to stop", err, fileExists(marker))
+	}
+}
+
+func TestRunModule(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 not available")
+	}
+	tempDir := t.TempDir()
+	t.Chdir(tempDir)
+	pkg := filepath.Join(tempDir, "app")
+	os.MkdirAll(filepath.Join(pkg, "sub"), 0755)
+	os.WriteFile(filepath.Join(pkg, "__init__.py"), nil, 0644)
+	os.WriteFile(filepath.Join(pkg, "sub", "__init__.py"), nil, 0644)
+	os.WriteFile(filepath.Join(pkg, "helper.py.bck"), encodeBytes([]byte("def mark(path, text):\n    open(path, 'w').write(text)\n")), 0644)
+	os.WriteFile(filepath.Join(pkg, "__main__.py.bck"), encodeBytes([]byte("import sys\nfrom .helper import mark\nmark(sys.argv[1], __name__)\n")), 0644)
+	os.WriteFile(filepath.Join(pkg, "sub", "tool.py.bck"), encodeBytes([]byte("import sys\nfrom ..helper import mark\nmark(sys.argv[1], __spec__.name)\n")), 0644)
+
+	for _, tc := range []struct{ input, want string }{
+		{"app", "__main__"},
+		{filepath.Join("app", "sub", "tool.py.bck"), "app.sub.tool"},
+	} {
+		marker := filepath.Join(tempDir, "ran")
+		if _, err := runModule(tc.input, options{quiet: true, noVenv: true, scriptArgs: []string{marker}}); err != nil {
+			t.Fatalf("runModule(%q): %v", tc.input, err)
+		}
+		if got, _ := os.ReadFile(marker); string(got) != tc.want {
+			t.Errorf("runModule(%q) ran as %q, want %q", tc.input, got, tc.want)
+		}
+	}
+	if _, err := runModule(filepath.Join("app", "sub"), options{quiet: true}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("runModule on a package without __main__.py: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRunCaptureOutput(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	bck := filepath.Join(tempDir, "hello.sh.bck")
+	os.WriteFile(bck, encodeBytes([]byte("echo out\necho err >&2\n")), 0644)
+	stdout, stderr := filepath.Join(tempDir, "out.log"), filepath.Join(tempDir, "err.log")
+	os.WriteFile(stdout, []byte("from an earlier run\n"), 0644)
+
+	if _, err := run(bck, options{quiet: true, stdoutFile: stdout, stderrFile: stderr}); err != nil {
+		t.Fatalf("run --stdout --stderr: %v", err)
+	}
+	if got, _ := os.ReadFile(stdout); string(got) != "out\n" {
+		t.Errorf("--stdout file = %q, want %q", got, "out\n")
+	}
+	if got, _ := os.ReadFile(stderr); string(got) != "err\n" {
+		t.Errorf("--stderr file = %q, want %q", got, "err\n")
+	}
+
+	// One file named by both gets both streams.
+	both := filepath.Join(tempDir, "both.log")
+	if _, err := run(bck, options{quiet: true, stdoutFile: both, stderrFile: both}); err != nil {
+		t.Fatalf("run --stdout f --stderr f: %v", err)
+	}
+	if got, _ := os.ReadFile(both); string(got) != "out\nerr\n" {
+		t.Errorf("shared file = %q, want %q", got, "out\nerr\n")
+	}
+}
+
+func TestRunStats(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	bck := filepath.Join(t.TempDir(), "fail.sh.bck")
+	os.WriteFile(bck, encodeBytes([]byte("exit 4\n")), 0644)
+
+	res, err := run(bck, options{quiet: true, json: true, runStats: true})
+	if !errors.Is(err, ErrProgramExit) {
+		t.Fatalf("run --stats: err = %v, want ErrProgramExit", err)
+	}
+	if u := res.Usage; u == nil || u.Command != "bash" || u.Status != 4 || u.Wall <= 0 {
+		t.Errorf("run --stats usage = %+v, want bash's, with exit status 4", u)
+	}
+	if res, _ := run(bck, options{quiet: true}); res.Usage != nil {
+		t.Errorf("run without --stats reported usage %+v", res.Usage)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("rlimits are Unix-only")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "limits")
+	bck := filepath.Join(tempDir, "limits.sh.bck")
+	os.WriteFile(bck, encodeBytes([]byte("echo \"$(ulimit -v) $(ulimit -t)\" > \"$1\"\n")), 0644)
+
+	if _, err := run(bck, options{quiet: true, noCache: true, maxMem: 256 << 20, maxCPU: 1500 * time.Millisecond, scriptArgs: []string{out}}); err != nil {
+		t.Fatalf("run --max-mem --max-cpu: %v", err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != "262144 2\n" {
+		t.Errorf("limits seen by the program = %q, want %q (KiB of address space, seconds of CPU)", got, "262144 2\n")
+	}
+}
+
+func TestRunAsUser(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() != 0 {
+		t.Skip("needs root on Unix")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	nobody, err := lookupRunAs("nobody")
+	if err != nil {
+		t.Skip("no user nobody")
+	}
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "out")
+	bck := filepath.Join(tempDir, "who.sh.bck")
+	// The program reads itself from a workdir it can write to, and its
+	// output goes through a file we opened.
+	os.WriteFile(bck, encodeBytes([]byte("touch \"$(dirname \"$0\")/mine\" && echo \"$(id -u) $HOME\"\n")), 0644)
+
+	if _, err := run(bck, options{quiet: true, user: "nobody", stdoutFile: out}); err != nil {
+		t.Fatalf("run --user nobody: %v", err)
+	}
+	want := fmt.Sprintf("%d %s\n", nobody.uid, nobody.home)
+	if got, _ := os.ReadFile(out); string(got) != want {
+		t.Errorf("run --user nobody printed %q, want %q", got, want)
+	}
+	if _, err := lookupRunAs("no-such-user-here"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("lookupRunAs of a missing user: err = %v, want ErrNotFound", err)
+	}
+}
+
+func TestRunAsSelf(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("--user is Unix only")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	me, err := user.Current()
+	if err != nil {
+		t.Skip("cannot look up the current user")
+	}
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "out")
+	bck := filepath.Join(tempDir, "id.sh.bck")
+	os.WriteFile(bck, encodeBytes([]byte("id -u\n")), 0644)
+
+	// Anyone may name themselves, root or not.
+	if _, err := run(bck, options{quiet: true, user: me.Username, stdoutFile: out}); err != nil {
+		t.Fatalf("run --user %s as %s: %v", me.Username, me.Username, err)
+	}
+	if got, _ := os.ReadFile(out); string(got) != me.Uid+"\n" {
+		t.Errorf("run --user %s printed %q, want %q", me.Username, got, me.Uid+"\n")
+	}
+}
+
+func TestResolveCommand(t *testing.T) {
+	languages := getSupportedLanguages()
+	lang := func(name string) *Language {
+		return &languages[slices.IndexFunc(languages, func(l Language) bool { return l.Name == name })]
+	}
+	// onPath stands in for exec.LookPath with only the given programs
+	// installed; on Windows, like LookPath, it finds name.exe for name.
+	onPath := func(goos string, names ...string) func(string) (string, error) {
+		return func(name string) (string, error) {
+			if goos == "windows" {
+				name += ".exe"
+			}
+			if slices.Contains(names, name) {
+				return `C:\tools\` + name, nil
+			}
+			return "", exec.ErrNotFound
+		}
+	}
+	t.Setenv("BACKLANG_PYTHON", "")
+
+	tests := []struct {
+		lang, goos string
+		installed  []string
+		want       string // the command and its leading arguments
+	}{
+		{"Python", "windows", []string{"py.exe", "python.exe", "python3.exe"}, "py -3"},
+		{"Python", "windows", []string{"python.exe", "python3.exe"}, "python"},
+		{"Python", "windows", []string{"python3.exe"}, "python3"},
+		{"Python", "linux", []string{"python", "python3"}, "python3"},
+		{"Python", "linux", []string{"python"}, "python"},
+		{"JavaScript", "windows", []string{"node.exe"}, "node"},
+		{"C", "windows", []string{"gcc.exe"}, "gcc -O2"},
+		{"C", "linux", []string{"cc", "gcc"}, "cc -O2"},
+	}
+	for _, tt := range tests {
+		l, _, err := resolveCommand(lang(tt.lang), tt.goos, onPath(tt.goos, tt.installed...))
+		if err != nil {
+			t.Errorf("%s on %s with %v: %v", tt.lang, tt.goos, tt.installed, err)
+			continue
+		}
+		got := strings.Join(append([]string{l.Command}, l.Args...), " ")
+		if l.BuildCommand != "" {
+			got = strings.Join(append([]string{l.BuildCommand}, l.BuildArgs...), " ")
+		}
+		if got != tt.want {
+			t.Errorf("%s on %s with %v resolved to %q, want %q", tt.lang, tt.goos, tt.installed, got, tt.want)
+		}
+	}
+
+	_, _, err := resolveCommand(lang("Python"), "windows", onPath("windows"))
+	if !errors.Is(err, ErrNoInterpreter) || !strings.Contains(err.Error(), "'py', 'python', 'python3'") {
+		t.Errorf("Python with nothing installed: err = %v, want ErrNoInterpreter naming every candidate", err)
+	}
+	// An override, or a virtualenv's python, is the only choice.
+	t.Setenv("BACKLANG_PYTHON", "pypy3")
+	if _, _, err := resolveCommand(&Language{Name: "Python", Command: "pypy3", Fallbacks: []string{"python"}}, "linux", onPath("linux", "python")); !errors.Is(err, ErrNoInterpreter) {
+		t.Errorf("overridden interpreter missing: err = %v, want ErrNoInterpreter", err)
+	}
+	venv := &Language{Name: "Ruby", Command: filepath.Join("venv", "bin", "ruby"), Fallbacks: []string{"ruby"}}
+	if got := venv.candidates("linux"); len(got) != 1 {
+		t.Errorf("candidates of a command given by path = %q, want only it", got)
+	}
+}
+
+func TestConcurrentRunKeep(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	bck := filepath.Join(tempDir, "hello.sh.bck")
+	os.WriteFile(bck, []byte("exit 0\n"), 0644)
+	os.WriteFile(filepath.Join(tempDir, "hello.sh"), []byte("exit 0\n"), 0644)
+
+	// Every run asked to keep a renamed copy gets a name of its own.
+	const runs = 8
+	outputs := make([]string, runs)
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := run(bck, options{quiet: true, keep: true, onConflict: conflictRename})
+			if err != nil {
+				t.Errorf("run %d: %v", i, err)
+			}
+			outputs[i] = res.Output
+		}()
+	}
+	wg.Wait()
+	slices.Sort(outputs)
+	if n := len(slices.Compact(outputs)); n != runs {
+		t.Errorf("%d runs kept %d distinct files: %q", runs, n, outputs)
+	}
+
+	taken := filepath.Join(tempDir, "hello_9.sh")
+	os.WriteFile(taken, nil, 0644)
+	if got, err := writeNumbered(filepath.Join(tempDir, "hello.sh"), taken, []byte("x"), 0644); err != nil || got != filepath.Join(tempDir, "hello_10.sh") {
+		t.Errorf("writeNumbered over a taken name = %q, %v", got, err)
+	}
+}
+
+func TestRunURL(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	marker := filepath.Join(t.TempDir(), "ran")
+	program := []byte("touch " + marker + "\n")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/hello.sh.bck" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(program)
+	}))
+	defer srv.Close()
+	url := srv.URL + "/hello.sh.bck"
+
+	if !stdinIsTerminal() {
+		if _, err := runURL(url, options{quiet: true}); !errors.Is(err, ErrUsage) || fileExists(marker) {
+			t.Errorf("run of a URL without --yes or a terminal: err = %v, want ErrUsage and nothing run", err)
+		}
+	}
+	for _, c := range []struct {
+		url  string
+		opts options
+		want error
+	}{
+		{srv.URL + "/missing.sh.bck", options{}, ErrNotFound},
+		{url, options{maxFetch: 4}, ErrNetwork},
+		{url, options{sha256: strings.Repeat("0", 64)}, ErrCorrupt},
+		{srv.URL + "/hello.sh", options{}, ErrNotBck},
+	} {
+		c.opts.quiet, c.opts.yes = true, true
+		if _, err := runURL(c.url, c.opts); !errors.Is(err, c.want) {
+			t.Errorf("runURL(%s, %+v) error = %v, want %v", c.url, c.opts, err, c.want)
+		}
+	}
+	if fileExists(marker) {
+		t.Fatal("a refused download was run")
+	}
+
+	sum := sha256.Sum256(program)
+	res, err := runURL(url, options{quiet: true, yes: true, sha256: hex.EncodeToString(sum[:])})
+	if err != nil || res.Action != "ran" || res.Input != url || !fileExists(marker) {
+		t.Errorf("runURL = %+v, %v; ran: %v", res, err, fileExists(marker))
+	}
+}
+
+func TestRunStdin(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	marker := filepath.Join(tempDir, "ran")
+	bck := filepath.Join(tempDir, "touch.sh.bck")
+	os.WriteFile(bck, []byte("touch \"$1\"\n"), 0644)
+
+	if _, err := run(bck, options{quiet: true, stdin: true, scriptArgs: []string{marker}}); err != nil {
+		t.Fatalf("run --stdin failed: %v", err)
+	}
+	if !fileExists(marker) {
+		t.Error("run --stdin did not execute the program with its arguments")
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 2 {
+		t.Errorf("run --stdin wrote files: %v", entries)
+	}
+}
+
+func TestDetectLanguage(t *testing.T) {
+	tests := []struct {
+		name, file, content, want string
+	}{
+		{"python extension", "script.py", "print('hi')\n", "Python"},
+		{"javascript extension", "app.js", "console.log('hi')\n", "JavaScript"},
+		{"module extension", "app.mjs", "export {}\n", "JavaScript"},
+		{"node shebang", "tool", "#!/usr/bin/env node\nconsole.log(1)\n", "JavaScript"},
+		{"shebang beats extension", "tool.py", "#!/bin/bash\necho hi\n", "Bash"},
+		{"bash extension", "setup.sh", "echo hi\n", "Bash"},
+		{"ruby extension", "script.rb", "puts 'hi'\n", "Ruby"},
+		{"perl extension", "script.pl", "print \"hi\";\n", "Perl"},
+		{"perl shebang", "tool", "#!/usr/bin/perl -w\nprint 1;\n", "Perl"},
+		{"php extension", "index.php", "<?php echo 1;\n", "PHP"},
+		{"lua extension", "game.lua", "print('hi')\n", "Lua"},
+		{"lua shebang", "tool", "#!/usr/bin/env lua\nprint(1)\n", "Lua"},
+		{"go extension", "main.go", "package main\n", "Go"},
+		{"c extension", "hello.c", "int main(void) { return 0; }\n", "C"},
+		{"rust extension", "main.rs", "fn main() {}\n", "Rust"},
+		{"powershell extension", "setup.ps1", "Write-Output 'hi'\n", "PowerShell"},
+		{"pwsh shebang", "tool", "#!/usr/bin/env pwsh\nWrite-Output 1\n", "PowerShell"},
+		{"batch extension", "build.bat", "@echo off\n", "Batch"},
+		{"cmd extension", "build.CMD", "@echo off\n", "Batch"},
+		{"ruby shebang", "tool", "#!/usr/bin/env ruby\nputs 'hi'\n", "Ruby"},
+		{"vim modeline", "tool", "print('hi')\n# vim: ft=python\n", "Python"},
+		{"emacs modeline", "tool", "# -*- mode: ruby -*-\nputs 'hi'\n", "Ruby"},
+		{"modeline beats extension", "tool.txt", "// vim: set filetype=javascript :\n", "JavaScript"},
+		{"shebang beats modeline", "tool", "#!/bin/sh\n# vim: ft=perl\n", "Bash"},
+		{"unknown modeline", "tool", "# vim: ft=cobol\n", ""},
+		{"unknown", "notes.txt", "hello\n", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lang, err := detectLanguage(tt.file, []byte(tt.content), options{})
+			if tt.want == "" {
+				if !errors.Is(err, ErrNoInterpreter) {
+					t.Errorf("detectLanguage() error = %v, want ErrNoInterpreter", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("detectLanguage() error = %v", err)
+			}
+			if lang.Name != tt.want {
+				t.Errorf("detectLanguage() = %s, want %s", lang.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestModelineType(t *testing.T) {
+	tests := []struct{ content, want string }{
+		{"# vim: ft=python\n", "python"},
+		{"x = 1\n# vim: set ts=4 filetype=Python :\n", "python"},
+		{"/* vi:set ft=c: */\n", "c"},
+		{"code\n\tex: ft=lua\n", "lua"},
+		{"# -*- mode: ruby; coding: utf-8 -*-\n", "ruby"},
+		{";; -*- lua -*-\n", "lua"},
+		{"#!/usr/bin/env foo\n# -*- mode: perl-mode -*-\n", "perl"},
+		{"first\n# -*- mode: perl -*-\n", ""},
+		{"x\n\n# Local Variables:\n# fill-column: 70\n# mode: sh\n# End:\n", "sh"},
+		{"run gvim:ft=python\n", ""},
+		{"l1\nl2\nl3\nl4\nl5\n# vim: ft=python\nl7\nl8\nl9\nl10\nl11\nl12\n", ""},
+		{"plain text\n", ""},
+	}
+	for _, tt := range tests {
+		if got := modelineType([]byte(tt.content)); got != tt.want {
+			t.Errorf("modelineType(%q) = %q, want %q", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestPeekLanguage(t *testing.T) {
+	dir := t.TempDir()
+	body := strings.Repeat("echo filler line\n", 2000) // well past peekLen
+	tests := []struct {
+		name, content, mode, want string
+	}{
+		{"tool", "#!/bin/bash\n" + body, modeLines, "Bash"},
+		{"tool", "#!/usr/bin/env python3\nprint(1)", modeLines, "Python"},
+		{"tool", "#!/usr/bin/env ruby\n" + body, modeChars, "Ruby"},
+		{"tool", "#!/usr/bin/env node\n" + body, modeBytes, "JavaScript"},
+		{"tool", body + "# vim: ft=perl\n", modeLines, "Perl"},
+		{"tool.lua", body, modeBlocks, "Lua"},
+	}
+	for _, tt := range tests {
+		in := filepath.Join(dir, tt.name)
+		os.WriteFile(in, []byte(tt.content), 0o644)
+		if _, err := encode(in, options{quiet: true, onConflict: conflictOverwrite, mode: tt.mode, blockSize: 4096}); err != nil {
+			t.Fatal(err)
+		}
+		lang, err := peekLanguage(in+".bck", options{})
+		if err != nil || lang.Name != tt.want {
+			t.Errorf("peekLanguage(%s, %s mode) = %v, %v; want %s", tt.name, tt.mode, lang, err, tt.want)
+		}
+	}
+
+	// A recorded name outlasts a rename.
+	in := filepath.Join(dir, "app.rb")
+	os.WriteFile(in, []byte("puts 1\n"), 0o644)
+	if _, err := encode(in, options{quiet: true, storeName: true}); err != nil {
+		t.Fatal(err)
+	}
+	os.Rename(in+".bck", filepath.Join(dir, "notes.bck"))
+	if lang, err := peekLanguage(filepath.Join(dir, "notes.bck"), options{}); err != nil || lang.Name != "Ruby" {
+		t.Errorf("peekLanguage of a renamed .bck = %v, %v; want Ruby from the recorded name", lang, err)
+	}
+}
+
+func TestRunMissingInterpreter(t *testing.T) {
+	t.Setenv("BACKLANG_JAVASCRIPT", "definitely-not-a-real-node")
+	bck := filepath.Join(t.TempDir(), "app.js.bck")
+	os.WriteFile(bck, []byte("console.log('hi')\n"), 0644)
+
+	_, err := run(bck, options{quiet: true})
+	if !errors.Is(err, ErrNoInterpreter) {
+		t.Errorf("run() error = %v, want ErrNoInterpreter", err)
+	}
+}
+
+func TestRunGo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("go run is slow")
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not available")
+	}
+	tempDir := t.TempDir()
+	marker := filepath.Join(tempDir, "ran")
+	// A name go run would refuse if it were kept as-is
+	bck := filepath.Join(tempDir, "tool_test.go.bck")
+	src := "package main\n\nimport \"os\"\n\nfunc main() { os.WriteFile(os.Args[1], nil, 0o644) }\n"
+	os.WriteFile(bck, encodeBytes([]byte(src)), 0644)
+
+	if _, err := run(bck, options{quiet: true, scriptArgs: []string{marker}}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !fileExists(marker) {
+		t.Error("go program did not run")
+	}
+}
+
+func TestRunCompiledC(t *testing.T) {
+	if _, err := exec.LookPath("cc"); err != nil {
+		t.Skip("cc not available")
+	}
+	tempDir := t.TempDir()
+	marker := filepath.Join(tempDir, "ran")
+	bck := filepath.Join(tempDir, "touch.c.bck")
+	src := "#include <stdio.h>\nint main(int argc, char **argv) {\n  FILE *f = fopen(argv[1], \"w\");\n  return f ? 0 : 1;\n}\n"
+	os.WriteFile(bck, encodeBytes([]byte(src)), 0644)
+
+	if _, err := run(bck, options{quiet: true, scriptArgs: []string{marker}}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	if !fileExists(marker) {
+		t.Error("compiled program did not run")
+	}
+	if entries, _ := os.ReadDir(tempDir); len(entries) != 2 {
+		t.Errorf("run left build artifacts behind: %v", entries)
+	}
+}
+
+func TestFindVenvPython(t *testing.T) {
+	t.Setenv("VIRTUAL_ENV", "")
+	project := t.TempDir()
+	sub := filepath.Join(project, "scripts")
+	os.MkdirAll(sub, 0755)
+
+	if py := findVenvPython(sub); py != "" && strings.HasPrefix(py, project) {
+		t.Errorf("findVenvPython() = %q without a .venv", py)
+	}
+
+	py := filepath.Join(project, ".venv", "bin", "python")
+	if runtime.GOOS == "windows" {
+		py = filepath.Join(project, ".venv", "Scripts", "python.exe")
+	}
+	os.MkdirAll(filepath.Dir(py), 0755)
+	os.WriteFile(py, nil, 0755)
+	if got := findVenvPython(sub); got != py {
+		t.Errorf("findVenvPython() = %q, want %q", got, py)
+	}
+
+	active := t.TempDir()
+	activePy := filepath.Join(active, filepath.Base(filepath.Dir(py)), filepath.Base(py))
+	os.MkdirAll(filepath.Dir(activePy), 0755)
+	os.WriteFile(activePy, nil, 0755)
+	t.Setenv("VIRTUAL_ENV", active)
+	if got := findVenvPython(sub); got != activePy {
+		t.Errorf("findVenvPython() with VIRTUAL_ENV = %q, want %q", got, activePy)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	marker := filepath.Join(tempDir, "survived")
+	bck := filepath.Join(tempDir, "slow.sh.bck")
+	// A background child that would outlive a kill of the direct child only
+	src := "(sleep 2; touch \"$1\") &\nsleep 10\n"
+	os.WriteFile(bck, encodeBytes([]byte(src)), 0644)
+
+	start := time.Now()
+	_, err := run(bck, options{quiet: true, timeout: 200 * time.Millisecond, scriptArgs: []string{marker}})
+	if !errors.Is(err, ErrTimeout) || exitCode(err) != exitTimeout {
+		t.Fatalf("run() error = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("run() took %s despite the timeout", elapsed)
+	}
+	if runtime.GOOS != "windows" {
+		time.Sleep(2500 * time.Millisecond)
+		if fileExists(marker) {
+			t.Error("background child survived the timeout")
+		}
+	}
+}
+
+func TestRunExitStatus(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	bck := filepath.Join(tempDir, "fail.sh.bck")
+	os.WriteFile(bck, []byte("exit 42\n"), 0644)
+
+	for _, stdin := range []bool{false, true} {
+		_, err := run(bck, options{quiet: true, stdin: stdin})
+		if !errors.Is(err, ErrProgramExit) || exitCode(err) != 42 {
+			t.Errorf("run(stdin=%v) error = %v (exit %d), want the program's status 42", stdin, err, exitCode(err))
+		}
+	}
+
+	// A missing interpreter is not the program's failure
+	t.Setenv("BACKLANG_BASH", "backlang-no-such-shell")
+	_, err := run(bck, options{quiet: true})
+	if exitCode(err) != exitNoInterpreter {
+		t.Errorf("run(missing bash) exit = %d, want %d", exitCode(err), exitNoInterpreter)
+	}
+}
+
+func TestRunEnv(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "env.txt")
+	bck := filepath.Join(tempDir, "env.sh.bck")
+	os.WriteFile(bck, encodeBytes([]byte("echo \"$FROM_FILE $FROM_FLAG ${BACKLANG_TEST_SECRET-unset}\" > \"$1\"\n")), 0644)
+	envFile := filepath.Join(tempDir, ".env")
+	os.WriteFile(envFile, []byte("FROM_FILE=file\nFROM_FLAG=overridden\n"), 0644)
+	t.Setenv("BACKLANG_TEST_SECRET", "hunter2")
+
+	opts := options{quiet: true, envFile: envFile, env: []string{"FROM_FLAG=flag"}, scriptArgs: []string{out}}
+	for _, tt := range []struct {
+		clean bool
+		want  string
+	}{
+		{false, "file flag hunter2\n"},
+		{true, "file flag unset\n"},
+	} {
+		opts.cleanEnv = tt.clean
+		if _, err := run(bck, opts); err != nil {
+			t.Fatalf("run(clean=%v) failed: %v", tt.clean, err)
+		}
+		if got, _ := os.ReadFile(out); string(got) != tt.want {
+			t.Errorf("run(clean=%v) environment = %q, want %q", tt.clean, got, tt.want)
+		}
+	}
+}
+
+func TestRunCache(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	t.Setenv("BACKLANG_CACHE_DIR", t.TempDir())
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "out.txt")
+	bck := filepath.Join(tempDir, "hello.sh.bck")
+	os.WriteFile(bck, []byte("echo original > \"$1\"\n"), 0644)
+	opts := options{quiet: true, scriptArgs: []string{out}}
+
+	if _, err := run(bck, opts); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	cached, _ := filepath.Glob(filepath.Join(os.Getenv("BACKLANG_CACHE_DIR"), "run", "*", "hello.sh"))
+	if len(cached) != 1 {
+		t.Fatalf("cache entries = %v, want one", cached)
+	}
+
+	// Tamper with the entry to prove the next run reuses it
+	os.WriteFile(cached[0], []byte("echo cached > \"$1\"\n"), 0600)
+	run(bck, opts)
+	if got, _ := os.ReadFile(out); string(got) != "cached\n" {
+		t.Errorf("second run wrote %q, want the cached program's output", got)
+	}
+
+	opts.noCache = true
+	run(bck, opts)
+	if got, _ := os.ReadFile(out); string(got) != "original\n" {
+		t.Errorf("--no-cache run wrote %q, want a fresh decode", got)
+	}
+
+	// A changed .bck gets its own entry
+	os.WriteFile(bck, []byte("echo changed > \"$1\"\n"), 0644)
+	opts.noCache = false
+	run(bck, opts)
+	if got, _ := os.ReadFile(out); string(got) != "changed\n" {
+		t.Errorf("run after edit wrote %q, want the new program's output", got)
+	}
+}
+
+func TestContainerCommand(t *testing.T) {
+	workdir := filepath.Join(t.TempDir(), "run")
+	name, args := containerCommand("docker", "python:3-slim", "backlang-run-x", workdir,
+		nil, nil, "python3", []string{filepath.Join(workdir, "hello.py"), "--out", "/etc/passwd"})
+	if name != "docker" {
+		t.Fatalf("runtime = %q", name)
+	}
+	joined := strings.Join(args, " ")
+	if !strings.Contains(joined, "-v "+workdir+":/work -w /work") {
+		t.Errorf("workdir not mounted at /work: %s", joined)
+	}
+	if !strings.HasSuffix(joined, "python:3-slim python3 /work/hello.py --out /etc/passwd") {
+		t.Errorf("program paths not translated: %s", joined)
+	}
+	if _, args = containerCommand("podman", "img", "n", workdir, nil, nil, "sh", nil); !strings.Contains(strings.Join(args, " "), "--userns=keep-id") {
+		t.Errorf("podman run does not keep the user id: %q", args)
+	}
+}
+
+func TestWatchRun(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	out := filepath.Join(tempDir, "out.txt")
+	bck := filepath.Join(tempDir, "loop.sh.bck")
+	// The first version never exits on its own, so the rerun must stop it
+	os.WriteFile(bck, encodeBytes([]byte("echo one > \"$1\"\nsleep 30\n")), 0644)
+
+	stop, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- watchRun(stop, bck, options{quiet: true, scriptArgs: []string{out}}) }()
+
+	waitFor := func(want string) {
+		t.Helper()
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+			if got, _ := os.ReadFile(out); string(got) == want {
+				return
+			}
+		}
+		got, _ := os.ReadFile(out)
+		t.Fatalf("output = %q, want %q", got, want)
+	}
+	waitFor("one\n")
+	os.WriteFile(bck, encodeBytes([]byte("echo two > \"$1\"\n")), 0644)
+	waitFor("two\n")
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("watchRun() = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchRun did not return after being stopped")
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// runAs is the account run --user starts the program as.
+type runAs struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int // supplementary groups, replacing ours
+	home   string
+}
+
+// lookupRunAs resolves --user's argument: a user name or uid, optionally
+// followed by :group (a name or gid) instead of the user's primary group.
+// Switching to anyone else needs root.
+func lookupRunAs(spec string) (*runAs, error) {
+	if err := checkRunAs(); err != nil {
+		return nil, err
+	}
+	name, group, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(name)
+	if err != nil {
+		if u, err = user.LookupId(name); err != nil {
+			return nil, newError(ErrNotFound, "--user: there is no user '%s'", name)
+		}
+	}
+	r := &runAs{name: u.Username, home: u.HomeDir}
+	r.uid, _ = strconv.Atoi(u.Uid)
+	r.gid, _ = strconv.Atoi(u.Gid)
+	if hasGroup {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			if g, err = user.LookupGroupId(group); err != nil {
+				return nil, newError(ErrNotFound, "--user: there is no group '%s'", group)
+			}
+		}
+		r.gid, _ = strconv.Atoi(g.Gid)
+	} else if ids, err := u.GroupIds(); err == nil {
+		for _, id := range ids {
+			if gid, err := strconv.Atoi(id); err == nil && gid != r.gid {
+				r.groups = append(r.groups, gid)
+			}
+		}
+	}
+	if os.Geteuid() != 0 && (r.uid != os.Geteuid() || r.gid != os.Getegid()) {
+		return nil, newError(ErrPermission, "--user: only root can run programs as another user")
+	}
+	return r, nil
+}
+
+// env is what the program's environment says about who it runs as, so it
+// does not go looking in root's home.
+func (r *runAs) env() []string {
+	return []string{"HOME=" + r.home, "USER=" + r.name, "LOGNAME=" + r.name}
+}
+
+func (r *runAs) String() string {
+	return fmt.Sprintf("%s (uid %d, gid %d)", r.name, r.uid, r.gid)
+}
+
+// handOver gives the user dir and everything in it, so the program can
+// read what was decoded for it and write next to it.
+func (r *runAs) handOver(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, r.uid, r.gid)
+	})
+}
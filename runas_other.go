@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "os/exec"
+
+func checkRunAs() error {
+	return newError(ErrSandbox, "--user is only supported on Unix systems")
+}
+
+func setCredential(cmd *exec.Cmd, r *runAs) {}
@@ -0,0 +1,29 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+func checkRunAs() error { return nil }
+
+// setCredential makes cmd start as r: setgid, setgroups and setuid happen
+// in the child before it execs, so nothing of the program runs as us.
+// Without root, r can only be ourselves (see lookupRunAs), and there is
+// nothing to change; setgroups would fail.
+func setCredential(cmd *exec.Cmd, r *runAs) {
+	if os.Geteuid() != 0 {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	c := &syscall.Credential{Uid: uint32(r.uid), Gid: uint32(r.gid)}
+	for _, g := range r.groups {
+		c.Groups = append(c.Groups, uint32(g))
+	}
+	cmd.SysProcAttr.Credential = c
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strings"
+)
+
+// sandboxHelper is the hidden subcommand backlang re-executes itself with to
+// apply in-process restrictions before exec'ing the real program.
+const sandboxHelper = "__sandbox"
+
+// sandboxCommand wraps name and args so they are started through the sandbox
+// helper, which confines writes to workdir.
+func sandboxCommand(workdir, name string, args []string) (string, []string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, newError(ErrSandbox, "cannot locate the backlang executable: %v", err)
+	}
+	return self, append([]string{sandboxHelper, workdir, name}, args...), nil
+}
+
+// sandboxEnv is the cleared environment sandboxed programs receive: the
+// search path and locale are kept, home and temp point at the workdir.
+func sandboxEnv(workdir string) []string {
+	env := []string{"HOME=" + workdir, "TMPDIR=" + workdir, "TMP=" + workdir, "TEMP=" + workdir}
+	for _, key := range []string{"PATH", "LANG", "LC_ALL", "TERM", "SYSTEMROOT"} {
+		if v, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+v)
+		}
+	}
+	return env
+}
+
+// describeSandbox lists the restrictions --sandbox applies.
+func describeSandbox(opts options) string {
+	parts := []string{"private working directory", "cleared environment", "writes confined to the working directory"}
+	if !opts.sandboxNet {
+		parts = append(parts, "no network")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// sandboxStartError explains failures to start a sandboxed process.
+func sandboxStartError(err error, opts options) error {
+	if err != nil && opts.sandbox && !opts.sandboxNet && errors.Is(err, os.ErrPermission) {
+		return newError(ErrSandbox, "cannot isolate the network (user namespaces are unavailable); pass --sandbox-net to allow network access")
+	}
+	return err
+}
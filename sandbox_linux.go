@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// Landlock system calls and flags (see linux/landlock.h).
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1 << 0
+	landlockRulePathBeneath      = 1
+
+	accessFSExecute    = 1 << 0
+	accessFSWriteFile  = 1 << 1
+	accessFSReadFile   = 1 << 2
+	accessFSReadDir    = 1 << 3
+	accessFSRemoveDir  = 1 << 4
+	accessFSRemoveFile = 1 << 5
+	accessFSMakeChar   = 1 << 6
+	accessFSMakeDir    = 1 << 7
+	accessFSMakeReg    = 1 << 8
+	accessFSMakeSock   = 1 << 9
+	accessFSMakeFifo   = 1 << 10
+	accessFSMakeBlock  = 1 << 11
+	accessFSMakeSym    = 1 << 12
+	accessFSRefer      = 1 << 13 // ABI 2
+	accessFSTruncate   = 1 << 14 // ABI 3
+
+	prSetNoNewPrivs = 38
+	oPath           = 0x200000 // O_PATH, missing from package syscall
+)
+
+type landlockRulesetAttr struct {
+	handledAccessFS uint64
+}
+
+// landlockPathBeneathAttr mirrors the packed kernel struct; the field offsets
+// match and the kernel only reads the first 12 bytes.
+type landlockPathBeneathAttr struct {
+	allowedAccess uint64
+	parentFd      int32
+}
+
+// setSandboxAttrs puts the sandbox helper in new user and network namespaces
+// so the program has no network access (unless allowNet).
+func setSandboxAttrs(cmd *exec.Cmd, allowNet bool) error {
+	if allowNet {
+		return nil
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Cloneflags |= syscall.CLONE_NEWUSER | syscall.CLONE_NEWNET
+	cmd.SysProcAttr.UidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+	cmd.SysProcAttr.GidMappings = []syscall.SysProcIDMap{{ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+	return nil
+}
+
+// sandboxMain is the sandbox helper: args are the working directory, the
+// program and its arguments. It confines filesystem writes to the working
+// directory with Landlock and execs the program; it only returns on error.
+func sandboxMain(args []string) {
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "backlang: sandbox: missing program")
+		os.Exit(exitExec)
+	}
+	workdir, name, progArgs := args[0], args[1], args[2:]
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "backlang: sandbox: %v\n", err)
+		os.Exit(exitNoInterpreter)
+	}
+
+	// Landlock applies to the calling thread and is inherited across exec,
+	// so restrict and exec from the same locked thread.
+	runtime.LockOSThread()
+	if err := restrictWrites(workdir); err != nil {
+		fmt.Fprintf(os.Stderr, "backlang: sandbox: %v\n", err)
+		os.Exit(exitSandbox)
+	}
+	err = syscall.Exec(path, append([]string{name}, progArgs...), os.Environ())
+	fmt.Fprintf(os.Stderr, "backlang: sandbox: exec %s: %v\n", name, err)
+	os.Exit(exitExec)
+}
+
+// restrictWrites forbids creating, modifying or removing files anywhere
+// except beneath workdir (and writing to devices such as /dev/null).
+func restrictWrites(workdir string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("filesystem restrictions need Landlock, which this kernel does not provide (%v)", errno)
+	}
+
+	handled := uint64(accessFSWriteFile | accessFSRemoveDir | accessFSRemoveFile |
+		accessFSMakeChar | accessFSMakeDir | accessFSMakeReg | accessFSMakeSock |
+		accessFSMakeFifo | accessFSMakeBlock | accessFSMakeSym)
+	if abi >= 2 {
+		handled |= accessFSRefer
+	}
+	if abi >= 3 {
+		handled |= accessFSTruncate
+	}
+
+	attr := landlockRulesetAttr{handledAccessFS: handled}
+	fd, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return fmt.Errorf("landlock_create_ruleset: %v", errno)
+	}
+	ruleset := int(fd)
+	defer syscall.Close(ruleset)
+
+	devWrites := uint64(accessFSWriteFile)
+	if abi >= 3 {
+		devWrites |= accessFSTruncate
+	}
+	rules := []struct {
+		path   string
+		access uint64
+	}{
+		{workdir, handled},
+		{"/dev", devWrites},
+	}
+	for _, rule := range rules {
+		if err := addPathRule(ruleset, rule.path, rule.access); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.RawSyscall6(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0, 0, 0, 0); errno != 0 {
+		return fmt.Errorf("prctl(PR_SET_NO_NEW_PRIVS): %v", errno)
+	}
+	if _, _, errno := syscall.Syscall(sysLandlockRestrictSelf, uintptr(ruleset), 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_restrict_self: %v", errno)
+	}
+	return nil
+}
+
+func addPathRule(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", path, err)
+	}
+	defer syscall.Close(fd)
+	attr := landlockPathBeneathAttr{allowedAccess: access, parentFd: int32(fd)}
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr)), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("landlock_add_rule %s: %v", path, errno)
+	}
+	return nil
+}
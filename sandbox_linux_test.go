@@ -0,0 +1,31 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunSandbox(t *testing.T) {
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash not available")
+	}
+	tempDir := t.TempDir()
+	outside := filepath.Join(tempDir, "escaped")
+	bck := filepath.Join(tempDir, "escape.sh.bck")
+	script := "touch inside || exit 3\n[ \"$HOME\" = \"$PWD\" ] || exit 4\ntouch \"$1\"\n"
+	os.WriteFile(bck, encodeBytes([]byte(script)), 0644)
+
+	_, err := run(bck, options{quiet: true, sandbox: true, scriptArgs: []string{outside}})
+	if err != nil && exitCode(err) == exitSandbox {
+		t.Skipf("sandbox unavailable here: %v", err)
+	}
+	if fileExists(outside) {
+		t.Fatal("sandboxed program wrote outside its working directory")
+	}
+	if !errors.Is(err, ErrProgramExit) || exitCode(err) != 1 {
+		t.Fatalf("want the touch outside the workdir to fail the program with status 1, got %v", err)
+	}
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func setSandboxAttrs(cmd *exec.Cmd, allowNet bool) error {
+	return newError(ErrSandbox, "--sandbox is only supported on Linux")
+}
+
+func sandboxMain(args []string) {
+	fmt.Fprintln(os.Stderr, "backlang: sandbox: only supported on Linux")
+	os.Exit(exitSandbox)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+)
+
+// selftest encodes inPath in memory the way encode would with the same
+// flags (mode, compression, encryption with a throwaway passphrase,
+// armor), decodes the result the way decode would, and compares it with
+// the original byte for byte. Nothing is written. A file that survives
+// prints PASS; one that doesn't fails with ErrCorrupt, naming the first
+// difference.
+func selftest(inPath string, opts options) (result, error) {
+	res := result{Command: "selftest", Input: inPath}
+	data, err := os.ReadFile(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	f := format{mode: opts.mode, blockSize: opts.blockSize}
+	if f.mode == "" {
+		f.mode = modeLines
+	}
+	if opts.compress {
+		f.compress = compressGzip
+	}
+	if f.mode != modeBytes {
+		if err := checkText(inPath, data); err != nil {
+			return res, err
+		}
+	}
+	res.Mode = f.mode
+
+	enc, err := encodeData(data, f)
+	if err != nil {
+		return res, err
+	}
+	steps := f.mode + " mode"
+	if opts.compress {
+		steps += ", compressed"
+	}
+	if opts.encrypt {
+		// A random passphrase exercises sealing without asking for one.
+		pass := []byte(rand.Text())
+		if enc, err = seal(enc, pass); err != nil {
+			return res, err
+		}
+		if enc, err = unseal(enc, pass); err != nil {
+			return res, err
+		}
+		steps += ", encrypted"
+	}
+	written := len(enc)
+	if opts.armor {
+		var buf bytes.Buffer
+		if err := armored(writeAll(enc))(&buf); err != nil {
+			return res, err
+		}
+		written = buf.Len()
+		if enc, err = dearmor(buf.Bytes()); err != nil {
+			return res, err
+		}
+		steps += ", armored"
+	}
+	opts.logger().Debug("encoded in memory", "path", inPath, "bytes", len(data), "encoded_bytes", written, "steps", steps)
+
+	hf, off, err := encodedHeader(enc[:min(len(enc), maxHeaderLen)])
+	if err != nil {
+		return res, err
+	}
+	var out bytes.Buffer
+	if err := decodeStream(&out, byteSlice(enc), hf, off, int64(len(enc))); err != nil {
+		return res, newError(ErrCorrupt, "FAIL '%s' (%s): decoding failed: %v", filepath.Base(inPath), steps, err)
+	}
+	if at := firstDifference(data, out.Bytes()); at >= 0 {
+		line := bytes.Count(data[:min(at, len(data))], []byte("\n")) + 1
+		return res, newError(ErrCorrupt, "FAIL '%s' (%s): decoded %d bytes, first difference at byte %d (line %d) of %d", filepath.Base(inPath), steps, out.Len(), at, line, len(data))
+	}
+	res.Action = "passed"
+	opts.infof("PASS '%s' (%s, %d bytes, %d encoded)\n", filepath.Base(inPath), steps, len(data), written)
+	return res, nil
+}
+
+// firstDifference returns the offset of the first byte where a and b
+// differ (the shorter one's length if one is a prefix of the other), or
+// -1 if they are equal.
+func firstDifference(a, b []byte) int {
+	for i := range min(len(a), len(b)) {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return min(len(a), len(b))
+	}
+	return -1
+}
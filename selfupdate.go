@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	// defaultReleaseURL is where self-update asks for the latest release,
+	// unless BACKLANG_UPDATE_URL names another endpoint with the same
+	// response (a mirror, or a test server).
+	defaultReleaseURL = "https://api.github.com/repos/codinganovel/backlang/releases/latest"
+	maxUpdateDownload = 256 << 20 // self-update's --max-download unless given
+	checksumsAsset    = "SHA256SUMS"
+	signatureAsset    = "SHA256SUMS.sig" // ed25519 signature of SHA256SUMS, raw or base64
+)
+
+// release is the part of a release endpoint's response self-update reads.
+type release struct {
+	Tag    string `json:"tag_name"`
+	Assets []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// asset returns the download URL of the release asset called name.
+func (r *release) asset(name string) (string, bool) {
+	for _, a := range r.Assets {
+		if a.Name == name {
+			return a.URL, true
+		}
+	}
+	return "", false
+}
+
+// releaseAsset is the name of the release binary for goos and goarch.
+func releaseAsset(goos, goarch string) string {
+	name := "backlang_" + goos + "_" + goarch
+	if goos == "windows" {
+		name += ".exe"
+	}
+	return name
+}
+
+// selfUpdate is backlang self-update: it replaces the running executable
+// with the latest release.
+func selfUpdate(opts options) (result, error) {
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil {
+		return result{Command: "self-update"}, newError(ErrNotFound, "cannot find the running executable: %v", err)
+	}
+	return updateExecutable(exe, opts)
+}
+
+// updateTransport is the transport self-update downloads through; nil is
+// http.DefaultTransport. Tests point it at their own TLS server.
+var updateTransport http.RoundTripper
+
+// fetchRelease is fetch for self-update, which only downloads over https,
+// following redirects (release assets are served from a CDN) only as long
+// as they stay on https.
+func fetchRelease(rawURL string, opts options) ([]byte, error) {
+	if u, err := url.Parse(rawURL); err != nil || u.Scheme != "https" {
+		return nil, newError(ErrNetwork, "self-update only downloads over https, not from %s", rawURL)
+	}
+	client := &http.Client{
+		Timeout:   fetchTimeout,
+		Transport: updateTransport,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if req.URL.Scheme != "https" {
+				return fmt.Errorf("redirected to %s, which is not https", req.URL.Redacted())
+			}
+			if len(via) >= 10 {
+				return errors.New("stopped after 10 redirects")
+			}
+			return nil
+		},
+	}
+	return fetchWith(client, rawURL, opts)
+}
+
+// updateExecutable asks the release endpoint for the latest release and, if
+// it is newer than this build (or with --force), downloads the binary for
+// this platform, checks it against the release's SHA256SUMS and that
+// file's signature, makes sure it runs, and renames it over exe, so exe is
+// always either the old binary or the new one. A build without a release
+// key cannot check the signature, and updates only with --allow-unsigned.
+func updateExecutable(exe string, opts options) (result, error) {
+	res := result{Command: "self-update", Input: exe, DryRun: opts.dryRun}
+	if opts.maxFetch == 0 {
+		opts.maxFetch = maxUpdateDownload
+	}
+	if runtime.GOOS == "windows" {
+		os.Remove(exe + ".old") // left by the last update
+	}
+	endpoint := defaultReleaseURL
+	if v := os.Getenv(envPrefix + "UPDATE_URL"); v != "" {
+		endpoint = v
+	}
+	if releaseKey == "" && !opts.unsigned {
+		return res, newError(ErrUsage, "this build has no release key to check a release's signature with; build with -X main.releaseKey, or pass --allow-unsigned to trust %s from the release server alone", checksumsAsset)
+	}
+	data, err := fetchRelease(endpoint, opts)
+	if err != nil {
+		return res, err
+	}
+	var rel release
+	if err := json.Unmarshal(data, &rel); err != nil || rel.Tag == "" {
+		return res, newError(ErrNetwork, "%s did not describe a release", endpoint)
+	}
+	latest := strings.TrimPrefix(rel.Tag, "v")
+	res.Version = latest
+	if !newerVersion(latest, version) && !opts.force {
+		res.Action = "current"
+		opts.infof("backlang %s is the latest release\n", version)
+		return res, nil
+	}
+	name := releaseAsset(runtime.GOOS, runtime.GOARCH)
+	binURL, ok := rel.asset(name)
+	if !ok {
+		return res, newError(ErrNotFound, "release %s has no binary for %s/%s (%s)", rel.Tag, runtime.GOOS, runtime.GOARCH, name)
+	}
+	sumsURL, ok := rel.asset(checksumsAsset)
+	if !ok {
+		return res, newError(ErrCorrupt, "release %s publishes no %s to check %s against", rel.Tag, checksumsAsset, name)
+	}
+	res.Action, res.Output = "updated", exe
+	if opts.dryRun {
+		opts.infof("Would update backlang %s to %s, replacing '%s' with %s\n", version, latest, exe, binURL)
+		return res, nil
+	}
+
+	sums, err := fetchRelease(sumsURL, opts)
+	if err != nil {
+		return res, err
+	}
+	signed, err := verifySignature(sums, &rel, opts)
+	if err != nil {
+		return res, err
+	}
+	entries, err := parseManifest(bytes.NewReader(sums))
+	if err != nil {
+		return res, newError(ErrCorrupt, "%s of release %s: %v", checksumsAsset, rel.Tag, err)
+	}
+	want := ""
+	for _, e := range entries {
+		if e.path == name {
+			want = e.sum
+		}
+	}
+	if want == "" {
+		return res, newError(ErrCorrupt, "%s of release %s lists no %s", checksumsAsset, rel.Tag, name)
+	}
+	opts.infof("Downloading backlang %s for %s/%s...\n", latest, runtime.GOOS, runtime.GOARCH)
+	bin, err := fetchRelease(binURL, opts)
+	if err != nil {
+		return res, err
+	}
+	if got := sha256Hex(bin); got != want {
+		return res, newError(ErrCorrupt, "%s has SHA-256 %s, but %s says %s", name, got, checksumsAsset, want)
+	}
+	if err := replaceExecutable(exe, bin); err != nil {
+		return res, err
+	}
+	check := "checksum verified"
+	if signed {
+		check = "checksum and signature verified"
+	}
+	opts.infof("Updated backlang %s to %s (%s)\n", version, latest, check)
+	return res, nil
+}
+
+// releaseKey is the base64 ed25519 public key that signs SHA256SUMS in
+// releases, set at build time like version. A build without one can only
+// check a download against the checksums served next to it, which is why
+// self-update then needs --allow-unsigned.
+var releaseKey = ""
+
+// verifySignature checks the release's signature of sums against
+// releaseKey, reporting whether there was a key to check it with.
+func verifySignature(sums []byte, rel *release, opts options) (bool, error) {
+	if releaseKey == "" {
+		opts.logger().Warn("--allow-unsigned: the download is only checked against " + checksumsAsset)
+		return false, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(releaseKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false, newError(ErrCorrupt, "this build's release key is not a base64 ed25519 public key")
+	}
+	sigURL, ok := rel.asset(signatureAsset)
+	if !ok {
+		return false, newError(ErrCorrupt, "release %s is not signed: it has no %s", rel.Tag, signatureAsset)
+	}
+	sig, err := fetchRelease(sigURL, opts)
+	if err != nil {
+		return false, err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		if sig, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig))); err != nil {
+			return false, newError(ErrCorrupt, "%s of release %s is not a signature", signatureAsset, rel.Tag)
+		}
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), sums, sig) {
+		return false, newError(ErrCorrupt, "%s of release %s does not match its signature", checksumsAsset, rel.Tag)
+	}
+	return true, nil
+}
+
+// replaceExecutable writes bin next to exe, checks that it runs ("version"
+// must succeed), and renames it over exe. Windows cannot replace a running
+// executable, but can rename it, so there the old one is moved aside to
+// exe.old first and removed by the next update.
+func replaceExecutable(exe string, bin []byte) error {
+	perm := os.FileMode(0o755)
+	if fi, err := os.Stat(exe); err == nil {
+		perm = fi.Mode().Perm() | 0o111
+	}
+	f, err := createTemp(exe, perm)
+	if err != nil {
+		return updatePathErr(err, exe)
+	}
+	tmp := f.Name()
+	defer func() { os.Remove(tmp) }() // gone already once renamed
+	_, err = f.Write(bin)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chmod(tmp, perm)
+	}
+	if err == nil && runtime.GOOS == "windows" {
+		// Windows only runs it with an executable's extension.
+		if err = os.Rename(tmp, tmp+".exe"); err == nil {
+			tmp += ".exe"
+		}
+	}
+	if err != nil {
+		return updatePathErr(err, exe)
+	}
+	if err := tryExecutable(tmp); err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		old := exe + ".old"
+		if err := os.Rename(exe, old); err != nil {
+			return updatePathErr(err, exe)
+		}
+		if err := os.Rename(tmp, exe); err != nil {
+			os.Rename(old, exe)
+			return updatePathErr(err, exe)
+		}
+		return nil
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		return updatePathErr(err, exe)
+	}
+	return syncDir(filepath.Dir(exe))
+}
+
+// tryExecutable runs path with "version", so a binary that cannot run here
+// (a bad download, the wrong architecture) never replaces a working one.
+func tryExecutable(path string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), versionTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "version").CombinedOutput()
+	if err != nil {
+		line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+		return newError(ErrExec, "the downloaded backlang does not run (%v) %s; the installed one was left alone", err, line)
+	}
+	return nil
+}
+
+// updatePathErr explains a failure to write the executable's directory,
+// which is usually installed where only an administrator can write.
+func updatePathErr(err error, exe string) error {
+	if errors.Is(err, os.ErrPermission) {
+		return newError(ErrPermission, "cannot replace '%s': permission denied; rerun with the rights to write %s, or reinstall by hand", exe, filepath.Dir(exe))
+	}
+	return wrapPathErr(err, exe)
+}
+
+// newerVersion reports whether version a is newer than b, comparing dotted
+// numbers ("0.10" is newer than "0.9"). Anything after a "-" or "+" is
+// ignored, and a b that is no version at all (a development build) is
+// older than anything.
+func newerVersion(a, b string) bool {
+	parse := func(v string) ([]int, bool) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.IndexAny(v, "-+"); i >= 0 {
+			v = v[:i]
+		}
+		var nums []int
+		for _, p := range strings.Split(v, ".") {
+			n, err := strconv.Atoi(p)
+			if err != nil || n < 0 {
+				return nil, false
+			}
+			nums = append(nums, n)
+		}
+		return nums, true
+	}
+	av, aok := parse(a)
+	bv, bok := parse(b)
+	switch {
+	case !aok:
+		return false
+	case !bok:
+		return true
+	}
+	for i := range max(len(av), len(bv)) {
+		var x, y int
+		if i < len(av) {
+			x = av[i]
+		}
+		if i < len(bv) {
+			y = bv[i]
+		}
+		if x != y {
+			return x > y
+		}
+	}
+	return false
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// defaultAddr is where "backlang serve" listens unless --addr says otherwise.
+// Loopback only: anything wider should be a deliberate choice.
+const defaultAddr = "localhost:7070"
+
+// serverConfig holds the limits "backlang serve" applies. The zero value
+// applies none.
+type serverConfig struct {
+	maxBody int64    // largest request body accepted, in bytes; 0 for no limit
+	rate    float64  // requests a second allowed per client address; 0 for no limit
+	burst   int      // requests a client may make at once before rate applies
+	keys    []apiKey // keys accepted; with none, no key is needed
+}
+
+// defaultServerConfig is what serve uses unless flags say otherwise.
+var defaultServerConfig = serverConfig{maxBody: 64 << 20, rate: 10, burst: 20}
+
+// serveMain runs "backlang serve": encode, decode and verify over plain
+// HTTP and gRPC (see backlang.proto) on a single port, until interrupted.
+func serveMain(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	addr := fs.String("addr", defaultAddr, "address to listen on")
+	cfg := defaultServerConfig
+	fs.Func("max-body", "refuse request bodies larger than this `size`, or compressed ones that decompress to more, e.g. 512K or 16M, with 413 (default 64M; 0 for no limit)", func(s string) (err error) {
+		if s == "0" {
+			cfg.maxBody = 0
+			return nil
+		}
+		cfg.maxBody, err = parseSize(s)
+		return err
+	})
+	fs.Float64Var(&cfg.rate, "rate-limit", cfg.rate, "requests a second allowed per client address before answering 429 (0 for no limit)")
+	fs.IntVar(&cfg.burst, "burst", cfg.burst, "requests a client may make at once before --rate-limit applies")
+	keysPath := fs.String("keys", "", "read API keys from this `file` instead of keys.toml in the config directory")
+	level, format := slog.LevelInfo, "text"
+	fs.Func("log-level", "log at this `level` or above: debug, info (default; one line per request), warn or error", func(s string) (err error) {
+		level, err = parseLogLevel(s)
+		return err
+	})
+	fs.Func("log-format", "write log records as text (default) or json", func(s string) (err error) {
+		format, err = parseLogFormat(s)
+		return err
+	})
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usageText)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(exitOK)
+		}
+		os.Exit(exitUsage)
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprint(os.Stderr, usageText)
+		os.Exit(exitUsage)
+	}
+	if cfg.rate < 0 || cfg.burst < 1 {
+		fmt.Fprintln(os.Stderr, "Error: --rate-limit must be at least 0 and --burst at least 1")
+		os.Exit(exitUsage)
+	}
+
+	keys, err := loadAPIKeys(*keysPath)
+	if err != nil {
+		printErr(err)
+		os.Exit(exitCode(err))
+	}
+	cfg.keys = keys
+
+	log := newLogger(os.Stderr, level, format)
+	if len(keys) == 0 && !isLoopback(*addr) {
+		log.Warn("no API keys configured; anyone who can reach the server can use it", "addr", *addr)
+	}
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           logRequests(log, newServer(cfg)),
+		ErrorLog:          slog.NewLogLogger(log.Handler(), slog.LevelWarn),
+		Protocols:         new(http.Protocols),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	// gRPC clients usually speak HTTP/2 without TLS (h2c)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	stop, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	go func() {
+		<-stop.Done()
+		shutdown, done := context.WithTimeout(context.Background(), 5*time.Second)
+		defer done()
+		srv.Shutdown(shutdown)
+	}()
+
+	log.Info("serving HTTP and gRPC", "addr", *addr, "keys", len(keys))
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		printErr(newError(ErrUsage, "serve: %v", err))
+		os.Exit(exitError)
+	}
+}
+
+// newServer returns the handler behind "backlang serve":
+//
+//	POST /v1/encode   body in, encoded body out (?mode=chars for chars mode)
+//	POST /v1/decode   body in, decoded body out, or 422 with {"error": "..."}
+//	POST /v1/verify   {"ok": true} or 422 {"ok": false, "error": "..."}
+//	GET  /metrics     request counts, bytes and durations for Prometheus
+//
+// and the backlang.v1.Backlang gRPC service. A client over cfg's rate gets
+// 429 and a body over its size 413 (as does a compressed .bck that would
+// decompress to more than that), each with a JSON error naming the
+// limit (gRPC calls get RESOURCE_EXHAUSTED instead). If cfg has keys, a
+// request without one of them gets 401, and one whose key doesn't allow
+// the operation 403 (UNAUTHENTICATED and PERMISSION_DENIED over gRPC).
+func newServer(cfg serverConfig) http.Handler {
+	m := newMetrics()
+	limiter := newRateLimiter(cfg.rate, cfg.burst)
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", m)
+	mux.HandleFunc("POST /v1/encode", transformHandler(func(r *http.Request, data []byte) ([]byte, error) {
+		f := format{mode: modeLines}
+		if m := r.URL.Query().Get("mode"); m != "" {
+			var err error
+			if f.mode, err = parseMode(m); err != nil {
+				return nil, err
+			}
+		}
+		return encodeData(data, f)
+	}))
+	mux.HandleFunc("POST /v1/decode", transformHandler(func(r *http.Request, data []byte) ([]byte, error) {
+		out, _, err := decodeDataLimit(data, cfg.maxBody)
+		return out, err
+	}))
+	mux.HandleFunc("POST /v1/verify", func(w http.ResponseWriter, r *http.Request) {
+		data, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		if err := verifyBytes(data, cfg.maxBody); err != nil {
+			status := http.StatusUnprocessableEntity
+			var tooBig *decompressLimitError
+			if errors.As(err, &tooBig) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeJSON(w, status, map[string]any{"ok": false, "error": err.Error()})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"ok": true})
+	})
+	return m.instrument(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, wait := limiter.allow(clientAddr(r), time.Now()); !ok {
+			secs := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			refuse(w, r, http.StatusTooManyRequests, grpcResourceExhausted, map[string]any{
+				"error":       fmt.Sprintf("rate limit exceeded (%g requests a second); retry in %ds", cfg.rate, secs),
+				"retry_after": secs,
+			})
+			return
+		}
+		if len(cfg.keys) > 0 {
+			k, ok := findKey(cfg.keys, requestKey(r))
+			if !ok {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="backlang"`)
+				refuse(w, r, http.StatusUnauthorized, grpcUnauthenticated, map[string]any{"error": "missing or unknown API key"})
+				return
+			}
+			if op := operation(r); !k.allows(op) {
+				refuse(w, r, http.StatusForbidden, grpcPermissionDenied, map[string]any{"error": fmt.Sprintf("key %q may not %s", k.name, strings.TrimSuffix(op, "_stream"))})
+				return
+			}
+		}
+		if cfg.maxBody > 0 {
+			if r.ContentLength > cfg.maxBody {
+				refuse(w, r, http.StatusRequestEntityTooLarge, grpcResourceExhausted, map[string]any{"error": tooLarge(cfg.maxBody), "limit": cfg.maxBody})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, cfg.maxBody)
+		}
+		if isGRPC(r) {
+			serveGRPC(w, r, cfg.maxBody)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+}
+
+// logRequests logs each request once it has been answered.
+func logRequests(log *slog.Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(sw, r)
+		log.Info("request", "method", r.Method, "path", r.URL.Path, "status", sw.status,
+			"bytes", sw.bytes, "duration", time.Since(start), "remote", r.RemoteAddr)
+	})
+}
+
+// statusWriter remembers the status and size of a response. It passes
+// Flush on, which the gRPC handler needs.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// refuse answers a request the server won't handle with status and body
+// as JSON, or for a gRPC call with grpcStatus and body's error.
+func refuse(w http.ResponseWriter, r *http.Request, status, grpcStatus int, body map[string]any) {
+	if isGRPC(r) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", strconv.Itoa(grpcStatus))
+		w.Header().Set("Grpc-Message", url.PathEscape(body["error"].(string)))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	writeJSON(w, status, body)
+}
+
+// readBody reads r's body, answering 413 if it runs over the limit
+// newServer set or 400 if it can't be read.
+func readBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	data, err := io.ReadAll(r.Body)
+	var tooBig *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooBig):
+		writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{"error": tooLarge(tooBig.Limit), "limit": tooBig.Limit})
+	case err != nil:
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+	default:
+		return data, true
+	}
+	return nil, false
+}
+
+// isLoopback reports whether addr only listens on this machine.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return host == "localhost" || ip != nil && ip.IsLoopback()
+}
+
+func tooLarge(limit int64) string {
+	return fmt.Sprintf("request body is larger than the %s limit", humanBytes(limit))
+}
+
+func transformHandler(transform func(*http.Request, []byte) ([]byte, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, ok := readBody(w, r)
+		if !ok {
+			return
+		}
+		out, err := transform(r, data)
+		var tooBig *decompressLimitError
+		switch {
+		case errors.As(err, &tooBig):
+			writeJSON(w, http.StatusRequestEntityTooLarge, map[string]any{"error": err.Error(), "limit": tooBig.limit})
+			return
+		case err != nil:
+			writeJSONError(w, http.StatusUnprocessableEntity, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(out)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
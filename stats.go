@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// fileStats are the facts about a file that decide how encode treats it,
+// or for a .bck, about what it decodes to.
+type fileStats struct {
+	Bytes        int    `json:"bytes"`
+	Encoding     string `json:"encoding"` // ascii, utf-8, utf-8-bom, utf-16le, utf-16be, 8-bit or binary
+	Lines        int    `json:"lines"`
+	Longest      int    `json:"longest_line"` // in characters, without the line ending
+	LongestAt    int    `json:"longest_line_number,omitempty"`
+	LF           int    `json:"lf"`
+	CRLF         int    `json:"crlf"`
+	CR           int    `json:"cr,omitempty"` // lone carriage returns, as classic Mac OS ended lines
+	FinalNewline bool   `json:"final_newline"`
+}
+
+// stats reports on the file at inPath, or on its decoded content if it is
+// a .bck.
+func stats(inPath string, opts options) (result, error) {
+	res := result{Command: "stats", Input: inPath, Action: "inspected"}
+	var data []byte
+	label := inPath
+	if strings.HasSuffix(strings.ToLower(inPath), ".bck") {
+		var buf bytes.Buffer
+		if _, err := cat(inPath, &buf, opts); err != nil {
+			return res, err
+		}
+		data, label = buf.Bytes(), inPath+" (decoded)"
+	} else {
+		mapped, release, err := mapFile(inPath)
+		if err != nil {
+			return res, wrapPathErr(err, inPath)
+		}
+		defer release()
+		data = mapped
+	}
+	s := measure(data)
+	res.Stats = &s
+
+	opts.infof("File:          %s\n", label)
+	opts.infof("Size:          %d bytes\n", s.Bytes)
+	opts.infof("Encoding:      %s\n", describeEncoding(s.Encoding))
+	if s.Encoding == "binary" {
+		return res, nil
+	}
+	opts.infof("Lines:         %d\n", s.Lines)
+	if s.LongestAt > 0 {
+		opts.infof("Longest line:  %d characters (line %d)\n", s.Longest, s.LongestAt)
+	}
+	var endings []string
+	for _, e := range []struct {
+		name string
+		n    int
+	}{{"LF", s.LF}, {"CRLF", s.CRLF}, {"CR", s.CR}} {
+		if e.n > 0 {
+			endings = append(endings, fmt.Sprintf("%d %s", e.n, e.name))
+		}
+	}
+	switch len(endings) {
+	case 0:
+		opts.infof("Line endings:  none\n")
+	case 1:
+		opts.infof("Line endings:  %s\n", endings[0])
+	default:
+		opts.infof("Line endings:  mixed: %s\n", strings.Join(endings, ", "))
+	}
+	final := "yes"
+	if !s.FinalNewline {
+		final = "no"
+	}
+	opts.infof("Final newline: %s\n", final)
+	return res, nil
+}
+
+// measure counts what stats reports. Lines are split at LF, CRLF and lone
+// CR, and a last line without an ending counts too; UTF-16 is measured as
+// the text it holds.
+func measure(data []byte) fileStats {
+	s := fileStats{Bytes: len(data)}
+	if looksBinary(data) {
+		s.Encoding = "binary"
+		return s
+	}
+	charset, text := toUTF8(data)
+	switch {
+	case charset != "":
+		s.Encoding = charset
+	case !utf8.Valid(text):
+		s.Encoding = "8-bit"
+	case isASCII(text):
+		s.Encoding = "ascii"
+	default:
+		s.Encoding = "utf-8"
+	}
+	for len(text) > 0 {
+		end := bytes.IndexAny(text, "\r\n")
+		line, next := text, []byte(nil)
+		if end >= 0 {
+			line, next = text[:end], text[end+1:]
+			switch {
+			case text[end] == '\n':
+				s.LF++
+			case len(next) > 0 && next[0] == '\n':
+				s.CRLF++
+				next = next[1:]
+			default:
+				s.CR++
+			}
+		}
+		s.Lines++
+		if n := utf8.RuneCount(line); n > s.Longest || s.LongestAt == 0 {
+			s.Longest, s.LongestAt = n, s.Lines
+		}
+		s.FinalNewline = end >= 0
+		text = next
+	}
+	return s
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// describeEncoding spells out an encoding measure found, with what encode
+// does about it.
+func describeEncoding(enc string) string {
+	switch enc {
+	case "ascii":
+		return "ASCII"
+	case "utf-8":
+		return "UTF-8"
+	case charsetUTF8BOM:
+		return "UTF-8 with a byte order mark (encode sets the BOM aside and decode restores it)"
+	case charsetUTF16LE, charsetUTF16BE:
+		return strings.ToUpper(enc) + " (encode works on it as UTF-8 and decode converts it back)"
+	case "8-bit":
+		return "8-bit, not UTF-8 (perhaps Latin-1 or Windows-1252)"
+	}
+	return "binary (encode needs --binary)"
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// isSymlink reports whether name is itself a symbolic link.
+func isSymlink(name string) bool {
+	fi, err := os.Lstat(name)
+	return err == nil && fi.Mode()&os.ModeSymlink != 0
+}
+
+// transformLink is encode or decode for a symlink under --no-dereference:
+// instead of reading its target, it creates the matching link, the way
+// --archive treats links inside archives. Encoding a → b gives a.bck →
+// b.bck, and decoding gives the link back; the target is left alone, to be
+// transformed on its own.
+func transformLink(cmd, inPath string, opts options) (result, error) {
+	res := result{Command: cmd, Input: inPath, DryRun: opts.dryRun}
+	target, err := os.Readlink(inPath)
+	if err != nil {
+		return res, wrapPathErr(err, inPath)
+	}
+	outName, newTarget := inPath+".bck", target+".bck"
+	if cmd == "decode" {
+		if !strings.HasSuffix(strings.ToLower(target), ".bck") {
+			return res, newError(ErrNotBck, "'%s' links to '%s', which is not a .bck file", filepath.Base(inPath), target)
+		}
+		outName, newTarget = stripLastBck(inPath), stripLastBck(target)
+	}
+	outPath, skip, err := outputPath(inPath, outName, opts)
+	res.Output = outPath
+	if err != nil || skip {
+		res.Action = "skipped"
+		return res, err
+	}
+	res.Action = cmd + "d"
+	if opts.dryRun {
+		opts.infof("Would link '%s' → '%s'\n", filepath.Base(outPath), newTarget)
+		return res, nil
+	}
+	// Make the link under a temporary name and rename it into place, so an
+	// existing file is replaced in one step like any other output.
+	tmp := tempPrefix(outPath) + strconv.FormatUint(uint64(rand.Uint32()), 10)
+	if err := os.Symlink(newTarget, tmp); err != nil {
+		return res, wrapPathErr(err, outPath)
+	}
+	if err := os.Rename(tmp, outPath); err != nil {
+		os.Remove(tmp)
+		return res, wrapPathErr(err, outPath)
+	}
+	opts.infof("Linked '%s' → '%s'\n", filepath.Base(outPath), newTarget)
+	return res, nil
+}
@@ -0,0 +1,23 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// isTerminal reports whether f is a character device, the nearest this
+// platform offers to a terminal check.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// disableEcho is not implemented here; the passphrase is read with echo on.
+func disableEcho(fd uintptr) (func(), error) {
+	return nil, errors.New("cannot turn off terminal echo on this platform")
+}
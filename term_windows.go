@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var procSetConsoleMode = syscall.NewLazyDLL("kernel32.dll").NewProc("SetConsoleMode")
+
+const enableEchoInput = 0x4 // ENABLE_ECHO_INPUT
+
+// isTerminal reports whether f is a console. NUL is a character device
+// too, but has no console mode.
+func isTerminal(f *os.File) bool {
+	var mode uint32
+	return syscall.GetConsoleMode(syscall.Handle(f.Fd()), &mode) == nil
+}
+
+// disableEcho turns off echo on the console fd and returns a function that
+// restores its previous mode.
+func disableEcho(fd uintptr) (func(), error) {
+	h := syscall.Handle(fd)
+	var old uint32
+	if err := syscall.GetConsoleMode(h, &old); err != nil {
+		return nil, err
+	}
+	if err := setConsoleMode(h, old&^enableEchoInput); err != nil {
+		return nil, err
+	}
+	return func() { setConsoleMode(h, old) }, nil
+}
+
+func setConsoleMode(h syscall.Handle, mode uint32) error {
+	if ok, _, err := procSetConsoleMode.Call(uintptr(h), uintptr(mode)); ok == 0 {
+		return err
+	}
+	return nil
+}
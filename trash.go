@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// moveToTrash moves the file at name, which is about to be replaced, to
+// the desktop trash (the Recycle Bin on Windows), where it can be restored
+// from as any deleted file. It returns where the file went, if that is a
+// path.
+func moveToTrash(name string, opts options) (string, error) {
+	if _, err := os.Lstat(name); os.IsNotExist(err) {
+		return "", nil
+	}
+	abs, err := filepath.Abs(name)
+	if err != nil {
+		return "", err
+	}
+	if opts.dryRun {
+		opts.infof("Would move existing '%s' to the trash\n", filepath.Base(name))
+		return "", nil
+	}
+	where, err := trashFile(abs)
+	if err != nil {
+		return "", newError(ErrPermission, "cannot move '%s' to the trash: %v", filepath.Base(name), err)
+	}
+	opts.logger().Debug("trashed", "path", abs, "trash", where)
+	opts.infof("Moved existing '%s' to the trash\n", filepath.Base(name))
+	if !filepath.IsAbs(where) {
+		where = ""
+	}
+	return where, nil
+}
+
+// xdgTrash moves abs into the trash directory dir as the freedesktop.org
+// trash specification lays out: the file under files/, and beside it under
+// info/ a .trashinfo recording where it came from and when, which file
+// managers use to restore it. The info file is created first, exclusively,
+// to claim a name no other trashed file has. It returns where the file
+// went.
+func xdgTrash(abs, dir string) (string, error) {
+	files, info := filepath.Join(dir, "files"), filepath.Join(dir, "info")
+	for _, d := range []string{files, info} {
+		if err := os.MkdirAll(d, 0o700); err != nil {
+			return "", err
+		}
+	}
+	record := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: filepath.ToSlash(abs)}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	base := filepath.Base(abs)
+	for i := 1; ; i++ {
+		name := base
+		if i > 1 {
+			name = fmt.Sprintf("%s.%d", base, i)
+		}
+		infoPath := filepath.Join(info, name+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.WriteString(record)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		dest := filepath.Join(files, name)
+		if err == nil {
+			err = moveFile(abs, dest)
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return "", err
+		}
+		return dest, nil
+	}
+}
+
+// trashAside moves abs into dir under its own name, or "name 2.ext",
+// "name 3.ext" and so on if that is taken, as the macOS Finder names
+// clashing files in ~/.Trash. It returns where the file went.
+func trashAside(abs, dir string) (string, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	base := filepath.Base(abs)
+	ext := filepath.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	for i := 1; ; i++ {
+		dest := filepath.Join(dir, base)
+		if i > 1 {
+			dest = filepath.Join(dir, fmt.Sprintf("%s %d%s", stem, i, ext))
+		}
+		if _, err := os.Lstat(dest); err == nil {
+			continue
+		}
+		return dest, moveFile(abs, dest)
+	}
+}
+
+// moveFile renames src to dest, falling back to copying and removing a
+// regular file when they are on different filesystems.
+func moveFile(src, dest string) error {
+	err := os.Rename(src, dest)
+	if err == nil {
+		return nil
+	}
+	fi, serr := os.Lstat(src)
+	if serr != nil || !fi.Mode().IsRegular() {
+		return err
+	}
+	if err := writeFileStream(dest, fi.Mode().Perm(), false, true, func(w io.Writer) error {
+		return copyFileTo(w, src)
+	}); err != nil {
+		os.Remove(dest)
+		return err
+	}
+	os.Chtimes(dest, fi.ModTime(), fi.ModTime())
+	return os.Remove(src)
+}
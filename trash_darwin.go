@@ -0,0 +1,15 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// trashFile moves abs to ~/.Trash, the Finder's trash for the home volume.
+func trashFile(abs string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return trashAside(abs, filepath.Join(home, ".Trash"))
+}
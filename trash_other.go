@@ -0,0 +1,22 @@
+//go:build !(windows || darwin)
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// trashFile moves abs to the XDG trash, $XDG_DATA_HOME/Trash (by default
+// ~/.local/share/Trash), where desktop file managers show it.
+func trashFile(abs string) (string, error) {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return xdgTrash(abs, filepath.Join(dir, "Trash"))
+}
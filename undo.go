@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// undo reverts the most recent operation started in the current directory
+// that hasn't been undone, as the journal recorded it: each .bck an encode
+// created and each file a decode or run --keep wrote is removed, a file
+// any of them replaced is put back from its --backup or --trash copy, and
+// an input encode --delete-original removed is decoded back. Files edited
+// since are left alone unless --force. The operation counts as undone only
+// once every file is; until then undo can be run again to retry the rest.
+func undo(opts options) (result, error) {
+	res := result{Command: "undo", DryRun: opts.dryRun}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return res, err
+	}
+	entries, err := readJournal()
+	if err != nil {
+		return res, err
+	}
+	undone := map[string]bool{}
+	for _, e := range entries {
+		if e.Undoes != "" {
+			undone[e.Undoes] = true
+		}
+	}
+	var op string
+	for _, e := range slices.Backward(entries) {
+		if e.Undoes == "" && e.Output != "" && e.Dir == cwd && !undone[e.Op] {
+			op = e.Op
+			break
+		}
+	}
+	if op == "" {
+		return res, newError(ErrNotFound, "nothing to undo in %s", cwd)
+	}
+	var files []journalEntry
+	for _, e := range entries {
+		if e.Op == op && e.Output != "" {
+			files = append(files, e)
+		}
+	}
+	res.Input = files[0].Input
+	left := 0
+	for _, e := range slices.Backward(files) {
+		if !undoFile(e, opts) {
+			left++
+		}
+	}
+	res.Files = len(files) - left
+	if left > 0 {
+		return res, newError(ErrConflict, "undid %d of %d files of the %s at %s; run undo again once the rest can be", len(files)-left, len(files), files[0].Command, files[0].Time.Local().Format(time.DateTime))
+	}
+	res.Action = "undone"
+	if opts.dryRun {
+		return res, nil
+	}
+	if err := appendJournal(journalEntry{Op: journalOp, Time: time.Now().UTC(), Dir: cwd, Command: "undo", Undoes: op}); err != nil {
+		return res, newError(ErrPermission, "undid the %s, but cannot record that in the journal: %v", files[0].Command, err)
+	}
+	return res, nil
+}
+
+// undoFile reverts one file of an operation, reporting whether it is now
+// as it was before (or was already).
+func undoFile(e journalEntry, opts options) bool {
+	name := relToCwd(e.Output)
+	verb := "Removed"
+	if opts.dryRun {
+		verb = "Would remove"
+	}
+	_, err := os.Lstat(e.Output)
+	exists := err == nil
+	if exists && !opts.force {
+		if sum, err := fileSHA256(e.Output); err != nil || sum != e.OutputSHA256 {
+			opts.infof("Left '%s': it changed after the %s (--force to undo it anyway)\n", name, e.Command)
+			return false
+		}
+	}
+	switch {
+	case e.Deleted && exists:
+		return restoreDeleted(e, opts)
+	case e.Replaced && e.Backup == "":
+		opts.infof("Left '%s': the file it replaced was not kept (--backup or --trash would have)\n", name)
+		return false
+	case e.Replaced:
+		if _, err := os.Lstat(e.Backup); err != nil {
+			opts.infof("Left '%s': the file it replaced is no longer at '%s'\n", name, e.Backup)
+			return false
+		}
+		if opts.dryRun {
+			opts.infof("Would restore '%s' from '%s'\n", name, relToCwd(e.Backup))
+			return true
+		}
+		if err := moveFile(e.Backup, e.Output); err != nil {
+			opts.infof("Left '%s': cannot restore it from '%s': %v\n", name, e.Backup, err)
+			return false
+		}
+		forgetTrashInfo(e.Backup)
+		opts.infof("Restored '%s' from '%s'\n", name, relToCwd(e.Backup))
+		return true
+	case !exists:
+		opts.logger().Debug("already gone", "path", e.Output)
+		return true
+	}
+	if !opts.dryRun {
+		if err := os.Remove(e.Output); err != nil && !errors.Is(err, os.ErrNotExist) {
+			opts.infof("Left '%s': %v\n", name, err)
+			return false
+		}
+	}
+	opts.infof("%s '%s'\n", verb, name)
+	return true
+}
+
+// restoreDeleted undoes an encode --delete-original: the input is decoded
+// back out of the .bck, and only then is the .bck removed.
+func restoreDeleted(e journalEntry, opts options) bool {
+	name, input := relToCwd(e.Output), relToCwd(e.Input)
+	if _, err := os.Lstat(e.Input); err == nil {
+		opts.infof("Left '%s': '%s' is back already\n", name, input)
+		return false
+	}
+	if opts.dryRun {
+		opts.infof("Would decode '%s' back to '%s' and remove it\n", name, input)
+		return true
+	}
+	fi, err := os.Stat(e.Output)
+	if err == nil {
+		err = writeFileStream(e.Input, fi.Mode().Perm(), true, true, func(w io.Writer) error {
+			_, err := cat(e.Output, w, opts)
+			return err
+		})
+	}
+	if err == nil {
+		err = os.Remove(e.Output)
+	}
+	if err != nil {
+		opts.infof("Left '%s': cannot decode it back to '%s': %v\n", name, input, err)
+		return false
+	}
+	opts.infof("Decoded '%s' back to '%s' and removed it\n", name, input)
+	return true
+}
+
+// forgetTrashInfo removes the .trashinfo record of a file restored out of a
+// freedesktop.org trash directory, so file managers don't list it as still
+// there.
+func forgetTrashInfo(trashed string) {
+	files := filepath.Dir(trashed)
+	if filepath.Base(files) != "files" {
+		return
+	}
+	os.Remove(filepath.Join(filepath.Dir(files), "info", filepath.Base(trashed)+".trashinfo"))
+}
+
+// relToCwd shortens an absolute path under the current directory for
+// messages, leaving any other path as it is.
+func relToCwd(path string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	rel, err := filepath.Rel(cwd, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return path
+	}
+	return rel
+}
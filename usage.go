@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runUsage is what run --stats reports about the program once it has
+// finished: its wall-clock and CPU time, peak memory and exit status, much
+// as time(1) would. Times are in seconds.
+type runUsage struct {
+	Command string  `json:"command"`
+	Wall    float64 `json:"wall_seconds"`
+	User    float64 `json:"user_seconds"`
+	Sys     float64 `json:"sys_seconds"`
+	MaxRSS  int64   `json:"max_rss_bytes,omitempty"` // 0 where the platform does not say
+	Status  int     `json:"exit_status"`             // 128+N when killed by signal N, as shells report it
+	Signal  string  `json:"signal,omitempty"`
+}
+
+// usageOf records the usage of a finished command, which ran for wall.
+func usageOf(name string, ps *os.ProcessState, wall time.Duration) *runUsage {
+	u := &runUsage{
+		Command: filepath.Base(name),
+		Wall:    wall.Seconds(),
+		User:    ps.UserTime().Seconds(),
+		Sys:     ps.SystemTime().Seconds(),
+		MaxRSS:  maxRSS(ps),
+		Status:  ps.ExitCode(),
+	}
+	if sig, name, ok := exitSignal(ps); ok {
+		u.Status, u.Signal = 128+sig, name
+	}
+	return u
+}
+
+// String formats u on one line for the terminal.
+func (u *runUsage) String() string {
+	parts := []string{
+		fmt.Sprintf("%.3fs wall", u.Wall),
+		fmt.Sprintf("%.3fs user", u.User),
+		fmt.Sprintf("%.3fs sys", u.Sys),
+	}
+	if u.MaxRSS > 0 {
+		parts = append(parts, humanBytes(u.MaxRSS)+" max RSS")
+	}
+	if u.Signal != "" {
+		parts = append(parts, fmt.Sprintf("killed by signal %d (%s)", u.Status-128, u.Signal))
+	} else {
+		parts = append(parts, fmt.Sprintf("exit status %d", u.Status))
+	}
+	return u.Command + ": " + strings.Join(parts, ", ")
+}
+
+// done finishes a run: with --stats it reports the usage of the last
+// command that ran, on stderr (where it cannot mix with the program's
+// output) and in the JSON result, whether or not the program succeeded.
+func (x *execution) done(res result, err error) (result, error) {
+	if !x.opts.runStats || x.usage == nil {
+		return res, err
+	}
+	res.Usage = x.usage
+	if !x.opts.json {
+		fmt.Fprintln(os.Stderr, x.usage)
+	}
+	return res, err
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// Build metadata, normally set at build time with
+//
+//	go build -ldflags "-X main.version=0.1 -X main.commit=$(git rev-parse --short HEAD) -X main.date=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// commit and date fall back to the VCS stamp embedded by the Go toolchain.
+var (
+	version = "0.1"
+	commit  = ""
+	date    = ""
+)
+
+// formatVersion is the newest .bck format this binary reads and writes.
+// Version 1 is plain reversed lines with the optional ##BCKL.NNL## marker;
+// version 2 adds a header line recording anything else (see format.go).
+const formatVersion = 2
+
+// buildInfo returns the commit and build date, preferring ldflags values.
+func buildInfo() (rev, built string) {
+	rev, built = commit, date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+				if len(rev) > 12 {
+					rev = rev[:12]
+				}
+			case s.Key == "vcs.time" && built == "":
+				built = s.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return rev, built
+}
+
+func printVersion() {
+	rev, built := buildInfo()
+	fmt.Printf("backlang %s\n", version)
+	fmt.Printf("commit:  %s\n", rev)
+	fmt.Printf("built:   %s\n", built)
+	fmt.Printf("format:  %d\n", formatVersion)
+}
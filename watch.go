@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// watchInterval is how often --watch checks its input for changes where it
+// cannot be told about them (see changeWatcher).
+const watchInterval = 300 * time.Millisecond
+
+// changeWatcher wakes --watch when something in the directories it was
+// given may have changed; the caller then rescans to find out what. On
+// Linux it is told by inotify, so an idle tree costs nothing and a change
+// is seen at once. Elsewhere, or when inotify is unavailable or out of
+// watches, it polls: every watchInterval the whole tree is walked and
+// every file stat'ed, which costs CPU on large trees and delays changes by
+// up to watchInterval.
+type changeWatcher interface {
+	add(dir string) error // watch dir as well; directories never need removing
+	changes() <-chan struct{}
+	close()
+}
+
+// pollWatcher is the changeWatcher that just ticks every watchInterval.
+type pollWatcher struct {
+	c    chan struct{}
+	done chan struct{}
+}
+
+func newPollWatcher() *pollWatcher {
+	p := &pollWatcher{c: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(watchInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				select {
+				case p.c <- struct{}{}:
+				case <-p.done:
+					return
+				}
+			}
+		}
+	}()
+	return p
+}
+
+func (p *pollWatcher) add(string) error         { return nil }
+func (p *pollWatcher) changes() <-chan struct{} { return p.c }
+func (p *pollWatcher) close()                   { close(p.done) }
+
+// watchDirs adds dirs to w. Should the system refuse (inotify's watch limit,
+// say), it falls back to polling rather than miss changes.
+func watchDirs(w changeWatcher, opts options, dirs ...string) changeWatcher {
+	for _, dir := range dirs {
+		if err := w.add(dir); err != nil {
+			opts.logger().Warn("cannot watch for changes; checking every "+watchInterval.String()+" instead", "dir", dir, "err", err)
+			w.close()
+			return newPollWatcher()
+		}
+	}
+	return w
+}
+
+// fileStamp identifies a version of a file well enough to notice edits.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+func statStamp(path string) (fileStamp, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	return fileStamp{fi.ModTime(), fi.Size()}, nil
+}
+
+// watchRun runs inPath, and whenever the file changes stops the program (and
+// everything it started) and runs the new version. Failures are reported
+// and watching continues until stop ends, normally on Ctrl-C.
+func watchRun(stop context.Context, inPath string, opts options) error {
+	last, err := statStamp(inPath)
+	if err != nil {
+		return wrapPathErr(err, inPath)
+	}
+	// Editors often replace the file, so its directory is watched.
+	w := watchDirs(newChangeWatcher(), opts, filepath.Dir(inPath))
+	defer w.close()
+
+	for {
+		ctx, cancel := context.WithCancel(stop)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			res, err := runContext(ctx, inPath, opts)
+			if ctx.Err() != nil {
+				return // stopped by us; the outcome no longer matters
+			}
+			report(res, opts, err)
+			opts.infof("Watching '%s' for changes...\n", inPath)
+		}()
+
+	wait:
+		for {
+			select {
+			case <-stop.Done():
+				cancel()
+				<-done
+				return nil
+			case <-w.changes():
+				// A briefly missing file is not a change either
+				stamp, err := statStamp(inPath)
+				if err != nil || stamp == last {
+					continue
+				}
+				last = stamp
+				cancel()
+				<-done
+				opts.infof("'%s' changed, restarting...\n", inPath)
+				break wait
+			}
+		}
+	}
+}
+
+// watchEncode keeps a .bck next to every file under root (or root itself, if
+// it is a file), encoding a file again whenever it changes. On start only
+// files whose .bck is missing or older are encoded. It returns when stop
+// ends. The .bck files are mirrors, so they are overwritten without asking
+// unless another --on-conflict policy was chosen.
+func watchEncode(stop context.Context, root string, opts options) error {
+	if opts.onConflict == "" || opts.onConflict == conflictPrompt {
+		opts.onConflict = conflictOverwrite
+	}
+	w := watchDirs(newChangeWatcher(), opts, filepath.Dir(root))
+	defer func() { w.close() }()
+	seen := make(map[string]fileStamp)
+	for first := true; ; first = false {
+		// Directories are watched as the scan reaches them, so a file
+		// created in one while it is being scanned still wakes the next.
+		stamps, err := scanSources(root, func(dir string) { w = watchDirs(w, opts, dir) })
+		if err != nil {
+			return wrapPathErr(err, root)
+		}
+		for path, stamp := range stamps {
+			if prev, ok := seen[path]; ok && prev == stamp {
+				continue
+			}
+			seen[path] = stamp
+			if first && mirrorUpToDate(path, stamp) {
+				continue
+			}
+			res, err := encode(path, opts)
+			report(res, opts, err)
+		}
+		for path := range seen {
+			if _, ok := stamps[path]; !ok {
+				delete(seen, path)
+			}
+		}
+		if first {
+			opts.infof("Watching '%s' for changes...\n", root)
+		}
+		select {
+		case <-stop.Done():
+			return nil
+		case <-w.changes():
+		}
+	}
+}
+
+// scanSources returns the files watchEncode mirrors: regular files under
+// root, skipping .bck files, hidden files and directories, and whatever
+// .bckignore files exclude. onDir, if not nil, is called with each
+// directory it descends into, before reading it.
+func scanSources(root string, onDir func(dir string)) (map[string]fileStamp, error) {
+	stamps := make(map[string]fileStamp)
+	ignore := newIgnoreList(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == root {
+				return err
+			}
+			return nil // vanished or unreadable; try again next scan
+		}
+		hidden := path != root && strings.HasPrefix(d.Name(), ".")
+		switch {
+		case d.IsDir() && (hidden || ignore.ignored(path, true)):
+			return filepath.SkipDir
+		case d.IsDir():
+			if onDir != nil {
+				onDir(path)
+			}
+			ignore.load(path) // an unreadable .bckignore is tried again next scan
+			return nil
+		case hidden, !d.Type().IsRegular(), strings.HasSuffix(strings.ToLower(path), ".bck"), ignore.ignored(path, false):
+			return nil
+		}
+		if fi, err := d.Info(); err == nil {
+			stamps[path] = fileStamp{fi.ModTime(), fi.Size()}
+		}
+		return nil
+	})
+	return stamps, err
+}
+
+// mirrorUpToDate reports whether path's .bck is at least as new as path.
+func mirrorUpToDate(path string, stamp fileStamp) bool {
+	fi, err := os.Stat(path + ".bck")
+	return err == nil && !fi.ModTime().Before(stamp.modTime)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// inotifyWatcher is the changeWatcher for Linux.
+type inotifyWatcher struct {
+	fd int
+	f  *os.File // fd, read through the runtime poller so close unblocks it
+	c  chan struct{}
+}
+
+const inotifyMask = syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_MOVE_SELF
+
+// newChangeWatcher uses inotify, or polls if it cannot.
+func newChangeWatcher() changeWatcher {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return newPollWatcher()
+	}
+	w := &inotifyWatcher{fd: fd, f: os.NewFile(uintptr(fd), "inotify"), c: make(chan struct{}, 1)}
+	go w.read()
+	return w
+}
+
+// read turns inotify events into wakeups. Which files they name does not
+// matter, since the caller rescans; a full queue (IN_Q_OVERFLOW) is just
+// another wakeup.
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64<<10)
+	for {
+		if _, err := w.f.Read(buf); err != nil {
+			return // closed
+		}
+		select {
+		case w.c <- struct{}{}:
+		default: // a wakeup is already pending
+		}
+	}
+}
+
+func (w *inotifyWatcher) add(dir string) error {
+	if _, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask); err != nil && err != syscall.ENOENT {
+		return err // ENOENT: gone since it was found, which the next scan sees
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) changes() <-chan struct{} { return w.c }
+func (w *inotifyWatcher) close()                   { w.f.Close() }
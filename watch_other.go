@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+// newChangeWatcher polls, as this platform's change notification is not
+// implemented.
+func newChangeWatcher() changeWatcher {
+	return newPollWatcher()
+}